@@ -0,0 +1,111 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// riskconv converts portfolio files between the ini, YAML, TOML and JSON
+// formats, keeping include keys and ${} references as they are. %include
+// lines of ini files are replaced by the lines they include, with a warning.
+//
+//   riskconv -to yaml desk.ini > desk.yaml
+//   riskconv -to toml -w -verify __1__/*.ini
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	engine "github.com/bhojpur/risk/pkg/engine"
+)
+
+var to = flag.String("to", "yaml", "output format: ini, yaml, toml or json")
+var write = flag.Bool("w", false, "write the output next to each input, with the extension of the format, instead of stdout")
+var verify = flag.Bool("verify", false, "parse the output again and fail unless it has the sections and values of the input")
+var shared = flag.String("shared", engine.SharedDir, "directory of firm wide .ini files of %include")
+
+var extensions = map[string]string{"ini": ".ini", "yaml": ".yaml", "toml": ".toml", "json": ".json"}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: riskconv [flags] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || extensions[*to] == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	engine.SharedDir = *shared
+	failed := false
+	for _, fn := range flag.Args() {
+		if err := convert(fn); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", fn, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func convert(fn string) error {
+	format := engine.FileFormat(filepath.Base(fn))
+	if format == "" {
+		return fmt.Errorf("unknown format, expect .ini, .yaml, .yml, .toml or .json")
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	cfg, err := engine.ParseFormat(format, string(b))
+	if err != nil {
+		return err
+	}
+	if format == "ini" {
+		for _, name := range engine.IniIncludes(string(b)) {
+			fmt.Fprintf(os.Stderr, "%s: warning: %%include %s is expanded in the output\n", fn, name)
+		}
+	}
+	out, err := engine.WriteFormat(*to, cfg)
+	if err != nil {
+		return err
+	}
+	if *verify {
+		cfg2, err := engine.ParseFormat(*to, out)
+		if err != nil {
+			return fmt.Errorf("verify: %s", err)
+		}
+		if err := engine.CompareIni(cfg, cfg2); err != nil {
+			return fmt.Errorf("verify: %s", err)
+		}
+	}
+	if !*write {
+		_, err = os.Stdout.WriteString(out)
+		return err
+	}
+	out2 := strings.TrimSuffix(fn, filepath.Ext(fn)) + extensions[*to]
+	if out2 == fn {
+		return fmt.Errorf("output would overwrite the input")
+	}
+	return ioutil.WriteFile(out2, []byte(out), 0644)
+}
@@ -0,0 +1,361 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/bhojpur/risk/pkg/client"
+	engine "github.com/bhojpur/risk/pkg/engine"
+)
+
+// The read-only REST API. Engine state is only touched from tradeServerJob,
+// so every handler runs its reads there through onEngine, and the response
+// is written afterwards so that a slow client does not hold up the engine.
+
+const defaultPageLimit = 100
+const maxPageLimit = 1000
+
+// engineCalls are run by tradeServerJob between trade server messages
+var engineCalls = make(chan func())
+
+// latestReports is the last result of RunUserPortfolios, owned by tradeServerJob
+var latestReports = make(map[int]map[string]interface{})
+
+func onEngine(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case engineCalls <- func() { f(); close(done) }:
+	case <-time.After(writeWait):
+		return false
+	}
+	<-done
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, code string, msg string) {
+	rd.JSON(w, status, map[string]interface{}{
+		"error": client.Error{Status: status, Code: code, Message: msg},
+	})
+}
+
+func writePage(w http.ResponseWriter, r *http.Request, items []interface{}) {
+	q := r.URL.Query()
+	offset, err := strconv.Atoi(q.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	total := len(items)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	rd.JSON(w, http.StatusOK, map[string]interface{}{"items": items[offset:end], "offset": offset, "limit": limit, "total": total})
+}
+
+// an apiFunc copies what it reads from the engine into its result, which
+// must not be changed by the engine afterwards
+type apiFunc func(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error)
+
+// apiPage is a result written as the page of the offset and limit asked for
+type apiPage []interface{}
+
+// apiHandler parses the :user parameter, checks it is the user of the
+// session, runs f on the engine goroutine and writes its result on the
+// request goroutine
+func apiHandler(f apiFunc) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		userId, err := strconv.Atoi(p.ByName("user"))
+		if err != nil || userId <= 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid user id: "+p.ByName("user"))
+			return
+		}
+		s := requestSession(r)
+		if s == nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or expired Bearer session token")
+			return
+		}
+		if s.UserId != userId {
+			writeError(w, http.StatusForbidden, "forbidden", "session is not of user "+p.ByName("user"))
+			return
+		}
+		var out interface{}
+		var e *client.Error
+		if !onEngine(func() { out, e = f(r, p, userId) }) {
+			e = errorf(http.StatusServiceUnavailable, "unavailable", "risk engine is busy or not connected")
+		}
+		if e != nil {
+			writeError(w, e.Status, e.Code, e.Message)
+		} else if items, ok := out.(apiPage); ok {
+			writePage(w, r, items)
+		} else {
+			rd.JSON(w, http.StatusOK, out)
+		}
+	}
+}
+
+func boundsJSON(bounds []float64) []interface{} {
+	out := make([]interface{}, 0, len(bounds))
+	for _, v := range bounds {
+		out = append(out, engine.ConvertNaN(v))
+	}
+	return out
+}
+
+func portfolioJSON(p *engine.Portfolio) client.Portfolio {
+	out := client.Portfolio{Name: p.Name, File: p.File, Acc: p.AccPatterns, Risks: []client.Risk{}}
+	for _, r := range p.RiskDefs {
+		risk := client.Risk{Name: r.Name, DisplayName: r.DisplayName, Groups: r.GroupNames, Params: []client.Param{}}
+		if risk.Groups == nil {
+			risk.Groups = []string{}
+		}
+		for _, rp := range r.Params {
+			param := client.Param{
+				Name:       rp.Name,
+				UpperBound: boundsJSON(rp.UpperBound),
+				LowerBound: boundsJSON(rp.LowerBound),
+				TradeStop:  rp.TradeStop,
+				Graph:      rp.Graph,
+			}
+			if rp.Formula != nil {
+				param.Aggregate = rp.Formula.A
+			}
+			risk.Params = append(risk.Params, param)
+		}
+		out.Risks = append(out.Risks, risk)
+	}
+	return out
+}
+
+func sortedPortfolios(userId int) []*engine.Portfolio {
+	var out []*engine.Portfolio
+	for _, p := range engine.UserPortfolios[userId] {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func apiPortfolios(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	items := []interface{}{}
+	for _, portfolio := range sortedPortfolios(userId) {
+		items = append(items, portfolioJSON(portfolio))
+	}
+	return apiPage(items), nil
+}
+
+func apiGetPortfolio(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	portfolio := engine.UserPortfolios[userId][p.ByName("portfolio")]
+	if portfolio == nil {
+		return nil, errorf(http.StatusNotFound, "not_found", "unknown portfolio: %s", p.ByName("portfolio"))
+	}
+	return portfolioJSON(portfolio), nil
+}
+
+func apiReport(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	rpt := latestReports[userId]
+	if rpt == nil {
+		rpt = map[string]interface{}{}
+	}
+	name := p.ByName("portfolio")
+	if name == "" {
+		return rpt, nil
+	}
+	if engine.UserPortfolios[userId][name] == nil {
+		return nil, errorf(http.StatusNotFound, "not_found", "unknown portfolio: %s", name)
+	}
+	out := rpt[name]
+	if out == nil {
+		out = map[string]interface{}{}
+	}
+	return out, nil
+}
+
+// apiPositions supports acc, symbol, market and securityId filters
+func apiPositions(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	q := r.URL.Query()
+	accName := q.Get("acc")
+	symbol := q.Get("symbol")
+	market := q.Get("market")
+	securityId, _ := strconv.ParseInt(q.Get("securityId"), 10, 64)
+	items := []interface{}{}
+	accs := append([]int{}, engine.UserIdAccs[userId]...)
+	sort.Ints(accs)
+	for _, acc := range accs {
+		if accName != "" && engine.AccNames[acc] != accName {
+			continue
+		}
+		var ids []int64
+		for id := range engine.Positions[acc] {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			pos := engine.Positions[acc][id]
+			s := pos.Security
+			if s == nil {
+				continue
+			}
+			if (symbol != "" && s.Symbol != symbol) || (market != "" && s.Market != market) || (securityId != 0 && s.Id != securityId) {
+				continue
+			}
+			items = append(items, client.Position{
+				Acc:             engine.AccNames[acc],
+				AccId:           acc,
+				SecurityId:      s.Id,
+				Symbol:          s.Symbol,
+				Market:          s.Market,
+				Type:            s.Type,
+				Currency:        s.Currency,
+				Qty:             pos.Qty,
+				AvgPx:           pos.AvgPx,
+				Commission:      pos.Commission,
+				RealizedPnl:     pos.RealizedPnl,
+				BuyQty:          pos.BuyQty,
+				BuyValue:        pos.BuyValue,
+				SellQty:         pos.SellQty,
+				SellValue:       pos.SellValue,
+				OutstandBuyQty:  pos.OutstandBuyQty,
+				OutstandSellQty: pos.OutstandSellQty,
+				Target:          pos.Target,
+				Close:           s.GetClose(),
+			})
+		}
+	}
+	return apiPage(items), nil
+}
+
+// apiBreaches supports portfolio and risk filters
+func apiBreaches(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	q := r.URL.Query()
+	portfolio := q.Get("portfolio")
+	risk := q.Get("risk")
+	items := []interface{}{}
+	for _, b := range engine.LatestBreaches[userId] {
+		if (portfolio != "" && b.Portfolio != portfolio) || (risk != "" && b.Risk != risk) {
+			continue
+		}
+		// acks change the breach on the engine goroutine
+		b2 := *b
+		items = append(items, &b2)
+	}
+	return apiPage(items), nil
+}
+
+func apiOverrides(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	overrides := engine.TradeStopOverrides(userId)
+	sort.Slice(overrides, func(i, j int) bool {
+		a, b := overrides[i], overrides[j]
+		return engine.BreachKey(a.Portfolio, a.Risk, a.Param, a.Group, "") < engine.BreachKey(b.Portfolio, b.Risk, b.Param, b.Group, "")
+	})
+	items := []interface{}{}
+	for _, o := range overrides {
+		o2 := *o
+		items = append(items, &o2)
+	}
+	return apiPage(items), nil
+}
+
+func apiHistoryHandler(r *http.Request, p httprouter.Params, userId int) (interface{}, *client.Error) {
+	q := r.URL.Query()
+	from, _ := strconv.ParseFloat(q.Get("from"), 64)
+	to, _ := strconv.ParseFloat(q.Get("to"), 64)
+	h := &client.History{Portfolio: p.ByName("portfolio"), Risk: p.ByName("risk"), Param: p.ByName("param"), Agg: q.Get("agg")}
+	status, err := queryHistory(userId, h, from, to, q.Get("resolution"))
+	if err != nil {
+		code := "bad_request"
+		if status == http.StatusNotFound {
+			code = "not_found"
+		}
+		return nil, errorf(status, code, "%s", err.Error())
+	}
+	return h, nil
+}
+
+func apiSchema(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("name")
+	if name == "" {
+		var names []string
+		for name := range schemas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rd.JSON(w, http.StatusOK, names)
+		return
+	}
+	schema := schemas[name]
+	if schema == nil {
+		writeError(w, http.StatusNotFound, "not_found", "unknown schema: "+name)
+		return
+	}
+	rd.JSON(w, http.StatusOK, schema)
+}
+
+// apiNotFound and apiMethodNotAllowed give JSON errors under /api/ only, the
+// other paths keep the plain text errors of net/http
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.NotFound(w, r)
+		return
+	}
+	writeError(w, http.StatusNotFound, "not_found", "no such resource: "+r.URL.Path)
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" not allowed on "+r.URL.Path)
+}
+
+func routeApi(router *httprouter.Router) {
+	router.GET("/api/openapi.json", apiOpenAPI)
+	router.GET("/api/schemas", apiSchema)
+	router.GET("/api/schemas/:name", apiSchema)
+	router.GET("/api/hub", apiHub)
+	router.GET("/api/users/:user/portfolios", apiHandler(apiPortfolios))
+	router.GET("/api/users/:user/portfolios/:portfolio", apiHandler(apiGetPortfolio))
+	router.GET("/api/users/:user/portfolios/:portfolio/report", apiHandler(apiReport))
+	router.GET("/api/users/:user/portfolios/:portfolio/history/:risk/:param", apiHandler(apiHistoryHandler))
+	router.GET("/api/users/:user/report", apiHandler(apiReport))
+	router.GET("/api/users/:user/positions", apiHandler(apiPositions))
+	router.GET("/api/users/:user/breaches", apiHandler(apiBreaches))
+	router.GET("/api/users/:user/overrides", apiHandler(apiOverrides))
+	router.NotFound = http.HandlerFunc(apiNotFound)
+	router.MethodNotAllowed = http.HandlerFunc(apiMethodNotAllowed)
+}
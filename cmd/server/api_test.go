@@ -0,0 +1,102 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestApiErrorsOnlyUnderApi(t *testing.T) {
+	router := httprouter.New()
+	routeApi(router)
+	for _, c := range []struct {
+		method, path string
+		status       int
+		json         bool
+	}{
+		{"GET", "/api/nothing", http.StatusNotFound, true},
+		{"POST", "/api/schemas", http.StatusMethodNotAllowed, true},
+		{"GET", "/nothing", http.StatusNotFound, false},
+		{"GET", "/risk/x", http.StatusNotFound, false},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		json := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+		if w.Code != c.status || json != c.json {
+			t.Errorf("%s %s = %d %q, want %d json %v", c.method, c.path, w.Code, w.Header().Get("Content-Type"), c.status, c.json)
+		}
+	}
+}
+
+// stalledWriter blocks the first Write until release is closed
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (self *stalledWriter) Write(b []byte) (int, error) {
+	close(self.writing)
+	<-self.release
+	return self.ResponseRecorder.Write(b)
+}
+
+func TestApiWritesOffEngine(t *testing.T) {
+	withTestEngine(t)
+	router := httprouter.New()
+	routeApi(router)
+	s := newSession(1, "alice")
+	req := httptest.NewRequest("GET", "/api/users/1/portfolios", nil)
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	w := &stalledWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(w, req)
+		close(done)
+	}()
+	select {
+	case <-w.writing:
+	case <-time.After(time.Second):
+		t.Fatal("no response written")
+	}
+	// the engine runs other calls while the client is stalled
+	ran := make(chan bool, 1)
+	go func() { ran <- onEngine(func() {}) }()
+	select {
+	case ok := <-ran:
+		if !ok {
+			t.Error("engine call timed out")
+		}
+	case <-time.After(time.Second):
+		t.Error("engine blocked by a stalled client")
+	}
+	close(w.release)
+	<-done
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"items":[]`) {
+		t.Errorf("portfolios = %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	engine "github.com/bhojpur/risk/pkg/engine"
+)
+
+// Clients login with a username and password checked by -auth: "trade"
+// validates them with the trade server, "htpasswd" against -htpasswd lines of
+// user:hash:userId (bcrypt or {SHA} hashes), "jwt" takes an HS256 token
+// signed with the -jwt-key file as password, its uid claim is the user id and
+// sub the user name. A login opens a session expiring after -session-ttl, its
+// token resumes the session on a new connection and authorizes REST calls as
+// a Bearer token.
+
+var errInvalidCredentials = errors.New("invalid username or password")
+var errAuthUnavailable = errors.New("authentication is unavailable")
+
+type Authenticator interface {
+	// Authenticate returns the user id and name of valid credentials
+	Authenticate(username string, password string) (int, string, error)
+}
+
+var auth Authenticator
+
+func newAuthenticator(kind string) (Authenticator, error) {
+	switch kind {
+	case "trade":
+		return &tradeAuth{pending: make(map[int64]chan int)}, nil
+	case "htpasswd":
+		if *htpasswd == "" {
+			return nil, fmt.Errorf("-htpasswd is required")
+		}
+		a := &htpasswdAuth{fn: *htpasswd}
+		return a, a.load()
+	case "jwt":
+		key, err := ioutil.ReadFile(*jwtKey)
+		if err != nil {
+			return nil, err
+		}
+		key = []byte(strings.TrimSpace(string(key)))
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty jwt key")
+		}
+		return &jwtAuth{key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown auth: %s", kind)
+}
+
+// tradeAuth asks the trade server with validate_user, the reply is a
+// user_validation msg handled by tradeServerJob
+type tradeAuth struct {
+	lock    sync.Mutex
+	counter int64
+	pending map[int64]chan int
+}
+
+func (self *tradeAuth) Authenticate(username string, password string) (int, string, error) {
+	ch := make(chan int, 1)
+	self.lock.Lock()
+	self.counter++
+	token := self.counter
+	self.pending[token] = ch
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		delete(self.pending, token)
+		self.lock.Unlock()
+	}()
+	engine.Request(engine.Array{"validate_user", username, password, token})
+	select {
+	case userId := <-ch:
+		if userId <= 0 {
+			return 0, "", errInvalidCredentials
+		}
+		return userId, username, nil
+	case <-time.After(writeWait):
+		return 0, "", errAuthUnavailable
+	}
+}
+
+func (self *tradeAuth) validated(token int64, userId int) {
+	self.lock.Lock()
+	ch := self.pending[token]
+	self.lock.Unlock()
+	if ch != nil {
+		ch <- userId
+	}
+}
+
+type htpasswdUser struct {
+	hash   string
+	userId int
+}
+
+// htpasswdAuth reloads the file when it changes
+type htpasswdAuth struct {
+	fn    string
+	lock  sync.Mutex
+	mtime time.Time
+	users map[string]htpasswdUser
+}
+
+func (self *htpasswdAuth) load() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	info, err := os.Stat(self.fn)
+	if err != nil {
+		return err
+	}
+	if self.users != nil && info.ModTime().Equal(self.mtime) {
+		return nil
+	}
+	f, err := os.Open(self.fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]htpasswdUser)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		toks := strings.Split(line, ":")
+		if len(toks) != 3 {
+			return fmt.Errorf("%s line %d: expect user:hash:userId", self.fn, i)
+		}
+		userId, err := strconv.Atoi(toks[2])
+		if err != nil || userId <= 0 {
+			return fmt.Errorf("%s line %d: invalid user id %s", self.fn, i, toks[2])
+		}
+		users[toks[0]] = htpasswdUser{toks[1], userId}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	self.users = users
+	self.mtime = info.ModTime()
+	return nil
+}
+
+func (self *htpasswdAuth) Authenticate(username string, password string) (int, string, error) {
+	if err := self.load(); err != nil {
+		return 0, "", err
+	}
+	self.lock.Lock()
+	u, ok := self.users[username]
+	self.lock.Unlock()
+	if !ok {
+		return 0, "", errInvalidCredentials
+	}
+	if strings.HasPrefix(u.hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		if subtle.ConstantTimeCompare([]byte(u.hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1 {
+			return u.userId, username, nil
+		}
+	} else if bcrypt.CompareHashAndPassword([]byte(u.hash), []byte(password)) == nil {
+		return u.userId, username, nil
+	}
+	return 0, "", errInvalidCredentials
+}
+
+type jwtAuth struct {
+	key []byte
+}
+
+// Authenticate ignores username, password is the token
+func (self *jwtAuth) Authenticate(username string, password string) (int, string, error) {
+	parts := strings.Split(password, ".")
+	if len(parts) != 3 {
+		return 0, "", errInvalidCredentials
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if decodeJWTPart(parts[0], &header) != nil || header.Alg != "HS256" {
+		return 0, "", errInvalidCredentials
+	}
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return 0, "", errInvalidCredentials
+	}
+	var claims struct {
+		Uid int     `json:"uid"`
+		Sub string  `json:"sub"`
+		Exp float64 `json:"exp"`
+		Nbf float64 `json:"nbf"`
+	}
+	if decodeJWTPart(parts[1], &claims) != nil || claims.Uid <= 0 {
+		return 0, "", errInvalidCredentials
+	}
+	now := float64(time.Now().Unix())
+	if (claims.Exp > 0 && now >= claims.Exp) || (claims.Nbf > 0 && now < claims.Nbf) {
+		return 0, "", errInvalidCredentials
+	}
+	return claims.Uid, claims.Sub, nil
+}
+
+func decodeJWTPart(part string, out interface{}) error {
+	tmp, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(tmp, out)
+}
+
+type session struct {
+	Token    string
+	UserId   int
+	Username string
+	Expires  time.Time
+}
+
+var sessions = make(map[string]*session)
+var sessionLock sync.Mutex
+
+func newSession(userId int, username string) *session {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	s := &session{Token: hex.EncodeToString(buf), UserId: userId, Username: username, Expires: now.Add(*sessionTTL)}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	for token, s2 := range sessions {
+		if now.After(s2.Expires) {
+			delete(sessions, token)
+		}
+	}
+	sessions[s.Token] = s
+	return s
+}
+
+// findSession returns nil for unknown or expired tokens
+func findSession(token string) *session {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	s := sessions[token]
+	if s == nil {
+		return nil
+	}
+	if time.Now().After(s.Expires) {
+		delete(sessions, token)
+		return nil
+	}
+	return s
+}
+
+func deleteSession(token string) {
+	sessionLock.Lock()
+	delete(sessions, token)
+	sessionLock.Unlock()
+}
+
+// requestSession returns the session of the Bearer token of a REST request
+func requestSession(r *http.Request) *session {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return nil
+	}
+	return findSession(strings.TrimSpace(h[len(prefix):]))
+}
+
+func (self *Client) expired() bool {
+	return time.Now().Unix() >= atomic.LoadInt64(&self.expires)
+}
+
+// checkOrigin allows -origins, "*" for any, by default the host of the
+// request only. Non-browser clients sending no Origin are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if *origins == "" {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range strings.Split(*origins, ",") {
+		o = strings.TrimSpace(o)
+		if o == "*" || strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("pass"))
+	fn := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\nalice:" + string(hash) + ":7\nbob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + ":8\n"
+	if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &htpasswdAuth{fn: fn}
+	for _, c := range []struct {
+		user, password string
+		userId         int
+	}{
+		{"alice", "secret", 7},
+		{"bob", "pass", 8},
+		{"alice", "pass", 0},
+		{"bob", "secret", 0},
+		{"carol", "secret", 0},
+	} {
+		userId, name, err := a.Authenticate(c.user, c.password)
+		if c.userId == 0 {
+			if err != errInvalidCredentials {
+				t.Errorf("%s/%s: %v, want invalid credentials", c.user, c.password, err)
+			}
+		} else if err != nil || userId != c.userId || name != c.user {
+			t.Errorf("%s/%s = %d %s %v", c.user, c.password, userId, name, err)
+		}
+	}
+	// a changed file is read again, and a bad line refuses all
+	if err := ioutil.WriteFile(fn, []byte("bob:x\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(fn, time.Now(), time.Now().Add(time.Minute))
+	if _, _, err := a.Authenticate("alice", "secret"); err == nil || err == errInvalidCredentials {
+		t.Errorf("bad htpasswd line: %v", err)
+	}
+}
+
+func testJWT(key string, header string, claims map[string]interface{}) string {
+	b, _ := json.Marshal(claims)
+	str := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(str))
+	return str + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJwtAuth(t *testing.T) {
+	a := &jwtAuth{key: []byte("k")}
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	now := float64(time.Now().Unix())
+	userId, name, err := a.Authenticate("", testJWT("k", hs256, map[string]interface{}{"uid": 5, "sub": "alice", "exp": now + 60}))
+	if err != nil || userId != 5 || name != "alice" {
+		t.Errorf("valid token = %d %s %v", userId, name, err)
+	}
+	for what, token := range map[string]string{
+		"other key":   testJWT("x", hs256, map[string]interface{}{"uid": 5}),
+		"alg none":    testJWT("k", `{"alg":"none"}`, map[string]interface{}{"uid": 5}),
+		"expired":     testJWT("k", hs256, map[string]interface{}{"uid": 5, "exp": now - 1}),
+		"not yet":     testJWT("k", hs256, map[string]interface{}{"uid": 5, "nbf": now + 60}),
+		"no uid":      testJWT("k", hs256, map[string]interface{}{"sub": "alice"}),
+		"not a token": "a.b",
+	} {
+		if _, _, err := a.Authenticate("", token); err != errInvalidCredentials {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := newSession(3, "carol")
+	if findSession(s.Token) != s {
+		t.Fatal("session not found")
+	}
+	r := httptest.NewRequest("GET", "/api/hub", nil)
+	r.Header.Set("Authorization", "Bearer "+s.Token)
+	if requestSession(r) != s {
+		t.Error("no session of the bearer token")
+	}
+	r.Header.Set("Authorization", "Basic "+s.Token)
+	if requestSession(r) != nil {
+		t.Error("session of a basic auth header")
+	}
+	deleteSession(s.Token)
+	if findSession(s.Token) != nil {
+		t.Error("deleted session found")
+	}
+	s = newSession(3, "carol")
+	s.Expires = time.Now().Add(-time.Second)
+	if findSession(s.Token) != nil {
+		t.Error("expired session found")
+	}
+	if findSession("") != nil {
+		t.Error("session of an empty token")
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	withTestEngine(t)
+	withRoles(t, "default = viewer\n")
+	fn := filepath.Join(t.TempDir(), "htpasswd")
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err := ioutil.WriteFile(fn, []byte("alice:"+string(hash)+":7\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth0 := auth
+	auth = &htpasswdAuth{fn: fn}
+	t.Cleanup(func() { auth = auth0 })
+	c := &Client{hub: newHub()}
+	if r := call(t, c, "riskFile", map[string]interface{}{"fn": "a.ini"}); errorStatus(r) != 401 {
+		t.Errorf("riskFile before login: %+v", r)
+	}
+	if r := call(t, c, "resume", map[string]interface{}{"session": "x"}); errorStatus(r) != 401 || r.Error.Code != "session_expired" {
+		t.Errorf("resume of an unknown session: %+v", r)
+	}
+	r := call(t, c, "login", map[string]interface{}{"username": "alice", "password": "secret"})
+	if r.Error != nil || r.Payload["userId"] != 7. || r.Payload["role"] != "viewer" {
+		t.Fatalf("login: %+v", r)
+	}
+	token, _ := r.Payload["session"].(string)
+	c2 := &Client{hub: newHub()}
+	if r := call(t, c2, "resume", map[string]interface{}{"session": token}); r.Error != nil || r.Payload["userId"] != 7. {
+		t.Errorf("resume: %+v", r)
+	}
+	if r := call(t, c2, "logout", nil); r.Error != nil {
+		t.Errorf("logout: %+v", r)
+	}
+	if findSession(token) != nil {
+		t.Error("session kept after logout")
+	}
+	c3 := &Client{hub: newHub()}
+	if r := call(t, c3, "login", map[string]interface{}{"username": "alice", "password": "x"}); errorStatus(r) != 401 {
+		t.Errorf("login with a wrong password: %+v", r)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := *origins
+	t.Cleanup(func() { *origins = allowed })
+	for _, c := range []struct {
+		origins, origin string
+		ok              bool
+	}{
+		{"", "", true},
+		{"", "https://risk.example.com", true},
+		{"", "https://evil.example.com", false},
+		{"https://a.example.com/, https://b.example.com", "https://b.example.com", true},
+		{"https://a.example.com", "https://risk.example.com", false},
+		{"*", "https://evil.example.com", true},
+	} {
+		*origins = c.origins
+		r := httptest.NewRequest("GET", "https://risk.example.com/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if checkOrigin(r) != c.ok {
+			t.Errorf("origins %q, origin %q: %v", c.origins, c.origin, !c.ok)
+		}
+	}
+}
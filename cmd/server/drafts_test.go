@@ -0,0 +1,158 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/risk/pkg/client"
+	engine "github.com/bhojpur/risk/pkg/engine"
+)
+
+// withTestEngine runs engine calls and keeps files and versions in a temp
+// dir until the test ends
+func withTestEngine(t *testing.T) {
+	root := t.TempDir()
+	files := engine.Files
+	engine.Files = &engine.LocalFileStore{Root: root}
+	if err := engine.OpenVersions(filepath.Join(root, "versions.db")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case f := <-engineCalls:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		engine.CloseVersions()
+		engine.Files = files
+	})
+}
+
+func testClient(userId int, username string) *Client {
+	s := newSession(userId, username)
+	return &Client{hub: newHub(), UserId: userId, Proto: client.ProtocolVersion, session: s, expires: s.Expires.Unix()}
+}
+
+// call handles a request of c and returns its reply
+func call(t *testing.T, c *Client, typ string, payload map[string]interface{}) *client.Envelope {
+	c.handle(&request{Type: typ, Id: "1", Payload: payload}, c.Id)
+	select {
+	case q := <-c.queue:
+		out := &client.Envelope{}
+		if err := json.Unmarshal(q.msg, out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	case <-time.After(time.Second):
+		t.Fatalf("no reply to %s", typ)
+	}
+	return nil
+}
+
+func errorStatus(e *client.Envelope) int {
+	if e.Error == nil {
+		return 0
+	}
+	return e.Error.Status
+}
+
+func TestApproveDraftOfOtherUser(t *testing.T) {
+	withTestEngine(t)
+	withRoles(t, "default = viewer\n[users]\nalice = risk-approver\nbob = risk-approver\ncarol = risk-author\n")
+	alice, bob, carol, dave := testClient(1, "alice"), testClient(2, "bob"), testClient(3, "carol"), testClient(4, "dave")
+	content := "[gross]\nformula = sum(abs(Pos) * Close)\nupper_bound = 100\n"
+	if r := call(t, alice, "saveDraft", map[string]interface{}{"fn": "a.ini", "content": content}); r.Error != nil {
+		t.Fatal(r.Error.Message)
+	}
+	if r := call(t, alice, "submitDraft", map[string]interface{}{"fn": "a.ini"}); r.Error != nil {
+		t.Fatal(r.Error.Message)
+	}
+	// the author, and users below risk-approver, are refused
+	if r := call(t, alice, "approveDraft", map[string]interface{}{"fn": "a.ini"}); errorStatus(r) != 403 {
+		t.Errorf("approved by the author: %+v", r)
+	}
+	for _, c := range []*Client{carol, dave} {
+		for _, typ := range []string{"approveDraft", "rejectDraft", "riskFileDraft"} {
+			if r := call(t, c, typ, map[string]interface{}{"fn": "a.ini", "owner": 1.}); errorStatus(r) != 403 {
+				t.Errorf("%s by %s: %+v", typ, c.session.Username, r)
+			}
+		}
+	}
+	if r := call(t, carol, "drafts", nil); len(r.Payload["drafts"].([]interface{})) != 0 {
+		t.Errorf("drafts of others listed to an author: %v", r.Payload)
+	}
+	r := call(t, bob, "drafts", nil)
+	if drafts, _ := r.Payload["drafts"].([]interface{}); len(drafts) != 1 || drafts[0].(map[string]interface{})["owner"] != 1. {
+		t.Fatalf("drafts of bob = %v, want the pending draft of user 1", r.Payload)
+	}
+	if r := call(t, bob, "riskFileDraft", map[string]interface{}{"fn": "a.ini", "owner": 1.}); r.Error != nil || r.Payload["diff"] == "" {
+		t.Errorf("riskFileDraft of user 1 by bob: %+v", r)
+	}
+	if r := call(t, bob, "approveDraft", map[string]interface{}{"fn": "a.ini", "owner": 1., "comment": "ok"}); r.Error != nil {
+		t.Fatalf("approved by bob: %s", r.Error.Message)
+	}
+	if data, _ := engine.Files.Read(1, "a.ini"); string(data) != content {
+		t.Errorf("live file of user 1 = %q, want the draft", data)
+	}
+	if _, err := engine.Files.Read(2, "a.ini"); err == nil {
+		t.Error("draft saved as a file of the approver")
+	}
+}
+
+func TestRollbackToDelete(t *testing.T) {
+	withTestEngine(t)
+	withRoles(t, "default = viewer\n[users]\nalice = risk-author\n")
+	defer func(b bool) { *fourEyes = b }(*fourEyes)
+	for _, four := range []bool{false, true} {
+		*fourEyes = four
+		alice := testClient(1, "alice")
+		content := "[gross]\nformula = sum(abs(Pos) * Close)\n"
+		if err := engine.SaveFile(1, "a.ini", content, "alice", ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.DeleteFile(1, "a.ini", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		versions, _ := engine.FileVersions(1, "a.ini")
+		deleted := float64(versions[len(versions)-1].Version)
+		r := call(t, alice, "rollbackRiskFile", map[string]interface{}{"fn": "a.ini", "version": deleted})
+		if errorStatus(r) != 400 || r.Error.Code != "bad_request" {
+			t.Errorf("four eyes %v: rollback to a delete = %+v", four, r)
+		}
+		if r := call(t, alice, "drafts", nil); len(r.Payload["drafts"].([]interface{})) != 0 {
+			t.Errorf("four eyes %v: drafts %v after rollback to a delete", four, r.Payload)
+		}
+		if _, err := engine.Files.Read(1, "a.ini"); err == nil {
+			t.Errorf("four eyes %v: deleted file written", four)
+		}
+	}
+}
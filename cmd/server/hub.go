@@ -0,0 +1,237 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Msgs to a client never block the sender. Replies go through a bounded
+// queue, handled by -slow-client once full: "disconnect" closes the
+// connection, "drop" discards the msg. Risk frames go through a slot holding
+// only the latest frame, a frame not yet written when the next one comes is
+// replaced, or for subscriptions the next delta waits so none is lost.
+
+type queued struct {
+	msg []byte // nil to close the connection once flushed
+	at  time.Time
+}
+
+type hub struct {
+	queue     chan queued
+	riskLock  sync.Mutex
+	risk      *queued // latest risk frame not yet written
+	riskReady chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	connected time.Time
+	sent      int64 // msgs written
+	dropped   int64 // msgs discarded on a full queue
+	coalesced int64 // risk frames replaced or skipped
+	lag       int64 // ns from queuing to writing of the last msg
+	maxLag    int64
+}
+
+func newHub() hub {
+	return hub{
+		queue:     make(chan queued, *queueSize),
+		riskReady: make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		connected: time.Now(),
+	}
+}
+
+func (self *Client) close() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		self.Conn.Close()
+	})
+}
+
+func (self *Client) isClosed() bool {
+	select {
+	case <-self.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *Client) enqueue(msg []byte) {
+	if self.isClosed() {
+		return
+	}
+	select {
+	case self.queue <- queued{msg, time.Now()}:
+		return
+	default:
+	}
+	if *slowClient == "drop" && msg != nil {
+		atomic.AddInt64(&self.dropped, 1)
+		return
+	}
+	log.Println("client", self.Id, "too slow, disconnecting")
+	self.close()
+}
+
+// closeAfterFlush closes the connection after the queued msgs are written
+func (self *Client) closeAfterFlush() {
+	self.enqueue(nil)
+}
+
+// riskPending tells if the last risk frame is not written yet
+func (self *Client) riskPending() bool {
+	self.riskLock.Lock()
+	defer self.riskLock.Unlock()
+	return self.risk != nil
+}
+
+func (self *Client) setRisk(msg []byte) {
+	self.riskLock.Lock()
+	if self.risk != nil {
+		atomic.AddInt64(&self.coalesced, 1)
+	}
+	self.risk = &queued{msg, time.Now()}
+	self.riskLock.Unlock()
+	select {
+	case self.riskReady <- struct{}{}:
+	default:
+	}
+}
+
+func (self *Client) send(q queued) bool {
+	self.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := self.Conn.WriteMessage(websocket.TextMessage, q.msg); err != nil {
+		log.Println("client", self.Id, "write error:", err)
+		return false
+	}
+	lag := int64(time.Since(q.at))
+	atomic.StoreInt64(&self.lag, lag)
+	if lag > atomic.LoadInt64(&self.maxLag) {
+		atomic.StoreInt64(&self.maxLag, lag)
+	}
+	atomic.AddInt64(&self.sent, 1)
+	return true
+}
+
+func (self *Client) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		self.close()
+	}()
+	for {
+		select {
+		case q := <-self.queue:
+			if q.msg == nil {
+				self.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				self.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if !self.send(q) {
+				return
+			}
+		case <-self.riskReady:
+			self.riskLock.Lock()
+			q := self.risk
+			self.risk = nil
+			self.riskLock.Unlock()
+			if q != nil && !self.send(*q) {
+				return
+			}
+		case <-ticker.C:
+			self.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := self.Conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				log.Print(err)
+				return
+			}
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+type hubStats struct {
+	Id        int64   `json:"id"`
+	UserId    int     `json:"userId"`
+	Proto     int     `json:"proto"`
+	Connected int64   `json:"connected"`
+	Queued    int     `json:"queued"`
+	QueueSize int     `json:"queueSize"`
+	Sent      int64   `json:"sent"`
+	Dropped   int64   `json:"dropped"`
+	Coalesced int64   `json:"coalesced"`
+	LagMs     float64 `json:"lagMs"`
+	MaxLagMs  float64 `json:"maxLagMs"`
+}
+
+// apiHub lists the connected clients of every user with their queue
+// metrics, to risk-admins only
+func apiHub(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s := requestSession(r)
+	if s == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "missing or expired Bearer session token")
+		return
+	}
+	if role := sessionRole(s); role < RoleAdmin {
+		writeError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("listing clients needs the %s role, you are %s", RoleAdmin, role))
+		return
+	}
+	items := []interface{}{}
+	var stats []hubStats
+	// UserId is set on the engine goroutine
+	if !onEngine(func() {
+		clients.Range(func(_, c interface{}) bool {
+			self := c.(*Client)
+			stats = append(stats, hubStats{
+				Id:        self.Id,
+				UserId:    self.UserId,
+				Proto:     self.Proto,
+				Connected: self.connected.Unix(),
+				Queued:    len(self.queue),
+				QueueSize: cap(self.queue),
+				Sent:      atomic.LoadInt64(&self.sent),
+				Dropped:   atomic.LoadInt64(&self.dropped),
+				Coalesced: atomic.LoadInt64(&self.coalesced),
+				LagMs:     float64(atomic.LoadInt64(&self.lag)) / 1e6,
+				MaxLagMs:  float64(atomic.LoadInt64(&self.maxLag)) / 1e6,
+			})
+			return true
+		})
+	}) {
+		writeError(w, http.StatusServiceUnavailable, "unavailable", "risk engine is busy or not connected")
+		return
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Id < stats[j].Id })
+	for _, s := range stats {
+		items = append(items, s)
+	}
+	writePage(w, r, items)
+}
@@ -0,0 +1,214 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withRoles loads roles from an ini content until the test ends
+func withRoles(t *testing.T, content string) {
+	fn := filepath.Join(t.TempDir(), "roles.ini")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	roles = &roleFile{fn: fn}
+	t.Cleanup(func() { roles = nil })
+}
+
+func getHub(s *session) int {
+	r := httptest.NewRequest("GET", "/api/hub", nil)
+	if s != nil {
+		r.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	w := httptest.NewRecorder()
+	apiHub(w, r, nil)
+	return w.Code
+}
+
+func TestApiHubNeedsAdmin(t *testing.T) {
+	withRoles(t, "default = viewer\n[users]\nroot = risk-admin\nbob = risk-approver\n")
+	go func() {
+		f := <-engineCalls
+		f()
+	}()
+	for _, c := range []struct {
+		s      *session
+		status int
+	}{
+		{nil, http.StatusUnauthorized},
+		{newSession(1, "alice"), http.StatusForbidden},
+		{newSession(2, "bob"), http.StatusForbidden},
+		{newSession(3, "root"), http.StatusOK},
+	} {
+		if got := getHub(c.s); got != c.status {
+			t.Errorf("GET /api/hub as %v = %d, want %d", c.s, got, c.status)
+		}
+	}
+}
+
+// wsClient is a client with a queue of size msgs connected to a test
+// server, and the other end of its connection
+func wsClient(t *testing.T, size int) (*Client, *websocket.Conn) {
+	defer func(n int) { *queueSize = n }(*queueSize)
+	*queueSize = size
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	c := &Client{hub: newHub(), Conn: <-conns}
+	t.Cleanup(c.close)
+	return c, peer
+}
+
+func withSlowClient(t *testing.T, policy string) {
+	old := *slowClient
+	*slowClient = policy
+	t.Cleanup(func() { *slowClient = old })
+}
+
+func readMsgs(t *testing.T, peer *websocket.Conn, n int) []string {
+	var out []string
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < n; i++ {
+		_, msg, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("msg %d: %v", i+1, err)
+		}
+		out = append(out, string(msg))
+	}
+	return out
+}
+
+func TestQueueDrop(t *testing.T) {
+	withSlowClient(t, "drop")
+	c, _ := wsClient(t, 2)
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		c.enqueue([]byte(msg))
+	}
+	if c.isClosed() || len(c.queue) != 2 || atomic.LoadInt64(&c.dropped) != 2 {
+		t.Errorf("closed %v, queued %d, dropped %d", c.isClosed(), len(c.queue), c.dropped)
+	}
+	// closing is never dropped
+	c.closeAfterFlush()
+	if !c.isClosed() {
+		t.Error("close on a full queue dropped")
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	withSlowClient(t, "disconnect")
+	c, peer := wsClient(t, 2)
+	c.enqueue([]byte("a"))
+	c.enqueue([]byte("b"))
+	if c.isClosed() {
+		t.Fatal("closed within the limit")
+	}
+	c.enqueue([]byte("c"))
+	if !c.isClosed() || atomic.LoadInt64(&c.dropped) != 0 {
+		t.Errorf("closed %v, dropped %d past the limit", c.isClosed(), c.dropped)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := peer.ReadMessage(); err == nil {
+		t.Error("connection of a slow client still open")
+	}
+	// nothing is queued once closed
+	n := len(c.queue)
+	c.enqueue([]byte("d"))
+	if len(c.queue) != n {
+		t.Error("queued to a closed client")
+	}
+}
+
+func TestRiskCoalesce(t *testing.T) {
+	c, peer := wsClient(t, 4)
+	for _, msg := range []string{"r1", "r2", "r3"} {
+		c.setRisk([]byte(msg))
+	}
+	if !c.riskPending() || atomic.LoadInt64(&c.coalesced) != 2 {
+		t.Errorf("pending %v, coalesced %d", c.riskPending(), c.coalesced)
+	}
+	c.enqueue([]byte("reply"))
+	go c.writeLoop()
+	got := readMsgs(t, peer, 2)
+	if !(got[0] == "reply" && got[1] == "r3") && !(got[0] == "r3" && got[1] == "reply") {
+		t.Errorf("written %v, want reply and r3", got)
+	}
+	c.setRisk([]byte("r4"))
+	if got := readMsgs(t, peer, 1); got[0] != "r4" {
+		t.Errorf("written %v, want r4", got)
+	}
+	if c.riskPending() || atomic.LoadInt64(&c.sent) != 3 {
+		t.Errorf("pending %v, sent %d", c.riskPending(), c.sent)
+	}
+}
+
+func TestWriteLoopExits(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		c, peer := wsClient(t, 4)
+		done := make(chan struct{})
+		go func() {
+			c.writeLoop()
+			close(done)
+		}()
+		if flush {
+			c.enqueue([]byte("last"))
+			c.closeAfterFlush()
+			if got := readMsgs(t, peer, 1); got[0] != "last" {
+				t.Errorf("written %v before closing", got)
+			}
+			_, _, err := peer.ReadMessage()
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("closed with %v", err)
+			}
+		} else {
+			c.close()
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("writeLoop running after close, flush %v", flush)
+		}
+		if !c.isClosed() {
+			t.Errorf("client open after writeLoop, flush %v", flush)
+		}
+	}
+}
@@ -29,7 +29,6 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,6 +37,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/unrolled/render"
 
+	"github.com/bhojpur/risk/pkg/client"
 	engine "github.com/bhojpur/risk/pkg/engine"
 )
 
@@ -58,79 +58,76 @@ const (
 var addr = flag.String("addr", "0.0.0.0:9113", "HTTP service address")
 var server = flag.String("server", "ws://localhost:9111/", "Bhojpur Trade server address")
 var username = flag.String("username", "admin", "username to login to Bhojpur Trade server")
-var passwd = flag.String("passwd", "test", "passwd to login to Bhojpur Trade server")
+var passwd = flag.String("passwd", "test", "deprecated, passwd to login to Bhojpur Trade server")
+var passwdFile = flag.String("passwd-file", "", "file of the passwd to login to Bhojpur Trade server, else $"+passwdEnv)
+var serverCA = flag.String("server-ca", "", "CA certs to verify a wss:// trade server, default the system ones")
+var serverCert = flag.String("server-cert", "", "client cert to the trade server")
+var serverKey = flag.String("server-key", "", "client cert key to the trade server")
+var maxFileSize = flag.Int64("max-file-size", engine.DefaultMaxFileSize, "max bytes of a risk file")
+var tlsCert = flag.String("tls-cert", "", "cert to serve https and wss, reloaded when changed")
+var tlsKey = flag.String("tls-key", "", "key of -tls-cert")
+var tlsClientCA = flag.String("tls-client-ca", "", "CA certs client certs are required to be signed by")
+var history = flag.String("history", "history.db", "file of the risk history database")
+var fourEyes = flag.Bool("four-eyes", false, "saving a portfolio file makes a draft a risk-approver other than the author activates")
+var shared = flag.String("shared", engine.SharedDir, "directory of firm wide .ini files to include and python modules")
+var watch = flag.Bool("watch", true, "reload risk files changed on disk")
+var versions = flag.String("versions", "versions.db", "file of the risk file version database")
+var retention = flag.Duration("retention", 7*24*time.Hour, "how long risk history is kept")
+var queueSize = flag.Int("client-queue", 256, "max msgs queued to a websocket client")
+var slowClient = flag.String("slow-client", "disconnect", "when a client queue is full: disconnect or drop")
+var authKind = flag.String("auth", "trade", "how logins are checked: trade, htpasswd or jwt")
+var htpasswd = flag.String("htpasswd", "", "file of user:hash:userId lines for -auth htpasswd")
+var jwtKey = flag.String("jwt-key", "", "file of the HS256 key for -auth jwt")
+var sessionTTL = flag.Duration("session-ttl", 12*time.Hour, "how long a login session lasts")
+var rolesFile = flag.String("roles", "", "ini file of user roles, everybody is risk-admin without")
+var auditLog = flag.String("audit", "audit.log", "file of the audit log")
+var origins = flag.String("origins", "", "comma separated websocket origins allowed, * for any, default the server host")
 var rd = render.New()
 var clients = sync.Map{}
 var clientCounter int64 = 0
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  checkOrigin,
+	Subprotocols: []string{client.Subprotocol},
 }
 
 func index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	rd.JSON(w, http.StatusOK, map[string]interface{}{"hello": "index page"})
 }
 
-func api(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	fmt.Fprintf(w, "api: %s\n", p.ByName("name"))
-}
-
-func publish2Client(ch chan []byte, c *websocket.Conn) {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		log.Println("publish2Client ended")
-		ticker.Stop()
-		c.Close()
-	}()
-	for {
-		select {
-		case msg := <-ch:
-			c.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				log.Println("publish2Client write error:", err)
-				return
-			}
-		case <-ticker.C:
-			c.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				log.Print(err)
-				return
-			}
-		}
-	}
-}
-
 type Client struct {
-	Ch     chan []byte
-	UserId int
-	Conn   *websocket.Conn
+	hub
+	Id      int64
+	UserId  int
+	Conn    *websocket.Conn
+	Proto   int           // 0 for legacy arrays, else the envelope protocol version
+	session *session      // nil before login, owned by the reader goroutine
+	expires int64         // unix seconds the session expires at
+	sub     *subscription // nil for full risk pushes, owned by tradeServerJob
 }
 
 func serveClient(w http.ResponseWriter, r *http.Request) {
-	n := atomic.AddInt64(&clientCounter, 1)
-	self := &Client{}
-	clients.Store(n, self)
-
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
-	log.Println("received client connection", n)
-	ch := make(chan []byte)
-	self.Ch = ch
-	self.Conn = c
+	n := atomic.AddInt64(&clientCounter, 1)
+	self := &Client{hub: newHub(), Id: n, Conn: c}
+	if c.Subprotocol() == client.Subprotocol {
+		self.Proto = client.ProtocolVersion
+	}
+	log.Println("received client connection", n, c.Subprotocol())
+	clients.Store(n, self)
 	defer func() {
 		log.Println("client connection", n, "closed")
 		clients.Delete(n)
-		close(ch)
-		c.Close()
+		self.close()
 	}()
 	// c.SetReadLimit(maxMessageSize)
 	c.SetReadDeadline(time.Now().Add(pongWait))
 	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	go publish2Client(ch, c)
+	go self.writeLoop()
 	for {
 		// mt is an int with value
 		// websocket.BinaryMessage or websocket.TextMessage
@@ -139,51 +136,561 @@ func serveClient(w http.ResponseWriter, r *http.Request) {
 			log.Println("read error:", err)
 			break
 		}
-		var msg []interface{}
-		err = json.Unmarshal(raw, &msg)
+		req, err := decodeRequest(raw)
 		if err != nil {
-			log.Println("received non-json msg", msg, mt)
+			log.Println("received invalid msg", string(raw), mt, err)
 			continue
 		}
-		action, _ := msg[0].(string)
-		if action == "login" {
-			msg[0] = "validate_user"
-		} else if action == "saveRiskFile" {
-			fn, _ := msg[1].(string)
-			content, _ := msg[2].(string)
-			if path.Ext(fn) == ".py" {
-				tmp := "." + strconv.Itoa(int(n)) + "tmp_" + fn
-				err = ioutil.WriteFile(tmp, []byte(content), 0755)
-				if err != nil {
-					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
-					continue
-				}
-				err = engine.CheckPy(tmp)
-				os.Remove(tmp)
-				if err != nil {
-					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
-					continue
-				}
-			} else if path.Ext(fn) == ".ini" {
-				cfg, err := engine.ParseIni(content)
-				if err != nil {
-					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
+		self.handle(req, n)
+	}
+}
+
+func (self *Client) handle(req *request, n int64) {
+	switch req.Type {
+	case "hello", "login", "resume":
+	default:
+		if self.session == nil || self.expired() {
+			self.reply(req, nil, errorf(http.StatusUnauthorized, "unauthorized", "login required"))
+			return
+		}
+	}
+	switch req.Type {
+	case "riskFile", "saveRiskFile", "deleteRiskFile", "riskFileVersions", "riskFileDiff", "rollbackRiskFile", "validateRiskFile",
+		"editRiskFile", "saveDraft", "submitDraft", "riskFileDraft", "approveDraft", "rejectDraft", "discardDraft":
+		if err := engine.ValidateFileName(req.str("fn")); err != nil {
+			self.reply(req, map[string]interface{}{"fn": req.str("fn")}, errorf(http.StatusBadRequest, "invalid_name", "%s", err.Error()))
+			return
+		}
+	}
+	switch req.Type {
+	case "hello":
+		versions, _ := req.Payload["versions"].([]interface{})
+		for _, v := range versions {
+			if v2, _ := v.(float64); int(v2) == client.ProtocolVersion {
+				self.Proto = client.ProtocolVersion
+				self.reply(req, map[string]interface{}{"version": client.ProtocolVersion}, nil)
+				return
+			}
+		}
+		self.reply(req, nil, errorf(http.StatusBadRequest, "unsupported_version", "supported versions: [%d]", client.ProtocolVersion))
+	case "login":
+		userId, name, err := auth.Authenticate(req.str("username"), req.str("password"))
+		if err == errInvalidCredentials {
+			if req.Legacy == nil {
+				self.reply(req, nil, errorf(http.StatusUnauthorized, "unauthorized", "%s", err.Error()))
+			}
+			self.closeAfterFlush()
+			return
+		} else if err != nil {
+			self.reply(req, nil, errorf(http.StatusServiceUnavailable, "unavailable", "%s", err.Error()))
+			return
+		}
+		log.Println("client", n, ":", userId)
+		self.startSession(req, newSession(userId, name))
+	case "resume":
+		s := findSession(req.str("session"))
+		if s == nil {
+			self.reply(req, nil, errorf(http.StatusUnauthorized, "session_expired", "unknown or expired session"))
+			return
+		}
+		self.startSession(req, s)
+	case "logout":
+		deleteSession(self.session.Token)
+		self.reply(req, map[string]interface{}{}, nil)
+		self.closeAfterFlush()
+	case "saveRiskFile":
+		fn := req.str("fn")
+		if !self.authorize(req, fileRole(fn), fn, map[string]interface{}{"fn": fn}) {
+			return
+		}
+		diags, ok := self.checkRiskFile(req, fn, req.str("content"))
+		if !ok {
+			return
+		}
+		if *fourEyes && engine.IsPortfolioFile(fn) {
+			self.saveDraft(req, fn, req.str("content"), req.str("comment"), diags)
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			if err := engine.SaveFile(self.UserId, fn, req.str("content"), self.session.Username, req.str("comment")); err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusInternalServerError, "io", "%s", err.Error())
+			}
+			return map[string]interface{}{"fn": fn, "diagnostics": diags}, nil
+		})
+	case "validateRiskFile":
+		fn := req.str("fn")
+		if !engine.IsPortfolioFile(fn) {
+			self.reply(req, map[string]interface{}{"fn": fn}, errorf(http.StatusBadRequest, "invalid_name", "only portfolio files are validated: %s", fn))
+			return
+		}
+		diags := engine.ValidateRiskFile(fn, req.str("content"), engine.GetPath(self.session.UserId))
+		self.reply(req, map[string]interface{}{"fn": fn, "diagnostics": diags}, nil)
+	case "editRiskFile":
+		self.editRiskFile(req)
+	case "riskFile":
+		fn := req.str("fn")
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			content, err := engine.GetFile(self.UserId, fn)
+			if err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusNotFound, "not_found", "%s", err.Error())
+			}
+			return map[string]interface{}{"fn": fn, "content": string(content)}, nil
+		})
+	case "deleteRiskFile":
+		fn := req.str("fn")
+		need := fileRole(fn)
+		if *fourEyes {
+			// no draft deletes a file
+			need = RoleAdmin
+		}
+		if !self.authorize(req, need, fn, map[string]interface{}{"fn": fn}) {
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			if err := engine.DeleteFile(self.UserId, fn, self.session.Username); err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusInternalServerError, "io", "%s", err.Error())
+			}
+			return map[string]interface{}{"fn": fn}, nil
+		})
+	case "riskFileVersions":
+		fn := req.str("fn")
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			versions, err := engine.FileVersions(self.UserId, fn)
+			if err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusInternalServerError, "io", "%s", err.Error())
+			}
+			return map[string]interface{}{"fn": fn, "versions": versions}, nil
+		})
+	case "riskFileDiff":
+		fn := req.str("fn")
+		from, to := int(req.float("from")), int(req.float("to"))
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			diff, err := engine.DiffFileVersions(self.UserId, fn, from, to)
+			if err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusNotFound, "not_found", "%s", err.Error())
+			}
+			return map[string]interface{}{"fn": fn, "from": from, "to": to, "diff": diff}, nil
+		})
+	case "rollbackRiskFile":
+		fn := req.str("fn")
+		version := int(req.float("version"))
+		payload := map[string]interface{}{"fn": fn, "version": version}
+		if !self.authorize(req, fileRole(fn), fmt.Sprintf("%s@%d", fn, version), payload) {
+			return
+		}
+		var content string
+		var v *engine.FileVersion
+		var err error
+		if !onEngine(func() { content, v, err = engine.FileVersionContent(self.UserId, fn, version) }) {
+			self.reply(req, payload, errorf(http.StatusServiceUnavailable, "unavailable", "risk engine is busy or not connected"))
+			return
+		}
+		if err != nil {
+			self.reply(req, payload, errorf(http.StatusNotFound, "not_found", "%s", err.Error()))
+			return
+		}
+		if v.Deleted {
+			// neither a draft nor RollbackFile deletes a file
+			self.reply(req, payload, errorf(http.StatusBadRequest, "bad_request", "version %d of %s is a delete, delete the file instead", version, fn))
+			return
+		}
+		if _, ok := self.checkRiskFile(req, fn, content); !ok {
+			return
+		}
+		if *fourEyes && engine.IsPortfolioFile(fn) {
+			comment := req.str("comment")
+			if comment == "" {
+				comment = fmt.Sprintf("rollback to version %d", version)
+			}
+			self.saveDraft(req, fn, content, comment, nil)
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			if err := engine.RollbackFile(self.UserId, fn, version, self.session.Username, req.str("comment")); err != nil {
+				return payload, errorf(http.StatusBadRequest, "rollback", "%s", err.Error())
+			}
+			return payload, nil
+		})
+	case "drafts":
+		approver := sessionRole(self.session) >= RoleApprover
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			drafts, err := engine.Drafts(self.UserId)
+			if err == nil && approver {
+				var pending []*engine.Draft
+				pending, err = engine.PendingDrafts(self.UserId)
+				drafts = append(drafts, pending...)
+			}
+			if err != nil {
+				return nil, errorf(http.StatusInternalServerError, "io", "%s", err.Error())
+			}
+			return map[string]interface{}{"drafts": drafts}, nil
+		})
+	case "saveDraft":
+		fn := req.str("fn")
+		if !engine.IsPortfolioFile(fn) {
+			self.reply(req, map[string]interface{}{"fn": fn}, errorf(http.StatusBadRequest, "draft", "drafts are only for portfolio files: %s", fn))
+			return
+		}
+		if !self.authorize(req, RoleAuthor, fn, map[string]interface{}{"fn": fn}) {
+			return
+		}
+		diags, ok := self.checkRiskFile(req, fn, req.str("content"))
+		if !ok {
+			return
+		}
+		self.saveDraft(req, fn, req.str("content"), req.str("comment"), diags)
+	case "riskFileDraft":
+		fn := req.str("fn")
+		owner := self.draftOwner(req)
+		if owner != self.UserId && !self.authorize(req, RoleApprover, draftTarget(owner, fn), map[string]interface{}{"fn": fn}) {
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			d, err := engine.GetDraft(owner, fn)
+			if err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusNotFound, "not_found", "%s", err.Error())
+			}
+			cur, _ := engine.GetFile(owner, fn)
+			limits, err := engine.DiffLimits(owner, fn, d.Content)
+			if err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusBadRequest, "invalid_file", "%s", err.Error())
+			}
+			diff := engine.UnifiedDiff(string(cur), d.Content, fn, fn+"@draft")
+			return map[string]interface{}{"fn": fn, "draft": d, "diff": diff, "limits": limits}, nil
+		})
+	case "submitDraft", "rejectDraft", "approveDraft", "discardDraft":
+		fn := req.str("fn")
+		need := RoleAuthor
+		// approvers act on the drafts of owner, authors on their own
+		owner := self.UserId
+		if req.Type == "rejectDraft" || req.Type == "approveDraft" {
+			need = RoleApprover
+			owner = self.draftOwner(req)
+		}
+		target := draftTarget(owner, fn)
+		if !self.authorize(req, need, target, map[string]interface{}{"fn": fn}) {
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			var d *engine.Draft
+			var err error
+			state := "active"
+			switch req.Type {
+			case "submitDraft":
+				d, err = engine.SubmitDraft(self.UserId, fn)
+			case "rejectDraft":
+				d, err = engine.RejectDraft(owner, fn, self.session.Username, req.str("comment"))
+			case "approveDraft":
+				d, err = engine.ApproveDraft(owner, fn, self.session.Username, req.str("comment"))
+			case "discardDraft":
+				state = "discarded"
+				err = engine.DiscardDraft(self.UserId, fn)
+			}
+			if err == engine.ErrSameApprover || err == engine.ErrAnonymousApprover {
+				self.audit(req.Type, target, false, err.Error())
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusForbidden, "forbidden", "%s", err.Error())
+			} else if err != nil {
+				return map[string]interface{}{"fn": fn}, errorf(http.StatusConflict, "conflict", "%s", err.Error())
+			}
+			if d != nil && req.Type != "approveDraft" {
+				state = d.State
+			}
+			self.audit("draft", target, true, state)
+			return map[string]interface{}{"fn": fn, "owner": owner, "state": state}, nil
+		})
+	case "historicalRisk":
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			return historicalRisk(self, req)
+		})
+	case "ackBreach":
+		key := engine.BreachKey(req.str("portfolio"), req.str("risk"), req.str("param"), req.str("group"), req.str("symbol"))
+		if !self.authorize(req, RoleAuthor, breachTarget(req), req.Payload) {
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			if err := engine.AckBreach(self.UserId, key, self.session.Username, req.str("comment")); err != nil {
+				return req.Payload, errorf(http.StatusNotFound, "not_found", "%s", err.Error())
+			}
+			return req.Payload, nil
+		})
+	case "tradeStopOverride":
+		o := &engine.Override{
+			Portfolio: req.str("portfolio"),
+			Risk:      req.str("risk"),
+			Param:     req.str("param"),
+			Group:     req.str("group"),
+			By:        self.session.Username,
+			Reason:    req.str("reason"),
+		}
+		if d := req.float("duration"); d > 0 {
+			o.Until = time.Now().Unix() + int64(d)
+		}
+		if !self.authorize(req, RoleAdmin, breachTarget(req), req.Payload) {
+			return
+		}
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			if err := engine.OverrideTradeStop(self.UserId, o); err != nil {
+				return req.Payload, errorf(http.StatusNotFound, "not_found", "%s", err.Error())
+			}
+			return map[string]interface{}{"override": o}, nil
+		})
+	case "subscribe":
+		sub := newSubscription(req)
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			self.sub = sub
+			return sub.payload(), nil
+		})
+	case "unsubscribe":
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			self.sub = nil
+			return map[string]interface{}{}, nil
+		})
+	default:
+		if req.Legacy == nil {
+			self.reply(req, nil, errorf(http.StatusBadRequest, "unknown_type", "unknown msg type: %s", req.Type))
+			return
+		}
+		// legacy clients may talk to the trade server through us
+		engine.Request(append(req.Legacy, n))
+	}
+}
+
+// draftOwner is the user id owner of a draft request, the user's own by default
+func (self *Client) draftOwner(req *request) int {
+	if owner := int(req.float("owner")); owner > 0 {
+		return owner
+	}
+	return self.UserId
+}
+
+// saveDraft saves the checked content of fn as a draft
+func (self *Client) saveDraft(req *request, fn string, content string, comment string, diags []*engine.Diagnostic) {
+	self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+		d, err := engine.SaveDraft(self.UserId, fn, content, self.session.Username, comment)
+		if err != nil {
+			return map[string]interface{}{"fn": fn}, errorf(http.StatusBadRequest, "draft", "%s", err.Error())
+		}
+		self.audit("draft", fn, true, d.State)
+		return map[string]interface{}{"fn": fn, "state": d.State, "diagnostics": diags}, nil
+	})
+}
+
+// editRiskFile applies the engine.EditOp list ops to a portfolio .ini file,
+// or to its draft with -four-eyes, and saves it as saveRiskFile does
+func (self *Client) editRiskFile(req *request) {
+	fn := req.str("fn")
+	payload := map[string]interface{}{"fn": fn}
+	if engine.FileFormat(fn) != "ini" {
+		self.reply(req, payload, errorf(http.StatusBadRequest, "invalid_name", "only portfolio .ini files are edited: %s", fn))
+		return
+	}
+	if !self.authorize(req, fileRole(fn), fn, payload) {
+		return
+	}
+	var ops []*engine.EditOp
+	if err := req.decode("ops", &ops); err != nil || len(ops) == 0 {
+		self.reply(req, payload, errorf(http.StatusBadRequest, "invalid_edit", "ops expected, a list of edits"))
+		return
+	}
+	var content []byte
+	var err error
+	if !onEngine(func() {
+		if *fourEyes {
+			if d, err2 := engine.GetDraft(self.UserId, fn); err2 == nil {
+				content = []byte(d.Content)
+				return
+			}
+		}
+		content, err = engine.GetFile(self.UserId, fn)
+	}) {
+		self.reply(req, payload, errorf(http.StatusServiceUnavailable, "unavailable", "risk engine is busy or not connected"))
+		return
+	}
+	if err != nil {
+		self.reply(req, payload, errorf(http.StatusNotFound, "not_found", "%s", err.Error()))
+		return
+	}
+	ed, err := engine.NewPortfolioEditor(string(content))
+	if err != nil {
+		self.reply(req, payload, errorf(http.StatusBadRequest, "invalid_file", "%s", err.Error()))
+		return
+	}
+	if err := ed.Apply(ops); err != nil {
+		self.reply(req, payload, errorf(http.StatusBadRequest, "invalid_edit", "%s", err.Error()))
+		return
+	}
+	out, err := ed.Content()
+	if err != nil {
+		self.reply(req, payload, errorf(http.StatusBadRequest, "invalid_edit", "%s", err.Error()))
+		return
+	}
+	diags, ok := self.checkRiskFile(req, fn, out)
+	if !ok {
+		return
+	}
+	if *fourEyes {
+		self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+			d, err := engine.SaveDraft(self.UserId, fn, out, self.session.Username, req.str("comment"))
+			if err != nil {
+				return payload, errorf(http.StatusBadRequest, "draft", "%s", err.Error())
+			}
+			self.audit("draft", fn, true, d.State)
+			return map[string]interface{}{"fn": fn, "content": out, "state": d.State, "diagnostics": diags}, nil
+		})
+		return
+	}
+	self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+		if err := engine.SaveFile(self.UserId, fn, out, self.session.Username, req.str("comment")); err != nil {
+			return payload, errorf(http.StatusInternalServerError, "io", "%s", err.Error())
+		}
+		return map[string]interface{}{"fn": fn, "content": out, "diagnostics": diags}, nil
+	})
+}
+
+// startSession replies to login or resume with the user id, risk files and
+// the session token
+func (self *Client) startSession(req *request, s *session) {
+	self.session = s
+	atomic.StoreInt64(&self.expires, s.Expires.Unix())
+	self.onEngine(req, func() (map[string]interface{}, *client.Error) {
+		self.UserId = s.UserId
+		return map[string]interface{}{
+			"userId":  s.UserId,
+			"files":   engine.GetFiles(s.UserId),
+			"session": s.Token,
+			"expires": s.Expires.Unix(),
+			"role":    sessionRole(s).String(),
+		}, nil
+	})
+}
+
+// onEngine runs f on the engine goroutine and replies with its result
+func (self *Client) onEngine(req *request, f func() (map[string]interface{}, *client.Error)) {
+	var payload map[string]interface{}
+	var e *client.Error
+	if !onEngine(func() { payload, e = f() }) {
+		e = errorf(http.StatusServiceUnavailable, "unavailable", "risk engine is busy or not connected")
+	}
+	self.reply(req, payload, e)
+}
+
+// checkRiskFile validates portfolio and .py files before saving them, replies
+// the diagnostics of an invalid file and returns false, else returns the
+// warnings
+func (self *Client) checkRiskFile(req *request, fn string, content string) ([]*engine.Diagnostic, bool) {
+	if engine.IsPortfolioFile(fn) {
+		diags := engine.ValidateRiskFile(fn, content, engine.GetPath(self.session.UserId))
+		for _, d := range diags {
+			if d.Severity == engine.SeverityError {
+				payload := map[string]interface{}{"fn": fn, "diagnostics": diags}
+				self.reply(req, payload, errorf(http.StatusBadRequest, "invalid_file", "line %d: %s", d.Line, d.Message))
+				return nil, false
+			}
+		}
+		return diags, true
+	}
+	if engine.IsListFile(fn) {
+		return nil, true
+	}
+	if err := checkPy(content); err != nil {
+		self.reply(req, map[string]interface{}{"fn": fn}, errorf(http.StatusBadRequest, "invalid_file", "%s", err.Error()))
+		return nil, false
+	}
+	return nil, true
+}
+
+func checkPy(content string) error {
+	f, err := ioutil.TempFile("", "risk-*.py")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(content)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return engine.CheckPy(f.Name())
+}
+
+// historicalRisk takes portfolio, risk (display name), param and the
+// optional from and to in unix seconds, resolution like "1m", "5m", "1h",
+// "raw" or "auto" (default), and agg "last" (default) or "ohlc". The reply is
+// a client.History, its series are {group: points}, or {group: {symbol:
+// points}} for non-aggregate (top or call() list) params.
+func historicalRisk(self *Client, req *request) (map[string]interface{}, *client.Error) {
+	h := &client.History{
+		Portfolio: req.str("portfolio"),
+		Risk:      req.str("risk"),
+		Param:     req.str("param"),
+		Agg:       req.str("agg"),
+	}
+	out := map[string]interface{}{"portfolio": h.Portfolio, "risk": h.Risk, "param": h.Param}
+	status, err := queryHistory(self.UserId, h, req.float("from"), req.float("to"), req.str("resolution"))
+	if status == http.StatusNotFound && req.Legacy != nil {
+		// legacy clients get no series for unknown params
+		return out, nil
+	}
+	if err != nil {
+		return out, errorf(status, errorCode(status), "%s", err.Error())
+	}
+	out["series"] = h.Series
+	out["resolution"] = h.Resolution
+	out["agg"] = h.Agg
+	return out, nil
+}
+
+// queryHistory fills in h.Series for h.Portfolio, h.Risk (display name) and
+// h.Param, downsampled to the resolution, and returns an http status
+func queryHistory(userId int, h *client.History, from float64, to float64, resolutionStr string) (int, error) {
+	if h.Agg != "ohlc" {
+		h.Agg = "last"
+	}
+	resolution, err := engine.ParseResolution(resolutionStr)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	portfolio := engine.UserPortfolios[userId][h.Portfolio]
+	if portfolio == nil {
+		return http.StatusNotFound, fmt.Errorf("unknown portfolio: %s", h.Portfolio)
+	}
+	for _, r := range portfolio.RiskDefs {
+		if h.Risk != r.DisplayName {
+			continue
+		}
+		for _, rp := range r.Params {
+			if rp.Name != h.Param {
+				continue
+			}
+			if !rp.Graph {
+				return http.StatusNotFound, fmt.Errorf("no history for %s %s, graph is not enabled", h.Risk, h.Param)
+			}
+			series := engine.QueryHistory(userId, portfolio.Name, r.Name, rp.Name, from, to)
+			if resolution == 0 {
+				resolution = engine.AutoResolution(series)
+			}
+			h.Resolution = resolution
+			h.Series = make(map[string]interface{}, len(series))
+			for name, points := range series {
+				points2 := engine.DownsampleHistory(points, resolution, h.Agg)
+				group, symbol := engine.SplitHistorySeries(name)
+				if symbol == "" {
+					h.Series[group] = points2
 					continue
 				}
-				_, err = engine.ParsePortfolio(cfg, engine.GetPath(self.UserId))
-				if err != nil {
-					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
-					continue
+				symbols, _ := h.Series[group].(map[string][][]float64)
+				if symbols == nil {
+					symbols = make(map[string][][]float64)
+					h.Series[group] = symbols
 				}
+				symbols[symbol] = points2
 			}
+			return http.StatusOK, nil
 		}
-		msg = append(msg, n)
-		engine.Request(msg)
 	}
+	return http.StatusNotFound, fmt.Errorf("unknown risk param: %s %s", h.Risk, h.Param)
 }
 
 func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
@@ -198,75 +705,12 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 	}()
 	for {
 		select {
-		case msg, _ := <-engine.ChannelWriteTradeServer:
-			action, _ := msg[0].(string)
-			if action == "riskFile" || action == "saveRiskFile" || action == "deleteRiskFile" || action == "historicalRisk" {
-				n, _ := msg[len(msg)-1].(int64)
-				tmp, _ := clients.Load(n)
-				if tmp != nil {
-					client := tmp.(*Client)
-					out := []interface{}{action}
-					if action == "historicalRisk" {
-						portfolios := engine.UserPortfolios[client.UserId]
-						if portfolios == nil {
-							continue
-						}
-						portfolioName, _ := msg[1].(string)
-						portfolio := portfolios[portfolioName]
-						if portfolio == nil {
-							continue
-						}
-						riskName, _ := msg[2].(string)
-						paramName, _ := msg[3].(string)
-						out = append(out, portfolioName)
-						out = append(out, riskName)
-						out = append(out, paramName)
-						for _, r := range portfolio.RiskDefs {
-							if riskName == r.DisplayName {
-								for _, rp := range r.Params {
-									if rp.Name == paramName {
-										if rp.Graph {
-											out = append(out, rp.History)
-										}
-										break
-									}
-								}
-								break
-							}
-						}
-					} else {
-						fn, _ := msg[1].(string)
-						out = append(out, fn)
-						if action == "riskFile" {
-							content, err := engine.GetFile(client.UserId, fn)
-							if err == nil {
-								out = append(out, string(content))
-							} else {
-								out = append(out, nil)
-								out = append(out, err.Error())
-							}
-						} else if action == "deleteRiskFile" {
-							err := engine.DeleteFile(client.UserId, fn)
-							if err != nil {
-								out = append(out, err.Error)
-							}
-						} else if action == "saveRiskFile" {
-							err := engine.SaveFile(client.UserId, fn, msg[2].(string))
-							if err != nil {
-								out = append(out, err.Error)
-							}
-						}
-					}
-					str, _ := json.Marshal(out)
-					client.Ch <- str
-				}
-			} else {
-				c.SetWriteDeadline(time.Now().Add(writeWait))
-				str, _ := json.Marshal(msg)
-				err := c.WriteMessage(websocket.TextMessage, str)
-				if err != nil {
-					log.Fatal("trade server: ", err)
-				}
+		case msg := <-engine.ChannelWriteTradeServer:
+			c.SetWriteDeadline(time.Now().Add(writeWait))
+			str, _ := json.Marshal(msg)
+			err := c.WriteMessage(websocket.TextMessage, str)
+			if err != nil {
+				log.Fatal("trade server: ", err)
 			}
 		case msg, ok := <-ch:
 			if !ok {
@@ -313,19 +757,8 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 			} else if action == "user_validation" {
 				userId := int(msg[1].(float64))
 				token := int64(msg[2].(float64))
-				tmp, _ := clients.Load(token)
-				if tmp == nil {
-					continue
-				}
-				client := tmp.(*Client)
-				if userId > 0 {
-					client.UserId = userId
-					log.Println("client", int(token), ":", userId)
-					if out, err := json.Marshal([]interface{}{"riskFiles", engine.GetFiles(userId)}); err == nil {
-						client.Ch <- out
-					}
-				} else {
-					client.Conn.Close()
+				if a, ok := auth.(*tradeAuth); ok {
+					a.validated(token, userId)
 				}
 			} else if action == "sub_account" {
 				// pass
@@ -348,26 +781,46 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 				log.Print(err)
 				return
 			}
+		case f := <-engineCalls:
+			f()
 		case <-riskTicker.C:
 			rpts := engine.RunUserPortfolios()
+			latestReports = rpts
+			now := time.Now()
 			clients.Range(func(_, c interface{}) bool {
-				client := c.(*Client)
-				rpt := rpts[client.UserId]
-				out, err := json.Marshal([]interface{}{"risk", rpt})
-				if err != nil {
-					log.Println("failed to Marshal:", rpt)
+				self := c.(*Client)
+				if self.UserId == 0 {
 					return true
 				}
-				client.Ch <- out
+				if self.expired() {
+					self.UserId = 0
+					self.notify("sessionExpired", map[string]interface{}{})
+					self.closeAfterFlush()
+					return true
+				}
+				if self.sub == nil {
+					self.push("risk", map[string]interface{}{"report": rpts[self.UserId]})
+				} else if self.riskPending() {
+					// the next delta goes against what was actually sent
+					atomic.AddInt64(&self.coalesced, 1)
+				} else if typ, payload := self.sub.update(rpts[self.UserId], now); payload != nil {
+					self.push(typ, payload)
+				}
 				return true
 			})
 		}
 	}
 }
 
-func tradeServer() {
+func tradeServer(pw string) {
 	log.Printf("connecting to Bhojpur Trade server: %s", *server)
-	c, _, err := websocket.DefaultDialer.Dial(*server, nil)
+	tlsConfig, err := dialerTLS()
+	if err != nil {
+		log.Fatal("trade server tls: ", err)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	c, _, err := dialer.Dial(*server, nil)
 	if err != nil {
 		log.Fatal("dial trade server: ", err)
 	}
@@ -381,7 +834,7 @@ func tradeServer() {
 	engine.Request(engine.Array{
 		"login",
 		*username,
-		*passwd,
+		pw,
 		true,
 	})
 
@@ -406,14 +859,65 @@ func main() {
 	log.Print("All rights reserved.")
 
 	flag.Parse()
+	if *slowClient != "disconnect" && *slowClient != "drop" {
+		log.Fatal("invalid -slow-client: ", *slowClient)
+	}
+	var err error
+	if auth, err = newAuthenticator(*authKind); err != nil {
+		log.Fatal("auth: ", err)
+	}
+	if *rolesFile != "" {
+		roles = &roleFile{fn: *rolesFile}
+		if err := roles.load(); err != nil {
+			log.Fatal("roles: ", err)
+		}
+	}
+	if err := engine.OpenAudit(*auditLog); err != nil {
+		log.Fatal("open audit: ", err)
+	}
+	defer engine.CloseAudit()
+	engine.Files = &engine.LocalFileStore{Root: ".", MaxSize: *maxFileSize}
+	if err := engine.ValidateSharedDir(*shared); err != nil {
+		log.Fatal("shared: ", err)
+	}
+	// includes are compared to it
+	engine.SharedDir = path.Clean(*shared)
 	engine.InitPy()
+	if err := engine.OpenHistory(*history, *retention); err != nil {
+		log.Fatal("open history: ", err)
+	}
+	defer engine.CloseHistory()
+	if err := engine.OpenVersions(*versions); err != nil {
+		log.Fatal("open versions: ", err)
+	}
+	defer engine.CloseVersions()
+	if *watch {
+		w, err := engine.WatchFiles(".", onEngine)
+		if err != nil {
+			log.Fatal("watch: ", err)
+		}
+		defer w.Close()
+	}
 	router := httprouter.New()
 	router.GET("/", index)
 	router.GET("/risk/", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		serveClient(w, r)
 	})
-	router.GET("/api/:name", api)
+	routeApi(router)
+	pw, err := tradePasswd()
+	if err != nil {
+		log.Fatal("passwd: ", err)
+	}
+	tlsConfig, err := listenerTLS()
+	if err != nil {
+		log.Fatal("tls: ", err)
+	}
+	srv := &http.Server{Addr: *addr, Handler: router, TLSConfig: tlsConfig}
+	go tradeServer(pw)
+	if tlsConfig != nil {
+		log.Print("risk server listening with tls on ", *addr)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
 	log.Print("risk server listening on ", *addr)
-	go tradeServer()
-	log.Fatal(http.ListenAndServe(*addr, router))
+	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,189 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// OpenAPI 3 document of the REST API, served at /api/openapi.json. The
+// websocket protocol of /risk/ is described under x-websocket-protocol and
+// its msg types under x-websocket-actions.
+
+func schemaRef(name string) schema {
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+func pageOf(name string) schema {
+	return schema{"allOf": []schema{
+		schemaRef("Page"),
+		jsonObject([]string{"items"}, schema{"items": jsonArray(schemaRef(name))}),
+	}}
+}
+
+func param(name string, in string, description string, s schema) schema {
+	return schema{"name": name, "in": in, "required": in == "path", "description": description, "schema": s}
+}
+
+var userParam = param("user", "path", "user id", jsonInteger)
+var portfolioParam = param("portfolio", "path", "portfolio name", jsonString)
+var pageParams = []schema{
+	param("offset", "query", "index of the first item", jsonInteger),
+	param("limit", "query", "page size, default 100, at most 1000", jsonInteger),
+}
+
+func operation(id string, summary string, params []schema, body schema) schema {
+	errorResponse := schema{"description": "error", "content": schema{"application/json": schema{"schema": schemaRef("Error")}}}
+	return schema{"get": schema{
+		"operationId": id,
+		"summary":     summary,
+		"parameters":  params,
+		"responses": schema{
+			"200":     schema{"description": "ok", "content": schema{"application/json": schema{"schema": body}}},
+			"default": errorResponse,
+		},
+	}}
+}
+
+// wsAction request and reply are the payload keys, also the positional args
+// of legacy array msgs in that order
+func wsAction(request []string, reply []string, description string) schema {
+	return schema{"request": request, "reply": reply, "description": description}
+}
+
+var openAPI = schema{
+	"openapi": "3.0.3",
+	"info": schema{
+		"title":   "Bhojpur Risk server",
+		"version": "1.0.0",
+	},
+	"paths": schema{
+		"/api/users/{user}/portfolios": operation("listPortfolios", "portfolio definitions of a user",
+			append([]schema{userParam}, pageParams...), pageOf("Portfolio")),
+		"/api/users/{user}/portfolios/{portfolio}": operation("getPortfolio", "one portfolio definition",
+			[]schema{userParam, portfolioParam}, schemaRef("Portfolio")),
+		"/api/users/{user}/report": operation("getReport", "latest risk report of all portfolios, keyed by portfolio name",
+			[]schema{userParam}, schema{"type": "object", "additionalProperties": schemaRef("Report")}),
+		"/api/users/{user}/portfolios/{portfolio}/report": operation("getPortfolioReport", "latest risk report of one portfolio",
+			[]schema{userParam, portfolioParam}, schemaRef("Report")),
+		"/api/users/{user}/portfolios/{portfolio}/history/{risk}/{param}": operation("getHistory", "history of a graph = true risk param",
+			[]schema{userParam, portfolioParam,
+				param("risk", "path", "display name of the risk", jsonString),
+				param("param", "path", "param name", jsonString),
+				param("from", "query", "unix seconds", jsonNumber),
+				param("to", "query", "unix seconds", jsonNumber),
+				param("resolution", "query", "bucket size like 1m, 5m, 1h, raw or auto", jsonString),
+				param("agg", "query", "last or ohlc", jsonString),
+			}, schemaRef("History")),
+		"/api/users/{user}/positions": operation("listPositions", "positions of the accounts of a user",
+			append([]schema{userParam,
+				param("acc", "query", "account name", jsonString),
+				param("symbol", "query", "security symbol", jsonString),
+				param("market", "query", "security market", jsonString),
+				param("securityId", "query", "security id", jsonInteger),
+			}, pageParams...), pageOf("Position")),
+		"/api/users/{user}/breaches": operation("listBreaches", "breaches of the latest risk run",
+			append([]schema{userParam,
+				param("portfolio", "query", "portfolio name", jsonString),
+				param("risk", "query", "display name of the risk", jsonString),
+			}, pageParams...), pageOf("Breach")),
+		"/api/users/{user}/overrides": operation("listOverrides", "trade stop overrides in effect",
+			append([]schema{userParam}, pageParams...), pageOf("Override")),
+		"/api/hub": operation("listHubClients", "websocket clients of every user with their queue metrics, risk-admin only",
+			pageParams, pageOf("HubClient")),
+		"/risk/": schema{"get": schema{
+			"operationId": "websocket",
+			"summary":     "websocket endpoint of the GUI, see x-websocket-actions",
+			"responses":   schema{"101": schema{"description": "switching protocols"}},
+		}},
+	},
+	"components": schema{
+		"schemas": schemas,
+		"securitySchemes": schema{
+			"session": schema{"type": "http", "scheme": "bearer", "description": "session token of a websocket login"},
+		},
+	},
+	"security": []schema{{"session": []string{}}},
+	"x-websocket-protocol": schema{
+		"subprotocol": "risk.v1",
+		"envelope":    schemaRef("Envelope"),
+		"description": "negotiate risk.v1 with Sec-WebSocket-Protocol, or send a hello envelope, " +
+			"to exchange envelopes with the request id echoed in replies; otherwise msgs are legacy " +
+			"arrays [type, args...] replied as [type, fields...] with a trailing error message on failure",
+	},
+	"x-websocket-actions": schema{
+		"hello": wsAction([]string{"versions"}, []string{"version"}, "switches to the envelope protocol"),
+		"login": wsAction([]string{"username", "password"}, []string{"userId", "files", "session", "expires", "role"},
+			"opens a session with the role of the user, other actions but hello and resume need one; the connection is closed on invalid credentials; "+
+				"password is the token with jwt auth; legacy reply is [riskFiles, files]"),
+		"resume": wsAction([]string{"session"}, []string{"userId", "files", "session", "expires", "role"},
+			"continues the session of an earlier login"),
+		"logout":         wsAction(nil, nil, "ends the session and closes the connection"),
+		"sessionExpired": wsAction(nil, nil, "pushed before the connection is closed when the session expires"),
+		"risk":           wsAction(nil, []string{"report"}, "pushed every second after login, report is {portfolio: Report}"),
+		"riskFile":       wsAction([]string{"fn"}, []string{"fn", "content"}, ""),
+		"saveRiskFile": wsAction([]string{"fn", "content", "comment"}, []string{"fn", "diagnostics"},
+			"portfolio (.ini, .yaml, .yml, .toml, .json) and .py files are validated before saving, portfolios and .csv lists need risk-author and .py risk-admin; "+
+				"every save adds a version; with -four-eyes a portfolio file is saved as a draft, the reply has state draft; diagnostics of a portfolio are [Diagnostic, ...], "+
+				"the warnings of a saved file or, with error invalid_file, all problems of a refused one"),
+		"validateRiskFile": wsAction([]string{"fn", "content"}, []string{"fn", "diagnostics"},
+			"validates a portfolio file without saving it, diagnostics is [Diagnostic, ...] sorted by line"),
+		"editRiskFile": wsAction([]string{"fn", "ops", "comment"}, []string{"fn", "content", "diagnostics"},
+			"applies ops [EditOp, ...] in order to a portfolio .ini file, keeping its comments, and saves the canonical result as saveRiskFile does; "+
+				"with -four-eyes the draft is edited if there is one, the reply has state; a failing op is error invalid_edit"),
+		"deleteRiskFile": wsAction([]string{"fn"}, []string{"fn"}, "needs the role of saveRiskFile, risk-admin with -four-eyes, adds a deleted version"),
+		"riskFileVersions": wsAction([]string{"fn"}, []string{"fn", "versions"},
+			"versions is [{version, author, comment, time, size, deleted}, ...], oldest first"),
+		"riskFileDiff": wsAction([]string{"fn", "from", "to"}, []string{"fn", "from", "to", "diff"},
+			"unified diff between two versions, from 0 for the latest version, to 0 for the current file"),
+		"rollbackRiskFile": wsAction([]string{"fn", "version", "comment"}, []string{"fn", "version"},
+			"saves an old version again as a new version, validated and with the role of saveRiskFile, as a draft with -four-eyes"),
+		"drafts": wsAction(nil, []string{"drafts"}, "drafts is [Draft, ...] without content, with the pending drafts of other users for risk-approvers"),
+		"saveDraft": wsAction([]string{"fn", "content", "comment"}, []string{"fn", "state", "diagnostics"},
+			"saves a validated portfolio file as a draft without changing the live one, needs risk-author, diagnostics as in saveRiskFile"),
+		"submitDraft": wsAction([]string{"fn"}, []string{"fn", "state"}, "asks for approval, the draft becomes pending, needs risk-author"),
+		"riskFileDraft": wsAction([]string{"fn", "owner"}, []string{"fn", "draft", "diff", "limits"},
+			"the draft of the user id owner, the user's own by default, with the unified diff to the live file and limits, the effective settings it changes, as [LimitChange, ...]; "+
+				"the drafts of others need risk-approver"),
+		"approveDraft": wsAction([]string{"fn", "comment", "owner"}, []string{"fn", "owner", "state"},
+			"activates a pending draft of the user id owner, saved as a version by its author, needs risk-approver and a named user other than the author"),
+		"rejectDraft": wsAction([]string{"fn", "comment", "owner"}, []string{"fn", "owner", "state"},
+			"sends a pending draft of the user id owner back to draft with the comment, needs risk-approver"),
+		"discardDraft": wsAction([]string{"fn"}, []string{"fn", "state"}, "removes a draft, needs risk-author"),
+		"historicalRisk": wsAction([]string{"portfolio", "risk", "param", "from", "to", "resolution", "agg"},
+			[]string{"portfolio", "risk", "param", "series", "resolution", "agg"}, "reply as in History"),
+		"ackBreach": wsAction([]string{"portfolio", "risk", "param", "group", "symbol", "comment"}, []string{"portfolio", "risk", "param", "group", "symbol", "comment"},
+			"acknowledges a breach of the latest run until it is gone, needs risk-author"),
+		"tradeStopOverride": wsAction([]string{"portfolio", "risk", "param", "group", "duration", "reason"}, []string{"override"},
+			"keeps a trade stop param, of one group or all, from disabling accounts for duration seconds, 0 removes it, needs risk-admin"),
+		"subscribe": wsAction([]string{"portfolios", "risks", "interval"}, []string{"portfolios", "risks", "interval"},
+			"replaces risk pushes with riskSnapshot then riskDelta, empty portfolios or risks (display names) for all, interval in ms (min 1000)"),
+		"unsubscribe":  wsAction(nil, nil, "back to full risk pushes"),
+		"riskSnapshot": wsAction(nil, []string{"set"}, "pushed after subscribe, set is [{path: [portfolio, risk, (param,) group], value: [value, breach?]}, ...]"),
+		"riskDelta":    wsAction(nil, []string{"set", "del"}, "rows changed since the last push, del is the paths of removed rows"),
+	},
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	rd.JSON(w, http.StatusOK, openAPI)
+}
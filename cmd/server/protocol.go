@@ -0,0 +1,237 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bhojpur/risk/pkg/client"
+)
+
+// Client messages come in two protocols. Clients negotiating the "risk.v1"
+// websocket subprotocol, or sending a hello envelope, exchange
+// client.Envelope objects with request ids echoed in the replies. Legacy
+// clients send [action, args...] arrays and get arrays back, mapped to and
+// from envelope payloads with the positional field lists below.
+
+// legacyArgs are the payload keys of the positional args of legacy requests
+var legacyArgs = map[string][]string{
+	"login":             {"username", "password"},
+	"riskFile":          {"fn"},
+	"saveRiskFile":      {"fn", "content", "comment"},
+	"deleteRiskFile":    {"fn"},
+	"historicalRisk":    {"portfolio", "risk", "param", "from", "to", "resolution", "agg"},
+	"subscribe":         {"portfolios", "risks", "interval"},
+	"resume":            {"session"},
+	"ackBreach":         {"portfolio", "risk", "param", "group", "symbol", "comment"},
+	"tradeStopOverride": {"portfolio", "risk", "param", "group", "duration", "reason"},
+	"riskFileVersions":  {"fn"},
+	"riskFileDiff":      {"fn", "from", "to"},
+	"rollbackRiskFile":  {"fn", "version", "comment"},
+	"saveDraft":         {"fn", "content", "comment"},
+	"submitDraft":       {"fn"},
+	"riskFileDraft":     {"fn", "owner"},
+	"approveDraft":      {"fn", "comment", "owner"},
+	"rejectDraft":       {"fn", "comment", "owner"},
+	"discardDraft":      {"fn"},
+	"validateRiskFile":  {"fn", "content"},
+	"editRiskFile":      {"fn", "ops", "comment"},
+}
+
+// legacyReplies are the action and payload keys of legacy replies
+var legacyReplies = map[string]struct {
+	Action string
+	Fields []string
+}{
+	"login":            {"riskFiles", []string{"files"}},
+	"resume":           {"riskFiles", []string{"files"}},
+	"risk":             {"risk", []string{"report"}},
+	"riskFile":         {"riskFile", []string{"fn", "content"}},
+	"saveRiskFile":     {"saveRiskFile", []string{"fn"}},
+	"deleteRiskFile":   {"deleteRiskFile", []string{"fn"}},
+	"historicalRisk":   {"historicalRisk", []string{"portfolio", "risk", "param", "series", "resolution", "agg"}},
+	"subscribe":        {"subscribe", []string{"portfolios", "risks", "interval"}},
+	"unsubscribe":      {"unsubscribe", nil},
+	"riskSnapshot":     {"riskSnapshot", []string{"set"}},
+	"riskDelta":        {"riskDelta", []string{"set", "del"}},
+	"riskFileVersions": {"riskFileVersions", []string{"fn", "versions"}},
+	"riskFileDiff":     {"riskFileDiff", []string{"fn", "from", "to", "diff"}},
+	"rollbackRiskFile": {"rollbackRiskFile", []string{"fn", "version"}},
+	"drafts":           {"drafts", []string{"drafts"}},
+	"saveDraft":        {"saveDraft", []string{"fn", "state"}},
+	"submitDraft":      {"submitDraft", []string{"fn", "state"}},
+	"riskFileDraft":    {"riskFileDraft", []string{"fn", "draft", "diff", "limits"}},
+	"approveDraft":     {"approveDraft", []string{"fn", "state"}},
+	"rejectDraft":      {"rejectDraft", []string{"fn", "state"}},
+	"discardDraft":     {"discardDraft", []string{"fn", "state"}},
+	"validateRiskFile": {"validateRiskFile", []string{"fn", "diagnostics"}},
+	"editRiskFile":     {"editRiskFile", []string{"fn", "content"}},
+}
+
+type request struct {
+	Type    string
+	Id      string
+	Payload map[string]interface{}
+	Legacy  []interface{} // the original array of a legacy request
+}
+
+func (r *request) str(key string) string {
+	v, _ := r.Payload[key].(string)
+	return v
+}
+
+func (r *request) float(key string) float64 {
+	v, _ := r.Payload[key].(float64)
+	return v
+}
+
+// decode decodes the payload value of key into out
+func (r *request) decode(key string, out interface{}) error {
+	tmp, err := json.Marshal(r.Payload[key])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(tmp, out)
+}
+
+func errorf(status int, code string, format string, args ...interface{}) *client.Error {
+	return &client.Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorCode is like "not_found" for http.StatusNotFound
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+func decodeRequest(raw []byte) (*request, error) {
+	for _, c := range raw {
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		if c == '{' {
+			var env client.Envelope
+			if err := json.Unmarshal(raw, &env); err != nil {
+				return nil, err
+			}
+			if env.Type == "" {
+				return nil, fmt.Errorf("missing type")
+			}
+			req := &request{Type: env.Type, Id: env.Id, Payload: env.Payload}
+			if req.Payload == nil {
+				req.Payload = make(map[string]interface{})
+			}
+			return req, nil
+		}
+		break
+	}
+	var msg []interface{}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("empty msg")
+	}
+	action, _ := msg[0].(string)
+	req := &request{Type: action, Payload: make(map[string]interface{}), Legacy: msg}
+	for i, key := range legacyArgs[action] {
+		if i+1 < len(msg) {
+			req.Payload[key] = msg[i+1]
+		}
+	}
+	return req, nil
+}
+
+// encodeLegacy turns a reply into [action, fields...], on error the first
+// missing field is null and followed by the error message
+func encodeLegacy(typ string, payload map[string]interface{}, e *client.Error) []interface{} {
+	def, known := legacyReplies[typ]
+	if !known {
+		def.Action = typ
+	}
+	out := []interface{}{def.Action}
+	for _, key := range def.Fields {
+		v, ok := payload[key]
+		if !ok {
+			break
+		}
+		out = append(out, v)
+	}
+	if !known && len(payload) > 0 {
+		out = append(out, payload)
+	}
+	if e != nil {
+		if len(out)-1 < len(def.Fields) {
+			out = append(out, nil)
+		}
+		out = append(out, e.Message)
+	}
+	return out
+}
+
+func marshal(msg interface{}) []byte {
+	out, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("failed to Marshal:", err)
+		return nil
+	}
+	return out
+}
+
+func (self *Client) write(msg interface{}) {
+	if out := marshal(msg); out != nil {
+		self.enqueue(out)
+	}
+}
+
+// reply answers req in the protocol it was sent with
+func (self *Client) reply(req *request, payload map[string]interface{}, e *client.Error) {
+	if req.Legacy != nil {
+		self.write(encodeLegacy(req.Type, payload, e))
+		return
+	}
+	self.write(client.Envelope{V: client.ProtocolVersion, Type: req.Type, Id: req.Id, Payload: payload, Error: e})
+}
+
+// frame is an unsolicited msg in the negotiated protocol
+func (self *Client) frame(typ string, payload map[string]interface{}) []byte {
+	if self.Proto == 0 {
+		return marshal(encodeLegacy(typ, payload, nil))
+	}
+	return marshal(client.Envelope{V: client.ProtocolVersion, Type: typ, Payload: payload})
+}
+
+// push sends a risk frame, see hub.go
+func (self *Client) push(typ string, payload map[string]interface{}) {
+	if out := self.frame(typ, payload); out != nil {
+		self.setRisk(out)
+	}
+}
+
+// notify sends an unsolicited msg queued with the replies
+func (self *Client) notify(typ string, payload map[string]interface{}) {
+	if out := self.frame(typ, payload); out != nil {
+		self.enqueue(out)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/bhojpur/risk/pkg/client"
+)
+
+func TestDecodeLegacy(t *testing.T) {
+	for _, c := range []struct {
+		msg     string
+		payload string
+	}{
+		{`["login","alice","pw"]`, `{"password":"pw","username":"alice"}`},
+		{`["riskFile","a.ini"]`, `{"fn":"a.ini"}`},
+		{`["saveRiskFile","a.ini","x = 1","why"]`, `{"comment":"why","content":"x = 1","fn":"a.ini"}`},
+		{`["deleteRiskFile","a.ini"]`, `{"fn":"a.ini"}`},
+		{`["historicalRisk","p","r","x",1,2,"5m","ohlc"]`, `{"agg":"ohlc","from":1,"param":"x","portfolio":"p","resolution":"5m","risk":"r","to":2}`},
+		{`["subscribe",["p"],["r"],2]`, `{"interval":2,"portfolios":["p"],"risks":["r"]}`},
+		{`["resume","tok"]`, `{"session":"tok"}`},
+		{`["ackBreach","p","r","x","g","s","ok"]`, `{"comment":"ok","group":"g","param":"x","portfolio":"p","risk":"r","symbol":"s"}`},
+		{`["tradeStopOverride","p","r","x","g",60,"why"]`, `{"duration":60,"group":"g","param":"x","portfolio":"p","reason":"why","risk":"r"}`},
+		{`["riskFileVersions","a.ini"]`, `{"fn":"a.ini"}`},
+		{`["riskFileDiff","a.ini",1,2]`, `{"fn":"a.ini","from":1,"to":2}`},
+		{`["rollbackRiskFile","a.ini",1,"undo"]`, `{"comment":"undo","fn":"a.ini","version":1}`},
+		{`["saveDraft","a.ini","x = 1","wip"]`, `{"comment":"wip","content":"x = 1","fn":"a.ini"}`},
+		{`["submitDraft","a.ini"]`, `{"fn":"a.ini"}`},
+		{`["riskFileDraft","a.ini","bob"]`, `{"fn":"a.ini","owner":"bob"}`},
+		{`["approveDraft","a.ini","ok","bob"]`, `{"comment":"ok","fn":"a.ini","owner":"bob"}`},
+		{`["rejectDraft","a.ini","no","bob"]`, `{"comment":"no","fn":"a.ini","owner":"bob"}`},
+		{`["discardDraft","a.ini"]`, `{"fn":"a.ini"}`},
+		{`["validateRiskFile","a.ini","x = 1"]`, `{"content":"x = 1","fn":"a.ini"}`},
+		{`["editRiskFile","a.ini",[{"op":"addRisk","risk":"r"}],"add"]`, `{"comment":"add","fn":"a.ini","ops":[{"op":"addRisk","risk":"r"}]}`},
+		// missing args are left out, extra ones ignored
+		{`["login","alice"]`, `{"username":"alice"}`},
+		{`["riskFile","a.ini","more"]`, `{"fn":"a.ini"}`},
+		{`["unsubscribe"]`, `{}`},
+		{`["unknown",1]`, `{}`},
+	} {
+		req, err := decodeRequest([]byte(c.msg))
+		if err != nil {
+			t.Errorf("%s: %v", c.msg, err)
+			continue
+		}
+		var msg []interface{}
+		json.Unmarshal([]byte(c.msg), &msg)
+		if req.Type != msg[0] || req.Id != "" || !reflect.DeepEqual(req.Legacy, msg) {
+			t.Errorf("%s: type %q id %q legacy %v", c.msg, req.Type, req.Id, req.Legacy)
+		}
+		if got := string(marshal(req.Payload)); got != c.payload {
+			t.Errorf("%s: payload %s, want %s", c.msg, got, c.payload)
+		}
+	}
+	if len(legacyArgs) != 20 {
+		t.Errorf("%d legacy requests, add the new ones above", len(legacyArgs))
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	req, err := decodeRequest([]byte(` {"v":1,"type":"riskFile","id":"7","payload":{"fn":"a.ini"}}`))
+	if err != nil || req.Type != "riskFile" || req.Id != "7" || req.str("fn") != "a.ini" || req.Legacy != nil {
+		t.Errorf("envelope = %+v, %v", req, err)
+	}
+	req, err = decodeRequest([]byte(`{"type":"unsubscribe"}`))
+	if err != nil || req.Payload == nil {
+		t.Errorf("envelope without payload = %+v, %v", req, err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, msg := range []string{``, ` `, `[`, `{`, `[]`, `null`, `123`, `"login"`, `{}`, `{"type":1}`, `{"payload":{}}`, `[1,2]x`, `{"type":"a"}}`} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%q panics: %v", msg, r)
+				}
+			}()
+			if req, err := decodeRequest([]byte(msg)); err == nil {
+				t.Errorf("%q decoded as %+v", msg, req)
+			}
+		}()
+	}
+	// a non-string action is an unknown request, not an error
+	for _, msg := range []string{`[1]`, `[null,"x"]`, `[{}]`} {
+		if req, err := decodeRequest([]byte(msg)); err != nil || req.Type != "" {
+			t.Errorf("%s = %+v, %v", msg, req, err)
+		}
+	}
+}
+
+func TestEncodeLegacy(t *testing.T) {
+	notFound := errorf(404, "not_found", "no such file")
+	for _, c := range []struct {
+		typ     string
+		payload map[string]interface{}
+		e       *client.Error
+		want    string
+	}{
+		{"login", map[string]interface{}{"files": []string{"a.ini"}, "session": "tok"}, nil, `["riskFiles",["a.ini"]]`},
+		{"login", nil, errorf(401, "unauthorized", "bad password"), `["riskFiles",null,"bad password"]`},
+		{"resume", map[string]interface{}{"files": []string{}}, nil, `["riskFiles",[]]`},
+		{"risk", map[string]interface{}{"report": map[string]interface{}{"p": 1}}, nil, `["risk",{"p":1}]`},
+		{"riskFile", map[string]interface{}{"fn": "a.ini", "content": "x = 1"}, nil, `["riskFile","a.ini","x = 1"]`},
+		{"riskFile", map[string]interface{}{"fn": "a.ini"}, notFound, `["riskFile","a.ini",null,"no such file"]`},
+		{"saveRiskFile", map[string]interface{}{"fn": "a.ini", "diagnostics": []int{}}, nil, `["saveRiskFile","a.ini"]`},
+		{"saveRiskFile", map[string]interface{}{"fn": "a.ini"}, errorf(400, "invalid_file", "line 1: bad"), `["saveRiskFile","a.ini","line 1: bad"]`},
+		{"deleteRiskFile", map[string]interface{}{"fn": "a.ini"}, nil, `["deleteRiskFile","a.ini"]`},
+		{"historicalRisk", map[string]interface{}{"portfolio": "p", "risk": "r", "param": "x", "series": map[string]interface{}{}, "resolution": 60, "agg": "last"}, nil, `["historicalRisk","p","r","x",{},60,"last"]`},
+		{"historicalRisk", map[string]interface{}{"portfolio": "p", "risk": "r", "param": "x"}, notFound, `["historicalRisk","p","r","x",null,"no such file"]`},
+		{"subscribe", map[string]interface{}{"portfolios": []string{"p"}, "risks": []string{}, "interval": 1}, nil, `["subscribe",["p"],[],1]`},
+		{"unsubscribe", map[string]interface{}{}, nil, `["unsubscribe"]`},
+		{"riskSnapshot", map[string]interface{}{"set": map[string]interface{}{"p/r": 1}}, nil, `["riskSnapshot",{"p/r":1}]`},
+		{"riskDelta", map[string]interface{}{"set": map[string]interface{}{}, "del": []string{"p/r"}}, nil, `["riskDelta",{},["p/r"]]`},
+		{"riskFileVersions", map[string]interface{}{"fn": "a.ini", "versions": []int{1}}, nil, `["riskFileVersions","a.ini",[1]]`},
+		{"riskFileDiff", map[string]interface{}{"fn": "a.ini", "from": 1, "to": 2, "diff": "-a\n+b\n"}, nil, `["riskFileDiff","a.ini",1,2,"-a\n+b\n"]`},
+		{"rollbackRiskFile", map[string]interface{}{"fn": "a.ini", "version": 1}, nil, `["rollbackRiskFile","a.ini",1]`},
+		{"drafts", map[string]interface{}{"drafts": []int{}}, nil, `["drafts",[]]`},
+		{"saveDraft", map[string]interface{}{"fn": "a.ini", "state": "draft"}, nil, `["saveDraft","a.ini","draft"]`},
+		{"submitDraft", map[string]interface{}{"fn": "a.ini", "state": "pending"}, nil, `["submitDraft","a.ini","pending"]`},
+		{"riskFileDraft", map[string]interface{}{"fn": "a.ini", "draft": nil, "diff": "", "limits": []int{}}, nil, `["riskFileDraft","a.ini",null,"",[]]`},
+		{"approveDraft", map[string]interface{}{"fn": "a.ini", "state": "approved"}, nil, `["approveDraft","a.ini","approved"]`},
+		{"rejectDraft", map[string]interface{}{"fn": "a.ini", "state": "rejected"}, nil, `["rejectDraft","a.ini","rejected"]`},
+		{"discardDraft", map[string]interface{}{"fn": "a.ini", "state": "discarded"}, nil, `["discardDraft","a.ini","discarded"]`},
+		{"validateRiskFile", map[string]interface{}{"fn": "a.ini", "diagnostics": []int{}}, nil, `["validateRiskFile","a.ini",[]]`},
+		{"editRiskFile", map[string]interface{}{"fn": "a.ini", "content": "x = 1\n"}, nil, `["editRiskFile","a.ini","x = 1\n"]`},
+		// other replies keep their action and payload
+		{"error", map[string]interface{}{"msg": "x"}, nil, `["error",{"msg":"x"}]`},
+		{"ackBreach", nil, errorf(404, "not_found", "no such breach"), `["ackBreach","no such breach"]`},
+	} {
+		if got := string(marshal(encodeLegacy(c.typ, c.payload, c.e))); got != c.want {
+			t.Errorf("%s: %s, want %s", c.typ, got, c.want)
+		}
+	}
+	if len(legacyReplies) != 23 {
+		t.Errorf("%d legacy replies, add the new ones above", len(legacyReplies))
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	engine "github.com/bhojpur/risk/pkg/engine"
+)
+
+// Roles of the -roles ini file, reloaded when it changes:
+//
+//   default = viewer
+//   [users]
+//   alice = risk-admin
+//   [user_ids]
+//   12 = risk-author
+//
+// users are login names, user_ids trade server user ids, names win. Without
+// -roles everybody is a risk-admin as before roles existed.
+
+type Role int
+
+const (
+	RoleViewer   Role = iota // read only
+	RoleAuthor               // also saves portfolio files and acknowledges breaches
+	RoleApprover             // also approves drafts of others
+	RoleAdmin                // also saves .py files and overrides trade stops
+)
+
+var roleNames = []string{"viewer", "risk-author", "risk-approver", "risk-admin"}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(str string) (Role, error) {
+	for i, name := range roleNames {
+		if name == str {
+			return Role(i), nil
+		}
+	}
+	return RoleViewer, fmt.Errorf("unknown role: %s", str)
+}
+
+type roleFile struct {
+	fn    string
+	lock  sync.Mutex
+	mtime time.Time
+	def   Role
+	names map[string]Role
+	ids   map[int]Role
+}
+
+var roles *roleFile
+
+func (self *roleFile) load() error {
+	info, err := os.Stat(self.fn)
+	if err != nil {
+		return err
+	}
+	if self.names != nil && info.ModTime().Equal(self.mtime) {
+		return nil
+	}
+	cfg, err := engine.ParseIniFile(self.fn)
+	if err != nil {
+		return err
+	}
+	def := RoleViewer
+	if v, ok := cfg.ValueMap["default"]; ok {
+		if def, err = parseRole(v[0]); err != nil {
+			return fmt.Errorf("%s line %s: %s", self.fn, v[1], err)
+		}
+	}
+	names := make(map[string]Role)
+	ids := make(map[int]Role)
+	for _, sname := range []string{"users", "user_ids"} {
+		s := cfg.SectionMap[sname]
+		if s == nil {
+			continue
+		}
+		for _, v := range s.Values {
+			role, err := parseRole(v[1])
+			if err != nil {
+				return fmt.Errorf("%s line %s: %s", self.fn, v[2], err)
+			}
+			if sname == "users" {
+				names[v[0]] = role
+				continue
+			}
+			id, err := strconv.Atoi(v[0])
+			if err != nil {
+				return fmt.Errorf("%s line %s: invalid user id %s", self.fn, v[2], v[0])
+			}
+			ids[id] = role
+		}
+	}
+	self.def, self.names, self.ids, self.mtime = def, names, ids, info.ModTime()
+	return nil
+}
+
+func (self *roleFile) role(username string, userId int) Role {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.load(); err != nil {
+		// keep the roles loaded last
+		log.Println("roles:", err)
+	}
+	if r, ok := self.names[username]; ok {
+		return r
+	}
+	if r, ok := self.ids[userId]; ok {
+		return r
+	}
+	return self.def
+}
+
+// fileRole is the role saving or deleting fn needs, python runs in process
+func fileRole(fn string) Role {
+	if engine.IsPortfolioFile(fn) || engine.IsListFile(fn) {
+		return RoleAuthor
+	}
+	return RoleAdmin
+}
+
+func sessionRole(s *session) Role {
+	if roles == nil {
+		return RoleAdmin
+	}
+	return roles.role(s.Username, s.UserId)
+}
+
+// breachTarget is portfolio/risk/param[/group[/symbol]] of a breach request
+func breachTarget(req *request) string {
+	out := []string{req.str("portfolio"), req.str("risk"), req.str("param")}
+	for _, key := range []string{"group", "symbol"} {
+		if v := req.str(key); v != "" {
+			out = append(out, v)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// draftTarget is the audited target of a draft, owner/fn
+func draftTarget(owner int, fn string) string {
+	return strconv.Itoa(owner) + "/" + fn
+}
+
+// audit logs action of the session on target
+func (self *Client) audit(action string, target string, allowed bool, detail string) {
+	engine.Audit(&engine.AuditEntry{
+		User:    self.session.Username,
+		UserId:  self.session.UserId,
+		Role:    sessionRole(self.session).String(),
+		Action:  action,
+		Target:  target,
+		Allowed: allowed,
+		Detail:  detail,
+	})
+}
+
+// authorize audits req on target and replies a denial with payload if the
+// session role is below need
+func (self *Client) authorize(req *request, need Role, target string, payload map[string]interface{}) bool {
+	role := sessionRole(self.session)
+	allowed := role >= need
+	self.audit(req.Type, target, allowed, "")
+	if !allowed {
+		self.reply(req, payload, errorf(http.StatusForbidden, "forbidden", "%s needs the %s role, you are %s", req.Type, need, role))
+	}
+	return allowed
+}
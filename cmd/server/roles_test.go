@@ -0,0 +1,147 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	engine "github.com/bhojpur/risk/pkg/engine"
+)
+
+func TestRoleFile(t *testing.T) {
+	withRoles(t, "default = risk-author\n[users]\nalice = risk-admin\n[user_ids]\n2 = viewer\n1 = risk-approver\n")
+	for _, c := range []struct {
+		name   string
+		userId int
+		role   Role
+	}{
+		{"alice", 1, RoleAdmin},
+		{"bob", 1, RoleApprover},
+		{"bob", 2, RoleViewer},
+		{"carol", 3, RoleAuthor},
+	} {
+		if r := roles.role(c.name, c.userId); r != c.role {
+			t.Errorf("%s (%d) is %s, want %s", c.name, c.userId, r, c.role)
+		}
+	}
+	// a bad file keeps the roles loaded last
+	if err := ioutil.WriteFile(roles.fn, []byte("default = root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(roles.fn, time.Now(), time.Now().Add(time.Minute))
+	if r := roles.role("alice", 1); r != RoleAdmin {
+		t.Errorf("alice is %s after a bad reload", r)
+	}
+	if err := ioutil.WriteFile(roles.fn, []byte("[users]\nalice = risk-author\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(roles.fn, time.Now(), time.Now().Add(2*time.Minute))
+	if r, r2 := roles.role("alice", 1), roles.role("carol", 3); r != RoleAuthor || r2 != RoleViewer {
+		t.Errorf("after reload alice is %s, carol %s", r, r2)
+	}
+	roles = nil
+	if r := sessionRole(&session{Username: "carol", UserId: 3}); r != RoleAdmin {
+		t.Errorf("without roles carol is %s", r)
+	}
+}
+
+func TestFileRole(t *testing.T) {
+	for fn, role := range map[string]Role{"a.ini": RoleAuthor, "a.yaml": RoleAuthor, "watch.csv": RoleAuthor, "m.py": RoleAdmin} {
+		if r := fileRole(fn); r != role {
+			t.Errorf("%s needs %s, want %s", fn, r, role)
+		}
+	}
+}
+
+// withAudit logs the audit entries to a temp file and returns them
+func withAudit(t *testing.T) func() []*engine.AuditEntry {
+	fn := filepath.Join(t.TempDir(), "audit.log")
+	if err := engine.OpenAudit(fn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.CloseAudit)
+	return func() []*engine.AuditEntry {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var out []*engine.AuditEntry
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := &engine.AuditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, e)
+		}
+		return out
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	withTestEngine(t)
+	withRoles(t, "default = viewer\n[users]\nalice = risk-author\nroot = risk-admin\n")
+	entries := withAudit(t)
+	viewer, author, admin := testClient(1, "bob"), testClient(2, "alice"), testClient(3, "root")
+	breach := map[string]interface{}{"portfolio": "p", "risk": "r", "param": "x", "group": "g"}
+	for _, c := range []struct {
+		c       *Client
+		typ     string
+		payload map[string]interface{}
+		denied  bool
+	}{
+		{viewer, "saveRiskFile", map[string]interface{}{"fn": "a.ini", "content": "name = a\n"}, true},
+		{author, "saveRiskFile", map[string]interface{}{"fn": "a.ini", "content": "name = a\n"}, false},
+		{author, "saveRiskFile", map[string]interface{}{"fn": "m.py", "content": "x = 1\n"}, true},
+		{viewer, "deleteRiskFile", map[string]interface{}{"fn": "a.ini"}, true},
+		{viewer, "ackBreach", breach, true},
+		{author, "ackBreach", breach, false},
+		{author, "tradeStopOverride", breach, true},
+		{admin, "tradeStopOverride", breach, false},
+	} {
+		r := call(t, c.c, c.typ, c.payload)
+		if denied := errorStatus(r) == 403; denied != c.denied {
+			t.Errorf("%s by %s: %+v", c.typ, c.c.session.Username, r)
+		}
+	}
+	var denied []string
+	for _, e := range entries() {
+		if !e.Allowed {
+			denied = append(denied, e.User+" "+e.Action+" "+e.Target)
+		}
+	}
+	want := []string{"bob saveRiskFile a.ini", "alice saveRiskFile m.py", "bob deleteRiskFile a.ini", "bob ackBreach p/r/x/g", "alice tradeStopOverride p/r/x/g"}
+	if len(denied) != len(want) {
+		t.Fatalf("denied %q, want %q", denied, want)
+	}
+	for i := range want {
+		if denied[i] != want[i] {
+			t.Errorf("denied %q, want %q", denied[i], want[i])
+		}
+	}
+}
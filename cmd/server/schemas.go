@@ -0,0 +1,203 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// JSON schemas of the REST API bodies, served under /api/schemas/:name
+
+type schema = map[string]interface{}
+
+func jsonObject(required []string, properties schema) schema {
+	return schema{"type": "object", "required": required, "properties": properties}
+}
+
+func jsonArray(items schema) schema {
+	return schema{"type": "array", "items": items}
+}
+
+var jsonString = schema{"type": "string"}
+var jsonInteger = schema{"type": "integer"}
+var jsonNumber = schema{"type": "number"}
+var jsonBool = schema{"type": "boolean"}
+
+// bounds are numbers, or the string "NaN" when not set
+var jsonBound = schema{"oneOf": []schema{jsonNumber, {"type": "string", "enum": []string{"NaN"}}}}
+
+var schemas = map[string]schema{
+	"Error": jsonObject([]string{"error"}, schema{
+		"error": jsonObject([]string{"status", "code", "message"}, schema{
+			"status":  jsonInteger,
+			"code":    jsonString,
+			"message": jsonString,
+		}),
+	}),
+	"Page": jsonObject([]string{"items", "offset", "limit", "total"}, schema{
+		"items":  schema{"type": "array"},
+		"offset": jsonInteger,
+		"limit":  jsonInteger,
+		"total":  jsonInteger,
+	}),
+	"Portfolio": jsonObject([]string{"name", "file", "acc", "risks"}, schema{
+		"name": jsonString,
+		"file": schema{"type": "string", "description": "the portfolio file it is loaded from"},
+		"acc":  schema{"type": "string", "description": "account name patterns, ~ to exclude"},
+		"risks": jsonArray(jsonObject([]string{"name", "displayName", "groups", "params"}, schema{
+			"name":        jsonString,
+			"displayName": jsonString,
+			"groups":      jsonArray(jsonString),
+			"params": jsonArray(jsonObject([]string{"name"}, schema{
+				"name":       jsonString,
+				"aggregate":  schema{"type": "string", "description": "an aggregate like sum, len, mean, std, min, max, median, pct, wmean, count_if or hhi, total, ref, group for aggregates inside an expression, top, call or empty"},
+				"upperBound": jsonArray(jsonBound),
+				"lowerBound": jsonArray(jsonBound),
+				"tradeStop":  jsonBool,
+				"graph":      jsonBool,
+			})),
+		})),
+	}),
+	"Position": jsonObject([]string{"acc", "accId", "securityId", "symbol", "qty"}, schema{
+		"acc":             jsonString,
+		"accId":           jsonInteger,
+		"securityId":      jsonInteger,
+		"symbol":          jsonString,
+		"market":          jsonString,
+		"type":            jsonString,
+		"currency":        jsonString,
+		"qty":             jsonNumber,
+		"avgPx":           jsonNumber,
+		"commission":      jsonNumber,
+		"realizedPnl":     jsonNumber,
+		"buyQty":          jsonNumber,
+		"buyValue":        jsonNumber,
+		"sellQty":         jsonNumber,
+		"sellValue":       jsonNumber,
+		"outstandBuyQty":  jsonNumber,
+		"outstandSellQty": jsonNumber,
+		"target":          jsonNumber,
+		"close":           jsonNumber,
+	}),
+	"Breach": jsonObject([]string{"portfolio", "risk", "param", "group", "value", "tradeStop", "time"}, schema{
+		"portfolio":  jsonString,
+		"risk":       jsonString,
+		"param":      jsonString,
+		"group":      jsonString,
+		"symbol":     schema{"type": "string", "description": "set for non-aggregate params"},
+		"value":      jsonNumber,
+		"lowerBound": jsonNumber,
+		"upperBound": jsonNumber,
+		"tradeStop":  jsonBool,
+		"overridden": schema{"type": "boolean", "description": "trade stop overridden, accounts are not disabled"},
+		"ack": jsonObject([]string{"by", "time"}, schema{
+			"by":      jsonString,
+			"comment": jsonString,
+			"time":    jsonInteger,
+		}),
+		"time": schema{"type": "integer", "description": "unix seconds"},
+	}),
+	"Override": jsonObject([]string{"portfolio", "risk", "param", "by", "until"}, schema{
+		"portfolio": jsonString,
+		"risk":      schema{"type": "string", "description": "display name"},
+		"param":     jsonString,
+		"group":     schema{"type": "string", "description": "empty for all groups"},
+		"by":        jsonString,
+		"reason":    jsonString,
+		"until":     schema{"type": "integer", "description": "unix seconds"},
+	}),
+	"FileVersion": jsonObject([]string{"version", "author", "time", "size"}, schema{
+		"version": jsonInteger,
+		"author":  jsonString,
+		"comment": jsonString,
+		"time":    schema{"type": "integer", "description": "unix seconds"},
+		"size":    jsonInteger,
+		"deleted": schema{"type": "boolean", "description": "the file was deleted, size is 0"},
+	}),
+	"Draft": jsonObject([]string{"fn", "author", "state", "time"}, schema{
+		"fn":         jsonString,
+		"content":    jsonString,
+		"author":     jsonString,
+		"comment":    jsonString,
+		"state":      schema{"type": "string", "enum": []string{"draft", "pending"}},
+		"time":       schema{"type": "integer", "description": "unix seconds of the save"},
+		"submitted":  schema{"type": "integer", "description": "unix seconds of submitDraft"},
+		"rejectedBy": jsonString,
+		"rejection":  jsonString,
+	}),
+	"LimitChange": jsonObject([]string{"portfolio", "key", "old", "new"}, schema{
+		"portfolio": jsonString,
+		"risk":      schema{"type": "string", "description": "display name, empty for portfolio settings"},
+		"param":     schema{"type": "string", "description": "empty for portfolio and risk settings"},
+		"key":       schema{"type": "string", "description": "acc, filter, group, formula, upper_bound, lower_bound, trade_stop or window"},
+		"old":       schema{"type": "string", "description": "empty if not set, bounds are - for groups without"},
+		"new":       jsonString,
+	}),
+	"Diagnostic": jsonObject([]string{"line", "col", "severity", "message"}, schema{
+		"line":     schema{"type": "integer", "description": "from 1, in file if set"},
+		"col":      schema{"type": "integer", "description": "from 1"},
+		"severity": schema{"type": "string", "enum": []string{"error", "warning"}},
+		"message":  jsonString,
+		"fix":      schema{"type": "string", "description": "suggested replacement of the text at col"},
+		"file":     schema{"type": "string", "description": "the included shared file of the problem"},
+	}),
+	"EditOp": jsonObject([]string{"op"}, schema{
+		"op":      schema{"type": "string", "enum": []string{"addRisk", "removeRisk", "addParam", "removeParam", "setFormula", "setBounds", "setValue"}},
+		"risk":    schema{"type": "string", "description": "section name of the risk, empty for portfolio values of setValue"},
+		"param":   schema{"type": "string", "description": "empty for the risk section itself"},
+		"key":     schema{"type": "string", "description": "of setValue"},
+		"value":   schema{"type": "string", "description": "of setValue, empty removes the key"},
+		"formula": schema{"type": "string", "description": "of setFormula, addParam and, optional, addRisk"},
+		"upper":   schema{"type": "array", "items": schema{"type": "number", "nullable": true}, "description": "bounds per group of setBounds, null for a group without one, [] removes them, missing keeps them"},
+		"lower":   schema{"type": "array", "items": schema{"type": "number", "nullable": true}, "description": "as upper"},
+	}),
+	"Report": schema{
+		"type":        "object",
+		"description": "risk name to [[group, value, breach?], ...], or param name to such list when a risk has several params",
+	},
+	"Envelope": jsonObject([]string{"v", "type"}, schema{
+		"v":       jsonInteger,
+		"type":    jsonString,
+		"id":      schema{"type": "string", "description": "set by the client on requests, echoed in the reply"},
+		"payload": schema{"type": "object"},
+		"error":   jsonObject([]string{"status", "code", "message"}, schema{"status": jsonInteger, "code": jsonString, "message": jsonString}),
+	}),
+	"HubClient": jsonObject([]string{"id", "userId", "proto", "queued", "queueSize", "sent", "dropped", "coalesced", "lagMs", "maxLagMs"}, schema{
+		"id":        jsonInteger,
+		"userId":    schema{"type": "integer", "description": "0 before login"},
+		"proto":     schema{"type": "integer", "description": "0 for legacy arrays"},
+		"connected": schema{"type": "integer", "description": "unix seconds"},
+		"queued":    jsonInteger,
+		"queueSize": jsonInteger,
+		"sent":      jsonInteger,
+		"dropped":   schema{"type": "integer", "description": "msgs discarded on a full queue with -slow-client=drop"},
+		"coalesced": schema{"type": "integer", "description": "risk frames replaced or skipped before written"},
+		"lagMs":     schema{"type": "number", "description": "queuing to writing of the last msg"},
+		"maxLagMs":  jsonNumber,
+	}),
+	"History": jsonObject([]string{"portfolio", "risk", "param", "resolution", "agg", "series"}, schema{
+		"portfolio":  jsonString,
+		"risk":       jsonString,
+		"param":      jsonString,
+		"resolution": schema{"type": "number", "description": "bucket seconds, -1 for raw points"},
+		"agg":        schema{"type": "string", "enum": []string{"last", "ohlc"}},
+		"series": schema{
+			"type":        "object",
+			"description": "group to [[t, v], ...] ([[t, o, h, l, c], ...] for ohlc), or group to symbol to points for non-aggregate params",
+		},
+	}),
+}
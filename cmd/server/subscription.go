@@ -0,0 +1,177 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Subscribed clients get a riskSnapshot of the portfolios and risks they
+// asked for, then riskDelta msgs with only the rows that changed, at most
+// once per interval, instead of the full risk report every second. A row is
+// addressed by its path [portfolio, risk, group], or [portfolio, risk, param,
+// group] for risks with several params, and its value is [value, breach?] as
+// in the full report.
+
+const minSubscribeInterval = time.Second
+
+type subscription struct {
+	Portfolios map[string]bool // empty for all
+	Risks      map[string]bool // display names, empty for all
+	Interval   time.Duration
+	sent       map[string]string // path key to the json value last sent
+	sentAt     time.Time
+}
+
+type deltaRow struct {
+	Path  []string    `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func newSubscription(req *request) *subscription {
+	s := &subscription{
+		Portfolios: make(map[string]bool),
+		Risks:      make(map[string]bool),
+		Interval:   time.Duration(req.float("interval")) * time.Millisecond,
+	}
+	if s.Interval < minSubscribeInterval {
+		s.Interval = minSubscribeInterval
+	}
+	for _, key := range []string{"portfolios", "risks"} {
+		names, _ := req.Payload[key].([]interface{})
+		for _, name := range names {
+			if str, ok := name.(string); ok {
+				if key == "portfolios" {
+					s.Portfolios[str] = true
+				} else {
+					s.Risks[str] = true
+				}
+			}
+		}
+	}
+	return s
+}
+
+func (s *subscription) keys(m map[string]bool) []string {
+	out := []string{}
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s *subscription) payload() map[string]interface{} {
+	return map[string]interface{}{
+		"portfolios": s.keys(s.Portfolios),
+		"risks":      s.keys(s.Risks),
+		"interval":   s.Interval.Milliseconds(),
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// flatten appends the subscribed rows of a user report
+func (s *subscription) flatten(rpt map[string]interface{}) []deltaRow {
+	var out []deltaRow
+	addRows := func(prefix []string, rows interface{}) {
+		tmp, _ := rows.([]interface{})
+		for _, row := range tmp {
+			row2, ok := row.([]interface{})
+			if !ok || len(row2) < 2 {
+				continue
+			}
+			group, _ := row2[0].(string)
+			path := append(append([]string{}, prefix...), group)
+			out = append(out, deltaRow{path, row2[1:]})
+		}
+	}
+	for _, p := range sortedKeys(rpt) {
+		if len(s.Portfolios) > 0 && !s.Portfolios[p] {
+			continue
+		}
+		risks, _ := rpt[p].(map[string]interface{})
+		for _, r := range sortedKeys(risks) {
+			if len(s.Risks) > 0 && !s.Risks[r] {
+				continue
+			}
+			if params, ok := risks[r].(map[string]interface{}); ok {
+				for _, param := range sortedKeys(params) {
+					addRows([]string{p, r, param}, params[param])
+				}
+			} else {
+				addRows([]string{p, r}, risks[r])
+			}
+		}
+	}
+	return out
+}
+
+// update returns the msg to push for a new user report, if any
+func (s *subscription) update(rpt map[string]interface{}, now time.Time) (string, map[string]interface{}) {
+	if s.sent != nil && now.Sub(s.sentAt) < s.Interval {
+		return "", nil
+	}
+	rows := s.flatten(rpt)
+	sent := make(map[string]string, len(rows))
+	var set []deltaRow
+	for _, row := range rows {
+		key := strings.Join(row.Path, "\x00")
+		tmp, err := json.Marshal(row.Value)
+		if err != nil {
+			continue
+		}
+		sent[key] = string(tmp)
+		if old, ok := s.sent[key]; !ok || old != string(tmp) {
+			set = append(set, row)
+		}
+	}
+	first := s.sent == nil
+	var del [][]string
+	for key := range s.sent {
+		if _, ok := sent[key]; !ok {
+			del = append(del, strings.Split(key, "\x00"))
+		}
+	}
+	s.sent = sent
+	s.sentAt = now
+	if first {
+		if set == nil {
+			set = []deltaRow{}
+		}
+		return "riskSnapshot", map[string]interface{}{"set": set}
+	}
+	if len(set) == 0 && len(del) == 0 {
+		return "", nil
+	}
+	sort.Slice(del, func(i, j int) bool { return strings.Join(del[i], "\x00") < strings.Join(del[j], "\x00") })
+	return "riskDelta", map[string]interface{}{"set": set, "del": del}
+}
@@ -0,0 +1,113 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testReport(t *testing.T, str string) map[string]interface{} {
+	var rpt map[string]interface{}
+	if err := json.Unmarshal([]byte(str), &rpt); err != nil {
+		t.Fatal(err)
+	}
+	return rpt
+}
+
+func TestSubscriptionUpdate(t *testing.T) {
+	// a report at t0 + at and the msg it gives
+	type step struct {
+		rpt  string
+		at   time.Duration
+		typ  string
+		want string
+	}
+	t0 := time.Unix(1000, 0)
+	for _, c := range []struct {
+		name  string
+		sub   map[string]interface{}
+		steps []step
+	}{
+		{"all", nil, []step{
+			{`{"p":{"r":[["a",1,false],["b",2,true]],"m":{"x":[["",3,false]]}}}`, 0, "riskSnapshot",
+				`{"set":[{"path":["p","m","x",""],"value":[3,false]},{"path":["p","r","a"],"value":[1,false]},{"path":["p","r","b"],"value":[2,true]}]}`},
+			// unchanged
+			{`{"p":{"r":[["a",1,false],["b",2,true]],"m":{"x":[["",3,false]]}}}`, time.Second, "", ""},
+			// changed field
+			{`{"p":{"r":[["a",1,true],["b",2,true]],"m":{"x":[["",3,false]]}}}`, 2 * time.Second, "riskDelta",
+				`{"del":null,"set":[{"path":["p","r","a"],"value":[1,true]}]}`},
+			// removed keys
+			{`{"p":{"r":[["b",2,true]]}}`, 3 * time.Second, "riskDelta",
+				`{"del":[["p","m","x",""],["p","r","a"]],"set":null}`},
+			// added back
+			{`{"p":{"r":[["a",5,false],["b",2,true]]}}`, 4 * time.Second, "riskDelta",
+				`{"del":null,"set":[{"path":["p","r","a"],"value":[5,false]}]}`},
+		}},
+		{"filtered", map[string]interface{}{"portfolios": []interface{}{"p"}, "risks": []interface{}{"r"}, "interval": 2000.0}, []step{
+			{`{}`, 0, "riskSnapshot", `{"set":[]}`},
+			{`{"p":{"r":[["a",1,false]],"s":[["a",9,false]]},"q":{"r":[["a",9,false]]}}`, time.Second, "", ""},
+			{`{"p":{"r":[["a",1,false]],"s":[["a",9,false]]},"q":{"r":[["a",9,false]]}}`, 2 * time.Second, "riskDelta",
+				`{"del":null,"set":[{"path":["p","r","a"],"value":[1,false]}]}`},
+			{`{"p":{"r":[["a",1,false]],"s":[["a",8,false]]},"q":{"r":[["a",8,false]]}}`, 4 * time.Second, "", ""},
+		}},
+	} {
+		if c.sub == nil {
+			c.sub = map[string]interface{}{}
+		}
+		s := newSubscription(&request{Payload: c.sub})
+		for i, st := range c.steps {
+			typ, payload := s.update(testReport(t, st.rpt), t0.Add(st.at))
+			got := ""
+			if payload != nil {
+				got = string(marshal(payload))
+			}
+			if typ != st.typ || got != st.want {
+				t.Errorf("%s step %d: %s %s, want %s %s", c.name, i, typ, got, st.typ, st.want)
+			}
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	withTestEngine(t)
+	c := testClient(1, "alice")
+	reply := call(t, c, "subscribe", map[string]interface{}{"portfolios": []interface{}{"p"}, "interval": 10.0})
+	if errorStatus(reply) != 0 || string(marshal(reply.Payload)) != `{"interval":1000,"portfolios":["p"],"risks":[]}` {
+		t.Errorf("subscribe = %+v", reply)
+	}
+	if c.sub == nil || c.sub.Interval != time.Second {
+		t.Fatalf("subscription %+v", c.sub)
+	}
+	if typ, _ := c.sub.update(map[string]interface{}{}, time.Now()); typ != "riskSnapshot" {
+		t.Errorf("first update %s", typ)
+	}
+	reply = call(t, c, "unsubscribe", nil)
+	if errorStatus(reply) != 0 || c.sub != nil {
+		t.Errorf("unsubscribe = %+v, sub %+v", reply, c.sub)
+	}
+	// subscribing again starts with a snapshot
+	call(t, c, "subscribe", map[string]interface{}{})
+	if typ, _ := c.sub.update(map[string]interface{}{}, time.Now()); typ != "riskSnapshot" {
+		t.Errorf("update after resubscribe %s", typ)
+	}
+}
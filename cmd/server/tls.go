@@ -0,0 +1,192 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The listener serves TLS with -tls-cert and -tls-key, and requires client
+// certs signed by -tls-client-ca if set. The files are checked every
+// certCheckInterval and reloaded when changed, so certs can be renewed
+// without a restart. The trade server is dialed with -server-ca and the
+// client cert -server-cert and -server-key for wss:// urls.
+
+const certCheckInterval = 5 * time.Second
+
+const passwdEnv = "RISK_TRADE_PASSWD"
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	lock     sync.Mutex
+	checked  time.Time
+	mtimes   []time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func (self *certReloader) files() []string {
+	out := []string{self.certFile, self.keyFile}
+	if self.caFile != "" {
+		out = append(out, self.caFile)
+	}
+	return out
+}
+
+// reload reads the files again if any of them changed, on errors the old
+// certs are kept
+func (self *certReloader) reload() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	if self.cert != nil && now.Sub(self.checked) < certCheckInterval {
+		return nil
+	}
+	self.checked = now
+	var mtimes []time.Time
+	changed := self.cert == nil
+	for i, fn := range self.files() {
+		info, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		mtimes = append(mtimes, info.ModTime())
+		if i >= len(self.mtimes) || !info.ModTime().Equal(self.mtimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(self.certFile, self.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if self.caFile != "" {
+		if pool, err = loadCertPool(self.caFile); err != nil {
+			return err
+		}
+	}
+	if self.cert != nil {
+		log.Print("reloaded tls certs")
+	}
+	self.cert, self.pool, self.mtimes = &cert, pool, mtimes
+	return nil
+}
+
+func (self *certReloader) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if err := self.reload(); err != nil {
+		log.Print("reload tls certs: ", err)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*self.cert},
+	}
+	if self.pool != nil {
+		cfg.ClientCAs = self.pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+func loadCertPool(fn string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certs found in %s", fn)
+	}
+	return pool, nil
+}
+
+// listenerTLS is nil without -tls-cert
+func listenerTLS() (*tls.Config, error) {
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsClientCA != "" {
+			return nil, fmt.Errorf("-tls-client-ca needs -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, fmt.Errorf("both -tls-cert and -tls-key are required")
+	}
+	r := &certReloader{certFile: *tlsCert, keyFile: *tlsKey, caFile: *tlsClientCA}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetConfigForClient: r.config}, nil
+}
+
+func dialerTLS() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *serverCA != "" {
+		pool, err := loadCertPool(*serverCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if *serverCert != "" || *serverKey != "" {
+		cert, err := tls.LoadX509KeyPair(*serverCert, *serverKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// tradePasswd is read from -passwd-file, else $RISK_TRADE_PASSWD, else the
+// deprecated -passwd
+func tradePasswd() (string, error) {
+	if *passwdFile != "" {
+		b, err := ioutil.ReadFile(*passwdFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if v, ok := os.LookupEnv(passwdEnv); ok {
+		return v, nil
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "passwd" {
+			log.Print("-passwd is deprecated, it is visible to other local users, use -passwd-file or $" + passwdEnv)
+		}
+	})
+	return *passwd, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed cert of name and its key, with the mtime
+// at, and returns the pem of the cert
+func writeCert(t *testing.T, certFile string, keyFile string, name string, at time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	writeAt(t, certFile, certPem, at)
+	writeAt(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), at)
+	return certPem
+}
+
+func writeAt(t *testing.T, fn string, content []byte, at time.Time) {
+	if err := ioutil.WriteFile(fn, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fn, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName is the common name of the cert served by r
+func servedName(t *testing.T, r *certReloader) string {
+	cfg, err := r.config(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	t0 := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "one", t0)
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, r); name != "one" {
+		t.Fatalf("serving %s, want one", name)
+	}
+	// renewed on disk, picked up once checked again
+	writeCert(t, certFile, keyFile, "two", t0.Add(time.Minute))
+	if name := servedName(t, r); name != "one" {
+		t.Errorf("serving %s before certCheckInterval", name)
+	}
+	r.checked = time.Time{}
+	if name := servedName(t, r); name != "two" {
+		t.Errorf("serving %s after renewal, want two", name)
+	}
+	// a cert not matching the key is not loaded
+	other := filepath.Join(dir, "other.pem")
+	certPem := writeCert(t, other, filepath.Join(dir, "other.key"), "three", t0)
+	writeAt(t, certFile, certPem, t0.Add(2*time.Minute))
+	r.checked = time.Time{}
+	if err := r.reload(); err == nil {
+		t.Error("mismatched cert and key loaded")
+	}
+	if name := servedName(t, r); name != "two" {
+		t.Errorf("serving %s after a failed reload, want two", name)
+	}
+	// nor a missing key
+	os.Remove(keyFile)
+	r.checked = time.Time{}
+	if name := servedName(t, r); name != "two" {
+		t.Errorf("serving %s without a key, want two", name)
+	}
+	// and the fixed pair is tried again
+	writeCert(t, certFile, keyFile, "four", t0.Add(3*time.Minute))
+	r.checked = time.Time{}
+	if name := servedName(t, r); name != "four" {
+		t.Errorf("serving %s after fixing the pair, want four", name)
+	}
+}
+
+func TestClientCAReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	t0 := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "server", t0)
+	writeAt(t, caFile, writeCert(t, filepath.Join(dir, "ca1.pem"), filepath.Join(dir, "ca1.key"), "ca1", t0), t0)
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	pool := r.pool
+	cfg, _ := r.config(nil)
+	if cfg.ClientCAs != pool || pool == nil {
+		t.Error("client CAs not required")
+	}
+	writeAt(t, caFile, []byte("not a cert"), t0.Add(time.Minute))
+	r.checked = time.Time{}
+	if err := r.reload(); err == nil {
+		t.Error("invalid CA file loaded")
+	}
+	if cfg, _ := r.config(nil); cfg.ClientCAs != pool {
+		t.Error("client CAs replaced by a failed reload")
+	}
+}
@@ -3,12 +3,17 @@ module github.com/bhojpur/risk
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/Knetic/govaluate v3.0.0+incompatible
 	github.com/eknkc/amber v0.0.0-20171010120322-cdade1c07385 // indirect
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/gorilla/websocket v1.4.0
 	github.com/julienschmidt/httprouter v1.2.0
 	github.com/sbinet/go-python v0.0.0-20190615090516-46d882be3991
 	github.com/stretchr/testify v1.7.1 // indirect
 	github.com/thoas/go-funk v0.4.0
 	github.com/unrolled/render v1.0.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20220314234659-1baeb1ce4c0b
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,202 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client of the risk server REST API, BaseURL is like "http://localhost:9113"
+// and Token is the session token of a websocket login, see Conn.Session.
+type Client struct {
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTP: http.DefaultClient}
+}
+
+type PageQuery struct {
+	Offset int
+	Limit  int // 0 for the server default
+}
+
+type PositionQuery struct {
+	PageQuery
+	Acc        string
+	Symbol     string
+	Market     string
+	SecurityId int64
+}
+
+type BreachQuery struct {
+	PageQuery
+	Portfolio string
+	Risk      string
+}
+
+// HistoryQuery From and To are unix seconds, Resolution is like "1m", "5m",
+// "1h", "raw" or "" (auto), Agg is "last" (default) or "ohlc".
+type HistoryQuery struct {
+	Portfolio  string
+	Risk       string
+	Param      string
+	From       float64
+	To         float64
+	Resolution string
+	Agg        string
+}
+
+func (q PageQuery) values() url.Values {
+	v := url.Values{}
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+func setNonEmpty(v url.Values, key string, value string) {
+	if value != "" {
+		v.Set(key, value)
+	}
+}
+
+func userPath(userId int, elems ...string) string {
+	p := "/api/users/" + strconv.Itoa(userId)
+	for _, e := range elems {
+		p += "/" + url.PathEscape(e)
+	}
+	return p
+}
+
+func (c *Client) get(ctx context.Context, p string, query url.Values, out interface{}) error {
+	u := c.BaseURL + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error *Error `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != nil {
+			return e.Error
+		}
+		return &Error{Status: resp.StatusCode, Code: "http", Message: fmt.Sprintf("unexpected response: %s", body)}
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *Client) Portfolios(ctx context.Context, userId int, q PageQuery) (*PortfolioPage, error) {
+	out := &PortfolioPage{}
+	return out, c.get(ctx, userPath(userId, "portfolios"), q.values(), out)
+}
+
+func (c *Client) Portfolio(ctx context.Context, userId int, name string) (*Portfolio, error) {
+	out := &Portfolio{}
+	return out, c.get(ctx, userPath(userId, "portfolios", name), nil, out)
+}
+
+// Report returns the latest report of all portfolios, keyed by portfolio name
+func (c *Client) Report(ctx context.Context, userId int) (map[string]Report, error) {
+	out := make(map[string]Report)
+	return out, c.get(ctx, userPath(userId, "report"), nil, &out)
+}
+
+func (c *Client) PortfolioReport(ctx context.Context, userId int, portfolio string) (Report, error) {
+	out := make(Report)
+	return out, c.get(ctx, userPath(userId, "portfolios", portfolio, "report"), nil, &out)
+}
+
+func (c *Client) Positions(ctx context.Context, userId int, q PositionQuery) (*PositionPage, error) {
+	v := q.values()
+	setNonEmpty(v, "acc", q.Acc)
+	setNonEmpty(v, "symbol", q.Symbol)
+	setNonEmpty(v, "market", q.Market)
+	if q.SecurityId != 0 {
+		v.Set("securityId", strconv.FormatInt(q.SecurityId, 10))
+	}
+	out := &PositionPage{}
+	return out, c.get(ctx, userPath(userId, "positions"), v, out)
+}
+
+func (c *Client) Breaches(ctx context.Context, userId int, q BreachQuery) (*BreachPage, error) {
+	v := q.values()
+	setNonEmpty(v, "portfolio", q.Portfolio)
+	setNonEmpty(v, "risk", q.Risk)
+	out := &BreachPage{}
+	return out, c.get(ctx, userPath(userId, "breaches"), v, out)
+}
+
+// Overrides are the trade stop overrides in effect
+func (c *Client) Overrides(ctx context.Context, userId int, q PageQuery) (*OverridePage, error) {
+	out := &OverridePage{}
+	return out, c.get(ctx, userPath(userId, "overrides"), q.values(), out)
+}
+
+func (c *Client) History(ctx context.Context, userId int, q HistoryQuery) (*History, error) {
+	v := url.Values{}
+	if q.From > 0 {
+		v.Set("from", strconv.FormatFloat(q.From, 'f', -1, 64))
+	}
+	if q.To > 0 {
+		v.Set("to", strconv.FormatFloat(q.To, 'f', -1, 64))
+	}
+	setNonEmpty(v, "resolution", q.Resolution)
+	setNonEmpty(v, "agg", q.Agg)
+	out := &History{}
+	return out, c.get(ctx, userPath(userId, "portfolios", q.Portfolio, "history", q.Risk, q.Param), v, out)
+}
+
+// OpenAPI returns the OpenAPI document of the server
+func (c *Client) OpenAPI(ctx context.Context) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	return out, c.get(ctx, "/api/openapi.json", nil, &out)
+}
@@ -0,0 +1,153 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// testServer answers every request with status and body, and records the
+// last request
+func testServer(t *testing.T, status int, body string) (*Client, *http.Request) {
+	last := &http.Request{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*last = *r.Clone(context.Background())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	c := New(srv.URL + "/")
+	c.Token = "tok"
+	return c, last
+}
+
+func TestRequests(t *testing.T) {
+	c, last := testServer(t, http.StatusOK, `{}`)
+	ctx := context.Background()
+	for _, r := range []struct {
+		call  func() error
+		path  string
+		query string
+	}{
+		{func() error { _, err := c.Portfolios(ctx, 1, PageQuery{}); return err }, "/api/users/1/portfolios", ""},
+		{func() error { _, err := c.Portfolios(ctx, 1, PageQuery{Offset: 10, Limit: 5}); return err }, "/api/users/1/portfolios", "limit=5&offset=10"},
+		{func() error { _, err := c.Portfolio(ctx, 2, "a b/c"); return err }, "/api/users/2/portfolios/a%20b%2Fc", ""},
+		{func() error { _, err := c.Report(ctx, 1); return err }, "/api/users/1/report", ""},
+		{func() error { _, err := c.PortfolioReport(ctx, 1, "p"); return err }, "/api/users/1/portfolios/p/report", ""},
+		{func() error {
+			_, err := c.Positions(ctx, 1, PositionQuery{Acc: "x", Symbol: "A&B", SecurityId: 7})
+			return err
+		}, "/api/users/1/positions", "acc=x&securityId=7&symbol=A%26B"},
+		{func() error { _, err := c.Breaches(ctx, 1, BreachQuery{Portfolio: "p", Risk: "r"}); return err }, "/api/users/1/breaches", "portfolio=p&risk=r"},
+		{func() error { _, err := c.Overrides(ctx, 1, PageQuery{Limit: 3}); return err }, "/api/users/1/overrides", "limit=3"},
+		{func() error {
+			_, err := c.History(ctx, 1, HistoryQuery{Portfolio: "p", Risk: "r", Param: "x", From: 1.5, To: 100, Resolution: "5m", Agg: "ohlc"})
+			return err
+		}, "/api/users/1/portfolios/p/history/r/x", "agg=ohlc&from=1.5&resolution=5m&to=100"},
+		{func() error { _, err := c.OpenAPI(ctx); return err }, "/api/openapi.json", ""},
+	} {
+		if err := r.call(); err != nil {
+			t.Errorf("%s: %v", r.path, err)
+			continue
+		}
+		if last.Method != http.MethodGet || last.URL.EscapedPath() != r.path || last.URL.RawQuery != r.query {
+			t.Errorf("request %s %s?%s, want %s?%s", last.Method, last.URL.EscapedPath(), last.URL.RawQuery, r.path, r.query)
+		}
+		if last.Header.Get("Authorization") != "Bearer tok" || last.Header.Get("Accept") != "application/json" {
+			t.Errorf("%s: headers %v", r.path, last.Header)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		body   string
+		want   Error
+	}{
+		{http.StatusNotFound, `{"error":{"status":404,"code":"not_found","message":"unknown portfolio: p"}}`, Error{404, "not_found", "unknown portfolio: p"}},
+		{http.StatusUnauthorized, `{"error":{"status":401,"code":"unauthorized","message":"expired"}}`, Error{401, "unauthorized", "expired"}},
+		{http.StatusBadGateway, `bad gateway`, Error{502, "http", "unexpected response: bad gateway"}},
+		{http.StatusInternalServerError, `{"other":1}`, Error{500, "http", `unexpected response: {"other":1}`}},
+	} {
+		cl, _ := testServer(t, c.status, c.body)
+		_, err := cl.Portfolio(context.Background(), 1, "p")
+		e, ok := err.(*Error)
+		if !ok || *e != c.want {
+			t.Errorf("%d %s: %#v, want %#v", c.status, c.body, err, c.want)
+		}
+	}
+	cl, _ := testServer(t, http.StatusOK, `{"name":`)
+	if _, err := cl.Portfolio(context.Background(), 1, "p"); err == nil {
+		t.Error("truncated body decoded")
+	}
+}
+
+func TestPages(t *testing.T) {
+	var all []Breach
+	for i := 0; i < 7; i++ {
+		all = append(all, Breach{Portfolio: "p", Risk: "r", Param: strconv.Itoa(i), Value: float64(i)})
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := offset + limit
+		if end > len(all) {
+			end = len(all)
+		}
+		json.NewEncoder(w).Encode(BreachPage{Page{offset, limit, len(all)}, all[offset:end]})
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	var got []Breach
+	q := BreachQuery{PageQuery: PageQuery{Limit: 3}}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("paging does not end")
+		}
+		page, err := c.Breaches(context.Background(), 1, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Offset != q.Offset || page.Limit != 3 || page.Total != len(all) {
+			t.Errorf("page %+v at offset %d", page.Page, q.Offset)
+		}
+		got = append(got, page.Items...)
+		q.Offset += len(page.Items)
+		if len(page.Items) == 0 || q.Offset >= page.Total {
+			break
+		}
+	}
+	if len(got) != len(all) {
+		t.Fatalf("%d items, want %d", len(got), len(all))
+	}
+	for i := range all {
+		if got[i].Param != all[i].Param || got[i].Value != all[i].Value {
+			t.Errorf("item %d = %+v, want %+v", i, got[i], all[i])
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import "fmt"
+
+// Types of the risk server REST API, see /api/openapi.json. The server uses
+// them too, so they can not drift apart.
+
+// ProtocolVersion of the websocket envelope protocol, negotiated with the
+// Subprotocol websocket subprotocol or a hello envelope
+const ProtocolVersion = 1
+const Subprotocol = "risk.v1"
+
+// Envelope is a websocket msg of the versioned protocol. Replies carry the
+// Id of their request, pushed msgs (like "risk") have no Id.
+type Envelope struct {
+	V       int                    `json:"v"`
+	Type    string                 `json:"type"`
+	Id      string                 `json:"id,omitempty"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+	Error   *Error                 `json:"error,omitempty"`
+}
+
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("risk server: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type Page struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	Total  int `json:"total"`
+}
+
+type Portfolio struct {
+	Name  string `json:"name"`
+	File  string `json:"file"`
+	Acc   string `json:"acc"`
+	Risks []Risk `json:"risks"`
+}
+
+type Risk struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"displayName"`
+	Groups      []string `json:"groups"`
+	Params      []Param  `json:"params"`
+}
+
+// Param bounds are numbers, or "NaN" when not set
+type Param struct {
+	Name       string        `json:"name"`
+	Aggregate  string        `json:"aggregate"`
+	UpperBound []interface{} `json:"upperBound"`
+	LowerBound []interface{} `json:"lowerBound"`
+	TradeStop  bool          `json:"tradeStop"`
+	Graph      bool          `json:"graph"`
+}
+
+type Position struct {
+	Acc             string  `json:"acc"`
+	AccId           int     `json:"accId"`
+	SecurityId      int64   `json:"securityId"`
+	Symbol          string  `json:"symbol"`
+	Market          string  `json:"market"`
+	Type            string  `json:"type"`
+	Currency        string  `json:"currency"`
+	Qty             float64 `json:"qty"`
+	AvgPx           float64 `json:"avgPx"`
+	Commission      float64 `json:"commission"`
+	RealizedPnl     float64 `json:"realizedPnl"`
+	BuyQty          float64 `json:"buyQty"`
+	BuyValue        float64 `json:"buyValue"`
+	SellQty         float64 `json:"sellQty"`
+	SellValue       float64 `json:"sellValue"`
+	OutstandBuyQty  float64 `json:"outstandBuyQty"`
+	OutstandSellQty float64 `json:"outstandSellQty"`
+	Target          float64 `json:"target"`
+	Close           float64 `json:"close"`
+}
+
+type Breach struct {
+	Portfolio  string   `json:"portfolio"`
+	Risk       string   `json:"risk"`
+	Param      string   `json:"param"`
+	Group      string   `json:"group"`
+	Symbol     string   `json:"symbol,omitempty"`
+	Value      float64  `json:"value"`
+	LowerBound *float64 `json:"lowerBound,omitempty"`
+	UpperBound *float64 `json:"upperBound,omitempty"`
+	TradeStop  bool     `json:"tradeStop"`
+	Overridden bool     `json:"overridden,omitempty"`
+	Ack        *Ack     `json:"ack,omitempty"`
+	Time       int64    `json:"time"`
+}
+
+type Ack struct {
+	By      string `json:"by"`
+	Comment string `json:"comment,omitempty"`
+	Time    int64  `json:"time"`
+}
+
+// Override keeps a trade stop param from disabling accounts until Until, in
+// unix seconds, Group empty for all groups
+type Override struct {
+	Portfolio string `json:"portfolio"`
+	Risk      string `json:"risk"`
+	Param     string `json:"param"`
+	Group     string `json:"group,omitempty"`
+	By        string `json:"by"`
+	Reason    string `json:"reason,omitempty"`
+	Until     int64  `json:"until"`
+}
+
+// FileVersion is a saved or deleted version of a risk file, Time in unix
+// seconds
+type FileVersion struct {
+	Version int    `json:"version"`
+	Author  string `json:"author"`
+	Comment string `json:"comment,omitempty"`
+	Time    int64  `json:"time"`
+	Size    int    `json:"size"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Draft is an unapproved portfolio file, State "draft" or "pending", of the
+// user id Owner
+type Draft struct {
+	Fn         string `json:"fn"`
+	Owner      int    `json:"owner"`
+	Content    string `json:"content,omitempty"`
+	Author     string `json:"author"`
+	Comment    string `json:"comment,omitempty"`
+	State      string `json:"state"`
+	Time       int64  `json:"time"`
+	Submitted  int64  `json:"submitted,omitempty"`
+	RejectedBy string `json:"rejectedBy,omitempty"`
+	Rejection  string `json:"rejection,omitempty"`
+}
+
+// LimitChange is an effective setting a draft changes
+type LimitChange struct {
+	Portfolio string `json:"portfolio"`
+	Risk      string `json:"risk,omitempty"`
+	Param     string `json:"param,omitempty"`
+	Key       string `json:"key"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+}
+
+// Diagnostic is a problem of a portfolio file, Severity "error" or "warning",
+// File set for problems in an included shared file
+type Diagnostic struct {
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"`
+	File     string `json:"file,omitempty"`
+}
+
+// EditOp is an edit of editRiskFile, Op one of addRisk, removeRisk,
+// addParam, removeParam, setFormula, setBounds and setValue. An empty Param
+// is the risk section itself. Bounds are per group, nil for a group without
+// one, an empty list removes them and a nil one keeps them.
+type EditOp struct {
+	Op      string     `json:"op"`
+	Risk    string     `json:"risk,omitempty"`
+	Param   string     `json:"param,omitempty"`
+	Key     string     `json:"key,omitempty"`
+	Value   string     `json:"value,omitempty"`
+	Formula string     `json:"formula,omitempty"`
+	Upper   []*float64 `json:"upper"`
+	Lower   []*float64 `json:"lower"`
+}
+
+// DraftReview is a draft with its diff to the live file
+type DraftReview struct {
+	Draft  *Draft        `json:"draft"`
+	Diff   string        `json:"diff"`
+	Limits []LimitChange `json:"limits"`
+}
+
+// History series are group to [[t, v], ...] ([[t, o, h, l, c], ...] for
+// ohlc), or group to symbol to points for non-aggregate params.
+type History struct {
+	Portfolio  string                 `json:"portfolio"`
+	Risk       string                 `json:"risk"`
+	Param      string                 `json:"param"`
+	Resolution float64                `json:"resolution"`
+	Agg        string                 `json:"agg"`
+	Series     map[string]interface{} `json:"series"`
+}
+
+// Report is risk name to [[group, value, breach?], ...], or risk name to
+// param name to such list when a risk has several params.
+type Report map[string]interface{}
+
+// DeltaRow is a report row of riskSnapshot and riskDelta pushes, Path is
+// [portfolio, risk, group] or [portfolio, risk, param, group] and Value is
+// [value, breach?]
+type DeltaRow struct {
+	Path  []string      `json:"path"`
+	Value []interface{} `json:"value"`
+}
+
+type PortfolioPage struct {
+	Page
+	Items []Portfolio `json:"items"`
+}
+
+type PositionPage struct {
+	Page
+	Items []Position `json:"items"`
+}
+
+type BreachPage struct {
+	Page
+	Items []Breach `json:"items"`
+}
+
+type OverridePage struct {
+	Page
+	Items []Override `json:"items"`
+}
@@ -0,0 +1,512 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrClosed = errors.New("risk server connection closed")
+
+// Conn is a websocket connection to the /risk/ endpoint speaking the
+// versioned envelope protocol, replies are matched to requests by id.
+type Conn struct {
+	ws      *websocket.Conn
+	reports chan map[string]Report
+	lock    sync.Mutex
+	writeMu sync.Mutex
+	nextId  int64
+	waiting map[string]chan *Envelope
+	err     error
+	done    chan struct{}
+	session string
+	rows    []DeltaRow     // subscribed rows in snapshot order, owned by read
+	rowIdx  map[string]int // path to index in rows
+}
+
+// Dial connects to a websocket url like "ws://localhost:9113/risk/"
+func Dial(ctx context.Context, url string, header http.Header) (*Conn, error) {
+	return DialTLS(ctx, url, header, nil)
+}
+
+// DialTLS is Dial with the tls config of wss:// urls, like the CA of the
+// server or a client cert
+func DialTLS(ctx context.Context, url string, header http.Header, tlsConfig *tls.Config) (*Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{Subprotocol}
+	dialer.TLSClientConfig = tlsConfig
+	ws, _, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != Subprotocol {
+		ws.Close()
+		return nil, fmt.Errorf("risk server does not support %s", Subprotocol)
+	}
+	c := &Conn{
+		ws:      ws,
+		reports: make(chan map[string]Report, 1),
+		waiting: make(map[string]chan *Envelope),
+		done:    make(chan struct{}),
+	}
+	go c.read()
+	return c, nil
+}
+
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+// Reports delivers the risk reports pushed every second, keyed by portfolio
+// name. Only the latest is kept if the reader falls behind. After Subscribe
+// the reports are rebuilt from the pushed deltas and hold the subscribed
+// portfolios and risks only.
+func (c *Conn) Reports() <-chan map[string]Report {
+	return c.reports
+}
+
+func (c *Conn) read() {
+	defer func() {
+		c.lock.Lock()
+		if c.err == nil {
+			c.err = ErrClosed
+		}
+		c.lock.Unlock()
+		close(c.done)
+	}()
+	for {
+		_, raw, err := c.ws.ReadMessage()
+		if err != nil {
+			c.lock.Lock()
+			c.err = err
+			c.lock.Unlock()
+			return
+		}
+		env := &Envelope{}
+		if json.Unmarshal(raw, env) != nil {
+			continue
+		}
+		if env.Id == "" {
+			c.pushed(env)
+			continue
+		}
+		c.lock.Lock()
+		ch := c.waiting[env.Id]
+		delete(c.waiting, env.Id)
+		c.lock.Unlock()
+		if ch != nil {
+			ch <- env
+		}
+	}
+}
+
+func (c *Conn) pushed(env *Envelope) {
+	var rpt map[string]Report
+	switch env.Type {
+	case "risk":
+		decodePayload(env.Payload["report"], &rpt)
+	case "riskSnapshot", "riskDelta":
+		var set []DeltaRow
+		var del [][]string
+		decodePayload(env.Payload["set"], &set)
+		decodePayload(env.Payload["del"], &del)
+		c.applyDelta(env.Type == "riskSnapshot", set, del)
+		rpt = c.deltaReport()
+	default:
+		return
+	}
+	select {
+	case <-c.reports:
+	default:
+	}
+	c.reports <- rpt
+}
+
+func (c *Conn) applyDelta(snapshot bool, set []DeltaRow, del [][]string) {
+	if snapshot || c.rowIdx == nil {
+		c.rows = nil
+		c.rowIdx = make(map[string]int)
+	}
+	if len(del) > 0 {
+		gone := make(map[string]bool, len(del))
+		for _, path := range del {
+			gone[pathKey(path)] = true
+		}
+		rows := c.rows[:0]
+		for _, row := range c.rows {
+			if !gone[pathKey(row.Path)] {
+				rows = append(rows, row)
+			}
+		}
+		c.rows = rows
+		c.rowIdx = make(map[string]int, len(rows))
+		for i, row := range rows {
+			c.rowIdx[pathKey(row.Path)] = i
+		}
+	}
+	for _, row := range set {
+		key := pathKey(row.Path)
+		if i, ok := c.rowIdx[key]; ok {
+			c.rows[i] = row
+		} else {
+			c.rowIdx[key] = len(c.rows)
+			c.rows = append(c.rows, row)
+		}
+	}
+}
+
+func pathKey(path []string) string {
+	tmp, _ := json.Marshal(path)
+	return string(tmp)
+}
+
+// deltaReport rebuilds the report of the subscribed rows
+func (c *Conn) deltaReport() map[string]Report {
+	out := make(map[string]Report)
+	for _, row := range c.rows {
+		n := len(row.Path)
+		if n < 3 {
+			continue
+		}
+		rpt := out[row.Path[0]]
+		if rpt == nil {
+			rpt = make(Report)
+			out[row.Path[0]] = rpt
+		}
+		line := append([]interface{}{row.Path[n-1]}, row.Value...)
+		risk := row.Path[1]
+		if n == 3 {
+			rows, _ := rpt[risk].([]interface{})
+			rpt[risk] = append(rows, line)
+			continue
+		}
+		params, _ := rpt[risk].(map[string]interface{})
+		if params == nil {
+			params = make(map[string]interface{})
+			rpt[risk] = params
+		}
+		rows, _ := params[row.Path[2]].([]interface{})
+		params[row.Path[2]] = append(rows, line)
+	}
+	return out
+}
+
+func decodePayload(v interface{}, out interface{}) error {
+	tmp, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(tmp, out)
+}
+
+// Call sends a request of typ and waits for its reply, the reply error is
+// returned as *Error
+func (c *Conn) Call(ctx context.Context, typ string, payload map[string]interface{}) (map[string]interface{}, error) {
+	ch := make(chan *Envelope, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	c.nextId++
+	id := strconv.FormatInt(c.nextId, 10)
+	c.waiting[id] = ch
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.waiting, id)
+		c.lock.Unlock()
+	}()
+	c.writeMu.Lock()
+	err := c.ws.WriteJSON(Envelope{V: ProtocolVersion, Type: typ, Id: id, Payload: payload})
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		if reply.Error != nil {
+			return reply.Payload, reply.Error
+		}
+		return reply.Payload, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Login opens a session and returns the risk files of the user, with a jwt
+// authenticating server passwd is the token. The server closes the
+// connection if the login fails.
+func (c *Conn) Login(ctx context.Context, username string, passwd string) ([]string, error) {
+	return c.startSession(c.Call(ctx, "login", map[string]interface{}{"username": username, "password": passwd}))
+}
+
+// Resume continues the session of an earlier login on this connection
+func (c *Conn) Resume(ctx context.Context, session string) ([]string, error) {
+	return c.startSession(c.Call(ctx, "resume", map[string]interface{}{"session": session}))
+}
+
+func (c *Conn) startSession(reply map[string]interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	decodePayload(reply["files"], &files)
+	c.lock.Lock()
+	c.session, _ = reply["session"].(string)
+	c.lock.Unlock()
+	return files, nil
+}
+
+// Session is the token of the session after Login or Resume, also the
+// Bearer token of the REST API
+func (c *Conn) Session() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.session
+}
+
+// Logout ends the session, the server closes the connection
+func (c *Conn) Logout(ctx context.Context) error {
+	_, err := c.Call(ctx, "logout", nil)
+	return err
+}
+
+func (c *Conn) RiskFile(ctx context.Context, fn string) (string, error) {
+	reply, err := c.Call(ctx, "riskFile", map[string]interface{}{"fn": fn})
+	if err != nil {
+		return "", err
+	}
+	content, _ := reply["content"].(string)
+	return content, nil
+}
+
+// SaveRiskFile saves a portfolio or .py file, both are validated by the server
+// before saving.
+func (c *Conn) SaveRiskFile(ctx context.Context, fn string, content string) error {
+	_, err := c.Call(ctx, "saveRiskFile", map[string]interface{}{"fn": fn, "content": content})
+	return err
+}
+
+func (c *Conn) DeleteRiskFile(ctx context.Context, fn string) error {
+	_, err := c.Call(ctx, "deleteRiskFile", map[string]interface{}{"fn": fn})
+	return err
+}
+
+// ValidateRiskFile returns the diagnostics of a portfolio file without saving
+// it. A save of a file with errors fails with code invalid_file and the
+// same diagnostics in the reply payload.
+func (c *Conn) ValidateRiskFile(ctx context.Context, fn string, content string) ([]Diagnostic, error) {
+	reply, err := c.Call(ctx, "validateRiskFile", map[string]interface{}{"fn": fn, "content": content})
+	if err != nil {
+		return nil, err
+	}
+	var out []Diagnostic
+	if err := decodePayload(reply["diagnostics"], &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EditRiskFile applies ops to a portfolio .ini file and saves it, the
+// server keeps comments and returns the new content with its warnings
+func (c *Conn) EditRiskFile(ctx context.Context, fn string, ops []EditOp, comment string) (string, []Diagnostic, error) {
+	reply, err := c.Call(ctx, "editRiskFile", map[string]interface{}{"fn": fn, "ops": ops, "comment": comment})
+	if err != nil {
+		return "", nil, err
+	}
+	content, _ := reply["content"].(string)
+	var out []Diagnostic
+	if err := decodePayload(reply["diagnostics"], &out); err != nil {
+		return "", nil, err
+	}
+	return content, out, nil
+}
+
+// SaveRiskFileComment is SaveRiskFile with a comment kept in the version
+// history
+func (c *Conn) SaveRiskFileComment(ctx context.Context, fn string, content string, comment string) error {
+	_, err := c.Call(ctx, "saveRiskFile", map[string]interface{}{"fn": fn, "content": content, "comment": comment})
+	return err
+}
+
+// RiskFileVersions are the versions of fn, oldest first
+func (c *Conn) RiskFileVersions(ctx context.Context, fn string) ([]FileVersion, error) {
+	reply, err := c.Call(ctx, "riskFileVersions", map[string]interface{}{"fn": fn})
+	if err != nil {
+		return nil, err
+	}
+	var out []FileVersion
+	if err := decodePayload(reply["versions"], &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RiskFileDiff is the unified diff of fn from version from to version to,
+// from 0 for the latest version and to 0 for the current file
+func (c *Conn) RiskFileDiff(ctx context.Context, fn string, from int, to int) (string, error) {
+	reply, err := c.Call(ctx, "riskFileDiff", map[string]interface{}{"fn": fn, "from": from, "to": to})
+	if err != nil {
+		return "", err
+	}
+	diff, _ := reply["diff"].(string)
+	return diff, nil
+}
+
+// Drafts of the user, and for risk-approvers the pending drafts of others
+func (c *Conn) Drafts(ctx context.Context) ([]Draft, error) {
+	reply, err := c.Call(ctx, "drafts", nil)
+	if err != nil {
+		return nil, err
+	}
+	var out []Draft
+	if err := decodePayload(reply["drafts"], &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SaveDraft saves a portfolio file as a draft, the live file is unchanged until
+// the draft is submitted and approved
+func (c *Conn) SaveDraft(ctx context.Context, fn string, content string, comment string) error {
+	_, err := c.Call(ctx, "saveDraft", map[string]interface{}{"fn": fn, "content": content, "comment": comment})
+	return err
+}
+
+func (c *Conn) SubmitDraft(ctx context.Context, fn string) error {
+	_, err := c.Call(ctx, "submitDraft", map[string]interface{}{"fn": fn})
+	return err
+}
+
+// ReviewDraft returns the draft of fn of the user id owner, 0 for the user's
+// own, with its diff and limit changes
+func (c *Conn) ReviewDraft(ctx context.Context, owner int, fn string) (*DraftReview, error) {
+	reply, err := c.Call(ctx, "riskFileDraft", map[string]interface{}{"owner": owner, "fn": fn})
+	if err != nil {
+		return nil, err
+	}
+	out := &DraftReview{}
+	if err := decodePayload(reply, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ApproveDraft activates a pending draft of fn of the user id owner, authored
+// by another user
+func (c *Conn) ApproveDraft(ctx context.Context, owner int, fn string, comment string) error {
+	_, err := c.Call(ctx, "approveDraft", map[string]interface{}{"owner": owner, "fn": fn, "comment": comment})
+	return err
+}
+
+func (c *Conn) RejectDraft(ctx context.Context, owner int, fn string, comment string) error {
+	_, err := c.Call(ctx, "rejectDraft", map[string]interface{}{"owner": owner, "fn": fn, "comment": comment})
+	return err
+}
+
+func (c *Conn) DiscardDraft(ctx context.Context, fn string) error {
+	_, err := c.Call(ctx, "discardDraft", map[string]interface{}{"fn": fn})
+	return err
+}
+
+// RollbackRiskFile saves version of fn again as a new version
+func (c *Conn) RollbackRiskFile(ctx context.Context, fn string, version int, comment string) error {
+	_, err := c.Call(ctx, "rollbackRiskFile", map[string]interface{}{"fn": fn, "version": version, "comment": comment})
+	return err
+}
+
+// Subscribe limits the pushed reports to the portfolios and risks (display
+// names), empty for all, sent at most once per interval as deltas. See
+// Reports.
+func (c *Conn) Subscribe(ctx context.Context, portfolios []string, risks []string, interval time.Duration) error {
+	_, err := c.Call(ctx, "subscribe", map[string]interface{}{
+		"portfolios": portfolios,
+		"risks":      risks,
+		"interval":   interval.Milliseconds(),
+	})
+	return err
+}
+
+// Unsubscribe goes back to full reports every second
+func (c *Conn) Unsubscribe(ctx context.Context) error {
+	_, err := c.Call(ctx, "unsubscribe", nil)
+	return err
+}
+
+// AckBreach acknowledges a breach of the latest risk run, b.Risk is the
+// display name, needs the risk-author role
+func (c *Conn) AckBreach(ctx context.Context, b Breach, comment string) error {
+	_, err := c.Call(ctx, "ackBreach", map[string]interface{}{
+		"portfolio": b.Portfolio,
+		"risk":      b.Risk,
+		"param":     b.Param,
+		"group":     b.Group,
+		"symbol":    b.Symbol,
+		"comment":   comment,
+	})
+	return err
+}
+
+// OverrideTradeStop keeps a trade stop param from disabling accounts for
+// duration, 0 removes the override, needs the risk-admin role
+func (c *Conn) OverrideTradeStop(ctx context.Context, o Override, duration time.Duration) error {
+	_, err := c.Call(ctx, "tradeStopOverride", map[string]interface{}{
+		"portfolio": o.Portfolio,
+		"risk":      o.Risk,
+		"param":     o.Param,
+		"group":     o.Group,
+		"duration":  duration.Seconds(),
+		"reason":    o.Reason,
+	})
+	return err
+}
+
+// HistoricalRisk q.Risk is the display name of the risk
+func (c *Conn) HistoricalRisk(ctx context.Context, q HistoryQuery) (*History, error) {
+	reply, err := c.Call(ctx, "historicalRisk", map[string]interface{}{
+		"portfolio":  q.Portfolio,
+		"risk":       q.Risk,
+		"param":      q.Param,
+		"from":       q.From,
+		"to":         q.To,
+		"resolution": q.Resolution,
+		"agg":        q.Agg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &History{}
+	return out, decodePayload(reply, out)
+}
@@ -0,0 +1,383 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Knetic/govaluate"
+)
+
+// AggregateArg is the kind of an arg of an aggregate
+type AggregateArg int
+
+const (
+	AggregateValue     AggregateArg = iota // a number of each position
+	AggregateCondition                     // a bool of each position, 1 if true else 0
+	AggregateConstant                      // a number literal
+)
+
+// Aggregate reduces the values of its args at the positions of a group to
+// a number, Reduce gets the values by position of the args of each
+// position in the order of Args, the first of which is one, and the
+// constants. Check refuses constants out of range.
+type Aggregate struct {
+	Args   []AggregateArg
+	Reduce func(values [][]float64, consts []float64) float64
+	Check  func(consts []float64) error
+}
+
+var aggregates = make(map[string]*Aggregate)
+
+// RegisterAggregate adds name(args) to formulas and [[[var]]] variables,
+// before portfolios are loaded. Names of functions with a different number
+// of args are kept for the function, as min(a, b).
+func RegisterAggregate(name string, a *Aggregate) {
+	if name == "" || name == "top" || name == "call" || aggregates[name] != nil {
+		panic("aggregate already registered: " + name)
+	}
+	for i, c := range name {
+		if !(unicode.IsLetter(c) || c == '_' || (i > 0 && unicode.IsDigit(c))) {
+			panic("invalid aggregate name: " + name)
+		}
+	}
+	if len(a.Args) == 0 || a.Args[0] == AggregateConstant || a.Reduce == nil {
+		panic("aggregate " + name + " needs a first arg of each position and Reduce")
+	}
+	aggregates[name] = a
+}
+
+func init() {
+	value := []AggregateArg{AggregateValue}
+	reduce1 := func(f func([]float64) float64) func([][]float64, []float64) float64 {
+		return func(values [][]float64, consts []float64) float64 { return f(values[0]) }
+	}
+	RegisterAggregate("sum", &Aggregate{Args: value, Reduce: reduce1(sum)})
+	RegisterAggregate("len", &Aggregate{Args: value, Reduce: reduce1(length)})
+	RegisterAggregate("mean", &Aggregate{Args: value, Reduce: reduce1(mean)})
+	RegisterAggregate("std", &Aggregate{Args: value, Reduce: reduce1(std)})
+	RegisterAggregate("min", &Aggregate{Args: value, Reduce: reduce1(minimum)})
+	RegisterAggregate("max", &Aggregate{Args: value, Reduce: reduce1(maximum)})
+	RegisterAggregate("median", &Aggregate{Args: value, Reduce: reduce1(func(nums []float64) float64 {
+		return percentile(nums, 50)
+	})})
+	RegisterAggregate("pct", &Aggregate{
+		Args: []AggregateArg{AggregateValue, AggregateConstant},
+		Reduce: func(values [][]float64, consts []float64) float64 {
+			return percentile(values[0], consts[0])
+		},
+		Check: func(consts []float64) error {
+			if !(consts[0] >= 0 && consts[0] <= 100) {
+				return fmt.Errorf("percentile %v not in [0, 100]", consts[0])
+			}
+			return nil
+		},
+	})
+	RegisterAggregate("wmean", &Aggregate{
+		Args: []AggregateArg{AggregateValue, AggregateValue},
+		Reduce: func(values [][]float64, consts []float64) float64 {
+			return weightedMean(values[0], values[1])
+		},
+	})
+	RegisterAggregate("count_if", &Aggregate{Args: []AggregateArg{AggregateCondition}, Reduce: reduce1(sum)})
+	RegisterAggregate("hhi", &Aggregate{Args: value, Reduce: reduce1(hhi)})
+}
+
+// the aggregates added with the registry skip NaN, no value of c ? x
+
+func numbers(nums []float64) []float64 {
+	out := make([]float64, 0, len(nums))
+	for _, v := range nums {
+		if !math.IsNaN(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func minimum(nums []float64) float64 {
+	res := math.NaN()
+	for _, v := range numbers(nums) {
+		if math.IsNaN(res) || v < res {
+			res = v
+		}
+	}
+	return res
+}
+
+func maximum(nums []float64) float64 {
+	res := math.NaN()
+	for _, v := range numbers(nums) {
+		if math.IsNaN(res) || v > res {
+			res = v
+		}
+	}
+	return res
+}
+
+// percentile interpolates between the closest ranks, as numpy
+func percentile(nums []float64, p float64) float64 {
+	nums = numbers(nums)
+	if len(nums) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(nums)
+	r := p / 100 * float64(len(nums)-1)
+	i := int(r)
+	if i >= len(nums)-1 {
+		return nums[len(nums)-1]
+	}
+	return nums[i] + (r-float64(i))*(nums[i+1]-nums[i])
+}
+
+func weightedMean(nums []float64, weights []float64) float64 {
+	var s, w float64
+	for i, v := range nums {
+		if math.IsNaN(v) || math.IsNaN(weights[i]) {
+			continue
+		}
+		s += v * weights[i]
+		w += weights[i]
+	}
+	if w == 0 {
+		return math.NaN()
+	}
+	return s / w
+}
+
+// hhi is the Herfindahl index of the shares of the absolute values, from
+// 1/n when even to 1 when all in one position
+func hhi(nums []float64) float64 {
+	nums = numbers(nums)
+	total := 0.
+	for _, v := range nums {
+		total += math.Abs(v)
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	res := 0.
+	for _, v := range nums {
+		s := v / total
+		res += s * s
+	}
+	return res
+}
+
+// splitCall splits expr of a whole call name(a, b) into its name and args,
+// the , of parentheses and quotes of args are kept
+func splitCall(expr string) (string, []string, bool) {
+	expr = strings.TrimSpace(expr)
+	i := 0
+	for i < len(expr) && isNameChar(rune(expr[i])) {
+		i++
+	}
+	name := expr[:i]
+	rest := strings.TrimLeft(expr[i:], " \t")
+	if name == "" || !strings.HasPrefix(rest, "(") {
+		return "", nil, false
+	}
+	var args []string
+	depth := 0
+	start := 1
+	for j := 0; j < len(rest); j++ {
+		switch c := rest[j]; c {
+		case '\'', '"':
+			for j++; j < len(rest) && rest[j] != c; j++ {
+				if rest[j] == '\\' {
+					j++
+				}
+			}
+		case '[':
+			for j < len(rest) && rest[j] != ']' {
+				j++
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				if j != len(rest)-1 {
+					// as f(a) + g(b)
+					return "", nil, false
+				}
+				if arg := strings.TrimSpace(rest[start:j]); arg != "" || len(args) > 0 {
+					args = append(args, arg)
+				}
+				return name, args, true
+			}
+		case ',':
+			if depth == 1 {
+				args = append(args, strings.TrimSpace(rest[start:j]))
+				start = j + 1
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func aggregateArgs(a *Aggregate) string {
+	var strs []string
+	for _, arg := range a.Args {
+		strs = append(strs, [...]string{"value", "condition", "constant"}[arg])
+	}
+	return "(" + strings.Join(strs, ", ") + ")"
+}
+
+// groupParam is a variable of params with one value by group, of type t,
+// an aggregate [[[var]]] or an aggregate in an expression
+type groupParam struct {
+	t exprType
+}
+
+func aggregateVar(i int) string {
+	return "aggregate " + strconv.Itoa(i)
+}
+
+// aggregateParams are params with the n aggregates of an expression
+func aggregateParams(params map[string]interface{}, n int) map[string]interface{} {
+	out := make(map[string]interface{}, len(params)+n)
+	for name, v := range params {
+		out[name] = v
+	}
+	for i := 0; i < n; i++ {
+		out[aggregateVar(i)] = groupParam{typeNumber}
+	}
+	return out
+}
+
+// extractAggregates replaces the calls of aggregates, total() and ref() in
+// expr by the variables [aggregate i] of the returned expressions
+func extractAggregates(ln string, expr string, name string, params map[string]interface{}, path string) (string, []*Expression, error) {
+	var out strings.Builder
+	var inner []*Expression
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				j = len(expr) - 1
+			}
+			out.WriteString(expr[i : j+1])
+			i = j
+		case c == '[':
+			j := strings.IndexByte(expr[i:], ']')
+			if j < 0 {
+				j = len(expr) - 1 - i
+			}
+			out.WriteString(expr[i : i+j+1])
+			i += j
+		case isNameChar(rune(c)):
+			j := i
+			for j < len(expr) && isNameChar(rune(expr[j])) {
+				j++
+			}
+			fname := expr[i:j]
+			if agg := aggregates[fname]; agg != nil || fname == "total" || fname == "ref" {
+				if k := callEnd(expr, j); k > 0 {
+					call := expr[i:k]
+					_, args, _ := splitCall(call)
+					if agg == nil || len(args) == len(agg.Args) {
+						e, err := ParseExpr(ln, call, name, params, 0.0, path)
+						if err != nil {
+							return expr, nil, err
+						}
+						out.WriteString("[" + aggregateVar(len(inner)) + "]")
+						inner = append(inner, e)
+						i = k - 1
+						continue
+					}
+				}
+			}
+			out.WriteString(fname)
+			i = j - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), inner, nil
+}
+
+// callEnd is the index after the ) of a call whose ( follows i, 0 if none
+func callEnd(expr string, i int) int {
+	for i < len(expr) && (expr[i] == ' ' || expr[i] == '\t') {
+		i++
+	}
+	if i >= len(expr) || expr[i] != '(' {
+		return 0
+	}
+	depth := 0
+	for ; i < len(expr); i++ {
+		switch c := expr[i]; c {
+		case '\'', '"':
+			for i++; i < len(expr) && expr[i] != c; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+		case '[':
+			for i < len(expr) && expr[i] != ']' {
+				i++
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// isGroupExpr tells if e only reads group values, to be evaluated once
+// by group rather than by position
+func isGroupExpr(e *govaluate.EvaluableExpression, params map[string]interface{}) bool {
+	for _, v := range e.Vars() {
+		if _, ok := params[v].(groupParam); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// walk calls f with e and the expressions in it
+func (e *Expression) walk(f func(e *Expression)) {
+	f(e)
+	for _, x := range e.R {
+		x.walk(f)
+	}
+	for _, x := range e.S {
+		x.walk(f)
+	}
+}
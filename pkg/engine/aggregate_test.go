@@ -0,0 +1,152 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func reduce(name string, consts []float64, values ...[]float64) float64 {
+	return aggregates[name].Reduce(values, consts)
+}
+
+func sameFloat(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-12 || math.IsNaN(a) && math.IsNaN(b)
+}
+
+func TestPercentile(t *testing.T) {
+	nan := math.NaN()
+	// numpy.percentile(x, p), its default linear interpolation
+	for _, c := range []struct {
+		nums []float64
+		p    float64
+		want float64
+	}{
+		{[]float64{4, 1, 3, 2}, 0, 1},
+		{[]float64{4, 1, 3, 2}, 100, 4},
+		{[]float64{4, 1, 3, 2}, 50, 2.5},
+		{[]float64{4, 1, 3, 2}, 25, 1.75},
+		{[]float64{4, 1, 3, 2}, 90, 3.7},
+		{[]float64{10, nan, 20, 30, nan}, 75, 25},
+		{[]float64{10, 20, 30, 40, 50}, 33, 23.2},
+		{[]float64{5}, 30, 5},
+		{[]float64{nan}, 50, nan},
+		{nil, 50, nan},
+	} {
+		if got := reduce("pct", []float64{c.p}, c.nums); !sameFloat(got, c.want) {
+			t.Errorf("pct(%v, %v) = %v, want %v", c.nums, c.p, got, c.want)
+		}
+	}
+	if got := reduce("median", nil, []float64{3, nan, 1, 2}); got != 2 {
+		t.Errorf("median = %v, want 2", got)
+	}
+}
+
+func TestReducersSkipNaN(t *testing.T) {
+	nan := math.NaN()
+	nums := []float64{nan, 3, -1, nan, 2}
+	for _, c := range []struct {
+		name string
+		want float64
+	}{
+		{"min", -1},
+		{"max", 3},
+		{"hhi", (9. + 1 + 4) / 36},
+	} {
+		if got := reduce(c.name, nil, nums); !sameFloat(got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, got, c.want)
+		}
+	}
+	if got := reduce("min", nil, []float64{nan}); !math.IsNaN(got) {
+		t.Errorf("min of NaN = %v", got)
+	}
+}
+
+func TestWeightedMean(t *testing.T) {
+	nan := math.NaN()
+	for _, c := range []struct {
+		nums, weights []float64
+		want          float64
+	}{
+		{[]float64{2, 4}, []float64{1, 3}, 3.5},
+		{[]float64{2, nan, 4}, []float64{1, 5, 3}, 3.5},
+		{[]float64{2, 8, 4}, []float64{1, nan, 3}, 3.5},
+		{[]float64{2, 4}, []float64{0, 0}, nan},
+		{[]float64{2, 4}, []float64{1, -1}, nan},
+		{nil, nil, nan},
+	} {
+		if got := reduce("wmean", nil, c.nums, c.weights); !sameFloat(got, c.want) {
+			t.Errorf("wmean(%v, %v) = %v, want %v", c.nums, c.weights, got, c.want)
+		}
+	}
+}
+
+func TestHHI(t *testing.T) {
+	for _, c := range []struct {
+		nums []float64
+		want float64
+	}{
+		{[]float64{7}, 1},
+		{[]float64{-7}, 1},
+		{[]float64{2, 2, 2, 2}, 0.25},
+		{[]float64{5, -5, 5, -5, 5}, 0.2},
+		{[]float64{0, 0}, math.NaN()},
+	} {
+		if got := reduce("hhi", nil, c.nums); !sameFloat(got, c.want) {
+			t.Errorf("hhi(%v) = %v, want %v", c.nums, got, c.want)
+		}
+	}
+}
+
+func TestAggregateOrFunction(t *testing.T) {
+	positions := []*Position{{Security: &Security{}}, {Security: &Security{}}}
+	positions[0].Qty, positions[1].Qty = 1, 5
+	e, err := ParseExpr("1", "min(Pos, 3)", "formula", nil, 0.0, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.A != "" {
+		t.Errorf("min(Pos, 3) is the aggregate %s", e.A)
+	}
+	if got := compiledValues(e, nil, positions); got[0] != 1 || got[1] != 3 {
+		t.Errorf("min(Pos, 3) = %v", got)
+	}
+	if e, err := ParseExpr("1", "min(Pos)", "formula", nil, 0.0, "."); err != nil || e.A != "min" {
+		t.Errorf("min(Pos): %v", err)
+	}
+	for _, c := range []struct{ expr, err string }{
+		{"pct(Pos, 150)", "percentile 150 not in [0, 100]"},
+		{"pct(Pos, -1)", "percentile -1 not in [0, 100]"},
+		{"pct(Pos, Close)", "argument 2 of pct() needs a number"},
+		{"wmean(Pos)", "wmean() takes (value, value), got 1"},
+		{"hhi(Pos, 1)", "hhi() takes (value), got 2"},
+	} {
+		_, err := ParseExpr("1", c.expr, "formula", nil, 0.0, ".")
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, want %s", c.expr, err, c.err)
+		}
+	}
+	if _, err := ParseExpr("1", "pct(Pos, 100) + pct(Pos, 0)", "formula", nil, 0.0, "."); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,85 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The audit log is a file of json lines, one AuditEntry each, appended on
+// every permission checked action, allowed or denied.
+
+type AuditEntry struct {
+	Time    int64  `json:"time"`
+	User    string `json:"user"`
+	UserId  int    `json:"userId"`
+	Role    string `json:"role"`
+	Action  string `json:"action"`
+	Target  string `json:"target,omitempty"`
+	Allowed bool   `json:"allowed"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+var auditFile *os.File
+var auditLock sync.Mutex
+
+func OpenAudit(fn string) error {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLock.Lock()
+	auditFile = f
+	auditLock.Unlock()
+	return nil
+}
+
+func CloseAudit() {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFile != nil {
+		auditFile.Close()
+		auditFile = nil
+	}
+}
+
+func Audit(e *AuditEntry) {
+	e.Time = time.Now().Unix()
+	if !e.Allowed {
+		log.Printf("denied %s %s to %s (%d, %s)", e.Action, e.Target, e.User, e.UserId, e.Role)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Println("audit:", err)
+	}
+}
@@ -0,0 +1,201 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Breach struct {
+	Portfolio  string   `json:"portfolio"`
+	Risk       string   `json:"risk"`
+	Param      string   `json:"param"`
+	Group      string   `json:"group"`
+	Symbol     string   `json:"symbol,omitempty"` // for non-aggregate params
+	Value      float64  `json:"value"`
+	LowerBound *float64 `json:"lowerBound,omitempty"`
+	UpperBound *float64 `json:"upperBound,omitempty"`
+	TradeStop  bool     `json:"tradeStop"`
+	Overridden bool     `json:"overridden,omitempty"` // trade stop overridden
+	Ack        *Ack     `json:"ack,omitempty"`
+	Time       int64    `json:"time"`
+}
+
+// Ack of a breach, dropped once the breach is gone
+type Ack struct {
+	By      string `json:"by"`
+	Comment string `json:"comment,omitempty"`
+	Time    int64  `json:"time"`
+}
+
+// Override keeps a trade stop param from disabling accounts until Until
+type Override struct {
+	Portfolio string `json:"portfolio"`
+	Risk      string `json:"risk"`
+	Param     string `json:"param"`
+	Group     string `json:"group,omitempty"` // empty for all groups
+	By        string `json:"by"`
+	Reason    string `json:"reason,omitempty"`
+	Until     int64  `json:"until"`
+}
+
+// BreachKey identifies a breach across runs, risk is the display name
+func BreachKey(portfolio string, risk string, param string, group string, symbol string) string {
+	return strings.Join([]string{portfolio, risk, param, group, symbol}, "\x1f")
+}
+
+func (b *Breach) key() string {
+	return BreachKey(b.Portfolio, b.Risk, b.Param, b.Group, b.Symbol)
+}
+
+// acks and overrides are only changed between runs
+var breachAcks = make(map[int]map[string]*Ack)
+var tradeStopOverrides = make(map[int]map[string]*Override)
+
+// LatestBreaches holds the breaches found by the last RunUserPortfolios
+var LatestBreaches = make(map[int][]*Breach)
+
+var runningBreaches map[int][]*Breach
+var breachLock sync.Mutex
+
+func boundPtr(v float64) *float64 {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
+
+func addBreach(userId int, b *Breach) {
+	b.Time = time.Now().Unix()
+	b.Ack = breachAcks[userId][b.key()]
+	breachLock.Lock()
+	runningBreaches[userId] = append(runningBreaches[userId], b)
+	breachLock.Unlock()
+}
+
+// AckBreach acknowledges a breach of the last run
+func AckBreach(userId int, key string, by string, comment string) error {
+	for _, b := range LatestBreaches[userId] {
+		if b.key() != key {
+			continue
+		}
+		if breachAcks[userId] == nil {
+			breachAcks[userId] = make(map[string]*Ack)
+		}
+		b.Ack = &Ack{By: by, Comment: comment, Time: time.Now().Unix()}
+		breachAcks[userId][key] = b.Ack
+		return nil
+	}
+	return fmt.Errorf("no such breach")
+}
+
+// pruneBreaches drops the acks of breaches gone in the last run and expired
+// overrides
+func pruneBreaches() {
+	now := time.Now().Unix()
+	for _, overrides := range tradeStopOverrides {
+		for key, o := range overrides {
+			if o.Until <= now {
+				delete(overrides, key)
+			}
+		}
+	}
+	for userId, acks := range breachAcks {
+		current := make(map[string]bool)
+		for _, b := range LatestBreaches[userId] {
+			current[b.key()] = true
+		}
+		for key := range acks {
+			if !current[key] {
+				delete(acks, key)
+			}
+		}
+	}
+}
+
+// dropBreachAcks removes the acks of keys starting with prefix
+func dropBreachAcks(userId int, prefix string) {
+	prefix = strings.TrimRight(prefix, "\x1f") + "\x1f"
+	for key := range breachAcks[userId] {
+		if strings.HasPrefix(key, prefix) {
+			delete(breachAcks[userId], key)
+		}
+	}
+}
+
+// OverrideTradeStop o.Risk is the display name of a risk with a trade_stop
+// param o.Param, o.Until 0 removes the override
+func OverrideTradeStop(userId int, o *Override) error {
+	p := UserPortfolios[userId][o.Portfolio]
+	if p == nil {
+		return fmt.Errorf("unknown portfolio: %s", o.Portfolio)
+	}
+	found := false
+	for _, r := range p.RiskDefs {
+		if r.DisplayName != o.Risk {
+			continue
+		}
+		for _, rp := range r.Params {
+			if rp.Name == o.Param && rp.TradeStop {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no trade stop param: %s %s", o.Risk, o.Param)
+	}
+	key := BreachKey(o.Portfolio, o.Risk, o.Param, o.Group, "")
+	if o.Until == 0 {
+		delete(tradeStopOverrides[userId], key)
+		return nil
+	}
+	if tradeStopOverrides[userId] == nil {
+		tradeStopOverrides[userId] = make(map[string]*Override)
+	}
+	tradeStopOverrides[userId][key] = o
+	return nil
+}
+
+// TradeStopOverrides are the overrides in effect of a user
+func TradeStopOverrides(userId int) []*Override {
+	now := time.Now().Unix()
+	var out []*Override
+	for _, o := range tradeStopOverrides[userId] {
+		if o.Until > now {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+func tradeStopOverridden(userId int, portfolio string, risk string, param string, group string) bool {
+	now := time.Now().Unix()
+	for _, g := range []string{group, ""} {
+		if o := tradeStopOverrides[userId][BreachKey(portfolio, risk, param, g, "")]; o != nil && o.Until > now {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,620 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Expressions compile to closures reading a PositionView, a struct of
+// arrays of the position variables filled column by column as expressions
+// read them, instead of the map of every variable Evaluate fills for
+// govaluate per position and expression. What is only known when
+// evaluated, like values of call() or of type any, is left to govaluate.
+
+// positionVar is a variable Evaluate sets, of type number or string
+type positionVar struct {
+	name string
+	t    exprType
+	num  func(p *Position) float64
+	str  func(p *Position) string
+}
+
+func numberVar(name string, f func(p *Position) float64) positionVar {
+	return positionVar{name: name, t: typeNumber, num: f}
+}
+
+func stringVar(name string, f func(p *Position) string) positionVar {
+	return positionVar{name: name, t: typeString, str: f}
+}
+
+var positionVars = []positionVar{
+	stringVar("Symbol", func(p *Position) string { return p.Security.Symbol }),
+	stringVar("Sector", func(p *Position) string { return p.Security.Sector }),
+	stringVar("Industry", func(p *Position) string { return p.Security.Industry }),
+	stringVar("IndustryGroup", func(p *Position) string { return p.Security.IndustryGroup }),
+	stringVar("SubIndustry", func(p *Position) string { return p.Security.SubIndustry }),
+	stringVar("Market", func(p *Position) string { return p.Security.Market }),
+	stringVar("Type", func(p *Position) string { return p.Security.Type }),
+	stringVar("Currency", func(p *Position) string { return p.Security.Currency }),
+	numberVar("Multiplier", func(p *Position) float64 { return p.Security.Multiplier }),
+	numberVar("Rate", func(p *Position) float64 { return p.Security.Rate }),
+	numberVar("Adv20", func(p *Position) float64 { return p.Security.Adv20 }),
+	numberVar("MarketCap", func(p *Position) float64 { return p.Security.MarketCap }),
+	numberVar("PrevClose", func(p *Position) float64 { return p.Security.PrevClose }),
+	numberVar("Open", func(p *Position) float64 { return p.Security.Open }),
+	numberVar("High", func(p *Position) float64 { return p.Security.High }),
+	numberVar("Low", func(p *Position) float64 { return p.Security.Low }),
+	numberVar("Close", func(p *Position) float64 { return p.Security.GetClose() }),
+	numberVar("Qty", func(p *Position) float64 { return p.Security.Qty }),
+	numberVar("Vol", func(p *Position) float64 { return p.Security.Vol }),
+	numberVar("Vwap", func(p *Position) float64 { return p.Security.Vwap }),
+	numberVar("Ask", func(p *Position) float64 { return p.Security.Ask }),
+	numberVar("Bid", func(p *Position) float64 { return p.Security.Bid }),
+	numberVar("AskSize", func(p *Position) float64 { return p.Security.AskSize }),
+	numberVar("BidSize", func(p *Position) float64 { return p.Security.BidSize }),
+	numberVar("OutstandBuyQty", func(p *Position) float64 { return p.OutstandBuyQty }),
+	numberVar("OutstandSellQty", func(p *Position) float64 { return p.OutstandSellQty }),
+	numberVar("Acc", func(p *Position) float64 { return float64(p.Acc) }),
+	numberVar("Pos", func(p *Position) float64 { return p.Qty }),
+	numberVar("AvgPx", func(p *Position) float64 { return p.AvgPx }),
+	numberVar("Commission", func(p *Position) float64 { return p.Commission }),
+	numberVar("RealizedPnl", func(p *Position) float64 { return p.RealizedPnl }),
+	numberVar("BuyQty", func(p *Position) float64 { return p.BuyQty }),
+	numberVar("SellQty", func(p *Position) float64 { return p.SellQty }),
+	numberVar("BuyValue", func(p *Position) float64 { return p.BuyValue }),
+	numberVar("SellValue", func(p *Position) float64 { return p.SellValue }),
+	numberVar("Pos0", func(p *Position) float64 { return p.Bod.Qty }),
+	numberVar("AvgPx0", func(p *Position) float64 { return p.Bod.AvgPx }),
+	numberVar("Commission0", func(p *Position) float64 { return p.Bod.Commission }),
+	numberVar("RealizedPnl0", func(p *Position) float64 { return p.Bod.RealizedPnl }),
+	numberVar("Target", func(p *Position) float64 { return p.Target }),
+	numberVar("NaN", func(p *Position) float64 { return math.NaN() }),
+}
+
+var positionVarIndex = make(map[string]int)
+
+func init() {
+	for i, v := range positionVars {
+		positionVarIndex[v.name] = i
+	}
+}
+
+// column holds the values of a variable by position index, in the slice
+// of its type
+type column struct {
+	num []float64
+	str []string
+	b   []bool
+	any []interface{}
+}
+
+func (self *column) value(i int) interface{} {
+	switch {
+	case self.num != nil:
+		return self.num[i]
+	case self.str != nil:
+		return self.str[i]
+	case self.b != nil:
+		return self.b[i]
+	case self.any != nil:
+		return self.any[i]
+	}
+	return nil
+}
+
+// PositionView is the struct of arrays of positions compiled expressions
+// read, not safe for concurrent use
+type PositionView struct {
+	Positions []*Position
+	cols      []*column // by positionVars index
+	all       []int
+}
+
+func NewPositionView(positions []*Position) *PositionView {
+	return &PositionView{Positions: positions, cols: make([]*column, len(positionVars))}
+}
+
+func (self *PositionView) column(id int) *column {
+	c := self.cols[id]
+	if c != nil {
+		return c
+	}
+	v := positionVars[id]
+	c = &column{}
+	if v.num != nil {
+		c.num = make([]float64, len(self.Positions))
+		for i, p := range self.Positions {
+			c.num[i] = v.num(p)
+		}
+	} else {
+		c.str = make([]string, len(self.Positions))
+		for i, p := range self.Positions {
+			c.str[i] = v.str(p)
+		}
+	}
+	self.cols[id] = c
+	return c
+}
+
+// Indexes are those of all the positions
+func (self *PositionView) Indexes() []int {
+	if self.all == nil {
+		self.all = make([]int, len(self.Positions))
+		for i := range self.all {
+			self.all[i] = i
+		}
+	}
+	return self.all
+}
+
+// Numbers evaluates e at the positions idx, NaN where its value is not a
+// number
+func (self *PositionView) Numbers(e *Expression, idx []int) []float64 {
+	env := &exprEnv{view: self}
+	return env.numbers(e, idx, make([]float64, 0, len(idx)))
+}
+
+// Compiled tells if e runs as closures rather than with govaluate
+func (e *Expression) Compiled() bool {
+	return e.X != nil
+}
+
+// node is a compiled expression of type t, its closure of the type is nil
+// if it is left to govaluate
+type node struct {
+	t    exprType
+	num  func(e *exprEnv) float64
+	b    func(e *exprEnv) bool
+	str  func(e *exprEnv) string
+	re   *regexp.Regexp // of a literal pattern
+	lit  interface{}    // value of a literal
+	list []*node        // of (a, b, c)
+	set  *symbolList    // of list("file.csv")
+	cond *node          // of c ? x without :, nil when c is false
+	then *node
+}
+
+func numberNode(f func(e *exprEnv) float64) *node {
+	return &node{t: typeNumber, num: f}
+}
+
+func boolNode(f func(e *exprEnv) bool) *node {
+	return &node{t: typeBool, b: f}
+}
+
+func stringNode(f func(e *exprEnv) string) *node {
+	return &node{t: typeString, str: f}
+}
+
+func compiled(nodes ...*node) bool {
+	for _, n := range nodes {
+		switch {
+		case n.t == typeNumber && n.num != nil:
+		case n.t == typeBool && n.b != nil:
+		case n.t == typeString && n.str != nil:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (self *node) value(e *exprEnv) interface{} {
+	switch self.t {
+	case typeNumber:
+		return self.num(e)
+	case typeBool:
+		return self.b(e)
+	}
+	return self.str(e)
+}
+
+// exprRef is a variable of positionVars, pos its index, or a [[[var]]]
+// with pos -1
+type exprRef struct {
+	name string
+	pos  int
+}
+
+type compiledExpr struct {
+	root *node
+	refs []exprRef // columns of exprEnv
+}
+
+// exprEnv evaluates expressions at position i of view, vars are the
+// columns of [[[var]]] variables
+type exprEnv struct {
+	view *PositionView
+	vars map[string]*column
+	cols []*column // of the refs of the compiled expression
+	i    int
+	// of the run of a param for a group
+	group  string
+	all    []int                                // positions of total()
+	values map[*RiskParamDef]map[string]float64 // by group, of ref()
+	totals map[*Expression]interface{}          // of total() once by run
+	span   []int                                // positions vars are filled at
+}
+
+// bind sets cols to the refs of x, false if a variable is missing
+func (self *exprEnv) bind(x *compiledExpr) bool {
+	self.cols = self.cols[:0]
+	for _, r := range x.refs {
+		var c *column
+		if r.pos >= 0 {
+			c = self.view.column(r.pos)
+		} else {
+			c = self.vars[r.name]
+		}
+		if c == nil {
+			return false
+		}
+		self.cols = append(self.cols, c)
+	}
+	return true
+}
+
+// params are the variables of govaluate at position i
+func (self *exprEnv) params(i int) map[string]interface{} {
+	params := make(map[string]interface{}, len(positionVars)+len(self.vars))
+	for name, c := range self.vars {
+		params[name] = c.value(i)
+	}
+	return params
+}
+
+// eval evaluates e at position i, nil on errors
+func (self *exprEnv) eval(e *Expression, i int) interface{} {
+	if x := e.X; x != nil && self.bind(x) {
+		self.i = i
+		return x.root.value(self)
+	}
+	v, _ := Evaluate(e, self.view.Positions[i], self.params(i))
+	return v
+}
+
+// numbers appends the values of e at the positions idx to out, NaN for
+// values that are not numbers
+func (self *exprEnv) numbers(e *Expression, idx []int, out []float64) []float64 {
+	if x := e.X; x != nil && x.root.num != nil && self.bind(x) {
+		f := x.root.num
+		for _, i := range idx {
+			self.i = i
+			out = append(out, f(self))
+		}
+		return out
+	}
+	for _, i := range idx {
+		v, ok := self.eval(e, i).(float64)
+		if !ok {
+			// nil of c ? x, or an any typed variable
+			v = math.NaN()
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// conditions appends 1 for the positions idx where e is true, else 0, to
+// out
+func (self *exprEnv) conditions(e *Expression, idx []int, out []float64) []float64 {
+	for _, i := range idx {
+		v := 0.
+		if ok, _ := self.test(e, i); ok {
+			v = 1
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// test tells if e is true at position i, and if it is a bool at all
+func (self *exprEnv) test(e *Expression, i int) (bool, bool) {
+	if x := e.X; x != nil && x.root.b != nil && self.bind(x) {
+		self.i = i
+		return x.root.b(self), true
+	}
+	v, ok := self.eval(e, i).(bool)
+	return v, ok
+}
+
+// fill evaluates e of a [[[var]]] at the positions idx into a column
+func (self *exprEnv) fill(e *Expression, idx []int) *column {
+	n := len(self.view.Positions)
+	c := &column{}
+	switch e.T {
+	case typeNumber:
+		c.num = make([]float64, n)
+		values := self.numbers(e, idx, make([]float64, 0, len(idx)))
+		for j, i := range idx {
+			c.num[i] = values[j]
+		}
+	case typeBool:
+		c.b = make([]bool, n)
+		for _, i := range idx {
+			c.b[i], _ = self.test(e, i)
+		}
+	case typeString:
+		c.str = make([]string, n)
+		for _, i := range idx {
+			c.str[i], _ = self.eval(e, i).(string)
+		}
+	default:
+		c.any = make([]interface{}, n)
+		for _, i := range idx {
+			c.any[i] = self.eval(e, i)
+		}
+	}
+	return c
+}
+
+// constColumn has value at the positions idx, of an aggregate [[[var]]]
+func (self *exprEnv) constColumn(value interface{}, idx []int) *column {
+	c := &column{}
+	n := len(self.view.Positions)
+	if v, ok := value.(float64); ok {
+		c.num = make([]float64, n)
+		for _, i := range idx {
+			c.num[i] = v
+		}
+	} else {
+		c.any = make([]interface{}, n)
+		for _, i := range idx {
+			c.any[i] = value
+		}
+	}
+	return c
+}
+
+func compileRef(k int, t exprType) *node {
+	switch t {
+	case typeNumber:
+		return numberNode(func(e *exprEnv) float64 { return e.cols[k].num[e.i] })
+	case typeBool:
+		return boolNode(func(e *exprEnv) bool { return e.cols[k].b[e.i] })
+	case typeString:
+		return stringNode(func(e *exprEnv) string { return e.cols[k].str[e.i] })
+	}
+	return &node{t: t}
+}
+
+func compileLiteral(tok govaluate.ExpressionToken) *node {
+	switch v := tok.Value.(type) {
+	case float64:
+		return numberNode(func(*exprEnv) float64 { return v })
+	case bool:
+		return boolNode(func(*exprEnv) bool { return v })
+	case string:
+		n := stringNode(func(*exprEnv) string { return v })
+		n.lit = v
+		return n
+	case *regexp.Regexp:
+		n := stringNode(func(*exprEnv) string { return v.String() })
+		n.re = v
+		return n
+	case time.Time:
+		// govaluate reads dates as unix seconds
+		secs := float64(v.Unix())
+		return numberNode(func(*exprEnv) float64 { return secs })
+	}
+	return &node{t: typeAny}
+}
+
+func compileTernary(c *node, x *node, y *node) (*node, error) {
+	t, err := sameType(x.t, y.t, "? :")
+	if err != nil || !compiled(c, x, y) {
+		return &node{t: t}, err
+	}
+	cond := c.b
+	switch t {
+	case typeNumber:
+		a, b := x.num, y.num
+		return numberNode(func(e *exprEnv) float64 {
+			if cond(e) {
+				return a(e)
+			}
+			return b(e)
+		}), nil
+	case typeBool:
+		a, b := x.b, y.b
+		return boolNode(func(e *exprEnv) bool {
+			if cond(e) {
+				return a(e)
+			}
+			return b(e)
+		}), nil
+	}
+	a, b := x.str, y.str
+	return stringNode(func(e *exprEnv) string {
+		if cond(e) {
+			return a(e)
+		}
+		return b(e)
+	}), nil
+}
+
+func compileLogical(op string, x *node, y *node) *node {
+	if !compiled(x, y) {
+		return &node{t: typeBool}
+	}
+	a, b := x.b, y.b
+	if op == "&&" {
+		return boolNode(func(e *exprEnv) bool { return a(e) && b(e) })
+	}
+	return boolNode(func(e *exprEnv) bool { return a(e) || b(e) })
+}
+
+func compileComparison(op string, x *node, y *node) *node {
+	out := &node{t: typeBool}
+	switch {
+	case op == "in" && y.set != nil:
+		if !compiled(x) {
+			return out
+		}
+		if x.t != typeString {
+			// the values of list files are strings
+			out.b = func(*exprEnv) bool { return false }
+			return out
+		}
+		a, l := x.str, y.set
+		out.b = func(e *exprEnv) bool {
+			_, set := l.get()
+			return set[a(e)]
+		}
+	case op == "in":
+		if !compiled(x) || y.t != typeList || !compiled(y.list...) {
+			return out
+		}
+		var items []*node
+		for _, item := range y.list {
+			// others are never equal
+			if item.t == x.t {
+				items = append(items, item)
+			}
+		}
+		eqs := make([]func(e *exprEnv) bool, len(items))
+		for i, item := range items {
+			eqs[i] = compileComparison("==", x, item).b
+		}
+		out.b = func(e *exprEnv) bool {
+			for _, eq := range eqs {
+				if eq(e) {
+					return true
+				}
+			}
+			return false
+		}
+	case op == "=~" || op == "!~":
+		if !compiled(x) || y.re == nil {
+			// patterns of variables may not compile
+			return out
+		}
+		a, re := x.str, y.re
+		not := op == "!~"
+		out.b = func(e *exprEnv) bool { return re.MatchString(a(e)) != not }
+	case !compiled(x, y) || x.t != y.t:
+		// comparing types that differ is refused or of any
+	case x.t == typeNumber:
+		a, b := x.num, y.num
+		out.b = map[string]func(e *exprEnv) bool{
+			"==": func(e *exprEnv) bool { return a(e) == b(e) },
+			"!=": func(e *exprEnv) bool { return a(e) != b(e) },
+			"<":  func(e *exprEnv) bool { return a(e) < b(e) },
+			"<=": func(e *exprEnv) bool { return a(e) <= b(e) },
+			">":  func(e *exprEnv) bool { return a(e) > b(e) },
+			">=": func(e *exprEnv) bool { return a(e) >= b(e) },
+		}[op]
+	case x.t == typeString:
+		a, b := x.str, y.str
+		out.b = map[string]func(e *exprEnv) bool{
+			"==": func(e *exprEnv) bool { return a(e) == b(e) },
+			"!=": func(e *exprEnv) bool { return a(e) != b(e) },
+			"<":  func(e *exprEnv) bool { return a(e) < b(e) },
+			"<=": func(e *exprEnv) bool { return a(e) <= b(e) },
+			">":  func(e *exprEnv) bool { return a(e) > b(e) },
+			">=": func(e *exprEnv) bool { return a(e) >= b(e) },
+		}[op]
+	case x.t == typeBool:
+		a, b := x.b, y.b
+		out.b = map[string]func(e *exprEnv) bool{
+			"==": func(e *exprEnv) bool { return a(e) == b(e) },
+			"!=": func(e *exprEnv) bool { return a(e) != b(e) },
+		}[op]
+	}
+	return out
+}
+
+// compileConcat joins values as govaluate with %v when one is a string
+func compileConcat(x *node, y *node) *node {
+	if !compiled(x, y) {
+		return &node{t: typeString}
+	}
+	a, b := x.stringer(), y.stringer()
+	return stringNode(func(e *exprEnv) string { return a(e) + b(e) })
+}
+
+func (self *node) stringer() func(e *exprEnv) string {
+	if self.t == typeNumber {
+		f := self.num
+		return func(e *exprEnv) string { return fmt.Sprint(f(e)) }
+	}
+	return self.str
+}
+
+func compileArithmetic(op string, x *node, y *node) *node {
+	if !compiled(x, y) {
+		return &node{t: typeNumber}
+	}
+	a, b := x.num, y.num
+	var f func(e *exprEnv) float64
+	switch op {
+	case "+":
+		f = func(e *exprEnv) float64 { return a(e) + b(e) }
+	case "-":
+		f = func(e *exprEnv) float64 { return a(e) - b(e) }
+	case "*":
+		f = func(e *exprEnv) float64 { return a(e) * b(e) }
+	case "/":
+		f = func(e *exprEnv) float64 { return a(e) / b(e) }
+	case "%":
+		f = func(e *exprEnv) float64 { return math.Mod(a(e), b(e)) }
+	case "**":
+		f = func(e *exprEnv) float64 { return math.Pow(a(e), b(e)) }
+	case "&":
+		f = func(e *exprEnv) float64 { return float64(int64(a(e)) & int64(b(e))) }
+	case "|":
+		f = func(e *exprEnv) float64 { return float64(int64(a(e)) | int64(b(e))) }
+	case "^":
+		f = func(e *exprEnv) float64 { return float64(int64(a(e)) ^ int64(b(e))) }
+	case "<<":
+		f = func(e *exprEnv) float64 { return float64(uint64(a(e)) << uint64(b(e))) }
+	case ">>":
+		f = func(e *exprEnv) float64 { return float64(uint64(a(e)) >> uint64(b(e))) }
+	default:
+		return &node{t: typeNumber}
+	}
+	return numberNode(f)
+}
+
+func compilePrefix(op string, x *node) *node {
+	if !compiled(x) {
+		if op == "!" {
+			return &node{t: typeBool}
+		}
+		return &node{t: typeNumber}
+	}
+	switch op {
+	case "-":
+		a := x.num
+		return numberNode(func(e *exprEnv) float64 { return -a(e) })
+	case "~":
+		a := x.num
+		return numberNode(func(e *exprEnv) float64 { return float64(^int64(a(e))) })
+	}
+	a := x.b
+	return boolNode(func(e *exprEnv) bool { return !a(e) })
+}
@@ -0,0 +1,189 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var benchFormulas = []string{
+	"Pos * Close * Multiplier * Rate",
+	"RealizedPnl + (Close - AvgPx) * Pos * Multiplier * Rate",
+	"abs(Pos) * Close / max(Adv20, 1)",
+	"Market == 'SH' && Sector != 'Energy' ? Pos * Close : 0",
+	"Pos > 0 ? Pos * Close",
+	"strlen(Symbol) + (Symbol + Market == 'S1SH' ? 1 : 0)",
+}
+
+var benchMarkets = []string{"SH", "SZ", "HK", "US"}
+var benchSectors = []string{"Energy", "Materials", "Industrials", "Financials", "Utilities"}
+
+// testBook has n random positions, the same for the same n
+func testBook(n int) []*Position {
+	r := rand.New(rand.NewSource(1))
+	out := make([]*Position, n)
+	for i := range out {
+		s := &Security{
+			Symbol:     fmt.Sprintf("S%d", i),
+			Market:     benchMarkets[r.Intn(len(benchMarkets))],
+			Sector:     benchSectors[r.Intn(len(benchSectors))],
+			Type:       "STK",
+			Currency:   "USD",
+			Multiplier: 1,
+			Rate:       1,
+			PrevClose:  10 + r.Float64()*100,
+			Adv20:      r.Float64() * 1e6,
+		}
+		s.Close = s.PrevClose * (0.9 + r.Float64()*0.2)
+		p := &Position{Security: s, Acc: r.Intn(10)}
+		p.Qty = float64(r.Intn(20000) - 10000)
+		p.AvgPx = s.PrevClose
+		p.RealizedPnl = r.NormFloat64() * 1000
+		if i%3 > 0 {
+			p.BuyQty = float64(r.Intn(1000))
+			p.BuyValue = p.BuyQty * s.Close
+			p.SellQty = float64(r.Intn(1000))
+			p.SellValue = p.SellQty * s.Close * 1.01
+			p.OutstandBuyQty = float64(r.Intn(100))
+		}
+		out[i] = p
+	}
+	return out
+}
+
+// govaluated is the evaluation before compiling, a map per position with
+// the variables evaluated before
+func govaluated(e *Expression, vars []NameExpression, positions []*Position) []float64 {
+	out := make([]float64, 0, len(positions))
+	for _, p := range positions {
+		params := make(map[string]interface{}, 60)
+		for _, v := range vars {
+			params[v.Name], _ = Evaluate(v.E, p, params)
+		}
+		v, _ := Evaluate(e, p, params)
+		f, ok := v.(float64)
+		if !ok {
+			f = math.NaN()
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+func compiledValues(e *Expression, vars []NameExpression, positions []*Position) []float64 {
+	view := NewPositionView(positions)
+	env := &exprEnv{view: view, vars: map[string]*column{}}
+	for _, v := range vars {
+		env.vars[v.Name] = env.fill(v.E, view.Indexes())
+	}
+	return env.numbers(e, view.Indexes(), make([]float64, 0, len(positions)))
+}
+
+func checkSame(t *testing.T, what string, a []float64, b []float64) {
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			t.Errorf("%s: %v instead of %v at position %d", what, b[i], a[i], i)
+			return
+		}
+	}
+}
+
+func parseBenchFormula(tb testing.TB, f string) *Expression {
+	e, err := ParseExpr("1", f, "formula", nil, nil, ".")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !e.Compiled() {
+		tb.Fatalf("%s is not compiled", f)
+	}
+	return e
+}
+
+func TestCompiledFormulas(t *testing.T) {
+	positions := testBook(1000)
+	for _, f := range benchFormulas {
+		e := parseBenchFormula(t, f)
+		checkSame(t, f, govaluated(e, nil, positions), compiledValues(e, nil, positions))
+	}
+}
+
+func TestCompiledTemplate(t *testing.T) {
+	cfg, err := ParseIniFile("template.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePortfolio(cfg, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := testBook(1000)
+	n := 0
+	for _, r := range p.RiskDefs {
+		for _, g := range r.Groups {
+			if e, ok := g.(*Expression); ok {
+				checkSame(t, r.Name+" group", govaluated(e, nil, positions), compiledValues(e, nil, positions))
+			}
+		}
+		for _, rp := range r.Params {
+			for i, v := range rp.Variables {
+				what := r.Name + "." + rp.Name + " " + v.Name
+				checkSame(t, what, govaluated(v.E, rp.Variables[:i], positions), compiledValues(v.E, rp.Variables[:i], positions))
+			}
+			what := r.Name + "." + rp.Name
+			checkSame(t, what, govaluated(rp.Formula, rp.Variables, positions), compiledValues(rp.Formula, rp.Variables, positions))
+			if rp.Formula.Compiled() {
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		t.Error("no formula of template.ini is compiled")
+	}
+}
+
+func BenchmarkEvaluateGovaluate(b *testing.B) {
+	positions := testBook(10000)
+	for _, f := range benchFormulas {
+		e := parseBenchFormula(b, f)
+		b.Run(f, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				govaluated(e, nil, positions)
+			}
+		})
+	}
+}
+
+func BenchmarkEvaluateCompiled(b *testing.B) {
+	positions := testBook(10000)
+	for _, f := range benchFormulas {
+		e := parseBenchFormula(b, f)
+		b.Run(f, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				compiledValues(e, nil, positions)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+// diffOp is ' ' for a line in both, '-' only in a and '+' only in b
+type diffOp struct {
+	Op   byte
+	Line string
+}
+
+// noNewline ends a last line without a newline, so that it differs from
+// the same line with one and is written as in diff -u
+const noNewline = "\n\\ No newline at end of file"
+
+func splitLines(str string) []string {
+	if str == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(str, "\n"), "\n")
+	if !strings.HasSuffix(str, "\n") {
+		lines[len(lines)-1] += noNewline
+	}
+	return lines
+}
+
+// diffLines is the shortest edit script from a to b, the linear space
+// variant of Myers' algorithm, splitting at the middle snake of the forward
+// and reverse paths
+func diffLines(a []string, b []string) []diffOp {
+	out := make([]diffOp, 0, len(a)+len(b))
+	return diffRange(a, b, out)
+}
+
+// a range needing more than diffMaxCost edits on either side of its middle
+// snake is given as all of a removed and all of b added, so that diffing two
+// large unrelated files takes O((n+m)*diffMaxCost) time
+var diffMaxCost = 1024
+
+func diffRange(a []string, b []string, out []diffOp) []diffOp {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		out = append(out, diffOp{' ', a[i]})
+		i++
+	}
+	a, b = a[i:], b[i:]
+	j := 0
+	for j < len(a) && j < len(b) && a[len(a)-1-j] == b[len(b)-1-j] {
+		j++
+	}
+	suffix := a[len(a)-j:]
+	a, b = a[:len(a)-j], b[:len(b)-j]
+	if len(a) == 0 || len(b) == 0 {
+		out = appendOps(out, '-', a)
+		out = appendOps(out, '+', b)
+	} else if x, y, u, v, ok := middleSnake(a, b); !ok {
+		out = appendOps(out, '-', a)
+		out = appendOps(out, '+', b)
+	} else {
+		out = diffRange(a[:x], b[:y], out)
+		out = appendOps(out, ' ', a[x:u])
+		out = diffRange(a[u:], b[v:], out)
+	}
+	return appendOps(out, ' ', suffix)
+}
+
+func appendOps(out []diffOp, op byte, lines []string) []diffOp {
+	for _, line := range lines {
+		out = append(out, diffOp{op, line})
+	}
+	return out
+}
+
+// middleSnake is the diagonal a[x:u] == b[y:v] in the middle of a shortest
+// edit script, a and b not empty and different in their first and last
+// lines, false if it is more than diffMaxCost edits from either end
+func middleSnake(a []string, b []string) (x, y, u, v int, ok bool) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta&1 != 0
+	max := (n + m + 1) / 2
+	if max > diffMaxCost {
+		max = diffMaxCost
+	}
+	// vf[k] is the furthest x on diagonal k = x - y from (0, 0), vb[k] the
+	// furthest distance back on diagonal k from (n, m)
+	offset := max + 1
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			vf[offset+k] = u
+			if kb := delta - k; odd && kb >= -(d-1) && kb <= d-1 && u+vb[offset+kb] >= n {
+				return x, y, u, v, true
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var bx int
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				bx = vb[offset+k+1]
+			} else {
+				bx = vb[offset+k-1] + 1
+			}
+			by := bx - k
+			ex, ey := bx, by
+			for ex < n && ey < m && a[n-1-ex] == b[m-1-ey] {
+				ex++
+				ey++
+			}
+			vb[offset+k] = ex
+			if kf := delta - k; !odd && kf >= -d && kf <= d && ex+vf[offset+kf] >= n {
+				return n - ex, m - ey, n - bx, m - by, true
+			}
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+// UnifiedDiff of a and b, empty if they are the same
+func UnifiedDiff(a string, b string, nameA string, nameB string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].Op == ' ' {
+			i++
+			continue
+		}
+		// a hunk from diffContext lines before the change to diffContext
+		// lines after the last change closer than 2*diffContext
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].Op != ' ' {
+				end = j
+			} else if j-end > 2*diffContext {
+				break
+			}
+		}
+		end += diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		lineA, lineB := 1, 1
+		for _, op := range ops[:start] {
+			if op.Op != '+' {
+				lineA++
+			}
+			if op.Op != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[start:end] {
+			if op.Op != '+' {
+				countA++
+			}
+			if op.Op != '-' {
+				countB++
+			}
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		if countA == 0 {
+			lineA--
+		}
+		if countB == 0 {
+			lineB--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.Op)
+			sb.WriteString(op.Line)
+			sb.WriteByte('\n')
+		}
+		i = end
+	}
+	return sb.String()
+}
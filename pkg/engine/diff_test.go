@@ -0,0 +1,189 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func editScript(ops []diffOp) string {
+	var out []string
+	for _, op := range ops {
+		out = append(out, string(op.Op)+op.Line)
+	}
+	return strings.Join(out, " ")
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, c := range []struct{ a, b, want string }{
+		{"", "", ""},
+		{"a b c", "a b c", " a  b  c"},
+		{"", "a b", "+a +b"},
+		{"a b", "", "-a -b"},
+		{"a b c a b b a", "c b a b a c", "-a +c  b -c  a  b -b  a +c"},
+		{"x a b c", "a b c y", "-x  a  b  c +y"},
+		{"a b c", "a x c", " a -b +x  c"},
+	} {
+		got := editScript(diffLines(strings.Fields(c.a), strings.Fields(c.b)))
+		if got != c.want {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+// lcs is the length of the longest common subsequence, a shortest edit
+// script has len(a) + len(b) - 2 * lcs edits
+func lcs(a []string, b []string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else if prev[j+1] > cur[j] {
+				cur[j+1] = prev[j+1]
+			} else {
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func checkScript(t *testing.T, a []string, b []string, ops []diffOp) int {
+	var x, y []string
+	edits := 0
+	for _, op := range ops {
+		if op.Op != '+' {
+			x = append(x, op.Line)
+		}
+		if op.Op != '-' {
+			y = append(y, op.Line)
+		}
+		if op.Op != ' ' {
+			edits++
+		}
+	}
+	if strings.Join(x, "\n") != strings.Join(a, "\n") || strings.Join(y, "\n") != strings.Join(b, "\n") {
+		t.Fatalf("edit script of %v to %v does not give them: %s", a, b, editScript(ops))
+	}
+	return edits
+}
+
+func TestDiffLinesShortest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		out := make([]string, r.Intn(30))
+		for i := range out {
+			out[i] = strconv.Itoa(r.Intn(4))
+		}
+		return out
+	}
+	for i := 0; i < 500; i++ {
+		a, b := lines(), lines()
+		edits := checkScript(t, a, b, diffLines(a, b))
+		if want := len(a) + len(b) - 2*lcs(a, b); edits != want {
+			t.Fatalf("diffLines(%v, %v) has %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func TestDiffLinesUnrelated(t *testing.T) {
+	defer func(n int) { diffMaxCost = n }(diffMaxCost)
+	diffMaxCost = 16
+	var a, b []string
+	for i := 0; i < 1000; i++ {
+		a = append(a, "a"+strconv.Itoa(i))
+		b = append(b, "b"+strconv.Itoa(i))
+	}
+	b[500] = a[500]
+	if edits := checkScript(t, a, b, diffLines(a, b)); edits != 2000 {
+		t.Errorf("unrelated diff has %d edits, want all lines replaced", edits)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\n3\n4\n5\nsix\n7\n8\n9\n10\n11\n12\n13\n"
+	c := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	want := `--- a
++++ b
+@@ -3,10 +3,11 @@
+ 3
+ 4
+ 5
+-6
++six
+ 7
+ 8
+ 9
+ 10
+ 11
+ 12
++13
+`
+	if got := UnifiedDiff(a, b, "a", "b"); got != want {
+		t.Errorf("UnifiedDiff = %q, want %q", got, want)
+	}
+	// changes more than 2*diffContext lines apart are separate hunks
+	want = `--- a
++++ c
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+`
+	if got := UnifiedDiff(a, c+"13\n", "a", "c"); got != want {
+		t.Errorf("UnifiedDiff = %q, want %q", got, want)
+	}
+	if got := UnifiedDiff(a, a, "a", "b"); got != "" {
+		t.Errorf("UnifiedDiff of the same = %q", got)
+	}
+}
+
+func TestUnifiedDiffNewline(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want string
+	}{
+		{"x\ny\n", "x\ny", "--- a\n+++ b\n@@ -1,2 +1,2 @@\n x\n-y\n+y\n\\ No newline at end of file\n"},
+		{"x\ny", "x\ny\n", "--- a\n+++ b\n@@ -1,2 +1,2 @@\n x\n-y\n\\ No newline at end of file\n+y\n"},
+		{"x\ny", "z\ny", "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-x\n+z\n y\n\\ No newline at end of file\n"},
+		{"", "x", "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+x\n\\ No newline at end of file\n"},
+		{"x", "x", ""},
+		{"\n", "", "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-\n"},
+	} {
+		if got := UnifiedDiff(c.a, c.b, "a", "b"); got != c.want {
+			t.Errorf("UnifiedDiff(%q, %q) = %q, want %q", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A draft of a portfolio file is saved without touching the live portfolios,
+// submitted for approval (pending) and activated by another user, when it is
+// saved as a new version of the file and removed. A draft per file is kept
+// in the versions database, under the user id owning the file, which is not
+// the user id of the approver.
+
+const (
+	DraftStateDraft   = "draft"
+	DraftStatePending = "pending"
+)
+
+var ErrSameApprover = errors.New("a draft can not be approved by its author")
+var ErrAnonymousApprover = errors.New("a draft needs a named author and approver")
+
+type Draft struct {
+	Fn         string `json:"fn"`
+	Owner      int    `json:"owner"` // the user id of the file
+	Content    string `json:"content,omitempty"`
+	Author     string `json:"author"`
+	Comment    string `json:"comment,omitempty"`
+	State      string `json:"state"`
+	Time       int64  `json:"time"`
+	Submitted  int64  `json:"submitted,omitempty"`
+	RejectedBy string `json:"rejectedBy,omitempty"`
+	Rejection  string `json:"rejection,omitempty"`
+}
+
+// LimitChange is an effective setting of a portfolio, risk or param changed
+// by a draft, Param and Risk empty for portfolio settings
+type LimitChange struct {
+	Portfolio string `json:"portfolio"`
+	Risk      string `json:"risk,omitempty"`
+	Param     string `json:"param,omitempty"`
+	Key       string `json:"key"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+}
+
+var draftsBucket = []byte("drafts")
+
+func draftBucket(tx *bolt.Tx, userId int, create bool) (*bolt.Bucket, error) {
+	if !create {
+		b := tx.Bucket(draftsBucket)
+		if b == nil {
+			return nil, nil
+		}
+		return b.Bucket([]byte(strconv.Itoa(userId))), nil
+	}
+	b, err := tx.CreateBucketIfNotExists(draftsBucket)
+	if err != nil {
+		return nil, err
+	}
+	return b.CreateBucketIfNotExists([]byte(strconv.Itoa(userId)))
+}
+
+func putDraft(userId int, d *Draft) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return versionsDb.Update(func(tx *bolt.Tx) error {
+		b, err := draftBucket(tx, userId, true)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(d.Fn), data)
+	})
+}
+
+// GetDraft returns the draft of fn
+func GetDraft(userId int, fn string) (*Draft, error) {
+	if versionsDb == nil {
+		return nil, fmt.Errorf("versions are not enabled")
+	}
+	var d *Draft
+	err := versionsDb.View(func(tx *bolt.Tx) error {
+		b, _ := draftBucket(tx, userId, false)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(fn))
+		if v == nil {
+			return nil
+		}
+		d = &Draft{Owner: userId}
+		return json.Unmarshal(v, d)
+	})
+	if err == nil && d == nil {
+		err = fmt.Errorf("no draft of %s", fn)
+	}
+	return d, err
+}
+
+// Drafts of a user without their content, sorted by file name
+func Drafts(userId int) ([]*Draft, error) {
+	if versionsDb == nil {
+		return nil, fmt.Errorf("versions are not enabled")
+	}
+	out := []*Draft{}
+	err := versionsDb.View(func(tx *bolt.Tx) error {
+		b, _ := draftBucket(tx, userId, false)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			d := &Draft{Owner: userId}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			d.Content = ""
+			out = append(out, d)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// PendingDrafts are the pending drafts of users other than except, without
+// their content, sorted by owner and file name, for approvers
+func PendingDrafts(except int) ([]*Draft, error) {
+	if versionsDb == nil {
+		return nil, fmt.Errorf("versions are not enabled")
+	}
+	out := []*Draft{}
+	err := versionsDb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(draftsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			userId, err := strconv.Atoi(string(k))
+			if err != nil || userId == except {
+				return nil
+			}
+			return b.Bucket(k).ForEach(func(k, v []byte) error {
+				d := &Draft{Owner: userId}
+				if err := json.Unmarshal(v, d); err != nil {
+					return err
+				}
+				if d.State == DraftStatePending {
+					d.Content = ""
+					out = append(out, d)
+				}
+				return nil
+			})
+		})
+	})
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Owner < out[j].Owner })
+	return out, err
+}
+
+// SaveDraft replaces the draft of fn, a pending one goes back to draft
+func SaveDraft(userId int, fn string, content string, author string, comment string) (*Draft, error) {
+	if versionsDb == nil {
+		return nil, fmt.Errorf("versions are not enabled")
+	}
+	if !IsPortfolioFile(fn) {
+		return nil, fmt.Errorf("drafts are only for portfolio files: %s", fn)
+	}
+	d := &Draft{
+		Fn:      fn,
+		Owner:   userId,
+		Content: content,
+		Author:  author,
+		Comment: comment,
+		State:   DraftStateDraft,
+		Time:    time.Now().Unix(),
+	}
+	return d, putDraft(userId, d)
+}
+
+// SubmitDraft asks for approval of the draft of fn
+func SubmitDraft(userId int, fn string) (*Draft, error) {
+	d, err := GetDraft(userId, fn)
+	if err != nil {
+		return nil, err
+	}
+	if d.State != DraftStateDraft {
+		return nil, fmt.Errorf("draft of %s is %s", fn, d.State)
+	}
+	d.State = DraftStatePending
+	d.Submitted = time.Now().Unix()
+	d.RejectedBy, d.Rejection = "", ""
+	return d, putDraft(userId, d)
+}
+
+// RejectDraft sends a pending draft of the user userId back to its author
+func RejectDraft(userId int, fn string, by string, comment string) (*Draft, error) {
+	d, err := GetDraft(userId, fn)
+	if err != nil {
+		return nil, err
+	}
+	if d.State != DraftStatePending {
+		return nil, fmt.Errorf("draft of %s is not pending", fn)
+	}
+	d.State = DraftStateDraft
+	d.Submitted = 0
+	d.RejectedBy, d.Rejection = by, comment
+	return d, putDraft(userId, d)
+}
+
+func DiscardDraft(userId int, fn string) error {
+	if _, err := GetDraft(userId, fn); err != nil {
+		return err
+	}
+	return versionsDb.Update(func(tx *bolt.Tx) error {
+		b, err := draftBucket(tx, userId, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.Delete([]byte(fn))
+	})
+}
+
+// ApproveDraft activates the pending draft of fn of the user userId, saved as
+// a version by its author, by has to be someone else and both have names
+func ApproveDraft(userId int, fn string, by string, comment string) (*Draft, error) {
+	d, err := GetDraft(userId, fn)
+	if err != nil {
+		return nil, err
+	}
+	if d.State != DraftStatePending {
+		return nil, fmt.Errorf("draft of %s is not pending", fn)
+	}
+	if by == "" || d.Author == "" {
+		return nil, ErrAnonymousApprover
+	}
+	if by == d.Author {
+		return nil, ErrSameApprover
+	}
+	msg := "approved by " + by
+	if d.Comment != "" {
+		msg = d.Comment + ", " + msg
+	}
+	if comment != "" {
+		msg += ": " + comment
+	}
+	if err := SaveFile(userId, fn, d.Content, d.Author, msg); err != nil {
+		return nil, err
+	}
+	if err := DiscardDraft(userId, fn); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DiffLimits are the effective settings changed if content replaced the
+// current fn of a user
+func DiffLimits(userId int, fn string, content string) ([]*LimitChange, error) {
+	cur, _ := Files.Read(userId, fn)
+	a, err := effectiveLimits(string(cur), fn, GetPath(userId))
+	if err != nil {
+		// the live file may be broken, everything in content is a change
+		a = map[[4]string]string{}
+	}
+	b, err := effectiveLimits(content, fn, GetPath(userId))
+	if err != nil {
+		return nil, err
+	}
+	out := []*LimitChange{}
+	for k, v := range b {
+		if a[k] != v {
+			out = append(out, &LimitChange{k[0], k[1], k[2], k[3], a[k], v})
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			out = append(out, &LimitChange{k[0], k[1], k[2], k[3], v, ""})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		x, y := out[i], out[j]
+		return strings.Join([]string{x.Portfolio, x.Risk, x.Param, x.Key}, "\x1f") <
+			strings.Join([]string{y.Portfolio, y.Risk, y.Param, y.Key}, "\x1f")
+	})
+	return out, nil
+}
+
+// effectiveLimits of a portfolio file keyed by [portfolio, risk, param, key], as
+// parsePortfolios loads it
+func effectiveLimits(content string, fn string, pyPath string) (map[[4]string]string, error) {
+	out := make(map[[4]string]string)
+	if content == "" {
+		return out, nil
+	}
+	cfg, err := ParseRiskFile(fn, content)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePortfolio(cfg, pyPath)
+	if err != nil {
+		return nil, err
+	}
+	name := p.Name
+	if name == "" {
+		name = fn[0 : len(fn)-len(path.Ext(fn))]
+	}
+	acc := p.AccPatterns
+	if acc == "" {
+		acc = "*"
+	}
+	out[[4]string{name, "", "", "acc"}] = acc
+	out[[4]string{name, "", "", "filter"}] = cfg.ValueMap["filter"][0]
+	for i, rd := range p.RiskDefs {
+		s := cfg.Sections[i]
+		out[[4]string{name, rd.DisplayName, "", "group"}] = strings.Join(rd.GroupNames, ", ")
+		out[[4]string{name, rd.DisplayName, "", "filter"}] = s.ValueMap["f"][0]
+		var sections []*IniSection
+		if s.ValueMap["formula"][0] != "" {
+			sections = append(sections, s)
+		}
+		for _, s2 := range s.Sections {
+			if s2.Name != "var" && s2.ValueMap["formula"][0] != "" {
+				sections = append(sections, s2)
+			}
+		}
+		for j, rp := range rd.Params {
+			k := [4]string{name, rd.DisplayName, rp.Name}
+			k[3] = "formula"
+			out[k] = sections[j].ValueMap["formula"][0]
+			k[3] = "upper_bound"
+			out[k] = formatBounds(rp.UpperBound)
+			k[3] = "lower_bound"
+			out[k] = formatBounds(rp.LowerBound)
+			k[3] = "trade_stop"
+			out[k] = strconv.FormatBool(rp.TradeStop)
+			k[3] = "window"
+			out[k] = ""
+			if rp.Window.Seconds > 0 {
+				out[k] = strconv.Itoa(rp.Window.Seconds)
+				if rp.Window.Type != "" {
+					out[k] += ", " + rp.Window.Type
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// formatBounds has - for a group without a bound
+func formatBounds(bounds []float64) string {
+	var strs []string
+	for _, v := range bounds {
+		if math.IsNaN(v) {
+			strs = append(strs, "-")
+		} else {
+			strs = append(strs, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	}
+	return strings.Join(strs, ", ")
+}
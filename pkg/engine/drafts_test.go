@@ -0,0 +1,123 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withTestStore keeps files and versions in a temp dir until the test ends
+func withTestStore(t *testing.T) string {
+	root := t.TempDir()
+	files := Files
+	Files = &LocalFileStore{Root: root}
+	if err := OpenVersions(filepath.Join(root, "versions.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		CloseVersions()
+		Files = files
+	})
+	return root
+}
+
+const testDraft = "[gross]\nformula = sum(abs(Pos) * Close)\nupper_bound = 100\n"
+
+func pendingDraft(t *testing.T, userId int, fn string, author string) {
+	if _, err := SaveDraft(userId, fn, testDraft, author, "more"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SubmitDraft(userId, fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApproveDraftFourEyes(t *testing.T) {
+	withTestStore(t)
+	pendingDraft(t, 1, "a.ini", "alice")
+	if _, err := ApproveDraft(1, "a.ini", "alice", ""); err != ErrSameApprover {
+		t.Errorf("approved by its author: %v", err)
+	}
+	if _, err := ApproveDraft(1, "a.ini", "", ""); err != ErrAnonymousApprover {
+		t.Errorf("approved without a name: %v", err)
+	}
+	d, err := ApproveDraft(1, "a.ini", "bob", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Owner != 1 {
+		t.Errorf("owner = %d, want 1", d.Owner)
+	}
+	if data, _ := Files.Read(1, "a.ini"); string(data) != testDraft {
+		t.Errorf("live file = %q, want the draft", data)
+	}
+	if _, err := GetDraft(1, "a.ini"); err == nil {
+		t.Error("approved draft kept")
+	}
+	versions, err := FileVersions(1, "a.ini")
+	if err != nil || len(versions) != 1 || versions[0].Author != "alice" {
+		t.Errorf("versions = %v %v, want one by alice", versions, err)
+	}
+}
+
+func TestApproveAnonymousDraft(t *testing.T) {
+	withTestStore(t)
+	pendingDraft(t, 1, "a.ini", "")
+	if _, err := ApproveDraft(1, "a.ini", "", ""); err != ErrAnonymousApprover {
+		t.Errorf("approved by an anonymous user: %v", err)
+	}
+	if _, err := ApproveDraft(1, "a.ini", "bob", ""); err != ErrAnonymousApprover {
+		t.Errorf("approved an anonymous draft: %v", err)
+	}
+}
+
+func TestPendingDrafts(t *testing.T) {
+	withTestStore(t)
+	pendingDraft(t, 2, "b.ini", "bob")
+	pendingDraft(t, 10, "a.ini", "carol")
+	if _, err := SaveDraft(2, "c.ini", testDraft, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	pendingDraft(t, 3, "a.ini", "alice")
+	drafts, err := PendingDrafts(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range drafts {
+		if d.Content != "" {
+			t.Errorf("content of %s listed", d.Fn)
+		}
+		got = append(got, fmt.Sprintf("%d/%s", d.Owner, d.Fn))
+	}
+	if want := []string{"2/b.ini", "10/a.ini"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingDrafts(3) = %v, want %v", got, want)
+	}
+	if _, err := RejectDraft(2, "b.ini", "alice", "no"); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := GetDraft(2, "b.ini"); d.State != DraftStateDraft || d.RejectedBy != "alice" {
+		t.Errorf("rejected draft = %+v", d)
+	}
+}
@@ -0,0 +1,448 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// An IniDoc is a risk .ini file kept for editing. Its comments, the order of
+// its keys and sections and its %include lines are written back by Format
+// in a canonical layout: key = value on one line, continuation lines joined,
+// a blank line before each top section. Unchanged values keep their quoting,
+// includes are not read. Without %dialect 2 changed values are written as
+// they are, or refused if that would not read back.
+
+type IniDoc struct {
+	Root    *IniNode
+	Tail    []string // comments after the last line
+	Dialect int
+}
+
+type IniNode struct {
+	Name     string
+	Depth    int
+	Comments []string // lines above the section
+	Comment  string   // inline
+	Entries  []*IniEntry
+	Sections []*IniNode
+}
+
+// IniEntry is a key = value, or with an empty Key an %include or ignored
+// line written as Value
+type IniEntry struct {
+	Key      string
+	Value    string
+	Comments []string
+	Comment  string
+	raw      string // Value as written
+}
+
+// ParseIniDoc parses content as parseIni does, without includes and
+// interpolation
+func ParseIniDoc(content string) (*IniDoc, error) {
+	if _, err := parseIni(content, "", &includer{}); err != nil {
+		return nil, err
+	}
+	doc := &IniDoc{Root: &IniNode{}, Dialect: 1}
+	stack := []*IniNode{doc.Root}
+	var comments []string
+	for _, l := range lexIni(content, "", &includer{}) {
+		if l.File != "" {
+			continue
+		}
+		cur := stack[len(stack)-1]
+		doc.Dialect = l.Dialect
+		switch l.Kind {
+		case iniComment:
+			comments = append(comments, l.Comment)
+			continue
+		case iniSectionLine:
+			stack = stack[:l.Depth]
+			s := &IniNode{Name: l.Name, Depth: l.Depth, Comments: comments, Comment: l.Comment}
+			parent := stack[len(stack)-1]
+			parent.Sections = append(parent.Sections, s)
+			stack = append(stack, s)
+		case iniValue:
+			cur.Entries = append(cur.Entries, &IniEntry{Key: l.Key, Value: l.Value, raw: l.Raw, Comments: comments, Comment: l.Comment})
+		case iniInclude:
+			name := l.Value
+			if str, _ := stripComment(name, 0); str != name || strings.ContainsAny(name, " \t") {
+				name = strconv.Quote(name)
+			}
+			cur.Entries = append(cur.Entries, &IniEntry{Value: "%include " + name, Comments: comments, Comment: l.Comment})
+		case iniDialect:
+			cur.Entries = append(cur.Entries, &IniEntry{Value: "%dialect " + l.Value, Comments: comments, Comment: l.Comment})
+		case iniOther:
+			cur.Entries = append(cur.Entries, &IniEntry{Value: l.Value, Comments: comments, Comment: l.Comment})
+		}
+		comments = nil
+	}
+	doc.Tail = comments
+	return doc, nil
+}
+
+// Format writes the canonical ini text of the document
+func (self *IniDoc) Format() (string, error) {
+	var sb strings.Builder
+	if err := self.Root.format(&sb, self.Dialect); err != nil {
+		return "", err
+	}
+	for _, c := range self.Tail {
+		sb.WriteString(c + "\n")
+	}
+	return sb.String(), nil
+}
+
+func (self *IniNode) format(sb *strings.Builder, dialect int) error {
+	for _, e := range self.Entries {
+		writeComments(sb, e.Comments)
+		line := e.Value
+		if e.Key != "" {
+			if strings.ContainsAny(e.Key, "=\n") || strings.ContainsAny(e.Key[:1], "[#;%") {
+				return fmt.Errorf("key %q can not be written to an ini file", e.Key)
+			}
+			value := e.raw
+			if value == "" && dialect < 2 {
+				value = e.Value
+				if value != strings.TrimSpace(value) || strings.ContainsAny(value, "\n\r") {
+					return fmt.Errorf("value of %s can not be written to an ini file without %%dialect 2", e.Key)
+				}
+			} else if value == "" {
+				value = iniQuote(e.Value)
+			}
+			line = e.Key + " = " + value
+		}
+		writeLine(sb, line, e.Comment)
+	}
+	for _, s := range self.Sections {
+		if s.Name == "" || strings.ContainsAny(s.Name, "[]\n") {
+			return fmt.Errorf("section %q can not be written to an ini file", s.Name)
+		}
+		if s.Depth == 1 && sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		writeComments(sb, s.Comments)
+		writeLine(sb, strings.Repeat("[", s.Depth)+s.Name+strings.Repeat("]", s.Depth), s.Comment)
+		if err := s.format(sb, dialect); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeComments(sb *strings.Builder, comments []string) {
+	for _, c := range comments {
+		sb.WriteString(c + "\n")
+	}
+}
+
+func writeLine(sb *strings.Builder, line string, comment string) {
+	sb.WriteString(line)
+	if comment != "" {
+		sb.WriteString("  " + comment)
+	}
+	sb.WriteString("\n")
+}
+
+func (self *IniNode) entry(key string) *IniEntry {
+	for _, e := range self.Entries {
+		if e.Key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// Get returns the value of key
+func (self *IniNode) Get(key string) (string, bool) {
+	if e := self.entry(key); e != nil {
+		return e.Value, true
+	}
+	return "", false
+}
+
+// Set changes the value of key in place, or appends it
+func (self *IniNode) Set(key string, value string) {
+	if e := self.entry(key); e != nil {
+		if e.Value != value {
+			e.Value, e.raw = value, ""
+		}
+		return
+	}
+	self.Entries = append(self.Entries, &IniEntry{Key: key, Value: value})
+}
+
+// Delete removes key and the comments above it
+func (self *IniNode) Delete(key string) bool {
+	for i, e := range self.Entries {
+		if e.Key == key {
+			self.Entries = append(self.Entries[:i:i], self.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Section returns the subsection name, nil if there is none
+func (self *IniNode) Section(name string) *IniNode {
+	for _, s := range self.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// AddSection appends the subsection name
+func (self *IniNode) AddSection(name string) *IniNode {
+	s := &IniNode{Name: name, Depth: self.Depth + 1}
+	self.Sections = append(self.Sections, s)
+	return s
+}
+
+// RemoveSection removes the subsection name with its sections and comments
+func (self *IniNode) RemoveSection(name string) bool {
+	for i, s := range self.Sections {
+		if s.Name == name {
+			self.Sections = append(self.Sections[:i:i], self.Sections[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// PortfolioEditor edits the risks and params of a portfolio file, a risk
+// is a top section and a param a section of it, an empty param is the risk
+// section itself, for a risk with its own formula
+type PortfolioEditor struct {
+	Doc *IniDoc
+}
+
+// EditOp is an edit of a PortfolioEditor as sent by clients, Op is one of
+// addRisk, removeRisk, addParam, removeParam, setFormula, setBounds and
+// setValue. Bounds are per group, null for a group without one, an empty
+// list removes them and a missing one is not changed. An empty value
+// removes the key of setValue, an empty risk is the portfolio.
+type EditOp struct {
+	Op      string     `json:"op"`
+	Risk    string     `json:"risk,omitempty"`
+	Param   string     `json:"param,omitempty"`
+	Key     string     `json:"key,omitempty"`
+	Value   string     `json:"value,omitempty"`
+	Formula string     `json:"formula,omitempty"`
+	Upper   []*float64 `json:"upper"`
+	Lower   []*float64 `json:"lower"`
+}
+
+func NewPortfolioEditor(content string) (*PortfolioEditor, error) {
+	doc, err := ParseIniDoc(content)
+	if err != nil {
+		return nil, err
+	}
+	return &PortfolioEditor{Doc: doc}, nil
+}
+
+// Content is the edited file
+func (self *PortfolioEditor) Content() (string, error) {
+	return self.Doc.Format()
+}
+
+func (self *PortfolioEditor) risk(name string) (*IniNode, error) {
+	if s := self.Doc.Root.Section(name); s != nil {
+		return s, nil
+	}
+	return nil, fmt.Errorf("no risk %s", name)
+}
+
+func (self *PortfolioEditor) param(risk string, param string) (*IniNode, error) {
+	r, err := self.risk(risk)
+	if err != nil || param == "" {
+		return r, err
+	}
+	if s := r.Section(param); s != nil && param != "var" {
+		return s, nil
+	}
+	return nil, fmt.Errorf("no param %s of risk %s", param, risk)
+}
+
+func checkSectionName(name string) error {
+	if name == "" || strings.ContainsAny(name, "[]\n") || name != strings.TrimSpace(name) {
+		return fmt.Errorf("invalid section name %q", name)
+	}
+	return nil
+}
+
+// AddRisk appends a risk, with its own formula if not empty
+func (self *PortfolioEditor) AddRisk(name string, formula string) error {
+	if err := checkSectionName(name); err != nil {
+		return err
+	}
+	if self.Doc.Root.Section(name) != nil {
+		return fmt.Errorf("risk %s exists", name)
+	}
+	s := self.Doc.Root.AddSection(name)
+	if formula != "" {
+		s.Set("formula", formula)
+	}
+	return nil
+}
+
+func (self *PortfolioEditor) RemoveRisk(name string) error {
+	if !self.Doc.Root.RemoveSection(name) {
+		return fmt.Errorf("no risk %s", name)
+	}
+	return nil
+}
+
+// AddParam appends a param to a risk
+func (self *PortfolioEditor) AddParam(risk string, param string, formula string) error {
+	r, err := self.risk(risk)
+	if err != nil {
+		return err
+	}
+	if err := checkSectionName(param); err != nil {
+		return err
+	}
+	if param == "var" {
+		return fmt.Errorf("var is not a param name")
+	}
+	if r.Section(param) != nil {
+		return fmt.Errorf("param %s of risk %s exists", param, risk)
+	}
+	if formula == "" {
+		return fmt.Errorf("param %s without formula", param)
+	}
+	r.AddSection(param).Set("formula", formula)
+	return nil
+}
+
+func (self *PortfolioEditor) RemoveParam(risk string, param string) error {
+	r, err := self.risk(risk)
+	if err != nil {
+		return err
+	}
+	if param == "var" || !r.RemoveSection(param) {
+		return fmt.Errorf("no param %s of risk %s", param, risk)
+	}
+	return nil
+}
+
+func (self *PortfolioEditor) SetFormula(risk string, param string, formula string) error {
+	s, err := self.param(risk, param)
+	if err != nil {
+		return err
+	}
+	if formula == "" {
+		return fmt.Errorf("empty formula")
+	}
+	s.Set("formula", formula)
+	return nil
+}
+
+// SetBounds sets the upper and lower bounds of a param, NaN for a group
+// without one, nil leaves them and an empty list removes them
+func (self *PortfolioEditor) SetBounds(risk string, param string, upper []float64, lower []float64) error {
+	s, err := self.param(risk, param)
+	if err != nil {
+		return err
+	}
+	for i, bounds := range [][]float64{upper, lower} {
+		key := [...]string{"upper_bound", "lower_bound"}[i]
+		if bounds == nil {
+			continue
+		}
+		if len(bounds) == 0 {
+			s.Delete(key)
+		} else {
+			s.Set(key, formatBounds(bounds))
+		}
+	}
+	return nil
+}
+
+// SetValue sets any key of the portfolio, a risk or a param, an empty
+// value removes it
+func (self *PortfolioEditor) SetValue(risk string, param string, key string, value string) error {
+	s := self.Doc.Root
+	if risk != "" {
+		var err error
+		if s, err = self.param(risk, param); err != nil {
+			return err
+		}
+	}
+	if key == "" || strings.ContainsAny(key, "=\n") || strings.ContainsAny(key[:1], "[#;%") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	if value == "" {
+		s.Delete(key)
+	} else {
+		s.Set(key, value)
+	}
+	return nil
+}
+
+// Apply runs ops in order, stopping at the first failing one
+func (self *PortfolioEditor) Apply(ops []*EditOp) error {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "addRisk":
+			err = self.AddRisk(op.Risk, op.Formula)
+		case "removeRisk":
+			err = self.RemoveRisk(op.Risk)
+		case "addParam":
+			err = self.AddParam(op.Risk, op.Param, op.Formula)
+		case "removeParam":
+			err = self.RemoveParam(op.Risk, op.Param)
+		case "setFormula":
+			err = self.SetFormula(op.Risk, op.Param, op.Formula)
+		case "setBounds":
+			err = self.SetBounds(op.Risk, op.Param, editBounds(op.Upper), editBounds(op.Lower))
+		case "setValue":
+			err = self.SetValue(op.Risk, op.Param, op.Key, op.Value)
+		default:
+			err = fmt.Errorf("unknown op")
+		}
+		if err != nil {
+			return fmt.Errorf("op %d (%s): %v", i+1, op.Op, err)
+		}
+	}
+	return nil
+}
+
+func editBounds(bounds []*float64) []float64 {
+	if bounds == nil {
+		return nil
+	}
+	out := make([]float64, len(bounds))
+	for i, v := range bounds {
+		if v == nil {
+			out[i] = math.NaN()
+		} else {
+			out[i] = *v
+		}
+	}
+	return out
+}
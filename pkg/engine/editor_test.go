@@ -0,0 +1,170 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"strings"
+	"testing"
+)
+
+func formatDoc(t *testing.T, doc *IniDoc) string {
+	out, err := doc.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestIniDocFormat(t *testing.T) {
+	content := strings.Join([]string{
+		"%dialect 2",
+		"# portfolio",
+		"name = p  ; inline",
+		"%include common.ini",
+		"[s]  # risk",
+		"; above param",
+		"[[p]]",
+		"formula = 1 +",
+		"    2",
+		"upper_bound = 1, 2",
+		"[t]",
+		"formula = 3",
+		"# tail",
+	}, "\n")
+	doc, err := ParseIniDoc(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"%dialect 2",
+		"# portfolio",
+		"name = p  ; inline",
+		"%include common.ini",
+		"",
+		"[s]  # risk",
+		"; above param",
+		"[[p]]",
+		"formula = 1 + 2",
+		"upper_bound = 1, 2",
+		"",
+		"[t]",
+		"formula = 3",
+		"# tail",
+		"",
+	}, "\n")
+	out := formatDoc(t, doc)
+	if out != want {
+		t.Errorf("format:\n%s\nwant\n%s", out, want)
+	}
+	doc2, err := ParseIniDoc(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out2 := formatDoc(t, doc2); out2 != out {
+		t.Errorf("format again:\n%s\nwant\n%s", out2, out)
+	}
+}
+
+func TestIniDocEdit(t *testing.T) {
+	doc, err := ParseIniDoc("%dialect 2\n[s]\n# keep\na = 1  # a\n# gone\nb = 2\nc = \"x y\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := doc.Root.Section("s")
+	s.Set("a", "3")
+	s.Set("c", "x y")
+	s.Set("d", " padded")
+	if !s.Delete("b") || s.Delete("b") {
+		t.Error("delete b")
+	}
+	if v, ok := s.Get("a"); !ok || v != "3" {
+		t.Errorf("a = %q %v", v, ok)
+	}
+	want := "%dialect 2\n\n[s]\n# keep\na = 3  # a\nc = \"x y\"\nd = \" padded\"\n"
+	if out := formatDoc(t, doc); out != want {
+		t.Errorf("edit:\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestIniDocLegacy(t *testing.T) {
+	doc, err := ParseIniDoc("[s]\na = \"q\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := doc.Root.Section("s")
+	// kept as written
+	if out := formatDoc(t, doc); out != "[s]\na = \"q\"\n" {
+		t.Errorf("legacy format: %q", out)
+	}
+	s.Set("b", "x # y")
+	if out := formatDoc(t, doc); out != "[s]\na = \"q\"\nb = x # y\n" {
+		t.Errorf("legacy set: %q", out)
+	}
+	s.Set("b", " x")
+	if _, err := doc.Format(); err == nil || !strings.Contains(err.Error(), "without %dialect 2") {
+		t.Errorf("legacy padded value: %v", err)
+	}
+}
+
+func TestPortfolioEditor(t *testing.T) {
+	e, err := NewPortfolioEditor("%dialect 2\n# risks\n[s]\n[[p]]\nformula = 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := 1.0, 2.0
+	ops := []*EditOp{
+		{Op: "setFormula", Risk: "s", Param: "p", Formula: "Qty"},
+		{Op: "setBounds", Risk: "s", Param: "p", Upper: []*float64{&one, nil, &two}},
+		{Op: "addParam", Risk: "s", Param: "q", Formula: "2"},
+		{Op: "setValue", Risk: "s", Param: "q", Key: "window", Value: "60"},
+		{Op: "addRisk", Risk: "t", Formula: "3"},
+		{Op: "setValue", Key: "name", Value: "book"},
+		{Op: "removeParam", Risk: "s", Param: "q"},
+	}
+	if err := e.Apply(ops); err != nil {
+		t.Fatal(err)
+	}
+	out, err := e.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "%dialect 2\nname = book\n\n# risks\n[s]\n[[p]]\nformula = Qty\nupper_bound = 1, -, 2\n\n[t]\nformula = 3\n"
+	if out != want {
+		t.Errorf("edited:\n%s\nwant\n%s", out, want)
+	}
+	for _, c := range []struct {
+		op  *EditOp
+		err string
+	}{
+		{&EditOp{Op: "addRisk", Risk: "s"}, "op 1 (addRisk): risk s exists"},
+		{&EditOp{Op: "addRisk", Risk: "[x]"}, `op 1 (addRisk): invalid section name "[x]"`},
+		{&EditOp{Op: "addParam", Risk: "s", Param: "var", Formula: "1"}, "op 1 (addParam): var is not a param name"},
+		{&EditOp{Op: "addParam", Risk: "s", Param: "r"}, "op 1 (addParam): param r without formula"},
+		{&EditOp{Op: "removeParam", Risk: "s", Param: "q"}, "op 1 (removeParam): no param q of risk s"},
+		{&EditOp{Op: "setFormula", Risk: "x", Param: "p", Formula: "1"}, "op 1 (setFormula): no risk x"},
+		{&EditOp{Op: "setValue", Risk: "s", Param: "p", Key: "#k", Value: "1"}, `op 1 (setValue): invalid key "#k"`},
+		{&EditOp{Op: "rename"}, "op 1 (rename): unknown op"},
+	} {
+		if err := e.Apply([]*EditOp{c.op}); err == nil || err.Error() != c.err {
+			t.Errorf("%s: %v, want %s", c.op.Op, err, c.err)
+		}
+	}
+}
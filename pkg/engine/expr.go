@@ -23,7 +23,6 @@ package engine
 import (
 	"fmt"
 	"math"
-	"reflect"
 	"strconv"
 	"strings"
 
@@ -32,110 +31,198 @@ import (
 
 type Expression struct {
 	E *govaluate.EvaluableExpression
-	A string    // aggregate function name
+	A string    // aggregate function name, total, ref, or group of an expression of aggregates
 	N [2]int    // for A == "top"
-	C [3]string // for call()
+	C [3]string // for call(), C[0] the param of ref()
+	T exprType  // of the value, of each position for aggregates
+	X *compiledExpr
+	R []*Expression // the other args of each position of aggregate A, or that of total()
+	K []float64     // the constant args of aggregate A
+	S []*Expression // the aggregates in the expression, its variables [aggregate i]
+	L string        // the line, of errors found after parsing
+	// the param of ref(), set by ParsePortfolio
+	Ref *RiskParamDef
 }
 
 var predefinedFunctions = map[string]govaluate.ExpressionFunction{
 	"min": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
-		b := args[1].(float64)
+		a := numberArg(args, 0)
+		b := numberArg(args, 1)
 		return math.Min(a, b), nil
 	},
 	"max": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
-		b := args[1].(float64)
+		a := numberArg(args, 0)
+		b := numberArg(args, 1)
 		return math.Max(a, b), nil
 	},
 	"pow": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
-		b := args[1].(float64)
+		a := numberArg(args, 0)
+		b := numberArg(args, 1)
 		return math.Pow(a, b), nil
 	},
 	"sqrt": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Sqrt(a), nil
 	},
 	"round": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Round(a), nil
 	},
 	"isNaN": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.IsNaN(a), nil
 	},
 	"ceil": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Ceil(a), nil
 	},
 	"floor": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Floor(a), nil
 	},
 	"exp": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Exp(a), nil
 	},
 	"exp2": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Exp2(a), nil
 	},
 	"abs": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Abs(a), nil
 	},
 	"log": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Log(a), nil
 	},
 	"log2": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Log2(a), nil
 	},
 	"log10": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.Log10(a), nil
 	},
 	"isInf": func(args ...interface{}) (interface{}, error) {
-		a := args[0].(float64)
+		a := numberArg(args, 0)
 		return math.IsInf(a, -1) || math.IsInf(a, 1), nil
 	},
 	"strlen": func(args ...interface{}) (interface{}, error) {
-		length := len(args[0].(string))
+		length := len(stringArg(args, 0))
 		return float64(length), nil
 	},
+	"if":          evalIf,
+	"coalesce":    evalCoalesce,
+	inFunction:    evalIn,
+	"startsWith":  evalStringTest(strings.HasPrefix),
+	"endsWith":    evalStringTest(strings.HasSuffix),
+	"contains":    evalStringTest(strings.Contains),
+	"regexMatch":  evalRegexMatch,
+	"clamp":       evalNumber(3, func(a []float64) float64 { return clamp(a[0], a[1], a[2]) }),
+	"sign":        evalNumber(1, func(a []float64) float64 { return sign(a[0]) }),
+	"now":         evalNumber(0, func([]float64) float64 { return now() }),
+	"today":       evalNumber(0, func([]float64) float64 { return today() }),
+	"daysBetween": evalNumber(2, func(a []float64) float64 { return daysBetween(a[0], a[1]) }),
+	"list":        listFunction(""),
 }
 
+// ParseExpr parses, type checks and compiles an expression, params are the
+// variables besides those of positions with a value of their type,
+// valueTmpl the type it must return, nil for any
 func ParseExpr(ln string, expr string, name string, params map[string]interface{}, valueTmpl interface{}, path string) (res *Expression, eres error) {
 	var a string
 	var n [2]int
-	if strings.HasPrefix(expr, "sum(") {
-		a = "sum"
-		expr = expr[4 : len(expr)-1]
-	} else if strings.HasPrefix(expr, "len(") {
-		a = "len"
-		expr = expr[4 : len(expr)-1]
-	} else if strings.HasPrefix(expr, "mean(") {
-		a = "mean"
-		expr = expr[5 : len(expr)-1]
-	} else if strings.HasPrefix(expr, "std(") {
-		a = "std"
-		expr = expr[4 : len(expr)-1]
-	} else if strings.HasPrefix(expr, "top(") {
-		expr = expr[4 : len(expr)-1]
-		fields := split(expr, ",")
-		if len(fields) > 1 {
-			expr = fields[0]
-			i, err := strconv.Atoi(fields[len(fields)-1])
+	var others []*Expression
+	var consts []float64
+	want := typeOfValue(valueTmpl)
+	fname, args, isCall := splitCall(expr)
+	if agg := aggregates[fname]; isCall && agg != nil && len(args) != len(agg.Args) {
+		// else the function, as min(a, b)
+		if _, ok := functionTypes[fname]; !ok {
+			eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + fname + "() takes " + aggregateArgs(agg) + ", got " + strconv.Itoa(len(args)))
+			return
+		}
+	} else if isCall && agg != nil {
+		a = fname
+		want = typeNumber
+		if agg.Args[0] == AggregateCondition {
+			want = typeBool
+		}
+		for i, kind := range agg.Args[1:] {
+			arg := args[i+1]
+			if kind == AggregateConstant {
+				v, err := strconv.ParseFloat(arg, 64)
+				if err != nil {
+					eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": argument " + strconv.Itoa(i+2) + " of " + fname + "() needs a number")
+					return
+				}
+				consts = append(consts, v)
+				continue
+			}
+			var tmpl interface{} = 0.0
+			if kind == AggregateCondition {
+				tmpl = true
+			}
+			e, err := ParseExpr(ln, arg, name, params, tmpl, path)
+			if err != nil {
+				eres = err
+				return
+			}
+			if e.A != "" {
+				eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + e.A + "() in " + fname + "()")
+				return
+			}
+			others = append(others, e)
+		}
+		if agg.Check != nil {
+			if err := agg.Check(consts); err != nil {
+				eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + fname + "(): " + err.Error())
+				return
+			}
+		}
+		expr = args[0]
+	} else if isCall && fname == "total" {
+		if len(args) != 1 {
+			eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": total() takes an aggregate")
+			return
+		}
+		e, err := ParseExpr(ln, args[0], name, params, 0.0, path)
+		if err != nil {
+			eres = err
+			return
+		}
+		if aggregates[e.A] == nil && e.A != "group" {
+			eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": total() takes an aggregate like sum(x)")
+			return
+		}
+		res = &Expression{A: "total", T: typeNumber, R: []*Expression{e}, L: ln}
+		return
+	} else if isCall && fname == "ref" {
+		var ref string
+		var err error
+		if len(args) == 1 {
+			ref, err = strconv.Unquote(strings.Replace(args[0], "'", "\"", -1))
+		}
+		if len(args) != 1 || err != nil || ref == "" {
+			eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": ref() takes the name of a param in quotes, as ref(\"risk.param\")")
+			return
+		}
+		res = &Expression{A: "ref", C: [3]string{ref}, T: typeNumber, L: ln}
+		return
+	} else if isCall && fname == "top" {
+		want = typeNumber
+		if len(args) > 1 {
+			expr = args[0]
+			i, err := strconv.Atoi(args[len(args)-1])
 			if err != nil {
 				eres = fmt.Errorf("invalid top expression on line " + ln + ": " + expr + ": bad top length")
 				return
 			}
 			a = "top"
 			n[1] = i
-			if len(fields) > 2 {
-				i, err := strconv.Atoi(fields[len(fields)-2])
+			if len(args) > 2 {
+				i, err := strconv.Atoi(args[len(args)-2])
 				if err != nil {
 					eres = fmt.Errorf("invalid top expression on line " + ln + ": " + expr + ": bad top length")
 					return
@@ -193,26 +280,50 @@ func ParseExpr(ln string, expr string, name string, params map[string]interface{
 		}
 		return
 	}
-	e, err := govaluate.NewEvaluableExpressionWithFunctions(expr, predefinedFunctions)
+	var inner []*Expression
+	if name != "filter" && name != "group" {
+		// filters and groups are of each position
+		if expr, inner, eres = extractAggregates(ln, expr, name, params, path); eres != nil {
+			return
+		}
+		if len(inner) > 0 {
+			params = aggregateParams(params, len(inner))
+		}
+	}
+	src := renameInCalls(expr)
+	e, err := govaluate.NewEvaluableExpressionWithFunctions(src, exprFunctions(path))
 	if err != nil {
 		eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + err.Error())
 		return
 	}
-	p := &Position{}
-	p.Security = &Security{}
-	v, err2 := Evaluate(&Expression{E: e}, p, params)
-	if err2 != nil {
-		eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + err2.Error())
+	t, x, err := checkExpr(src, e, params, path)
+	if err != nil {
+		eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + err.Error())
 		return
 	}
-	if valueTmpl != nil && reflect.TypeOf(v) != reflect.TypeOf(valueTmpl) {
-		eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": which must return " + reflect.TypeOf(valueTmpl).String())
+	if err := expectType(t, want, "which"); err != nil {
+		eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": which must return " + want.String() + ", not " + t.String())
 		return
 	}
 	res = &Expression{
 		E: e,
 		A: a,
 		N: n,
+		T: t,
+		X: x,
+		R: others,
+		K: consts,
+		S: inner,
+		L: ln,
+	}
+	if a == "" && len(inner) > 0 && isGroupExpr(e, params) {
+		res.A = "group"
+		return
+	}
+	if a == "top" {
+		res.T = typeAny
+	} else if a != "" {
+		res.T = typeNumber
 	}
 	return
 }
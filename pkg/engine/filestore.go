@@ -0,0 +1,189 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileStore keeps the risk files of the users. Names are plain file names
+// without directories, checked by ValidateFileName. List fails with an
+// os.IsNotExist error for users without any file yet.
+type FileStore interface {
+	List(userId int) ([]string, error)
+	Read(userId int, fn string) ([]byte, error)
+	Write(userId int, fn string, data []byte) error
+	Remove(userId int, fn string) error
+}
+
+// Files is the store of GetFiles, GetFile, SaveFile and DeleteFile. Python
+// risk modules are imported from GetPath(userId) of the working directory,
+// so .py files need a LocalFileStore rooted there.
+var Files FileStore = &LocalFileStore{Root: "."}
+
+// RiskFileExtensions are the extensions ValidateFileName allows
+var RiskFileExtensions = []string{".ini", ".yaml", ".yml", ".toml", ".json", ".py", ".csv"}
+
+const maxFileNameLen = 128
+
+const DefaultMaxFileSize = 1 << 20
+
+// ValidateFileName allows [A-Za-z0-9_.-] names not starting with a dot and
+// with one of RiskFileExtensions, python module names must be identifiers
+func ValidateFileName(fn string) error {
+	if fn == "" || len(fn) > maxFileNameLen {
+		return fmt.Errorf("invalid file name length: %d", len(fn))
+	}
+	if fn[0] == '.' || strings.Contains(fn, "..") {
+		return fmt.Errorf("invalid file name: %s", fn)
+	}
+	for _, c := range fn {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			return fmt.Errorf("invalid character %q in file name: %s", c, fn)
+		}
+	}
+	ext := path.Ext(fn)
+	found := false
+	for _, e := range RiskFileExtensions {
+		if ext == e {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("file extension %q not allowed, expect one of %s", ext, strings.Join(RiskFileExtensions, ", "))
+	}
+	if ext == ".py" {
+		base := fn[:len(fn)-len(ext)]
+		if base == "__init__" || strings.ContainsAny(base, ".-") || (base[0] >= '0' && base[0] <= '9') {
+			return fmt.Errorf("invalid python module name: %s", fn)
+		}
+	}
+	return nil
+}
+
+// LocalFileStore keeps the files of a user under Root/GetPath(userId), with
+// __init__.py making it a python package. Writes are atomic, through a temp
+// file renamed over the old one.
+type LocalFileStore struct {
+	Root    string
+	MaxSize int64 // DefaultMaxFileSize if 0
+}
+
+func (self *LocalFileStore) dir(userId int) string {
+	return filepath.Join(self.Root, GetPath(userId))
+}
+
+func (self *LocalFileStore) file(userId int, fn string) (string, error) {
+	if err := ValidateFileName(fn); err != nil {
+		return "", err
+	}
+	return filepath.Join(self.dir(userId), fn), nil
+}
+
+func (self *LocalFileStore) List(userId int) ([]string, error) {
+	files, err := ioutil.ReadDir(self.dir(userId))
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "__init__.py" || ValidateFileName(f.Name()) != nil {
+			continue
+		}
+		out = append(out, f.Name())
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (self *LocalFileStore) Read(userId int, fn string) ([]byte, error) {
+	fn, err := self.file(userId, fn)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fn)
+}
+
+func (self *LocalFileStore) Write(userId int, fn string, data []byte) error {
+	max := self.MaxSize
+	if max <= 0 {
+		max = DefaultMaxFileSize
+	}
+	if int64(len(data)) > max {
+		return fmt.Errorf("file too large: %d bytes, at most %d", len(data), max)
+	}
+	fn, err := self.file(userId, fn)
+	if err != nil {
+		return err
+	}
+	dir := self.dir(userId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	initPy := filepath.Join(dir, "__init__.py")
+	if _, err := os.Stat(initPy); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(initPy, nil, 0644); err != nil {
+			return err
+		}
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (self *LocalFileStore) Remove(userId int, fn string) error {
+	fn, err := self.file(userId, fn)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fn); err != nil {
+		return err
+	}
+	if path.Ext(fn) == ".py" {
+		os.Remove(fn + "c")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateFileName(t *testing.T) {
+	for _, fn := range []string{"a.ini", "desk-1.yaml", "x.yml", "b_2.toml", "c.json", "watch.csv", "my_risk.py", "a.b.ini"} {
+		if err := ValidateFileName(fn); err != nil {
+			t.Errorf("%s: %v", fn, err)
+		}
+	}
+	for _, fn := range []string{
+		"", ".a.ini", "../a.ini", "a..ini", "dir/a.ini", `dir\a.ini`, "a b.ini", "a.txt", "a", "a.INI",
+		"__init__.py", "my-risk.py", "a.b.py", "2risk.py", "\x00.ini", "é.ini",
+		strings.Repeat("a", 125) + ".ini",
+	} {
+		if err := ValidateFileName(fn); err == nil {
+			t.Errorf("%q accepted", fn)
+		}
+	}
+}
+
+func TestLocalFileStore(t *testing.T) {
+	root := t.TempDir()
+	s := &LocalFileStore{Root: root, MaxSize: 10}
+	if _, err := s.List(1); !os.IsNotExist(err) {
+		t.Errorf("List of a new user: %v", err)
+	}
+	if err := s.Write(1, "a.ini", []byte("x = 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(1, "a.ini", []byte("x = 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.Read(1, "a.ini"); err != nil || string(b) != "x = 2\n" {
+		t.Errorf("Read = %q %v", b, err)
+	}
+	if err := s.Write(1, "b.ini", []byte("x = 123456\n")); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Write of 11 bytes: %v", err)
+	}
+	for _, fn := range []string{"../a.ini", "a.sh", "/etc/passwd"} {
+		if err := s.Write(1, fn, nil); err == nil {
+			t.Errorf("Write of %s", fn)
+		}
+		if _, err := s.Read(1, fn); err == nil {
+			t.Errorf("Read of %s", fn)
+		}
+	}
+	dir := filepath.Join(root, GetPath(1))
+	if _, err := os.Stat(filepath.Join(dir, "__init__.py")); err != nil {
+		t.Errorf("no __init__.py: %v", err)
+	}
+	// temp files, other files and directories are not listed
+	ioutil.WriteFile(filepath.Join(dir, ".tmp-1"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	os.Mkdir(filepath.Join(dir, "sub.ini"), 0755)
+	if err := s.Write(1, "m.py", []byte("x = 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "m.pyc"), nil, 0644)
+	files, err := s.List(1)
+	if err != nil || strings.Join(files, ",") != "a.ini,m.py" {
+		t.Errorf("List = %v %v", files, err)
+	}
+	if err := s.Remove(1, "m.py"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "m.pyc")); !os.IsNotExist(err) {
+		t.Errorf("m.pyc kept: %v", err)
+	}
+	if err := s.Remove(1, "m.py"); !os.IsNotExist(err) {
+		t.Errorf("Remove of a removed file: %v", err)
+	}
+}
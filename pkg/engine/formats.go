@@ -0,0 +1,649 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Portfolios are defined in YAML, TOML or JSON files as well as ini ones.
+// Mappings are sections, scalars are values and lists of scalars comma
+// separated values, so
+//
+//   name: desk
+//   pnls:
+//     group: [acc, sector]
+//     net:
+//       formula: sum(Pos*Close)
+//       upper_bound: 1e6
+//
+// is the ini file
+//
+//   name = desk
+//   [pnls]
+//   group = acc, sector
+//   [[net]]
+//   formula = sum(Pos*Close)
+//   upper_bound = 1e6
+//
+// The order of keys is kept, risks are reported in it.
+
+var portfolioFormats = map[string]string{
+	".ini":  "ini",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+	".json": "json",
+}
+
+// FileFormat is the format of a portfolio file, ini, yaml, toml or json,
+// empty for other files
+func FileFormat(fn string) string {
+	return portfolioFormats[path.Ext(fn)]
+}
+
+// IsPortfolioFile tells if fn defines a portfolio rather than python code
+func IsPortfolioFile(fn string) bool {
+	return FileFormat(fn) != ""
+}
+
+// ParseRiskFile parses a portfolio file in the format of its name and
+// expands its includes
+func ParseRiskFile(fn string, content string) (*IniSection, error) {
+	format := FileFormat(fn)
+	if format == "" {
+		return nil, fmt.Errorf("not a portfolio file: %s", fn)
+	}
+	return parseRisk(format, content)
+}
+
+func parseRisk(format string, content string) (*IniSection, error) {
+	cfg, err := ParseFormat(format, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := expandIncludes(cfg, sharedIncludes); err != nil {
+		return nil, err
+	}
+	return cfg, interpolateIni(cfg)
+}
+
+// ParseFormat parses a portfolio as written, includes and ${} references
+// are left to ParseRiskFile, but %include of ini files is expanded, see
+// IniIncludes
+func ParseFormat(format string, content string) (*IniSection, error) {
+	switch format {
+	case "ini":
+		return parseIni(content, "", sharedIncludes)
+	case "yaml":
+		return parseYaml(content)
+	case "toml":
+		return parseToml(content)
+	case "json":
+		return parseJson(content)
+	}
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// IniIncludes lists the files of the %include lines of an ini content
+func IniIncludes(content string) []string {
+	var names []string
+	for _, l := range lexIni(content, "", &includer{}) {
+		if l.Kind == iniInclude && l.File == "" && l.Err == "" {
+			names = append(names, l.Value)
+		}
+	}
+	return names
+}
+
+// WriteFormat writes s in a format ParseFormat reads back the same
+func WriteFormat(format string, s *IniSection) (string, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "ini":
+		buf.WriteString("%dialect 2\n")
+		err = writeIni(&buf, s)
+	case "yaml":
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err = enc.Encode(yamlNode(s)); err == nil {
+			err = enc.Close()
+		}
+	case "toml":
+		writeToml(&buf, s, nil)
+		if bytes.HasPrefix(buf.Bytes(), []byte("\n")) {
+			buf.ReadByte()
+		}
+	case "json":
+		writeJson(&buf, s, "")
+		buf.WriteString("\n")
+	default:
+		err = fmt.Errorf("unknown format %s", format)
+	}
+	return buf.String(), err
+}
+
+// CompareIni returns the first difference of the values and sections of a
+// and b, their lines aside, nil if there is none
+func CompareIni(a *IniSection, b *IniSection) error {
+	where := a.Name
+	for p := a.Parent; p != nil && p.Parent != nil; p = p.Parent {
+		where = p.Name + "." + where
+	}
+	if where != "" {
+		where = "[" + where + "] "
+	}
+	if len(a.Values) != len(b.Values) {
+		return fmt.Errorf("%s%d values instead of %d", where, len(b.Values), len(a.Values))
+	}
+	for i, v := range a.Values {
+		v2 := b.Values[i]
+		if v[0] != v2[0] || v[1] != v2[1] {
+			return fmt.Errorf("%s%s = %q instead of %s = %q", where, v2[0], v2[1], v[0], v[1])
+		}
+	}
+	if len(a.Sections) != len(b.Sections) {
+		return fmt.Errorf("%s%d sections instead of %d", where, len(b.Sections), len(a.Sections))
+	}
+	for i, s := range a.Sections {
+		if s.Name != b.Sections[i].Name {
+			return fmt.Errorf("%ssection %s instead of %s", where, b.Sections[i].Name, s.Name)
+		}
+		if err := CompareIni(s, b.Sections[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addValue(s *IniSection, key string, value string, line int) error {
+	if _, ok := s.ValueMap[key]; ok {
+		return fmt.Errorf("line %d: duplicate key %s", line, key)
+	}
+	lns := strconv.Itoa(line)
+	s.ValueMap[key] = [2]string{value, lns}
+	s.Values = append(s.Values, [3]string{key, value, lns})
+	return nil
+}
+
+func addSection(s *IniSection, name string, line int) (*IniSection, error) {
+	if s.SectionMap[name] != nil {
+		return nil, fmt.Errorf("line %d: duplicate section %s", line, name)
+	}
+	s2 := newSection(name, s.Depth+1, s)
+	s2.Line = line
+	return s2, nil
+}
+
+// scalarString is a decoded toml or json scalar as a value
+func scalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+func parseYaml(content string) (*IniSection, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	top := newSection("", 0, nil)
+	if len(doc.Content) == 0 {
+		return top, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expect a mapping of keys to values and sections", root.Line)
+	}
+	return top, yamlSection(top, root)
+}
+
+func yamlSection(s *IniSection, n *yaml.Node) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		var err error
+		switch v.Kind {
+		case yaml.MappingNode:
+			var s2 *IniSection
+			if s2, err = addSection(s, k.Value, k.Line); err == nil {
+				err = yamlSection(s2, v)
+			}
+		case yaml.ScalarNode:
+			value := v.Value
+			if v.Tag == "!!null" {
+				value = ""
+			}
+			err = addValue(s, k.Value, value, k.Line)
+		case yaml.SequenceNode:
+			var strs []string
+			for _, v2 := range v.Content {
+				if v2.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: %s may only list scalars", v2.Line, k.Value)
+				}
+				strs = append(strs, v2.Value)
+			}
+			err = addValue(s, k.Value, strings.Join(strs, ", "), k.Line)
+		default:
+			err = fmt.Errorf("line %d: unsupported value of %s", v.Line, k.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// yamlNode is a mapping of s, scalars plain unless they need quotes
+func yamlNode(s *IniSection) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	for _, v := range s.Values {
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: v[1]}
+		switch v[1] {
+		case "~", "null", "Null", "NULL":
+			value.Style = yaml.DoubleQuotedStyle
+		}
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: v[0]}, value)
+	}
+	for _, s2 := range s.Sections {
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s2.Name}, yamlNode(s2))
+	}
+	return n
+}
+
+func parseToml(content string) (*IniSection, error) {
+	var data map[string]interface{}
+	md, err := toml.Decode(content, &data)
+	if err != nil {
+		var pe toml.ParseError
+		if !errors.As(err, &pe) {
+			return nil, err
+		}
+		msg := pe.Message
+		if msg == "" {
+			// toml: line n (last key "k"): msg
+			msg = strings.TrimPrefix(pe.Error(), fmt.Sprintf("toml: line %d", pe.Position.Line))
+			if strings.HasPrefix(msg, " (last key") {
+				msg = msg[strings.Index(msg, "):")+1:]
+			}
+			msg = strings.TrimPrefix(msg, ": ")
+		}
+		return nil, fmt.Errorf("line %d: %s", pe.Position.Line, msg)
+	}
+	lines := tomlLines(content)
+	top := newSection("", 0, nil)
+	for _, key := range md.Keys() {
+		s, m := top, data
+		ln := 1
+		for i, name := range key[:len(key)-1] {
+			if l, ok := lines[strings.Join(key[:i+1], "\x1f")]; ok {
+				ln = l
+			}
+			if s.SectionMap[name] == nil {
+				newSection(name, s.Depth+1, s).Line = ln
+			}
+			s = s.SectionMap[name]
+			m, _ = m[name].(map[string]interface{})
+		}
+		if l, ok := lines[strings.Join(key, "\x1f")]; ok {
+			ln = l
+		}
+		name := key[len(key)-1]
+		switch v := m[name].(type) {
+		case map[string]interface{}:
+			if s.SectionMap[name] == nil {
+				newSection(name, s.Depth+1, s).Line = ln
+			}
+		case []interface{}:
+			var strs []string
+			for _, v2 := range v {
+				str, ok := scalarString(v2)
+				if !ok {
+					return nil, fmt.Errorf("line %d: %s may only list scalars", ln, name)
+				}
+				strs = append(strs, str)
+			}
+			if err := addValue(s, name, strings.Join(strs, ", "), ln); err != nil {
+				return nil, err
+			}
+		default:
+			str, ok := scalarString(v)
+			if !ok {
+				return nil, fmt.Errorf("line %d: unsupported value of %s", ln, name)
+			}
+			if err := addValue(s, name, str, ln); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return top, nil
+}
+
+// tomlLines maps the keys of a toml file, joined by \x1f, to the lines of
+// their table headers or key = value lines
+func tomlLines(content string) map[string]int {
+	out := make(map[string]int)
+	var table []string
+	multi := "" // the quotes of a multiline string
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if multi != "" {
+			if strings.Count(line, multi)%2 == 1 {
+				multi = ""
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "[[") {
+			continue
+		}
+		if line[0] == '[' {
+			if parts, rest := tomlKey(line[1:]); strings.HasPrefix(rest, "]") {
+				table = parts
+				out[strings.Join(table, "\x1f")] = i + 1
+			}
+			continue
+		}
+		parts, rest := tomlKey(line)
+		if !strings.HasPrefix(rest, "=") || len(parts) == 0 {
+			continue
+		}
+		key := append(append([]string{}, table...), parts...)
+		out[strings.Join(key, "\x1f")] = i + 1
+		for _, q := range []string{`"""`, `'''`} {
+			if strings.Count(rest, q)%2 == 1 {
+				multi = q
+			}
+		}
+	}
+	return out
+}
+
+// tomlKey splits the dotted key at the start of s, rest follows it
+func tomlKey(s string) (parts []string, rest string) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return parts, s
+		}
+		var part string
+		if s[0] == '"' || s[0] == '\'' {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, ""
+			}
+			part = s[1 : end+1]
+			if s[0] == '"' {
+				if u, err := strconv.Unquote(s[:end+2]); err == nil {
+					part = u
+				}
+			}
+			s = s[end+2:]
+		} else {
+			n := strings.IndexAny(s, ". \t=]")
+			if n < 0 {
+				n = len(s)
+			}
+			part, s = s[:n], s[n:]
+		}
+		parts = append(parts, part)
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ".") {
+			return parts, s
+		}
+		s = s[1:]
+	}
+}
+
+func writeToml(buf *bytes.Buffer, s *IniSection, table []string) {
+	if len(table) > 0 {
+		var strs []string
+		for _, name := range table {
+			strs = append(strs, tomlKeyString(name))
+		}
+		buf.WriteString("\n[" + strings.Join(strs, ".") + "]\n")
+	}
+	for _, v := range s.Values {
+		buf.WriteString(tomlKeyString(v[0]) + " = " + tomlString(v[1]) + "\n")
+	}
+	for _, s2 := range s.Sections {
+		writeToml(buf, s2, append(table[:len(table):len(table)], s2.Name))
+	}
+}
+
+func tomlKeyString(key string) string {
+	for _, c := range key {
+		if !(c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return tomlString(key)
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+	return key
+}
+
+// tomlString is a toml basic string
+func tomlString(str string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range str {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(c)
+		case c == '\n':
+			sb.WriteString(`\n`)
+		case c == '\t':
+			sb.WriteString(`\t`)
+		case c == '\r':
+			sb.WriteString(`\r`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&sb, `\u%04X`, c)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+type jsonParser struct {
+	dec     *json.Decoder
+	content string
+}
+
+func parseJson(content string) (*IniSection, error) {
+	self := &jsonParser{dec: json.NewDecoder(strings.NewReader(content)), content: content}
+	self.dec.UseNumber()
+	top := newSection("", 0, nil)
+	t, err := self.dec.Token()
+	if err != nil {
+		return nil, self.error(err)
+	}
+	if t != json.Delim('{') {
+		return nil, fmt.Errorf("line %d: expect an object of keys to values and sections", self.line(self.dec.InputOffset()))
+	}
+	if err := self.object(top); err != nil {
+		return nil, self.error(err)
+	}
+	if _, err := self.dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("line %d: unexpected data after the object", self.line(self.dec.InputOffset()))
+	}
+	return top, nil
+}
+
+func (self *jsonParser) line(offset int64) int {
+	if offset > int64(len(self.content)) {
+		offset = int64(len(self.content))
+	}
+	return 1 + strings.Count(self.content[:offset], "\n")
+}
+
+func (self *jsonParser) error(err error) error {
+	if e, ok := err.(*json.SyntaxError); ok {
+		return fmt.Errorf("line %d: %s", self.line(e.Offset), e)
+	}
+	if err == io.EOF {
+		return fmt.Errorf("line %d: unexpected end of JSON input", self.line(int64(len(self.content))))
+	}
+	return err
+}
+
+// object reads the keys of an object into s, after its {
+func (self *jsonParser) object(s *IniSection) error {
+	for self.dec.More() {
+		t, err := self.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := t.(string)
+		ln := self.line(self.dec.InputOffset())
+		if t, err = self.dec.Token(); err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'):
+			s2, err := addSection(s, key, ln)
+			if err != nil {
+				return err
+			}
+			if err := self.object(s2); err != nil {
+				return err
+			}
+		case json.Delim('['):
+			var strs []string
+			for self.dec.More() {
+				t, err := self.dec.Token()
+				if err != nil {
+					return err
+				}
+				str, ok := scalarString(t)
+				if !ok {
+					return fmt.Errorf("line %d: %s may only list scalars", self.line(self.dec.InputOffset()), key)
+				}
+				strs = append(strs, str)
+			}
+			if _, err := self.dec.Token(); err != nil {
+				return err
+			}
+			if err := addValue(s, key, strings.Join(strs, ", "), ln); err != nil {
+				return err
+			}
+		default:
+			str, _ := scalarString(t)
+			if err := addValue(s, key, str, ln); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := self.dec.Token()
+	return err
+}
+
+func writeJson(buf *bytes.Buffer, s *IniSection, indent string) {
+	buf.WriteString("{")
+	n := 0
+	for _, v := range s.Values {
+		if n++; n > 1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n" + indent + "  " + jsonString(v[0]) + ": " + jsonString(v[1]))
+	}
+	for _, s2 := range s.Sections {
+		if n++; n > 1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n" + indent + "  " + jsonString(s2.Name) + ": ")
+		writeJson(buf, s2, indent+"  ")
+	}
+	if n > 0 {
+		buf.WriteString("\n" + indent)
+	}
+	buf.WriteString("}")
+}
+
+// jsonString does not escape <, > and & of expressions
+func jsonString(str string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(str)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func writeIni(buf *bytes.Buffer, s *IniSection) error {
+	for _, v := range s.Values {
+		if v[0] == "" || strings.ContainsAny(v[0], "=\n") || strings.ContainsAny(v[0][:1], "[#;%") {
+			return fmt.Errorf("key %q can not be written to an ini file", v[0])
+		}
+		buf.WriteString(v[0] + " = " + iniQuote(v[1]) + "\n")
+	}
+	for _, s2 := range s.Sections {
+		if strings.ContainsAny(s2.Name, "[]\n") {
+			return fmt.Errorf("section %q can not be written to an ini file", s2.Name)
+		}
+		if s2.Depth == 1 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(strings.Repeat("[", s2.Depth) + s2.Name + strings.Repeat("]", s2.Depth) + "\n")
+		if err := writeIni(buf, s2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iniQuote quotes values lexIni would not read back as they are
+func iniQuote(value string) string {
+	if strings.HasPrefix(value, `"`) || strings.ContainsAny(value, "\n\r") || strings.HasSuffix(value, `\`) ||
+		value != strings.TrimSpace(value) {
+		return strconv.Quote(value)
+	}
+	if str, _ := stripComment(value, 0); str != value {
+		return strconv.Quote(value)
+	}
+	return value
+}
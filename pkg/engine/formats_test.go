@@ -0,0 +1,179 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func exprString(e *Expression) string {
+	if e == nil {
+		return ""
+	}
+	return e.A + ":" + e.E.String()
+}
+
+// portfolioString has what a portfolio evaluates, NaN bounds compare equal
+// in it
+func portfolioString(p *Portfolio) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s acc=%s filter=%s\n", p.Name, p.AccPatterns, exprString(p.Filter))
+	for _, r := range p.RiskDefs {
+		fmt.Fprintf(&sb, "[%s] %s names=%q filter=%s groups=", r.Name, r.DisplayName, r.GroupNames, exprString(r.Filter))
+		for _, g := range r.Groups {
+			if e, ok := g.(*Expression); ok {
+				sb.WriteString(exprString(e) + "; ")
+			} else {
+				fmt.Fprint(&sb, g, "; ")
+			}
+		}
+		sb.WriteString("\n")
+		for _, rp := range r.Params {
+			fmt.Fprintf(&sb, "[[%s]] %s upper=%v lower=%v stop=%v window=%v graph=%v\n",
+				rp.Name, exprString(rp.Formula), rp.UpperBound, rp.LowerBound, rp.TradeStop, rp.Window, rp.Graph)
+			for _, v := range rp.Variables {
+				fmt.Fprintf(&sb, "%s = %s\n", v.Name, exprString(v.E))
+			}
+			sb.WriteString(rp.Source)
+		}
+	}
+	return sb.String()
+}
+
+func parsePortfolioFormat(t *testing.T, format string, content string) string {
+	cfg, err := parseRisk(format, content)
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", format, err, content)
+	}
+	p, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", format, err, content)
+	}
+	return portfolioString(p)
+}
+
+var roundTripEdges = map[string]string{
+	"quoted": strings.Join([]string{
+		"%dialect 2",
+		`name = "\"quoted\" desk"`,
+		"acc = *",
+		"[quoted]",
+		`f = "SH" == Market`,
+		"group = acc",
+		"name = a $${b}",
+		"[[p]]",
+		"formula = sum(Pos)",
+	}, "\n"),
+	"legacy": strings.Join([]string{
+		`name = "desk"`,
+		"[legacy]",
+		"name = a ${b} # c",
+		"group = acc, sector",
+		"[[p]]",
+		"formula = sum(Pos)",
+		"upper_bound = 5 \\",
+	}, "\n"),
+	"nan": strings.Join([]string{
+		"%dialect 2",
+		"[bounds]",
+		"[[p]]",
+		"formula = sum(Pos)",
+		"upper_bound = 1, NaN, 3",
+		"lower_bound = nan, -1",
+		"trade_stop = true",
+		"window = 60, max",
+	}, "\n"),
+	"empty": strings.Join([]string{
+		"%dialect 2",
+		"[empty]",
+		"[other]",
+		"[[p]]",
+		"[[q]]",
+		"formula = sum(Pos)",
+	}, "\n"),
+	"var": strings.Join([]string{
+		"%dialect 2",
+		"[vars]",
+		"group = acc, sector",
+		"[[p]]",
+		"formula = sum(A * B)",
+		"[[[var]]]",
+		"A = Pos",
+		"B = Close",
+		"[[q]]",
+		"formula = max(Pos)",
+		"[[[var]]]",
+	}, "\n"),
+}
+
+func TestRoundTrip(t *testing.T) {
+	b, err := ioutil.ReadFile("template.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"template.ini": string(b)}
+	for name, content := range roundTripEdges {
+		files[name] = content
+	}
+	for name, content := range files {
+		cfg, err := ParseFormat("ini", content)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := parsePortfolioFormat(t, "ini", content)
+		for _, format := range []string{"yaml", "toml", "json", "ini"} {
+			out, err := WriteFormat(format, cfg)
+			if err != nil {
+				t.Fatalf("%s to %s: %v", name, format, err)
+			}
+			back, err := ParseFormat(format, out)
+			if err != nil {
+				t.Fatalf("%s to %s: %v\n%s", name, format, err, out)
+			}
+			if err := CompareIni(cfg, back); err != nil {
+				t.Errorf("%s to %s: %v\n%s", name, format, err, out)
+				continue
+			}
+			ini, err := WriteFormat("ini", back)
+			if err != nil {
+				t.Fatalf("%s from %s: %v", name, format, err)
+			}
+			for i, got := range []string{parsePortfolioFormat(t, format, out), parsePortfolioFormat(t, "ini", ini)} {
+				if got != want {
+					t.Errorf("%s via %s (%d):\n%s\nwant\n%s", name, format, i, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestIniIncludes(t *testing.T) {
+	got := IniIncludes("%dialect 2\n%include firm/a.ini  # a\n[x]\n%include \"firm/b c.ini\"\n")
+	if strings.Join(got, ",") != "firm/a.ini,firm/b c.ini" {
+		t.Errorf("got %q", got)
+	}
+	if got := IniIncludes("%include firm/a.ini\n"); len(got) != 0 {
+		t.Errorf("legacy file: got %q", got)
+	}
+}
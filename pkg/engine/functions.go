@@ -0,0 +1,492 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// The function library besides the math helpers, each in predefinedFunctions
+// for govaluate and in functionTypes for the type checker and compiler.
+// Arguments govaluate passes of another type, like nil of c ? x, are NaN
+// or "" instead of failing.
+
+// inFunction is the name govaluate knows in(x, list) by, in alone is the
+// operator of x in (a, b)
+const inFunction = "in_"
+
+// renameInCalls renames the in( calls of expr that do not follow a value
+func renameInCalls(expr string) string {
+	var out strings.Builder
+	afterValue := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				j = len(expr) - 1
+			}
+			out.WriteString(expr[i : j+1])
+			i = j
+			afterValue = true
+		case c == '[':
+			j := strings.IndexByte(expr[i:], ']')
+			if j < 0 {
+				j = len(expr) - 1 - i
+			}
+			out.WriteString(expr[i : i+j+1])
+			i += j
+			afterValue = true
+		case isNameChar(rune(c)):
+			j := i
+			for j < len(expr) && isNameChar(rune(expr[j])) {
+				j++
+			}
+			name := expr[i:j]
+			if name == "in" && !afterValue && strings.HasPrefix(strings.TrimLeft(expr[j:], " \t"), "(") {
+				name = inFunction
+			}
+			out.WriteString(name)
+			i = j - 1
+			afterValue = name != "in" && name != "IN"
+		default:
+			out.WriteByte(c)
+			if c != ' ' && c != '\t' {
+				afterValue = c == ')'
+			}
+		}
+	}
+	return out.String()
+}
+
+// exprFunctions are predefinedFunctions with list() reading the files of
+// the user directory dir
+func exprFunctions(dir string) map[string]govaluate.ExpressionFunction {
+	out := make(map[string]govaluate.ExpressionFunction, len(predefinedFunctions))
+	for name, f := range predefinedFunctions {
+		out[name] = f
+	}
+	out["list"] = listFunction(dir)
+	return out
+}
+
+func numberArg(args []interface{}, i int) float64 {
+	if i < len(args) {
+		if v, ok := args[i].(float64); ok {
+			return v
+		}
+	}
+	return math.NaN()
+}
+
+func stringArg(args []interface{}, i int) string {
+	if i < len(args) {
+		if v, ok := args[i].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func isMissing(v interface{}) bool {
+	f, ok := v.(float64)
+	return v == nil || (ok && math.IsNaN(f))
+}
+
+func evalIf(args ...interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("if() takes (bool, any, any), got %d", len(args))
+	}
+	if c, _ := args[0].(bool); c {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+func evalCoalesce(args ...interface{}) (interface{}, error) {
+	for _, a := range args {
+		if !isMissing(a) {
+			return a, nil
+		}
+	}
+	return math.NaN(), nil
+}
+
+func evalIn(args ...interface{}) (interface{}, error) {
+	if len(args) < 2 {
+		return false, nil
+	}
+	list, _ := args[len(args)-1].([]interface{})
+	for _, v := range list {
+		if v == args[0] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func evalRegexMatch(args ...interface{}) (interface{}, error) {
+	re := cachedRegexp(stringArg(args, 1))
+	return re != nil && re.MatchString(stringArg(args, 0)), nil
+}
+
+// evalNumber passes n args to f, NaN for those missing
+func evalNumber(n int, f func(args []float64) float64) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		nums := make([]float64, n)
+		for i := range nums {
+			nums[i] = numberArg(args, i)
+		}
+		return f(nums), nil
+	}
+}
+
+func evalStringTest(f func(string, string) bool) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		return f(stringArg(args, 0), stringArg(args, 1)), nil
+	}
+}
+
+func sign(a float64) float64 {
+	switch {
+	case a > 0:
+		return 1
+	case a < 0:
+		return -1
+	}
+	// 0 or NaN
+	return a
+}
+
+func clamp(a float64, lo float64, hi float64) float64 {
+	return math.Max(lo, math.Min(a, hi))
+}
+
+func now() float64 {
+	return float64(time.Now().Unix())
+}
+
+func today() float64 {
+	y, m, d := time.Now().Date()
+	return float64(time.Date(y, m, d, 0, 0, 0, 0, time.Local).Unix())
+}
+
+// timeField is f of the local time of unix seconds, like dates govaluate
+// reads from strings
+func timeField(f func(t time.Time) int) func(float64) float64 {
+	return func(secs float64) float64 {
+		if math.IsNaN(secs) || math.IsInf(secs, 0) {
+			return math.NaN()
+		}
+		return float64(f(time.Unix(int64(secs), 0)))
+	}
+}
+
+var timeFields = map[string]func(float64) float64{
+	"year":    timeField(func(t time.Time) int { return t.Year() }),
+	"month":   timeField(func(t time.Time) int { return int(t.Month()) }),
+	"day":     timeField(func(t time.Time) int { return t.Day() }),
+	"hour":    timeField(func(t time.Time) int { return t.Hour() }),
+	"minute":  timeField(func(t time.Time) int { return t.Minute() }),
+	"weekday": timeField(func(t time.Time) int { return int(t.Weekday()) }),
+}
+
+func daysBetween(a float64, b float64) float64 {
+	return (b - a) / 86400
+}
+
+func init() {
+	for name, f := range timeFields {
+		f := f
+		predefinedFunctions[name] = evalNumber(1, func(args []float64) float64 { return f(args[0]) })
+		functionTypes[name] = number1(f)
+	}
+}
+
+var regexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// cachedRegexp compiles patterns of regexMatch() once, nil if invalid
+func cachedRegexp(pattern string) *regexp.Regexp {
+	regexps.Lock()
+	defer regexps.Unlock()
+	re, ok := regexps.m[pattern]
+	if !ok {
+		re, _ = regexp.Compile(pattern)
+		if len(regexps.m) > 1000 {
+			regexps.m = make(map[string]*regexp.Regexp)
+		}
+		regexps.m[pattern] = re
+	}
+	return re
+}
+
+// IsListFile tells if fn is a file of list() values rather than a portfolio
+// or python
+func IsListFile(fn string) bool {
+	return path.Ext(fn) == ".csv"
+}
+
+// symbolList is the first column of a list("file.csv"), found and read
+// again when the files change
+type symbolList struct {
+	dir     string
+	name    string
+	fn      string // the file read, empty if there is none
+	mtime   time.Time
+	checked time.Time
+	values  []interface{}
+	set     map[string]bool
+}
+
+var symbolLists = struct {
+	sync.Mutex
+	m map[string]*symbolList // by dir and name
+}{m: make(map[string]*symbolList)}
+
+// listRecheck is how often a list file is checked for changes
+const listRecheck = time.Second
+
+// loadList finds name in dir, else in SharedDir, as python modules
+func loadList(dir string, name string) (*symbolList, error) {
+	if err := ValidateFileName(name); err != nil || path.Ext(name) != ".csv" {
+		return nil, fmt.Errorf("invalid list file name: %s", name)
+	}
+	key := dir + "\x00" + name
+	symbolLists.Lock()
+	defer symbolLists.Unlock()
+	if l := symbolLists.m[key]; l != nil {
+		return l, nil
+	}
+	l := &symbolList{dir: dir, name: name}
+	fn := l.find()
+	if fn == "" {
+		return nil, fmt.Errorf("list file not found: %s", name)
+	}
+	if err := l.load(fn); err != nil {
+		return nil, err
+	}
+	symbolLists.m[key] = l
+	return l, nil
+}
+
+// find is the file of the list, in dir, else in SharedDir, empty if there
+// is none
+func (self *symbolList) find() string {
+	for _, d := range []string{self.dir, SharedDir} {
+		if d == "" {
+			continue
+		}
+		fn := path.Join(d, self.name)
+		if _, err := os.Stat(fn); err == nil {
+			return fn
+		}
+	}
+	return ""
+}
+
+func (self *symbolList) load(fn string) error {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	var values []interface{}
+	set := make(map[string]bool)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		v := strings.TrimSpace(rec[0])
+		if v == "" || set[v] {
+			continue
+		}
+		set[v] = true
+		values = append(values, v)
+	}
+	self.fn = fn
+	self.mtime = st.ModTime()
+	self.checked = time.Now()
+	self.values = values
+	self.set = set
+	return nil
+}
+
+// get returns the values, finding and reading the file again if another
+// one shadows it or it changed, a file failing to read keeps the values
+// read before, a removed one leaves the list empty
+func (self *symbolList) get() ([]interface{}, map[string]bool) {
+	symbolLists.Lock()
+	defer symbolLists.Unlock()
+	if now := time.Now(); now.Sub(self.checked) >= listRecheck {
+		self.checked = now
+		fn := self.find()
+		if fn == "" {
+			if self.fn != "" {
+				log.Println("list file removed:", self.fn)
+				self.fn, self.mtime, self.values, self.set = "", time.Time{}, nil, map[string]bool{}
+			}
+		} else if st, err := os.Stat(fn); err == nil && (fn != self.fn || !st.ModTime().Equal(self.mtime)) {
+			if err := self.load(fn); err != nil {
+				log.Println("failed to reload list", err)
+			}
+		}
+	}
+	return self.values, self.set
+}
+
+func listFunction(dir string) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		l, err := loadList(dir, stringArg(args, 0))
+		if err != nil {
+			return nil, err
+		}
+		values, _ := l.get()
+		return values, nil
+	}
+}
+
+// functions whose result depends on the args, or that check literals
+
+func checkIf(self *typeChecker, args []*node) (*node, error) {
+	if _, err := sameType(args[1].t, args[2].t, "if()"); err != nil {
+		return nil, err
+	}
+	return compileTernary(args[0], args[1], args[2])
+}
+
+func checkCoalesce(self *typeChecker, args []*node) (*node, error) {
+	t := args[0].t
+	for _, a := range args[1:] {
+		var err error
+		if t, err = sameType(t, a.t, "coalesce()"); err != nil {
+			return nil, err
+		}
+	}
+	if !compiled(args...) {
+		return &node{t: t}, nil
+	}
+	if t != typeNumber {
+		// only nil is skipped, compiled values are never nil
+		return args[0], nil
+	}
+	nums := make([]func(e *exprEnv) float64, len(args))
+	for i, a := range args {
+		nums[i] = a.num
+	}
+	return numberNode(func(e *exprEnv) float64 {
+		var v float64
+		for _, f := range nums {
+			if v = f(e); !math.IsNaN(v) {
+				break
+			}
+		}
+		return v
+	}), nil
+}
+
+func checkIn(self *typeChecker, args []*node) (*node, error) {
+	return compileComparison("in", args[0], args[1]), nil
+}
+
+func checkRegexMatch(self *typeChecker, args []*node) (*node, error) {
+	if p, ok := args[1].lit.(string); ok {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("regexMatch(): %v", err)
+		}
+		if !compiled(args[0]) {
+			return &node{t: typeBool}, nil
+		}
+		a := args[0].str
+		return boolNode(func(e *exprEnv) bool { return re.MatchString(a(e)) }), nil
+	}
+	if !compiled(args...) {
+		return &node{t: typeBool}, nil
+	}
+	a, p := args[0].str, args[1].str
+	return boolNode(func(e *exprEnv) bool {
+		re := cachedRegexp(p(e))
+		return re != nil && re.MatchString(a(e))
+	}), nil
+}
+
+func checkList(self *typeChecker, args []*node) (*node, error) {
+	name, ok := args[0].lit.(string)
+	if !ok {
+		return nil, fmt.Errorf("list() needs the name of a .csv file in quotes")
+	}
+	l, err := loadList(self.path, name)
+	if err != nil {
+		return nil, fmt.Errorf("list(): %v", err)
+	}
+	return &node{t: typeList, set: l}, nil
+}
+
+func stringTest(f func(string, string) bool) funcType {
+	return funcType{Args: []exprType{typeString, typeString}, Result: typeBool, Compile: func(args []*node) *node {
+		a, b := args[0].str, args[1].str
+		return boolNode(func(e *exprEnv) bool { return f(a(e), b(e)) })
+	}}
+}
+
+func compileClamp(args []*node) *node {
+	a, lo, hi := args[0].num, args[1].num, args[2].num
+	return numberNode(func(e *exprEnv) float64 { return clamp(a(e), lo(e), hi(e)) })
+}
+
+func number0(f func() float64) funcType {
+	return funcType{Result: typeNumber, Compile: func([]*node) *node {
+		return numberNode(func(*exprEnv) float64 { return f() })
+	}}
+}
@@ -0,0 +1,140 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, fn string, content string) {
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFunctionTypes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "watch.csv"), "AAA\n")
+	for _, c := range []struct{ expr, err string }{
+		{"if(Pos > 0, 'a', 1)", "if()"},
+		{"if(Pos, 1, 2)", "needs bool"},
+		{"coalesce(Pos, Symbol)", "coalesce()"},
+		{"regexMatch(Symbol, '[') ? 1 : 0", "regexMatch()"},
+		{"regexMatch(Pos, 'a') ? 1 : 0", "needs string"},
+		{"in(Symbol, list(Market)) ? 1 : 0", "list() needs the name"},
+		{"in(Symbol, list('watch.txt')) ? 1 : 0", "invalid list file name"},
+		{"in(Symbol, list('missing.csv')) ? 1 : 0", "list file not found"},
+	} {
+		_, err := ParseExpr("1", c.expr, "formula", nil, 0.0, dir)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, want %s", c.expr, err, c.err)
+		}
+	}
+}
+
+func TestFunctionValues(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "watch.csv"), "# watched\nBBB, why\n\nCCC\n")
+	positions := []*Position{
+		{Security: &Security{Symbol: "AAA", Market: "SH", Adv20: 3}},
+		{Security: &Security{Symbol: "BBB", Market: "HK", Adv20: math.NaN()}},
+	}
+	positions[0].Qty, positions[1].Qty = 10, -5
+	for _, c := range []struct {
+		expr string
+		want []float64
+	}{
+		{"if(Market == 'SH', Pos, -Pos)", []float64{10, 5}},
+		{"if(Pos > 0, Symbol, Market) == 'AAA' ? 1 : 0", []float64{1, 0}},
+		{"coalesce(Adv20, 7)", []float64{3, 7}},
+		{"coalesce(Adv20, NaN, Pos)", []float64{3, -5}},
+		{"in(Market, ('SH', 'SZ')) ? 1 : 0", []float64{1, 0}},
+		{"Market in ('HK', 'US') ? 1 : 0", []float64{0, 1}},
+		{"regexMatch(Symbol, '^A+$') ? 1 : 0", []float64{1, 0}},
+		{"regexMatch(Symbol, Market == 'SH' ? 'B' : 'B') ? 1 : 0", []float64{0, 1}},
+		{"in(Symbol, list('watch.csv')) ? 1 : 0", []float64{0, 1}},
+		{"Symbol in list(\"watch.csv\") ? 2 : 0", []float64{0, 2}},
+	} {
+		e, err := ParseExpr("1", c.expr, "formula", nil, 0.0, dir)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if !e.Compiled() {
+			t.Errorf("%s is not compiled", c.expr)
+		}
+		a, b := govaluated(e, nil, positions), compiledValues(e, nil, positions)
+		for i, v := range c.want {
+			if a[i] != v || b[i] != v {
+				t.Errorf("%s at %d: %v with govaluate, %v compiled, want %v", c.expr, i, a[i], b[i], v)
+			}
+		}
+	}
+}
+
+// listValues are the values of l after a recheck
+func listValues(l *symbolList) string {
+	l.checked = time.Time{}
+	values, set := l.get()
+	var out []string
+	for _, v := range values {
+		out = append(out, v.(string))
+		if !set[v.(string)] {
+			return "not in set: " + v.(string)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func TestLoadList(t *testing.T) {
+	shared := withSharedFiles(t, map[string]string{"watch.csv": "AAA\n"})
+	dir := t.TempDir()
+	l, err := loadList(dir, "watch.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "watch.csv")
+	for _, c := range []struct {
+		change func()
+		want   string
+	}{
+		{func() {}, "AAA"},
+		{func() { writeTestFile(t, fn, "BBB\n") }, "BBB"},
+		{func() { writeTestFile(t, fn, "BBB\nCCC\n"); os.Chtimes(fn, time.Now(), time.Now().Add(time.Minute)) }, "BBB,CCC"},
+		{func() { os.Remove(fn) }, "AAA"},
+		{func() { os.Remove(filepath.Join(shared, "watch.csv")) }, ""},
+		{func() { writeTestFile(t, fn, "DDD\n") }, "DDD"},
+	} {
+		c.change()
+		if got := listValues(l); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+	if _, err := loadList(dir, "other.csv"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("loadList of a missing file: %v", err)
+	}
+}
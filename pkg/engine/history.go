@@ -0,0 +1,422 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// History of graph = true risk parameters is kept in an embedded bolt
+// database. Every series (userId/portfolio/risk/param) has its own bucket,
+// keyed by names rather than pointers so that reparsing portfolios or
+// restarting the server does not lose it. Inside a bucket the keys are
+// series + "\x00" + big endian unix seconds, the values are float64 bits,
+// where series is the group name, or group + "\x1f" + symbol for the items
+// of non-aggregate (top or call() list) formulas.
+
+var HistoryRetention = 7 * 24 * time.Hour
+
+var historyDb *bolt.DB
+var historyLock sync.Mutex
+var historyTails = make(map[string]*historyTail)
+var historyPending []historyOp
+var historyPruned time.Time
+
+type historyTail struct {
+	Points [][2]float64 // the last two points of the series, at most
+}
+
+type historyOp struct {
+	Bucket string
+	Key    []byte
+	Value  []byte // nil for delete
+}
+
+func OpenHistory(fn string, retention time.Duration) error {
+	db, err := bolt.Open(fn, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	historyDb = db
+	if retention > 0 {
+		HistoryRetention = retention
+	}
+	return nil
+}
+
+func CloseHistory() {
+	FlushHistory()
+	if historyDb != nil {
+		historyDb.Close()
+		historyDb = nil
+	}
+}
+
+func historyBucket(userId int, portfolio string, risk string, param string) string {
+	return strings.Join([]string{strconv.Itoa(userId), portfolio, risk, param}, "\x00")
+}
+
+func HistorySeries(group string, symbol string) string {
+	return group + "\x1f" + symbol
+}
+
+// SplitHistorySeries is the reverse of HistorySeries, symbol is empty for
+// aggregate series.
+func SplitHistorySeries(series string) (group string, symbol string) {
+	i := strings.IndexByte(series, '\x1f')
+	if i < 0 {
+		return series, ""
+	}
+	return series[:i], series[i+1:]
+}
+
+func historyKey(series string, tm float64) []byte {
+	key := make([]byte, 0, len(series)+9)
+	key = append(key, series...)
+	key = append(key, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(key[len(series)+1:], uint64(tm))
+	return key
+}
+
+func parseHistoryKey(key []byte) (series string, tm float64, ok bool) {
+	n := len(key) - 9
+	if n < 0 || key[n] != 0 {
+		return
+	}
+	series = string(key[:n])
+	tm = float64(binary.BigEndian.Uint64(key[n+1:]))
+	ok = true
+	return
+}
+
+func historyValue(v float64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, math.Float64bits(v))
+	return out
+}
+
+// recordHistory appends v to the series, or replaces the last point if it is
+// within one minute of the previous one and has not changed significantly,
+// the same as the in-memory history used to do.
+func recordHistory(bucket string, series string, v float64) {
+	if historyDb == nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	now := float64(time.Now().Unix())
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	id := bucket + "\x01" + series
+	tail := historyTails[id]
+	if tail == nil {
+		tail = &historyTail{}
+		historyTails[id] = tail
+	}
+	tmp := tail.Points
+	n := len(tmp)
+	if n > 1 {
+		tmp1 := tmp[n-2]
+		tmp2 := tmp[n-1]
+		if !(now-tmp1[0] > 60. && math.Abs(tmp1[1]-v) > math.Abs(tmp1[1]+v)/2000.) {
+			if tmp2[0] != now {
+				historyPending = append(historyPending, historyOp{bucket, historyKey(series, tmp2[0]), nil})
+			}
+			historyPending = append(historyPending, historyOp{bucket, historyKey(series, now), historyValue(v)})
+			tmp[n-1] = [2]float64{now, v}
+			return
+		}
+		tmp = tmp[1:]
+	}
+	historyPending = append(historyPending, historyOp{bucket, historyKey(series, now), historyValue(v)})
+	tail.Points = append(tmp, [2]float64{now, v})
+}
+
+// resetHistoryTails forgets the last points of the series of bucket, the
+// next ones are appended
+func resetHistoryTails(bucket string) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	for id := range historyTails {
+		if strings.HasPrefix(id, bucket+"\x01") {
+			delete(historyTails, id)
+		}
+	}
+}
+
+// FlushHistory writes the points recorded since the last call in one
+// transaction, and drops points older than HistoryRetention once an hour.
+func FlushHistory() {
+	if historyDb == nil {
+		return
+	}
+	now := time.Now()
+	historyLock.Lock()
+	ops := historyPending
+	historyPending = nil
+	prune := now.Sub(historyPruned) > time.Hour
+	if prune {
+		historyPruned = now
+	}
+	historyLock.Unlock()
+	if len(ops) > 0 {
+		err := historyDb.Update(func(tx *bolt.Tx) error {
+			for _, op := range ops {
+				b, err := tx.CreateBucketIfNotExists([]byte(op.Bucket))
+				if err != nil {
+					return err
+				}
+				if op.Value == nil {
+					err = b.Delete(op.Key)
+				} else {
+					err = b.Put(op.Key, op.Value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("failed to write history:", err)
+		}
+	}
+	if prune {
+		evictHistoryTails(float64(now.Add(-historyTailIdle).Unix()))
+		if err := pruneHistory(float64(now.Add(-HistoryRetention).Unix())); err != nil {
+			log.Println("failed to prune history:", err)
+		}
+	}
+}
+
+// a series not recorded for historyTailIdle, like a symbol that left a top
+// list, starts again with a new point instead of keeping its tail in memory
+var historyTailIdle = time.Hour
+
+func evictHistoryTails(before float64) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	for id, tail := range historyTails {
+		if n := len(tail.Points); n == 0 || tail.Points[n-1][0] < before {
+			delete(historyTails, id)
+		}
+	}
+}
+
+// the most points deleted in one write transaction when pruning, so that
+// recording is not blocked for long
+var historyPruneBatch = 10000
+
+// nextSeries is the smallest key after every key of series
+func nextSeries(series string) []byte {
+	return append([]byte(series), 1)
+}
+
+func pruneHistory(before float64) error {
+	var names [][]byte
+	err := historyDb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		for more := true; more; {
+			more = false
+			err := historyDb.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(name)
+				if b == nil {
+					return nil
+				}
+				var old [][]byte
+				c := b.Cursor()
+				for k, _ := c.First(); k != nil; {
+					series, tm, ok := parseHistoryKey(k)
+					if ok && tm >= before {
+						// keys of a series are in time order
+						k, _ = c.Seek(nextSeries(series))
+						continue
+					}
+					if ok {
+						if len(old) == historyPruneBatch {
+							more = true
+							break
+						}
+						old = append(old, append([]byte(nil), k...))
+					}
+					k, _ = c.Next()
+				}
+				for _, k := range old {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+				if k, _ := b.Cursor().First(); k == nil {
+					return tx.DeleteBucket(name)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// QueryHistory returns the points of every group of a risk parameter within
+// [from, to] in unix seconds, to <= 0 means up to now.
+func QueryHistory(userId int, portfolio string, risk string, param string, from float64, to float64) map[string][][2]float64 {
+	out := make(map[string][][2]float64)
+	if historyDb == nil {
+		return out
+	}
+	FlushHistory()
+	if to <= 0 {
+		to = math.MaxFloat64
+	}
+	if from < 0 {
+		from = 0
+	}
+	historyDb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(historyBucket(userId, portfolio, risk, param)))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; {
+			series, _, ok := parseHistoryKey(k)
+			if !ok {
+				k, _ = c.Next()
+				continue
+			}
+			// seek to from within the series, and to the next series once past to
+			for k, v := c.Seek(historyKey(series, from)); k != nil; k, v = c.Next() {
+				s, tm, ok := parseHistoryKey(k)
+				if !ok || s != series || tm > to {
+					break
+				}
+				if len(v) == 8 {
+					out[series] = append(out[series], [2]float64{tm, math.Float64frombits(binary.BigEndian.Uint64(v))})
+				}
+			}
+			k, _ = c.Seek(nextSeries(series))
+		}
+		return nil
+	})
+	return out
+}
+
+// resolutions tried in order when a client does not ask for one, the first
+// giving no more than MaxHistoryPoints points per series wins
+var historyResolutions = []float64{60, 5 * 60, 15 * 60, 3600, 4 * 3600, 24 * 3600}
+
+var MaxHistoryPoints = 1000
+
+// ParseResolution parses bucket sizes like "30s", "5m", "1h" or "1d", an empty
+// string or "auto" returns 0 (choose automatically), "raw" returns -1.
+func ParseResolution(str string) (float64, error) {
+	str = strings.TrimSpace(strings.ToLower(str))
+	if str == "" || str == "auto" {
+		return 0, nil
+	}
+	if str == "raw" {
+		return -1, nil
+	}
+	if strings.HasSuffix(str, "d") {
+		n, err := strconv.ParseFloat(str[:len(str)-1], 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid resolution: %s", str)
+		}
+		return n * 24 * 3600, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid resolution: %s", str)
+	}
+	return d.Seconds(), nil
+}
+
+// AutoResolution picks the smallest bucket keeping every series within
+// MaxHistoryPoints, or -1 if the raw points are already small enough.
+func AutoResolution(series map[string][][2]float64) float64 {
+	var n int
+	var span float64
+	for _, points := range series {
+		if len(points) > n {
+			n = len(points)
+		}
+		if len(points) > 1 && points[len(points)-1][0]-points[0][0] > span {
+			span = points[len(points)-1][0] - points[0][0]
+		}
+	}
+	if n <= MaxHistoryPoints {
+		return -1
+	}
+	for _, r := range historyResolutions {
+		if span/r <= float64(MaxHistoryPoints) {
+			return r
+		}
+	}
+	return historyResolutions[len(historyResolutions)-1]
+}
+
+// DownsampleHistory aggregates points into buckets of resolution seconds,
+// stamped with the bucket start. agg "ohlc" gives [t, open, high, low, close],
+// anything else gives [t, last]. A resolution <= 0 keeps the raw points.
+func DownsampleHistory(points [][2]float64, resolution float64, agg string) [][]float64 {
+	out := make([][]float64, 0, len(points))
+	ohlc := agg == "ohlc"
+	for _, pt := range points {
+		t := pt[0]
+		if resolution > 0 {
+			t = math.Floor(t/resolution) * resolution
+		}
+		n := len(out)
+		if n > 0 && out[n-1][0] == t {
+			last := out[n-1]
+			if ohlc {
+				last[2] = math.Max(last[2], pt[1])
+				last[3] = math.Min(last[3], pt[1])
+				last[4] = pt[1]
+			} else {
+				last[1] = pt[1]
+			}
+			continue
+		}
+		if ohlc {
+			out = append(out, []float64{t, pt[1], pt[1], pt[1], pt[1]})
+		} else {
+			out = append(out, []float64{t, pt[1]})
+		}
+	}
+	return out
+}
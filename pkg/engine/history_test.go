@@ -0,0 +1,222 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestHistory(t *testing.T) {
+	if err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		CloseHistory()
+		historyTails = make(map[string]*historyTail)
+		historyPruned = time.Time{}
+	})
+}
+
+func putHistory(t *testing.T, bucket string, series string, points ...[2]float64) {
+	err := historyDb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for _, pt := range points {
+			if err := b.Put(historyKey(series, pt[0]), historyValue(pt[1])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryHistoryRange(t *testing.T) {
+	openTestHistory(t)
+	historyPruned = time.Now()
+	bucket := historyBucket(1, "p", "r", "x")
+	putHistory(t, bucket, "a", [2]float64{10, 1}, [2]float64{20, 2}, [2]float64{30, 3})
+	putHistory(t, bucket, "ab", [2]float64{15, 4}, [2]float64{25, 5})
+	putHistory(t, bucket, HistorySeries("a", "AAPL"), [2]float64{5, 6}, [2]float64{40, 7})
+	got := QueryHistory(1, "p", "r", "x", 15, 30)
+	want := map[string][][2]float64{
+		"a":  {{20, 2}, {30, 3}},
+		"ab": {{15, 4}, {25, 5}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryHistory(15, 30) = %v, want %v", got, want)
+	}
+	got = QueryHistory(1, "p", "r", "x", 0, 0)
+	if len(got["a"]) != 3 || len(got["ab"]) != 2 || len(got["a\x1fAAPL"]) != 2 {
+		t.Errorf("QueryHistory(0, 0) = %v, want every point", got)
+	}
+	if got := QueryHistory(1, "p", "r", "y", 0, 0); len(got) != 0 {
+		t.Errorf("QueryHistory of a missing param = %v", got)
+	}
+}
+
+func TestPruneHistoryBatches(t *testing.T) {
+	openTestHistory(t)
+	defer func(n int) { historyPruneBatch = n }(historyPruneBatch)
+	historyPruneBatch = 3
+	historyPruned = time.Now()
+	bucket := historyBucket(1, "p", "r", "x")
+	var points [][2]float64
+	for i := 0; i < 10; i++ {
+		points = append(points, [2]float64{float64(100 + i), float64(i)})
+	}
+	putHistory(t, bucket, "a", points...)
+	putHistory(t, bucket, "b", [2]float64{100, 1}, [2]float64{101, 2})
+	putHistory(t, historyBucket(1, "p", "r", "old"), "a", [2]float64{1, 1})
+	if err := pruneHistory(105); err != nil {
+		t.Fatal(err)
+	}
+	got := QueryHistory(1, "p", "r", "x", 0, 0)
+	if len(got["a"]) != 5 || got["a"][0][0] != 105 || len(got["b"]) != 0 {
+		t.Errorf("after prune = %v, want a from 105 and no b", got)
+	}
+	historyDb.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(historyBucket(1, "p", "r", "old"))) != nil {
+			t.Error("empty bucket not deleted")
+		}
+		return nil
+	})
+}
+
+func TestEvictHistoryTails(t *testing.T) {
+	openTestHistory(t)
+	historyPruned = time.Now()
+	recordHistory("b", HistorySeries("", "AAPL"), 1)
+	recordHistory("b", HistorySeries("", "MSFT"), 2)
+	historyTails["b\x01"+HistorySeries("", "MSFT")].Points[0][0] -= 2 * historyTailIdle.Seconds()
+	evictHistoryTails(float64(time.Now().Add(-historyTailIdle).Unix()))
+	if _, ok := historyTails["b\x01"+HistorySeries("", "MSFT")]; ok {
+		t.Error("idle tail kept")
+	}
+	if _, ok := historyTails["b\x01"+HistorySeries("", "AAPL")]; !ok {
+		t.Error("recent tail evicted")
+	}
+}
+
+func TestPruneHistoryRetention(t *testing.T) {
+	openTestHistory(t)
+	defer func(d time.Duration) { HistoryRetention = d }(HistoryRetention)
+	HistoryRetention = time.Hour
+	now := float64(time.Now().Unix())
+	bucket := historyBucket(1, "p", "r", "x")
+	putHistory(t, bucket, "a", [2]float64{now - 7200, 1}, [2]float64{now - 3601, 2}, [2]float64{now - 1800, 3}, [2]float64{now, 4})
+	putHistory(t, bucket, "b", [2]float64{now - 5000, 5})
+	// historyPruned is zero, so this flush prunes
+	FlushHistory()
+	got := QueryHistory(1, "p", "r", "x", 0, 0)
+	want := map[string][][2]float64{"a": {{now - 1800, 3}, {now, 4}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after retention prune = %v, want %v", got, want)
+	}
+}
+
+func TestParseResolution(t *testing.T) {
+	for _, c := range []struct {
+		str  string
+		want float64
+		err  bool
+	}{
+		{"", 0, false},
+		{" Auto ", 0, false},
+		{"raw", -1, false},
+		{"30s", 30, false},
+		{"5m", 300, false},
+		{"1h", 3600, false},
+		{"1H30M", 5400, false},
+		{"2d", 2 * 86400, false},
+		{"0.5d", 43200, false},
+		{"500ms", 0, true},
+		{"0s", 0, true},
+		{"0d", 0, true},
+		{"-1d", 0, true},
+		{"d", 0, true},
+		{"5", 0, true},
+		{"5x", 0, true},
+	} {
+		got, err := ParseResolution(c.str)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("ParseResolution(%q) = %v, %v", c.str, got, err)
+		}
+	}
+}
+
+func TestAutoResolution(t *testing.T) {
+	defer func(n int) { MaxHistoryPoints = n }(MaxHistoryPoints)
+	MaxHistoryPoints = 10
+	series := func(n int, step float64) [][2]float64 {
+		var out [][2]float64
+		for i := 0; i < n; i++ {
+			out = append(out, [2]float64{float64(i) * step, 0})
+		}
+		return out
+	}
+	for _, c := range []struct {
+		series map[string][][2]float64
+		want   float64
+	}{
+		{map[string][][2]float64{}, -1},
+		{map[string][][2]float64{"a": series(10, 1)}, -1},
+		{map[string][][2]float64{"a": series(11, 1)}, 60},
+		{map[string][][2]float64{"a": series(11, 60)}, 60},
+		{map[string][][2]float64{"a": series(11, 61)}, 300},
+		{map[string][][2]float64{"a": series(2, 86400), "b": series(100, 60)}, 4 * 3600},
+		{map[string][][2]float64{"a": series(100, 86400)}, 86400},
+	} {
+		if got := AutoResolution(c.series); got != c.want {
+			t.Errorf("AutoResolution(%v) = %v, want %v", c.series, got, c.want)
+		}
+	}
+}
+
+func TestDownsampleHistory(t *testing.T) {
+	points := [][2]float64{{0, 1}, {59, 3}, {60, 2}, {61, 5}, {119, 4}, {300, 6}}
+	for _, c := range []struct {
+		resolution float64
+		agg        string
+		want       [][]float64
+	}{
+		{60, "last", [][]float64{{0, 3}, {60, 4}, {300, 6}}},
+		{60, "ohlc", [][]float64{{0, 1, 3, 1, 3}, {60, 2, 5, 2, 4}, {300, 6, 6, 6, 6}}},
+		{300, "", [][]float64{{0, 4}, {300, 6}}},
+		{-1, "", [][]float64{{0, 1}, {59, 3}, {60, 2}, {61, 5}, {119, 4}, {300, 6}}},
+	} {
+		if got := DownsampleHistory(points, c.resolution, c.agg); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("DownsampleHistory(%v, %q) = %v, want %v", c.resolution, c.agg, got, c.want)
+		}
+	}
+	if got := DownsampleHistory(nil, 60, "ohlc"); len(got) != 0 {
+		t.Errorf("DownsampleHistory(nil) = %v", got)
+	}
+}
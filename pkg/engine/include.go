@@ -0,0 +1,195 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Firm wide risk files live in SharedDir of the working directory. A section
+// of a user .ini file, or the top of it, inherits from shared files with
+//
+//   include = firm/limits.ini, firm/var.ini
+//
+// the values and sections of the included files come first, later files and
+// the including section override them, sections of the same name merging
+// recursively. Shared files may include other shared files. Python modules
+// of call() are looked up in the user directory, then SharedDir, which needs
+// an __init__.py and a base name that is a python identifier, its parent is
+// put on PYTHONPATH.
+
+var SharedDir = "firm"
+
+// ValidateSharedDir checks the base name of dir can be imported as a python
+// package
+func ValidateSharedDir(dir string) error {
+	base := filepath.Base(filepath.Clean(dir))
+	for i, c := range base {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || i > 0 && c >= '0' && c <= '9') {
+			return fmt.Errorf("invalid shared directory %s, its name %s is not a python identifier", dir, base)
+		}
+	}
+	return nil
+}
+
+const includeKey = "include"
+
+// ParseRiskIni parses a user .ini file and expands its includes, values
+// are interpolated after so they may refer to included ones
+func ParseRiskIni(content string) (*IniSection, error) {
+	cfg, err := parseIni(content, "", sharedIncludes)
+	if err != nil {
+		return nil, err
+	}
+	if err := expandIncludes(cfg, sharedIncludes); err != nil {
+		return nil, err
+	}
+	return cfg, interpolateIni(cfg)
+}
+
+// sharedFile checks an include is a .ini file directly in SharedDir, as
+// firm/x.ini or ./firm/x.ini alike
+func sharedFile(name string) (string, error) {
+	dir, base := path.Split(name)
+	if path.Clean(dir) != path.Clean(SharedDir) || path.Ext(base) != ".ini" || ValidateFileName(base) != nil {
+		return "", fmt.Errorf("invalid include %s, expect %s/<name>.ini", name, SharedDir)
+	}
+	return filepath.Join(SharedDir, base), nil
+}
+
+// An includer reads the files of include keys and %include lines alike, it
+// looks them up with resolve, limits their size and reports cycles. Without
+// resolve includes are empty, for editing.
+type includer struct {
+	resolve func(name string) (string, error) // the path of name
+	stack   []string                          // the files being included
+}
+
+var sharedIncludes = &includer{resolve: sharedFile}
+
+// include reads name, and the includer of its own includes
+func (self *includer) include(name string) (string, *includer, error) {
+	for _, name2 := range self.stack {
+		if name == name2 {
+			return "", nil, fmt.Errorf("include cycle %s", strings.Join(append(self.stack, name), " -> "))
+		}
+	}
+	sub := &includer{resolve: self.resolve, stack: append(self.stack[:len(self.stack):len(self.stack)], name)}
+	if self.resolve == nil {
+		return "", sub, nil
+	}
+	fn, err := self.resolve(name)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("include %s not found", name)
+	} else if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, DefaultMaxFileSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(b) > DefaultMaxFileSize {
+		return "", nil, fmt.Errorf("include %s is larger than %d bytes", name, DefaultMaxFileSize)
+	}
+	return string(b), sub, nil
+}
+
+// expandIncludes replaces s and its sections with the merge of their
+// includes, read with inc or the includer of an %include they are in
+func expandIncludes(s *IniSection, inc *includer) error {
+	if v, ok := s.ValueMap[includeKey]; ok {
+		read := inc
+		if s.inc != nil {
+			read = s.inc
+		}
+		merged := newSection(s.Name, s.Depth, nil)
+		for _, name := range split(v[0], ",") {
+			str, sub, err := read.include(name)
+			if err != nil {
+				return fmt.Errorf("line %s: %s", v[1], err)
+			}
+			cfg, err := parseIni(str, name, sub)
+			if err != nil {
+				return err
+			}
+			if err := expandIncludes(cfg, sub); err != nil {
+				return err
+			}
+			mergeIni(merged, cfg)
+		}
+		delete(s.ValueMap, includeKey)
+		for i, v2 := range s.Values {
+			if v2[0] == includeKey {
+				s.Values = append(s.Values[:i:i], s.Values[i+1:]...)
+				break
+			}
+		}
+		mergeIni(merged, s)
+		s.ValueMap, s.Values = merged.ValueMap, merged.Values
+		s.SectionMap, s.Sections = merged.SectionMap, merged.Sections
+		for _, s2 := range s.Sections {
+			s2.Parent = s
+		}
+	}
+	for _, s2 := range s.Sections {
+		if err := expandIncludes(s2, inc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeIni overrides dst with the values and sections of src
+func mergeIni(dst *IniSection, src *IniSection) {
+	for _, v := range src.Values {
+		if _, ok := dst.ValueMap[v[0]]; ok {
+			for i, v2 := range dst.Values {
+				if v2[0] == v[0] {
+					dst.Values[i] = v
+				}
+			}
+		} else {
+			dst.Values = append(dst.Values, v)
+		}
+		dst.ValueMap[v[0]] = [2]string{v[1], v[2]}
+	}
+	for _, s := range src.Sections {
+		s2 := dst.SectionMap[s.Name]
+		if s2 == nil {
+			s2 = newSection(s.Name, dst.Depth+1, dst)
+		}
+		if s.inc != nil {
+			s2.inc = s.inc
+		}
+		mergeIni(s2, s)
+	}
+}
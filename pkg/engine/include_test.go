@@ -0,0 +1,131 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSharedDir(t *testing.T) {
+	for _, dir := range []string{"firm", "firm/", "/opt/firm", "a/b_2", "../_x"} {
+		if err := ValidateSharedDir(dir); err != nil {
+			t.Errorf("ValidateSharedDir(%q): %v", dir, err)
+		}
+	}
+	for _, dir := range []string{"/opt/my-firm", "a/2b", "firm.d", "."} {
+		if err := ValidateSharedDir(dir); err == nil {
+			t.Errorf("ValidateSharedDir(%q) accepted", dir)
+		}
+	}
+}
+
+// withSharedFiles makes a temp SharedDir with files until the test ends
+func withSharedFiles(t *testing.T, files map[string]string) string {
+	dir := filepath.Join(t.TempDir(), "firm")
+	shared := SharedDir
+	SharedDir = dir
+	t.Cleanup(func() { SharedDir = shared })
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fn, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(strings.ReplaceAll(content, "$SHARED", dir)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludeMerge(t *testing.T) {
+	dir := withSharedFiles(t, map[string]string{
+		"limits.ini": "acc = *\nlimit = 5\n[pnls]\n[[pos]]\nformula = sum(Pos)\nupper_bound = 1\n",
+		"var.ini":    "include = $SHARED/limits.ini\nlimit = 6\n",
+	})
+	cfg, err := ParseRiskIni("name = desk\ninclude = " + dir + "/var.ini\n[pnls]\n[[pos]]\nupper_bound = 7\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := cfg.SectionMap["pnls"].SectionMap["pos"]
+	for _, c := range [][3]string{
+		{cfg.ValueMap["name"][0], "desk"},
+		{cfg.ValueMap["acc"][0], "*"},
+		{cfg.ValueMap["limit"][0], "6"},
+		{pos.ValueMap["formula"][0], "sum(Pos)"},
+		{pos.ValueMap["upper_bound"][0], "7"},
+	} {
+		if c[0] != c[1] {
+			t.Errorf("got %q, want %q", c[0], c[1])
+		}
+	}
+	if _, ok := cfg.ValueMap[includeKey]; ok {
+		t.Error("include key kept")
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := withSharedFiles(t, map[string]string{
+		"a.ini":   "include = $SHARED/b.ini\n",
+		"b.ini":   "x = 1\ninclude = $SHARED/a.ini\n",
+		"c.ini":   "%dialect 2\n%include $SHARED/d.ini\n",
+		"d.ini":   "include = $SHARED/c.ini\n",
+		"big.ini": "x = " + strings.Repeat("1", DefaultMaxFileSize) + "\n",
+	})
+	for _, c := range []struct{ content, err string }{
+		{"include = " + dir + "/a.ini\n", "line 2 of " + dir + "/b.ini: include cycle " + dir + "/a.ini -> " + dir + "/b.ini -> " + dir + "/a.ini"},
+		{"%dialect 2\n%include " + dir + "/a.ini\n", "include cycle " + dir + "/a.ini -> " + dir + "/b.ini -> " + dir + "/a.ini"},
+		{"include = " + dir + "/c.ini\n", "line 1 of " + dir + "/d.ini: include cycle " + dir + "/c.ini -> " + dir + "/d.ini -> " + dir + "/c.ini"},
+		{"include = " + dir + "/big.ini\n", "larger than"},
+		{"%dialect 2\n%include " + dir + "/big.ini\n", "larger than"},
+		{"include = " + dir + "/missing.ini\n", "not found"},
+		{"include = other/a.ini\n", "invalid include"},
+		{"include = " + dir + "/a.py\n", "invalid include"},
+	} {
+		_, err := ParseRiskIni(c.content)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("ParseRiskIni(%q) = %v, want %s", c.content, err, c.err)
+		}
+	}
+}
+
+func TestSharedFile(t *testing.T) {
+	defer func(dir string) { SharedDir = dir }(SharedDir)
+	for _, dir := range []string{"firm", "firm/", "./firm", "./firm/"} {
+		SharedDir = dir
+		for _, name := range []string{"firm/x.ini", "./firm/x.ini", "firm//x.ini"} {
+			if fn, err := sharedFile(name); err != nil || fn != filepath.Join("firm", "x.ini") {
+				t.Errorf("SharedDir %q: sharedFile(%q) = %q, %v", dir, name, fn, err)
+			}
+		}
+		for _, name := range []string{"x.ini", "other/x.ini", "firm/sub/x.ini", "../firm/x.ini", "firm/x.py", "firm/.ini"} {
+			if fn, err := sharedFile(name); err == nil {
+				t.Errorf("SharedDir %q: sharedFile(%q) = %q", dir, name, fn)
+			}
+		}
+	}
+	SharedDir = "/opt/firm/"
+	if fn, err := sharedFile("/opt/firm/x.ini"); err != nil || fn != "/opt/firm/x.ini" {
+		t.Errorf("absolute SharedDir: %q, %v", fn, err)
+	}
+}
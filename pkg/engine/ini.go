@@ -23,10 +23,36 @@ package engine
 import (
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// The ini dialect 2, of files starting with a %dialect 2 line, comments
+// aside:
+//
+//   %dialect 2                      the dialect of the file
+//   [section], [[subsection]] ...   nested by the number of brackets
+//   key = value                     a key once per section
+//   # comment, ; comment            whole lines, or inline after a blank
+//                                   and out of quotes
+//   key = a + \                     a trailing backslash continues a value,
+//     b                             as does an indented line that is not a
+//                                   key = value, joined with a blank
+//   key = "a # b\n"                 a double quoted value is unquoted as a
+//                                   Go string, single quotes are kept for
+//                                   expressions
+//   %include firm/limits.ini        the lines of another file, in place
+//   key = ${other}, ${sec.key}      the value of another key, looked up in
+//                                   the section then its parents, $${ for a
+//                                   literal ${
+//
+// Values keep their order and the line of their key, "n of file" for
+// included lines. Files without %dialect 2 are read as they always were:
+// sections, key = value and whole line comments only, the rest of a line is
+// its value and other lines are ignored. Every file has its own dialect, an
+// %include too.
+
 type IniSection struct {
 	ValueMap   map[string][2]string
 	SectionMap map[string]*IniSection
@@ -35,6 +61,8 @@ type IniSection struct {
 	Parent     *IniSection
 	Depth      int
 	Name       string
+	Line       int       // of the section in its file, 0 for the top
+	inc        *includer // of its include key, read by an %include
 }
 
 func newSection(name string, depth int, parent *IniSection) *IniSection {
@@ -54,67 +82,515 @@ func newSection(name string, depth int, parent *IniSection) *IniSection {
 
 type IniErrSyntax struct {
 	Line int
+	File string // of an %include, empty for the parsed text
 	Text string
 }
 
 func (e IniErrSyntax) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("invalid INI syntax on line %d of %s: %s", e.Line, e.File, e.Text)
+	}
 	return fmt.Sprintf("invalid INI syntax on line %d: %s", e.Line, e.Text)
 }
 
+// ParseIniFile parses fn, %include is relative to its directory
 func ParseIniFile(fn string) (*IniSection, error) {
 	b, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return nil, err
 	}
-	return ParseIni(string(b))
+	dir := filepath.Dir(fn)
+	cfg, err := parseIni(string(b), "", &includer{resolve: func(name string) (string, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return name, nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, interpolateIni(cfg)
 }
 
+// ParseIni parses a risk file, %include reads shared files
 func ParseIni(str string) (*IniSection, error) {
-	lines := strings.Split(str, "\n")
+	cfg, err := parseIni(str, "", sharedIncludes)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, interpolateIni(cfg)
+}
+
+// parseIni parses str without interpolation, file is the name in the line
+// numbers of values
+func parseIni(str string, file string, inc *includer) (*IniSection, error) {
 	s := newSection("", 0, nil)
 	top := s
-	for ln, line := range lines {
-		ln = ln + 1
-		line = strings.Trim(line, " \t\n\r")
-		if line == "" || line[0] == '#' || line[0] == ';' {
-			continue
+	for _, l := range lexIni(str, file, inc) {
+		if l.Err != "" {
+			return nil, IniErrSyntax{Line: l.Ln, File: l.File, Text: l.Err}
 		}
-		if line[0] == '[' {
-			depth := 0
-			for i := 0; i < len(line); i++ {
-				if line[i] != '[' {
-					break
-				}
-				depth = i + 1
+		switch l.Kind {
+		case iniSectionLine:
+			if l.Closing != l.Depth {
+				return nil, IniErrSyntax{Line: l.Ln, File: l.File, Text: "unbalanced section brackets"}
 			}
-			sname := line[depth : len(line)-depth]
-			if depth > s.Depth+1 {
-				return nil, IniErrSyntax{Line: ln, Text: "section with wrong depth"}
+			if l.Depth > s.Depth+1 {
+				return nil, IniErrSyntax{Line: l.Ln, File: l.File, Text: "section with wrong depth"}
 			}
-			n := s.Depth - depth + 1
+			n := s.Depth - l.Depth + 1
 			for i := 0; i < n; i++ {
 				s = s.Parent
 			}
 			parent := s
-			s = parent.SectionMap[sname]
+			s = parent.SectionMap[l.Name]
 			if s != nil {
-				return nil, IniErrSyntax{Line: ln, Text: "duplicate section name on the same level"}
+				return nil, IniErrSyntax{Line: l.Ln, File: l.File, Text: "duplicate section name on the same level"}
+			}
+			s = newSection(l.Name, l.Depth, parent)
+			s.Line = l.Ln
+		case iniValue:
+			if _, ok := s.ValueMap[l.Key]; ok {
+				return nil, IniErrSyntax{Line: l.Ln, File: l.File, Text: "duplicate key " + l.Key + " in the section"}
+			}
+			lns := l.lineStr()
+			value := l.Value
+			if l.Dialect < 2 {
+				// not a reference for interpolateIni
+				value = strings.ReplaceAll(value, "${", "$${")
+			}
+			if l.Key == includeKey && l.File != file {
+				s.inc = l.inc
 			}
-			s = newSection(sname, depth, parent)
+			s.ValueMap[l.Key] = [2]string{value, lns}
+			s.Values = append(s.Values, [3]string{l.Key, value, lns})
+		}
+	}
+	return top, nil
+}
+
+const (
+	iniValue = iota
+	iniSectionLine
+	iniOther // without =, ignored
+	iniComment
+	iniInclude
+	iniDialect
+)
+
+// iniLine is a logical line, its continuation lines joined
+type iniLine struct {
+	Kind    int
+	Ln      int    // of the first physical line
+	File    string // of an %include
+	Col     int    // of the first non blank, from 1
+	Depth   int    // of sections, opening brackets
+	Closing int    // closing brackets
+	Name    string // of sections
+	Key     string
+	Value   string // unquoted, or the text of other lines
+	Raw     string // of values as written
+	VCol    int    // of the value
+	Comment string // inline, or the text of comment lines
+	Dialect int    // of the file of the line
+	Err     string
+	Warn    string    // what the line would mean in dialect 2 if it differs
+	inc     *includer // that read the file of the line
+}
+
+func (l *iniLine) lineStr() string {
+	if l.File != "" {
+		return strconv.Itoa(l.Ln) + " of " + l.File
+	}
+	return strconv.Itoa(l.Ln)
+}
+
+// iniDialectOf is 2 if the first line of lines but comments is %dialect 2
+func iniDialectOf(lines []string) int {
+	for _, line := range lines {
+		text := strings.TrimSpace(line)
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		text, _ = stripComment(text, 0)
+		if f := strings.Fields(text); len(f) == 2 && f[0] == "%dialect" && f[1] == "2" {
+			return 2
+		}
+		break
+	}
+	return 1
+}
+
+// lexIni splits str into logical lines, skipping blanks, inc reads the
+// %include files
+func lexIni(str string, file string, inc *includer) []*iniLine {
+	var out []*iniLine
+	var last *iniLine // the value continuation lines are added to
+	cont := false     // last ends with a backslash
+	var quote byte    // open in the value of last
+	lines := strings.Split(str, "\n")
+	dialect := iniDialectOf(lines)
+	for i, raw := range lines {
+		ln := i + 1
+		line := strings.TrimRight(raw, " \t\r")
+		text := strings.TrimLeft(line, " \t")
+		col := len(line) - len(text) + 1
+		comment := text == "" || text[0] == '#' || text[0] == ';'
+		if dialect < 2 && !comment {
+			l := lexLegacyIni(text, last)
+			l.Ln, l.File, l.Col, l.inc = ln, file, col, inc
+			if l.Kind == iniValue {
+				l.VCol += col
+			}
+			if l.Kind == iniDialect && hasValues(out) {
+				l.Err = "%dialect must be the first line but comments"
+			}
+			out = append(out, l)
+			last = l
+			continue
+		}
+		if last != nil && text != "" && (cont || (col > 1 && !comment && text[0] != '[' && !isKeyLine(text))) {
+			var part string
+			part, quote = stripComment(text, quote)
+			last.addComment(text[len(part):])
+			part, cont = trimContinuation(part)
+			if part != "" {
+				if last.Value != "" {
+					last.Value += " "
+				}
+				last.Value += part
+			}
+			continue
+		}
+		last, cont, quote = nil, false, 0
+		if comment {
+			if text != "" {
+				out = append(out, &iniLine{Kind: iniComment, Ln: ln, File: file, Col: col, Comment: text, Dialect: dialect})
+			}
+			continue
+		}
+		l := &iniLine{Ln: ln, File: file, Col: col, Dialect: dialect, inc: inc}
+		out = append(out, l)
+		if isDirective(text, "%dialect") {
+			l.Kind = iniDialect
+			l.Value, _ = stripComment(strings.TrimSpace(text[8:]), 0)
+			l.addComment(strings.TrimSpace(text[8:])[len(l.Value):])
+			if hasValues(out[:len(out)-1]) {
+				l.Err = "%dialect must be the first line but comments"
+			}
+			continue
+		}
+		if isDirective(text, "%include") {
+			l.Kind = iniInclude
+			name, _ := stripComment(strings.TrimSpace(text[8:]), 0)
+			l.addComment(strings.TrimSpace(text[8:])[len(name):])
+			if u, err := strconv.Unquote(name); err == nil {
+				name = u
+			}
+			l.Value = name
+			out = append(out, includeIni(l, name, inc)...)
+			continue
+		}
+		stripped, q := stripComment(text, 0)
+		l.addComment(text[len(stripped):])
+		text, quote = stripped, q
+		if text[0] == '[' {
+			l.Kind = iniSectionLine
+			l.Depth = len(text) - len(strings.TrimLeft(text, "["))
+			l.Closing = len(text) - len(strings.TrimRight(text, "]"))
+			l.Name = strings.TrimSpace(strings.Trim(text, "[]"))
+			continue
+		}
+		n := strings.Index(text, "=")
+		if n <= 0 {
+			l.Kind = iniOther
+			l.Value = text
+			continue
+		}
+		l.Kind = iniValue
+		l.Key = strings.TrimSpace(text[:n])
+		value := strings.TrimLeft(text[n+1:], " \t")
+		l.VCol = col + len(text) - len(value)
+		l.Value, cont = trimContinuation(value)
+		last = l
+	}
+	for _, l := range out {
+		if l.Kind == iniValue && l.File == file && dialect == 2 {
+			l.Raw = l.Value
+			unquoteIni(l)
+		}
+	}
+	return out
+}
+
+func isDirective(text string, name string) bool {
+	return strings.HasPrefix(text, name) && (len(text) == len(name) || text[len(name)] == ' ' || text[len(name)] == '\t')
+}
+
+// hasValues tells if lines have more than comments
+func hasValues(lines []*iniLine) bool {
+	for _, l := range lines {
+		if l.Kind != iniComment {
+			return true
+		}
+	}
+	return false
+}
+
+// lexLegacyIni lexes a line not blank or a comment of a file without
+// %dialect 2, last is the line before, noting what dialect 2 would read
+// differently
+func lexLegacyIni(text string, last *iniLine) *iniLine {
+	l := &iniLine{Dialect: 1}
+	switch {
+	case isDirective(text, "%dialect"):
+		l.Kind = iniDialect
+		l.Value = strings.TrimSpace(text[8:])
+		if l.Value != "1" {
+			l.Err = "unknown %dialect " + l.Value + ", expect 1 or 2"
+		}
+	case isDirective(text, "%include"):
+		l.Kind = iniInclude
+		l.Value = strings.TrimSpace(text[8:])
+		l.Err = "%include needs %dialect 2 on the first line"
+	case text[0] == '[':
+		l.Kind = iniSectionLine
+		l.Depth = len(text) - len(strings.TrimLeft(text, "["))
+		l.Closing = len(text) - len(strings.TrimRight(text, "]"))
+		l.Name = strings.TrimSpace(strings.Trim(text, "[]"))
+	case strings.Index(text, "=") <= 0:
+		l.Kind = iniOther
+		l.Value = text
+		if last != nil && last.Kind == iniValue {
+			l.Warn = "line ignored, continuation lines need %dialect 2"
+		}
+	default:
+		n := strings.Index(text, "=")
+		l.Kind = iniValue
+		l.Key = strings.TrimSpace(text[:n])
+		l.Value = strings.TrimLeft(text[n+1:], " \t")
+		l.VCol = len(text) - len(l.Value)
+		l.Raw = l.Value
+		switch {
+		case strings.HasPrefix(l.Value, `"`):
+			l.Warn = "the quotes are part of the value, quoted values need %dialect 2"
+		case strings.HasSuffix(l.Value, `\`):
+			l.Warn = "the \\ is part of the value, continuation lines need %dialect 2"
+		case strings.Contains(l.Value, "${"):
+			l.Warn = "${} is part of the value, references need %dialect 2"
+		default:
+			if str, _ := stripComment(l.Value, 0); str != l.Value {
+				l.Warn = "the comment is part of the value, inline comments need %dialect 2"
+			}
+		}
+	}
+	return l
+}
+
+func (l *iniLine) addComment(str string) {
+	if str = strings.TrimSpace(str); str != "" {
+		if l.Comment != "" {
+			l.Comment += " "
+		}
+		l.Comment += str
+	}
+}
+
+// unquoteIni unquotes a value that is a double quoted string as a whole,
+// others like "SH" == Market are expressions
+func unquoteIni(l *iniLine) {
+	if !strings.HasPrefix(l.Value, `"`) {
+		return
+	}
+	end := -1
+	for i := 1; i < len(l.Value); i++ {
+		if l.Value[i] == '\\' {
+			i++
+		} else if l.Value[i] == '"' {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		l.Err = "unterminated quote in " + l.Key
+	} else if end == len(l.Value)-1 {
+		u, err := strconv.Unquote(l.Value)
+		if err != nil {
+			l.Err = "invalid quoted value of " + l.Key + ": " + err.Error()
 		} else {
-			n := strings.Index(line, "=")
-			if n <= 0 {
+			l.Value = u
+		}
+	}
+}
+
+// includeIni lexes an %include of line l
+func includeIni(l *iniLine, name string, inc *includer) []*iniLine {
+	if name == "" {
+		l.Err = "%include without a file name"
+		return nil
+	}
+	str, sub, err := inc.include(name)
+	if err != nil {
+		l.Err = err.Error()
+		return nil
+	}
+	return lexIni(str, name, sub)
+}
+
+// isKeyLine tells if text is key = value rather than the continuation of an
+// expression, where = is part of ==, != , <= or >=
+func isKeyLine(text string) bool {
+	n := strings.Index(text, "=")
+	if n <= 0 || strings.ContainsAny(text[n-1:n], "!<>=") || (n+1 < len(text) && text[n+1] == '=') {
+		return false
+	}
+	for _, c := range strings.TrimSpace(text[:n]) {
+		if !(c == '_' || c == '-' || c == '.' || c == ' ' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// stripComment cuts an inline # or ; comment, which follows a blank and is
+// out of quotes, quote is the quote left open by the line before
+func stripComment(s string, quote byte) (string, byte) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case (c == '#' || c == ';') && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimRight(s[:i], " \t"), quote
+		}
+	}
+	return s, quote
+}
+
+func trimContinuation(s string) (string, bool) {
+	if strings.HasSuffix(s, `\`) {
+		return strings.TrimRight(s[:len(s)-1], " \t"), true
+	}
+	return s, false
+}
+
+// interpolateIni replaces the ${key} and ${section.key} references in the
+// values of top and its sections
+func interpolateIni(top *IniSection) error {
+	self := &iniInterpolator{state: make(map[*IniSection]map[string]int)}
+	return self.section(top)
+}
+
+type iniInterpolator struct {
+	state map[*IniSection]map[string]int // 1 resolving, 2 done
+}
+
+func (self *iniInterpolator) section(s *IniSection) error {
+	for _, v := range s.Values {
+		if err := self.value(s, v[0]); err != nil {
+			return err
+		}
+	}
+	for _, s2 := range s.Sections {
+		if err := self.section(s2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *iniInterpolator) value(s *IniSection, key string) error {
+	m := self.state[s]
+	if m == nil {
+		m = make(map[string]int)
+		self.state[s] = m
+	}
+	v := s.ValueMap[key]
+	switch m[key] {
+	case 1:
+		return fmt.Errorf("line %s: interpolation cycle on %s", v[1], key)
+	case 2:
+		return nil
+	}
+	m[key] = 1
+	if strings.Contains(v[0], "${") {
+		var sb strings.Builder
+		str := v[0]
+		for {
+			i := strings.Index(str, "${")
+			if i < 0 {
+				sb.WriteString(str)
+				break
+			}
+			if i > 0 && str[i-1] == '$' {
+				// $${ is a literal ${
+				sb.WriteString(str[:i] + "{")
+				str = str[i+2:]
 				continue
 			}
-			a := strings.Trim(line[:n], " \t\n\r")
-			b := strings.Trim(line[n+1:], " \t\n\r")
-			if _, ok := s.ValueMap[a]; ok {
-				return nil, IniErrSyntax{Line: ln, Text: "duplicate section name on the same level"}
+			j := strings.Index(str[i:], "}")
+			if j < 0 {
+				return fmt.Errorf("line %s: unterminated ${ in %s", v[1], key)
+			}
+			ref := strings.TrimSpace(str[i+2 : i+j])
+			s2, key2 := lookupIni(s, ref)
+			if s2 == nil {
+				return fmt.Errorf("line %s: undefined ${%s} in %s", v[1], ref, key)
+			}
+			if err := self.value(s2, key2); err != nil {
+				return err
+			}
+			sb.WriteString(str[:i] + s2.ValueMap[key2][0])
+			str = str[i+j+1:]
+		}
+		v[0] = sb.String()
+		s.ValueMap[key] = v
+		for i, v2 := range s.Values {
+			if v2[0] == key {
+				s.Values[i][1] = v[0]
 			}
-			lns := strconv.Itoa(ln)
-			s.ValueMap[a] = [2]string{b, lns}
-			s.Values = append(s.Values, [3]string{a, b, lns})
 		}
 	}
-	return top, nil
+	m[key] = 2
+	return nil
+}
+
+// lookupIni finds the section of a dotted reference, relative to s or the
+// nearest of its parents having it
+func lookupIni(s *IniSection, ref string) (*IniSection, string) {
+	parts := strings.Split(ref, ".")
+	key := parts[len(parts)-1]
+	for base := s; base != nil; base = base.Parent {
+		s2 := base
+		for _, name := range parts[:len(parts)-1] {
+			if s2 = s2.SectionMap[name]; s2 == nil {
+				break
+			}
+		}
+		if s2 != nil {
+			if _, ok := s2.ValueMap[key]; ok {
+				return s2, key
+			}
+		}
+	}
+	return nil, ""
+}
+
+// iniSource is the values of s and its sections without line numbers
+func iniSource(s *IniSection) string {
+	var sb strings.Builder
+	for _, v := range s.Values {
+		sb.WriteString(v[0] + "=" + v[1] + "\n")
+	}
+	for _, s2 := range s.Sections {
+		sb.WriteString(strings.Repeat("[", s2.Depth) + s2.Name + strings.Repeat("]", s2.Depth) + "\n")
+		sb.WriteString(iniSource(s2))
+	}
+	return sb.String()
 }
@@ -0,0 +1,174 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"strings"
+	"testing"
+)
+
+func iniValues(t *testing.T, str string) map[string]string {
+	cfg, err := ParseIni(str)
+	if err != nil {
+		t.Fatalf("ParseIni(%q): %v", str, err)
+	}
+	m := map[string]string{}
+	for _, v := range cfg.Values {
+		m[v[0]] = v[1]
+	}
+	for _, s := range cfg.Sections {
+		for _, v := range s.Values {
+			m[s.Name+"."+v[0]] = v[1]
+		}
+	}
+	return m
+}
+
+func checkValues(t *testing.T, got map[string]string, want map[string]string) {
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIniLegacy(t *testing.T) {
+	got := iniValues(t, strings.Join([]string{
+		"# a comment",
+		`name = "desk # 1"`,
+		"filter = Market == 'SH'  ; not a comment",
+		"group = acc, \\",
+		"    sector",
+		"limit = 5",
+		"upper = ${limit}",
+		"escaped = $${limit}",
+		"[pnls]",
+		"formula = sum(Pos)",
+		"    * 2",
+	}, "\n"))
+	checkValues(t, got, map[string]string{
+		"name":         `"desk # 1"`,
+		"filter":       "Market == 'SH'  ; not a comment",
+		"group":        "acc, \\",
+		"limit":        "5",
+		"upper":        "${limit}",
+		"escaped":      "$${limit}",
+		"pnls.formula": "sum(Pos)",
+	})
+	if _, err := ParseIni("%include firm/x.ini\n"); err == nil || !strings.Contains(err.Error(), "%dialect 2") {
+		t.Errorf("%%include without dialect 2: %v", err)
+	}
+}
+
+func TestIniDialect2(t *testing.T) {
+	got := iniValues(t, strings.Join([]string{
+		"; the dialect may follow comments",
+		"%dialect 2  # of this file",
+		`name = "desk # 1"           # quoted`,
+		`tab = "a\tb"`,
+		`expr = "SH" == Market`,
+		"filter = Market == 'SH'  ; a comment",
+		"group = acc, \\",
+		"    sector",
+		"limit = 5",
+		"upper = ${limit}",
+		"escaped = $${limit}",
+		"[pnls]",
+		"formula = sum(Pos",
+		"    * Close)  # continued",
+		"path = ${limit}0",
+	}, "\n"))
+	checkValues(t, got, map[string]string{
+		"name":         "desk # 1",
+		"tab":          "a\tb",
+		"expr":         `"SH" == Market`,
+		"filter":       "Market == 'SH'",
+		"group":        "acc, sector",
+		"limit":        "5",
+		"upper":        "5",
+		"escaped":      "${limit}",
+		"pnls.formula": "sum(Pos * Close)",
+		"pnls.path":    "50",
+	})
+}
+
+func TestIniErrors(t *testing.T) {
+	for _, c := range []struct{ content, err string }{
+		{"a = 1\n%dialect 2\n", "line 2: %dialect must be the first line"},
+		{"%dialect 3\n", "unknown %dialect 3"},
+		{"%dialect 2\n%dialect 2\n", "line 2: %dialect must be the first line"},
+		{"%dialect 2\na = \"x\n", "unterminated quote in a"},
+		{"%dialect 2\na = ${b}\nb = ${a}\n", "interpolation cycle on"},
+		{"%dialect 2\n[x]\na = ${x.a}\n", "line 3: interpolation cycle on a"},
+		{"%dialect 2\na = ${b\n", "unterminated ${ in a"},
+		{"%dialect 2\na = ${b}\n", "undefined ${b} in a"},
+		{"%dialect 2\n%include\n", "%include without a file name"},
+	} {
+		_, err := ParseIni(c.content)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("ParseIni(%q) = %v, want %s", c.content, err, c.err)
+		}
+	}
+}
+
+func TestIniPercentInclude(t *testing.T) {
+	dir := withSharedFiles(t, map[string]string{
+		"common.ini": "%dialect 2\nlimit = 5  # included\n",
+		"legacy.ini": "acc = * # all\n",
+		"a.ini":      "%dialect 2\n%include $SHARED/b.ini\n",
+		"b.ini":      "%dialect 2\nx = 1\n%include $SHARED/a.ini\n",
+	})
+	got := iniValues(t, "%dialect 2\n%include "+dir+"/common.ini\n%include \""+dir+"/legacy.ini\"\nupper = ${limit}\n")
+	checkValues(t, got, map[string]string{"limit": "5", "acc": "* # all", "upper": "5"})
+	_, err := ParseIni("%dialect 2\n%include " + dir + "/a.ini\n")
+	want := "include cycle " + dir + "/a.ini -> " + dir + "/b.ini -> " + dir + "/a.ini"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("include cycle: %v, want %s", err, want)
+	}
+}
+
+func TestValidateLegacyIni(t *testing.T) {
+	content := strings.Join([]string{
+		"a = x # y",
+		`b = "q"`,
+		"c = 1 \\",
+		"    2",
+		"d = ${a}",
+		"e = plain",
+	}, "\n")
+	lines := map[int]bool{}
+	for _, d := range ValidateRiskIni(content, "") {
+		if strings.Contains(d.Message, "%dialect 2") {
+			if d.Severity != SeverityWarning {
+				t.Errorf("line %d: %s is not a warning", d.Line, d.Message)
+			}
+			lines[d.Line] = true
+		}
+	}
+	for ln := 1; ln <= 6; ln++ {
+		if lines[ln] != (ln != 6) {
+			t.Errorf("line %d warned %v", ln, lines[ln])
+		}
+	}
+}
@@ -21,6 +21,8 @@ package engine
 // THE SOFTWARE.
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -38,6 +40,8 @@ type Portfolio struct {
 	RiskDefs    []*RiskDef
 	AccPatterns string
 	Filter      *Expression
+	File        string          // the portfolio file of the user it is loaded from
+	order       []*RiskParamDef // the params of RiskDefs, after those of their ref()
 }
 
 func ParsePortfolio(cfg *IniSection, path string) (p *Portfolio, eres error) {
@@ -62,9 +66,84 @@ func ParsePortfolio(cfg *IniSection, path string) (p *Portfolio, eres error) {
 		}
 		p.Filter = res
 	}
+	p.order, eres = orderParams(p.RiskDefs)
 	return
 }
 
+// orderParams resolves the ref("risk.param") of params, ref("risk") for the
+// param of a risk section, and orders them after the params they refer to
+func orderParams(defs []*RiskDef) ([]*RiskParamDef, error) {
+	byName := make(map[string]*RiskParamDef)
+	for _, r := range defs {
+		for _, rp := range r.Params {
+			byName[r.Name+"."+rp.Name] = rp
+			if rp.Name == r.Name {
+				byName[r.Name] = rp
+			}
+		}
+	}
+	deps := make(map[*RiskParamDef][]*Expression)
+	for _, r := range defs {
+		for _, rp := range r.Params {
+			var err error
+			f := func(e *Expression) {
+				if e.A != "ref" || err != nil {
+					return
+				}
+				e.Ref = byName[e.C[0]]
+				if e.Ref == nil {
+					err = fmt.Errorf("invalid formula expression on line %s: ref(%q): no param %s", e.L, e.C[0], e.C[0])
+				} else if a := e.Ref.Formula.A; a == "" || a == "top" || a == "call" {
+					err = fmt.Errorf("invalid formula expression on line %s: ref(%q): %s is not an aggregate", e.L, e.C[0], e.C[0])
+				}
+				deps[rp] = append(deps[rp], e)
+			}
+			rp.Formula.walk(f)
+			for _, v := range rp.Variables {
+				v.E.walk(f)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	var order []*RiskParamDef
+	state := make(map[*RiskParamDef]int) // 1 visiting, 2 done
+	var path []string
+	var visit func(rp *RiskParamDef) error
+	visit = func(rp *RiskParamDef) error {
+		state[rp] = 1
+		path = append(path, rp.Parent.Name+"."+rp.Name)
+		for _, e := range deps[rp] {
+			switch state[e.Ref] {
+			case 1:
+				name := e.Ref.Parent.Name + "." + e.Ref.Name
+				i := funk.IndexOf(path, name)
+				cycle := strings.Join(append(path[i:], name), " -> ")
+				return fmt.Errorf("invalid formula expression on line %s: ref(%q): cycle %s", e.L, e.C[0], cycle)
+			case 0:
+				if err := visit(e.Ref); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[rp] = 2
+		order = append(order, rp)
+		return nil
+	}
+	for _, r := range defs {
+		for _, rp := range r.Params {
+			if state[rp] == 0 {
+				if err := visit(rp); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return order, nil
+}
+
 var UserIdAccs = make(map[int][]int)
 var AccNames = make(map[int]string)
 
@@ -92,10 +171,19 @@ func ParseUserIdAcc(msg []interface{}) {
 }
 
 func (p *Portfolio) Run(positions []*Position, userId int) map[string]interface{} {
+	view := NewPositionView(positions)
+	values := make(map[*RiskParamDef]map[string]float64)
+	runs := make(map[*RiskDef]*riskRun, len(p.RiskDefs))
+	for _, riskDef := range p.RiskDefs {
+		runs[riskDef] = riskDef.newRun(view, values)
+	}
+	for _, rp := range p.order {
+		rp.Parent.runParam(runs[rp.Parent], rp, p.Name, userId)
+	}
 	rpt := make(map[string]interface{})
 	for _, riskDef := range p.RiskDefs {
 		name := riskDef.DisplayName
-		tmp := riskDef.Run(positions, p.Name, userId)
+		tmp := riskDef.report(runs[riskDef])
 		if tmp != nil {
 			rpt[name] = tmp
 		}
@@ -103,21 +191,16 @@ func (p *Portfolio) Run(positions []*Position, userId int) map[string]interface{
 	return rpt
 }
 
-func copy(from string, to string) error {
-	data, err := ioutil.ReadFile(from)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(to, data, 0755)
-	return err
-}
-
 var UserPortfolios = make(map[int]map[string]*Portfolio)
 
 func GetPath(userId int) string {
 	return "__" + strconv.Itoa(userId) + "__"
 }
 
+// loadedFiles are the sha1 of the files of a user loaded last, so reloads
+// skip unchanged files
+var loadedFiles = make(map[int]map[string][sha1.Size]byte)
+
 func parsePortfolios(userId int) {
 	m := UserPortfolios[userId]
 	if m != nil {
@@ -125,108 +208,200 @@ func parsePortfolios(userId int) {
 	}
 	m = make(map[string]*Portfolio)
 	UserPortfolios[userId] = m
-	p := GetPath(userId)
-	stat, err := os.Stat(p)
-	tmp := false
-	if err == nil {
-		if !stat.IsDir() {
-			os.Remove(p)
-			tmp = true
-		}
-	} else {
-		tmp = true
-	}
-	if tmp {
-		err := os.Mkdir(p, 0755)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = copy("template.ini", path.Join(p, "template.ini"))
-		if err != nil {
-			log.Fatal(err)
+	loadedFiles[userId] = make(map[string][sha1.Size]byte)
+	files, err := Files.List(userId)
+	if os.IsNotExist(err) {
+		// new users start with the template, the shared one if any
+		data := []byte(includeKey + " = " + SharedDir + "/template.ini\n")
+		_, err2 := os.Stat(filepath.Join(SharedDir, "template.ini"))
+		if err2 != nil {
+			if data, err2 = ioutil.ReadFile("template.ini"); err2 != nil {
+				log.Fatal(err2)
+			}
 		}
-		err = ioutil.WriteFile(path.Join(p, "__init__.py"), nil, 0755)
-		if err != nil {
-			log.Fatal(err)
+		if err2 = Files.Write(userId, "template.ini", data); err2 != nil {
+			log.Fatal(err2)
 		}
+		files, err = Files.List(userId)
 	}
-	files, err := ioutil.ReadDir(p)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, f := range files {
-		fn := path.Join(p, f.Name())
-		if path.Ext(fn) == ".ini" {
-			cfg, err := ParseIniFile(fn)
-			if err != nil {
-				log.Println("failed to load", fn+":", err.Error())
-			}
-			portfolio, err := ParsePortfolio(cfg, p)
-			if err != nil {
-				log.Println("error when loading", fn+":", err.Error())
+	for _, name := range files {
+		if IsPortfolioFile(name) {
+			ReloadFile(userId, name)
+		} else if path.Ext(name) == ".py" {
+			if data, err := Files.Read(userId, name); err == nil {
+				loadedFiles[userId][name] = sha1.Sum(data)
 			}
-			if portfolio.Name == "" {
-				portfolio.Name = f.Name()[0 : len(f.Name())-len(path.Ext(fn))]
-			}
-			if portfolio.AccPatterns == "" {
-				portfolio.AccPatterns = "*"
-			}
-			m[portfolio.Name] = portfolio
 		}
 	}
 }
 
-func GetFiles(userId int) []string {
-	p := GetPath(userId)
-	files, err := ioutil.ReadDir(p)
-	out := []string{}
+func loadPortfolio(userId int, fn string, data []byte) (*Portfolio, error) {
+	cfg, err := ParseRiskFile(fn, string(data))
 	if err != nil {
-		return out
+		return nil, err
 	}
-	for _, f := range files {
-		if f.IsDir() {
-			continue
+	portfolio, err := ParsePortfolio(cfg, GetPath(userId))
+	if err != nil {
+		return nil, err
+	}
+	portfolio.File = fn
+	if portfolio.Name == "" {
+		portfolio.Name = fn[0 : len(fn)-len(path.Ext(fn))]
+	}
+	if portfolio.AccPatterns == "" {
+		portfolio.AccPatterns = "*"
+	}
+	return portfolio, nil
+}
+
+// ReloadFile loads fn of a user again if it changed, the portfolio of a
+// portfolio file or python for a .py file. A portfolio failing to load keeps the
+// one loaded before. Users not loaded yet are left to parsePortfolios.
+func ReloadFile(userId int, fn string) {
+	m := UserPortfolios[userId]
+	if m == nil {
+		return
+	}
+	ext := path.Ext(fn)
+	if !IsPortfolioFile(fn) && ext != ".py" {
+		return
+	}
+	where := path.Join(GetPath(userId), fn)
+	loaded := loadedFiles[userId]
+	data, err := Files.Read(userId, fn)
+	if os.IsNotExist(err) {
+		if _, ok := loaded[fn]; !ok {
+			return
 		}
-		if f.Name() == "__init__.py" {
-			continue
+		log.Println("unload", where)
+		delete(loaded, fn)
+		if ext == ".py" {
+			RestartPy()
 		}
-		if path.Ext(f.Name()) == ".pyc" {
-			continue
+		for name, p := range m {
+			if p.File == fn {
+				delete(m, name)
+				migrateState(userId, p, nil)
+			}
 		}
-		if strings.HasPrefix(f.Name(), ".") {
-			continue
+		return
+	}
+	if err != nil {
+		log.Println("failed to read", where+":", err.Error())
+		return
+	}
+	sum := sha1.Sum(data)
+	if old, ok := loaded[fn]; ok && old == sum {
+		return
+	}
+	if ext == ".py" {
+		loaded[fn] = sum
+		log.Println("reload", where)
+		RestartPy()
+		return
+	}
+	portfolio, err := loadPortfolio(userId, fn, data)
+	if err != nil {
+		log.Println("failed to load", where+":", err.Error())
+		return
+	}
+	if _, ok := loaded[fn]; ok {
+		log.Println("reload", where)
+	}
+	loaded[fn] = sum
+	var old *Portfolio
+	for name, p := range m {
+		if p.File == fn {
+			old = p
+			delete(m, name)
+		}
+	}
+	if p := m[portfolio.Name]; p != nil {
+		log.Println(where+": portfolio", portfolio.Name, "of", p.File, "replaced")
+	}
+	m[portfolio.Name] = portfolio
+	migrateState(userId, old, portfolio)
+}
+
+// ReloadShared reloads all loaded portfolio files after a change of SharedDir,
+// any of them may include it
+func ReloadShared() {
+	log.Println("reload", SharedDir)
+	for userId, loaded := range loadedFiles {
+		for fn := range loaded {
+			if IsPortfolioFile(fn) {
+				delete(loaded, fn)
+				ReloadFile(userId, fn)
+			}
+		}
+	}
+}
+
+// migrateState drops the breach acks and history tails of the params of old
+// missing or changed in next, unchanged ones keep theirs
+func migrateState(userId int, old *Portfolio, next *Portfolio) {
+	if old == nil {
+		return
+	}
+	kept := make(map[string]string)
+	if next != nil && next.Name == old.Name {
+		for _, rd := range next.RiskDefs {
+			for _, rp := range rd.Params {
+				kept[rd.DisplayName+"\x1f"+rp.Name] = rd.Name + "\x1f" + rp.Source
+			}
+		}
+	}
+	for _, rd := range old.RiskDefs {
+		for _, rp := range rd.Params {
+			if kept[rd.DisplayName+"\x1f"+rp.Name] == rd.Name+"\x1f"+rp.Source {
+				continue
+			}
+			dropBreachAcks(userId, BreachKey(old.Name, rd.DisplayName, rp.Name, "", ""))
+			resetHistoryTails(historyBucket(userId, old.Name, rd.Name, rp.Name))
 		}
-		out = append(out, f.Name())
 	}
-	return out
+}
+
+func GetFiles(userId int) []string {
+	files, err := Files.List(userId)
+	if err != nil {
+		return []string{}
+	}
+	return files
 }
 
 func GetFile(userId int, fn string) (data []byte, err error) {
-	fn = path.Join(GetPath(userId), fn)
-	data, err = ioutil.ReadFile(fn)
-	return
+	return Files.Read(userId, fn)
 }
 
-func DeleteFile(userId int, fn string) error {
+func DeleteFile(userId int, fn string, author string) error {
 	log.Println("delete file:", fn, userId)
-	err := os.Remove(path.Join(GetPath(userId), fn))
-	if path.Ext(fn) == ".py" {
-		os.Remove(path.Join(GetPath(userId), fn+"c"))
+	prev, _ := Files.Read(userId, fn)
+	if err := Files.Remove(userId, fn); err != nil {
+		return err
 	}
-	delete(UserPortfolios, userId)
-	parsePortfolios(userId)
-	return err
+	if err := recordVersion(userId, fn, prev, nil, author, "", true); err != nil {
+		log.Println("record version:", err)
+	}
+	ReloadFile(userId, fn)
+	return nil
 }
 
-func SaveFile(userId int, fn string, content string) error {
+// SaveFile records a version by author with comment, see versions.go
+func SaveFile(userId int, fn string, content string, author string, comment string) error {
 	log.Println("save file:", fn, userId)
-	err := ioutil.WriteFile(path.Join(GetPath(userId), fn), []byte(content), 0755)
-	if path.Ext(fn) == ".py" {
-		RestartPy()
+	prev, _ := Files.Read(userId, fn)
+	if err := Files.Write(userId, fn, []byte(content)); err != nil {
+		return err
 	}
-	delete(UserPortfolios, userId)
-	parsePortfolios(userId)
-	return err
+	if err := recordVersion(userId, fn, prev, []byte(content), author, comment, false); err != nil {
+		log.Println("record version:", err)
+	}
+	ReloadFile(userId, fn)
+	return nil
 }
 
 func getAccMatch(patternsStr string, values []int) []int {
@@ -269,6 +444,7 @@ func getAccMatch(patternsStr string, values []int) []int {
 
 func RunUserPortfolios() map[int]map[string]interface{} {
 	out := make(map[int]map[string]interface{})
+	runningBreaches = make(map[int][]*Breach)
 	var wg sync.WaitGroup
 	wg.Add(len(UserIdAccs))
 	for userId, accs := range UserIdAccs {
@@ -281,21 +457,21 @@ func RunUserPortfolios() map[int]map[string]interface{} {
 			for _, p := range portfolios {
 				usedAccs := getAccMatch(p.AccPatterns, accs2)
 				var positions []*Position
-				if len(usedAccs) > 0 {
-					for _, acc := range usedAccs {
-						tmp := Positions[acc]
-						for _, tmp2 := range tmp {
-							if p.Filter != nil {
-								v, _ := Evaluate(p.Filter, tmp2)
-								if v2, ok2 := v.(bool); ok2 {
-									if !v2 {
-										continue
-									}
-								}
-							}
-							positions = append(positions, tmp2)
+				for _, acc := range usedAccs {
+					for _, tmp := range Positions[acc] {
+						positions = append(positions, tmp)
+					}
+				}
+				if p.Filter != nil && len(positions) > 0 {
+					env := &exprEnv{view: NewPositionView(positions)}
+					var filtered []*Position
+					for i, tmp := range positions {
+						if v, ok := env.test(p.Filter, i); ok && !v {
+							continue
 						}
+						filtered = append(filtered, tmp)
 					}
+					positions = filtered
 				}
 				if len(positions) > 0 {
 					rpt[p.Name] = p.Run(positions, userId)
@@ -304,5 +480,8 @@ func RunUserPortfolios() map[int]map[string]interface{} {
 		}()
 	}
 	wg.Wait()
+	LatestBreaches = runningBreaches
+	pruneBreaches()
+	FlushHistory()
 	return out
 }
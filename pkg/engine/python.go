@@ -26,7 +26,8 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/sbinet/go-python"
 )
@@ -129,8 +130,20 @@ func (p *Position) ToPy() *python.PyObject {
 	return out
 }
 
+// pythonPath is PYTHONPATH before InitPy
+var pythonPath = os.Getenv("PYTHONPATH")
+
+// InitPy puts the working directory, holding the user packages, and the
+// parent of SharedDir, holding the shared package, on PYTHONPATH
 func InitPy() {
-	os.Setenv("PYTHONPATH", "."+string(os.PathListSeparator)+os.Getenv("PYTHONPATH"))
+	dirs := []string{"."}
+	if parent := filepath.Dir(filepath.Clean(SharedDir)); parent != "." {
+		dirs = append(dirs, parent)
+	}
+	if pythonPath != "" {
+		dirs = append(dirs, pythonPath)
+	}
+	os.Setenv("PYTHONPATH", strings.Join(dirs, string(os.PathListSeparator)))
 	err := python.Initialize()
 	if err != nil {
 		log.Panic(err.Error())
@@ -143,11 +156,11 @@ func RestartPy() {
 }
 
 func CallPy(moduleName string, funcName string, strArgs string, positions []*Position, mpath string) (res interface{}, eres error) {
-	if mpath != "" {
-		_, err := os.Stat(path.Join(mpath, moduleName+".py"))
-		if err == nil {
-			moduleName = mpath + "." + moduleName
-		}
+	// the user module, else the shared one, else any on PYTHONPATH
+	if _, err := os.Stat(filepath.Join(mpath, moduleName+".py")); mpath != "" && err == nil {
+		moduleName = mpath + "." + moduleName
+	} else if _, err := os.Stat(filepath.Join(SharedDir, moduleName+".py")); err == nil {
+		moduleName = filepath.Base(filepath.Clean(SharedDir)) + "." + moduleName
 	}
 	module := python.PyImport_ImportModule(moduleName)
 	if module == nil {
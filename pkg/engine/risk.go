@@ -27,7 +27,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/thoas/go-funk"
 )
@@ -71,8 +70,11 @@ type RiskParamDef struct {
 	TradeStop  bool
 	Window     WindowDef
 	Variables  []NameExpression
-	Graph      bool
-	History    map[string][][2]float64 // only if Graph = true
+	Graph      bool   // record history, see history.go
+	Source     string // the ini values defining it, to tell changed params on reload
+	total      bool   // if a total() reads values of the group
+	// the total() calls reading no values of the group, run once by run
+	totals map[*Expression]bool
 }
 
 type RiskDef struct {
@@ -101,6 +103,7 @@ func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres erro
 	r = &RiskParamDef{
 		Parent: parent,
 		Name:   s.Name,
+		Source: iniSource(s),
 	}
 	var params map[string]interface{}
 	variables := s.SectionMap["var"]
@@ -113,16 +116,21 @@ func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres erro
 				return
 			}
 			r.Variables = append(r.Variables, NameExpression{nameExpr[0], res})
-			params[nameExpr[0]] = 0.0
+			if res.A != "" {
+				params[nameExpr[0]] = groupParam{res.T}
+			} else {
+				params[nameExpr[0]] = res.T.zero()
+			}
 		}
 	}
 	if f[0] != "" {
-		res, err := ParseExpr(f[1], f[0], "formula", params, nil, parent.Path)
+		res, err := ParseExpr(f[1], f[0], "formula", params, 0.0, parent.Path)
 		if err != nil {
 			eres = err
 			return
 		}
 		r.Formula = res
+		r.findTotals()
 	}
 	w := split(s.ValueMap["window"][0], ",")
 	if len(w) > 0 {
@@ -157,16 +165,77 @@ func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres erro
 	}
 	str = strings.ToLower(s.ValueMap["graph"][0])
 	if str == "true" || str == "y" || str == "yes" || str == "1" {
-		if r.Formula.A == "" {
-			log.Print("Graph only allowable for aggregate formula")
+		if r.Formula == nil {
+			log.Print("Graph only allowable with formula")
 		} else {
 			r.Graph = true
-			r.History = make(map[string][][2]float64)
 		}
 	}
 	return
 }
 
+// findTotals sorts the total() calls of the formula and variables into
+// those evaluated once by run and those reading values of the group, of a
+// ref(), call() or variable with an aggregate
+func (self *RiskParamDef) findTotals() {
+	names := make(map[string]bool)
+	for _, v := range self.Variables {
+		names[v.Name] = true
+	}
+	vars := self.positionVars()
+	f := func(e *Expression) {
+		if e.A != "total" {
+			return
+		}
+		if groupFree(e.R[0], names, vars) {
+			if self.totals == nil {
+				self.totals = make(map[*Expression]bool)
+			}
+			self.totals[e] = true
+		} else {
+			self.total = true
+		}
+	}
+	self.Formula.walk(f)
+	for _, v := range self.Variables {
+		v.E.walk(f)
+	}
+}
+
+// positionVars are the variables without aggregates, of position values
+// and the variables before like them
+func (self *RiskParamDef) positionVars() map[string]bool {
+	names := make(map[string]bool)
+	vars := make(map[string]bool)
+	for _, v := range self.Variables {
+		if v.E.A == "" && len(v.E.S) == 0 && groupFree(v.E, names, vars) {
+			vars[v.Name] = true
+		}
+		names[v.Name] = true
+	}
+	return vars
+}
+
+// groupFree tells if e reads no ref(), call() or variables of names but
+// those of vars
+func groupFree(e *Expression, names map[string]bool, vars map[string]bool) bool {
+	ok := true
+	e.walk(func(x *Expression) {
+		if x.A == "ref" || x.A == "call" {
+			ok = false
+		}
+		if x.E == nil {
+			return
+		}
+		for _, name := range x.E.Vars() {
+			if names[name] && !vars[name] {
+				ok = false
+			}
+		}
+	})
+	return ok
+}
+
 func newRiskDef(s *IniSection, path string) (r *RiskDef, eres error) {
 	r = &RiskDef{
 		Path:        path,
@@ -216,6 +285,10 @@ func newRiskDef(s *IniSection, path string) (r *RiskDef, eres error) {
 			eres = err
 			return
 		}
+		if rp.Formula == nil {
+			log.Print("param without formula ignored: ", r.Name, ".", p.Name)
+			continue
+		}
 		r.Params = append(r.Params, rp)
 	}
 	rp, err := newRiskParamDef(s, r)
@@ -229,31 +302,52 @@ func newRiskDef(s *IniSection, path string) (r *RiskDef, eres error) {
 	return
 }
 
+// riskRun is a run of a RiskDef on the positions of a view, by param
+type riskRun struct {
+	view       *PositionView
+	grouped    map[string][]int // indexes of view
+	gnames     []string         // for making order stable when showing on gui
+	igroupMap  map[string]int
+	all        []int // of any group, of total()
+	values     map[*RiskParamDef]map[string]float64
+	totals     map[*Expression]interface{} // of RiskParamDef.totals
+	tradeStops map[int]string
+	outs       map[*RiskParamDef][]interface{}
+}
+
+// Run evaluates the params in order, ref() of params not run yet is NaN,
+// Portfolio.Run runs the params of all its risks in the order of ref()
 func (self *RiskDef) Run(positions []*Position, portfolioName string, userId int) interface{} {
-	tradeStops := make(map[int]string)
-	grouped := make(map[string][]*Position)
-	var gnames []string // for making order stable when showing on gui
+	run := self.newRun(NewPositionView(positions), make(map[*RiskParamDef]map[string]float64))
+	for _, rp := range self.Params {
+		self.runParam(run, rp, portfolioName, userId)
+	}
+	return self.report(run)
+}
+
+// newRun groups the positions of view
+func (self *RiskDef) newRun(view *PositionView, values map[*RiskParamDef]map[string]float64) *riskRun {
+	positions := view.Positions
+	env := &exprEnv{view: view}
+	grouped := make(map[string][]int)
+	var gnames []string
 	igroupMap := make(map[string]int)
+	var all []int
 	if len(self.Groups) > 0 {
+		seen := make([]bool, len(positions))
 		for igroup, expr := range self.Groups {
 			var subGroupNames []string
 			e, eok := expr.(*Expression)
-			for _, p := range positions {
+			for i, p := range positions {
 				if self.Filter != nil {
-					v, _ := Evaluate(self.Filter, p)
-					if v2, ok2 := v.(bool); ok2 {
-						if !v2 {
-							continue
-						}
+					if v, ok := env.test(self.Filter, i); ok && !v {
+						continue
 					}
 				}
 				tmp := ""
 				if eok {
-					v, _ := Evaluate(e, p)
-					if v2, ok2 := v.(bool); ok2 {
-						if v2 {
-							tmp = self.GroupNames[igroup]
-						}
+					if v, ok := env.test(e, i); ok && v {
+						tmp = self.GroupNames[igroup]
 					}
 				} else {
 					switch expr {
@@ -278,7 +372,11 @@ func (self *RiskDef) Run(positions []*Position, portfolioName string, userId int
 						subGroupNames = append(subGroupNames, tmp)
 						igroupMap[tmp] = igroup
 					}
-					grouped[tmp] = append(grouped[tmp], p)
+					grouped[tmp] = append(grouped[tmp], i)
+					if !seen[i] {
+						seen[i] = true
+						all = append(all, i)
+					}
 				}
 			}
 			if len(self.GroupNames) > igroup {
@@ -292,76 +390,133 @@ func (self *RiskDef) Run(positions []*Position, portfolioName string, userId int
 			}
 		}
 	} else {
-		grouped[""] = positions
+		grouped[""] = view.Indexes()
 		gnames = append(gnames, "")
 	}
-	rpt := make(map[string]interface{})
-	for _, rp := range self.Params {
-		var out []interface{}
-		for _, gname := range gnames {
-			positions := grouped[gname]
-			if len(positions) > 0 {
-				value := rp.Run(gname, positions)
-				igroup := igroupMap[gname]
-				lowerBound := math.NaN()
-				if len(rp.LowerBound) > 0 {
-					if igroup >= len(rp.LowerBound) {
-						lowerBound = rp.LowerBound[len(rp.LowerBound)-1]
-					} else {
-						lowerBound = rp.LowerBound[igroup]
-					}
+	sort.Ints(all)
+	if all == nil {
+		all = grouped[""]
+	}
+	return &riskRun{
+		view:       view,
+		grouped:    grouped,
+		gnames:     gnames,
+		igroupMap:  igroupMap,
+		all:        all,
+		values:     values,
+		totals:     make(map[*Expression]interface{}),
+		tradeStops: make(map[int]string),
+		outs:       make(map[*RiskParamDef][]interface{}),
+	}
+}
+
+// runParam evaluates rp for the groups of run and checks its bounds
+func (self *RiskDef) runParam(run *riskRun, rp *RiskParamDef, portfolioName string, userId int) {
+	positions := run.view.Positions
+	tradeStops := run.tradeStops
+	values := make(map[string]float64)
+	run.values[rp] = values
+	var out []interface{}
+	for _, gname := range run.gnames {
+		idx := run.grouped[gname]
+		if len(idx) > 0 {
+			value := rp.Run(gname, run, idx, historyBucket(userId, portfolioName, self.Name, rp.Name))
+			if v, ok := value.(float64); ok {
+				values[gname] = v
+			}
+			igroup := run.igroupMap[gname]
+			lowerBound := math.NaN()
+			if len(rp.LowerBound) > 0 {
+				if igroup >= len(rp.LowerBound) {
+					lowerBound = rp.LowerBound[len(rp.LowerBound)-1]
+				} else {
+					lowerBound = rp.LowerBound[igroup]
 				}
-				upperBound := math.NaN()
-				if len(rp.UpperBound) > 0 {
-					if igroup >= len(rp.UpperBound) {
-						upperBound = rp.UpperBound[len(rp.UpperBound)-1]
-					} else {
-						upperBound = rp.UpperBound[igroup]
-					}
+			}
+			upperBound := math.NaN()
+			if len(rp.UpperBound) > 0 {
+				if igroup >= len(rp.UpperBound) {
+					upperBound = rp.UpperBound[len(rp.UpperBound)-1]
+				} else {
+					upperBound = rp.UpperBound[igroup]
 				}
-				if floatValue, ok := value.(float64); ok {
-					var breach []interface{}
-					if floatValue < lowerBound || floatValue > upperBound {
-						breach = append(breach, convertNaN(lowerBound))
-						breach = append(breach, convertNaN(upperBound))
-					}
-					if breach != nil {
-						if rp.TradeStop {
-							reason := fmt.Sprintf("OpenRisk: %d '%s' '%s' '%s' '%s' value %f out of range [%f, %f]", userId, portfolioName, self.Name, rp.Name, gname, floatValue, lowerBound, upperBound)
-							for _, pos := range positions {
-								tradeStops[pos.Acc] = reason
-							}
-							breach = append(breach, true)
+			}
+			if floatValue, ok := value.(float64); ok {
+				var breach []interface{}
+				if floatValue < lowerBound || floatValue > upperBound {
+					breach = append(breach, ConvertNaN(lowerBound))
+					breach = append(breach, ConvertNaN(upperBound))
+				}
+				if breach != nil {
+					overridden := rp.TradeStop && tradeStopOverridden(userId, portfolioName, self.DisplayName, rp.Name, gname)
+					if rp.TradeStop && !overridden {
+						reason := fmt.Sprintf("OpenRisk: %d '%s' '%s' '%s' '%s' value %f out of range [%f, %f]", userId, portfolioName, self.Name, rp.Name, gname, floatValue, lowerBound, upperBound)
+						for _, i := range idx {
+							tradeStops[positions[i].Acc] = reason
 						}
-						out = append(out, []interface{}{gname, value, breach})
-						continue
 					}
-				} else if array, ok := value.([][2]interface{}); ok {
-					var newArray []interface{}
-					for _, item := range array {
-						if floatValue, ok := item[1].(float64); ok {
-							var breach []interface{}
-							if floatValue < lowerBound || floatValue > upperBound {
-								breach = append(breach, convertNaN(lowerBound))
-								breach = append(breach, convertNaN(upperBound))
-							}
-							// non-aggregate not support trade stop yet
-							if breach != nil {
-								newArray = append(newArray, []interface{}{item[0], item[1], breach})
-								continue
-							}
+					if rp.TradeStop {
+						breach = append(breach, true)
+					}
+					addBreach(userId, &Breach{
+						Portfolio:  portfolioName,
+						Risk:       self.DisplayName,
+						Param:      rp.Name,
+						Group:      gname,
+						Value:      floatValue,
+						LowerBound: boundPtr(lowerBound),
+						UpperBound: boundPtr(upperBound),
+						TradeStop:  rp.TradeStop,
+						Overridden: overridden,
+					})
+					out = append(out, []interface{}{gname, value, breach})
+					continue
+				}
+			} else if array, ok := value.([][2]interface{}); ok {
+				var newArray []interface{}
+				for _, item := range array {
+					if floatValue, ok := item[1].(float64); ok {
+						var breach []interface{}
+						if floatValue < lowerBound || floatValue > upperBound {
+							breach = append(breach, ConvertNaN(lowerBound))
+							breach = append(breach, ConvertNaN(upperBound))
+						}
+						// non-aggregate not support trade stop yet
+						if breach != nil {
+							symbol, _ := item[0].(string)
+							addBreach(userId, &Breach{
+								Portfolio:  portfolioName,
+								Risk:       self.DisplayName,
+								Param:      rp.Name,
+								Group:      gname,
+								Symbol:     symbol,
+								Value:      floatValue,
+								LowerBound: boundPtr(lowerBound),
+								UpperBound: boundPtr(upperBound),
+							})
+							newArray = append(newArray, []interface{}{item[0], item[1], breach})
+							continue
 						}
-						newArray = append(newArray, item)
 					}
-					value = newArray
+					newArray = append(newArray, item)
 				}
-				out = append(out, []interface{}{gname, value})
+				value = newArray
 			}
+			out = append(out, []interface{}{gname, value})
 		}
-		for acc, reason := range tradeStops {
-			fmt.Print(acc, reason)
-			Request(Array{"admin", "sub accounts", "disable", acc, reason})
-		}
+	}
+	for acc, reason := range tradeStops {
+		log.Printf("trade stop, disabling sub account %d: %s", acc, reason)
+		Request(Array{"admin", "sub accounts", "disable", acc, reason})
+	}
+	run.outs[rp] = out
+}
+
+// report is the result of run, by param
+func (self *RiskDef) report(run *riskRun) interface{} {
+	rpt := make(map[string]interface{})
+	for _, rp := range self.Params {
+		out := run.outs[rp]
 		if len(out) > 0 {
 			if len(self.Params) == 1 {
 				return out
@@ -409,7 +564,7 @@ func std(nums []float64) float64 {
 	return sd
 }
 
-func convertNaN(value float64) interface{} {
+func ConvertNaN(value float64) interface{} {
 	if math.IsNaN(value) {
 		// json Marshal failed to work with NaN, so change to string
 		return "NaN"
@@ -417,53 +572,83 @@ func convertNaN(value float64) interface{} {
 	return value
 }
 
-func (self *RiskParamDef) evaluate(positions []*Position, params map[string]interface{}, optional ...*Expression) interface{} {
+// evaluate the formula, or the optional variable, at the positions idx of
+// the view of env
+func (self *RiskParamDef) evaluate(env *exprEnv, idx []int, optional ...*Expression) interface{} {
 	var e *Expression
-	var isFormula bool
 	if len(optional) > 0 {
 		e = optional[0]
 	} else {
 		e = self.Formula
-		isFormula = true
 		if e.A == "" {
 			// by default, only return top 10 result
 			e.A = "top"
 			e.N = [2]int{10, 0}
 		}
 	}
+	positions := env.view.Positions
 	if e.A == "call" {
-		res, _ := CallPy(e.C[0], e.C[1], e.C[2], positions, self.Parent.Path)
+		group := make([]*Position, len(idx))
+		for j, i := range idx {
+			group[j] = positions[i]
+		}
+		res, _ := CallPy(e.C[0], e.C[1], e.C[2], group, self.Parent.Path)
 		return res
 	}
+	if e.A == "total" {
+		if self.totals[e] {
+			return self.runTotal(env, e)
+		}
+		return self.evaluate(env, env.all, e.R[0])
+	}
+	if e.A == "ref" {
+		values := env.values[e.Ref]
+		v, ok := values[env.group]
+		if !ok {
+			// of a risk without groups
+			v, ok = values[""]
+		}
+		if !ok {
+			return ConvertNaN(math.NaN())
+		}
+		return ConvertNaN(v)
+	}
+	self.bindAggregates(env, idx, e)
 	value := math.NaN()
-	res := make([]float64, 0, len(positions))
-	for _, p := range positions {
-		if isFormula {
-			// prepare non-aggregate variable
-			for _, v := range self.Variables {
-				if v.E.A == "" {
-					params[v.Name], _ = Evaluate(v.E, p, params)
-				}
+	if e.A == "group" {
+		if len(idx) == 0 {
+			return ConvertNaN(value)
+		}
+		v := env.eval(e, idx[0])
+		if f, ok := v.(float64); ok {
+			return ConvertNaN(f)
+		}
+		return v
+	} else if agg := aggregates[e.A]; agg != nil {
+		var values [][]float64
+		args := append([]*Expression{e}, e.R...)
+		for _, kind := range agg.Args {
+			if kind == AggregateConstant {
+				continue
+			}
+			x := args[0]
+			args = args[1:]
+			self.bindAggregates(env, idx, x)
+			if kind == AggregateCondition {
+				values = append(values, env.conditions(x, idx, make([]float64, 0, len(idx))))
+			} else {
+				values = append(values, env.numbers(x, idx, make([]float64, 0, len(idx))))
 			}
 		}
-		tmp, _ := Evaluate(e, p, params)
-		res = append(res, tmp.(float64))
-	}
-	if e.A == "std" {
-		value = std(res)
-	} else if e.A == "sum" {
-		value = sum(res)
-	} else if e.A == "len" {
-		value = length(res)
-	} else if e.A == "mean" {
-		value = mean(res)
+		value = agg.Reduce(values, e.K)
 	} else if e.A == "top" {
+		res := env.numbers(e, idx, make([]float64, 0, len(idx)))
 		tmp := make([][2]interface{}, 0, len(Positions))
-		for i, p := range positions {
-			if math.IsNaN(res[i]) {
+		for j, i := range idx {
+			if math.IsNaN(res[j]) {
 				continue
 			}
-			tmp = append(tmp, [2]interface{}{p.Security.Symbol, res[i]})
+			tmp = append(tmp, [2]interface{}{positions[i].Security.Symbol, res[j]})
 		}
 		// will optimize with nth_element
 		var out [][2]interface{}
@@ -480,46 +665,108 @@ func (self *RiskParamDef) evaluate(positions []*Position, params map[string]inte
 		}
 		return out
 	}
-	return convertNaN(value)
+	return ConvertNaN(value)
 }
 
-func (self *RiskParamDef) Run(gname string, positions []*Position) interface{} {
-	var params map[string]interface{}
+// runTotal evaluates a total() of totals once by run, with the variables
+// it reads at all positions
+func (self *RiskParamDef) runTotal(env *exprEnv, e *Expression) interface{} {
+	if v, ok := env.totals[e]; ok {
+		return v
+	}
+	env2 := &exprEnv{
+		view:   env.view,
+		vars:   make(map[string]*column, len(self.Variables)),
+		all:    env.all,
+		values: env.values,
+		totals: env.totals,
+		span:   env.all,
+	}
+	vars := self.positionVars()
+	for _, v := range self.Variables {
+		if vars[v.Name] {
+			env2.vars[v.Name] = env2.fill(v.E, env2.span)
+		}
+	}
+	v := self.evaluate(env2, env.all, e.R[0])
+	env.totals[e] = v
+	return v
+}
+
+// value is evaluate of an expression of one value by group, the
+// expressions reading it need NaN rather than ConvertNaN
+func (self *RiskParamDef) value(env *exprEnv, idx []int, e *Expression) interface{} {
+	value := self.evaluate(env, idx, e)
+	if value == "NaN" {
+		value = math.NaN()
+	}
+	return value
+}
+
+// bindAggregates sets the variables [aggregate i] of e to the values of its
+// aggregates at the positions idx
+func (self *RiskParamDef) bindAggregates(env *exprEnv, idx []int, e *Expression) {
+	if len(e.S) == 0 {
+		return
+	}
+	// all first, those of e.S use the same names
+	values := make([]interface{}, len(e.S))
+	for i, s := range e.S {
+		values[i] = self.value(env, idx, s)
+	}
+	for i, v := range values {
+		env.vars[aggregateVar(i)] = env.constColumn(v, env.span)
+	}
+}
+
+// Run evaluates the param for the group gname of the positions idx of run
+func (self *RiskParamDef) Run(gname string, run *riskRun, idx []int, historyBucket string) interface{} {
+	env := &exprEnv{
+		view:   run.view,
+		vars:   make(map[string]*column, len(self.Variables)),
+		group:  gname,
+		all:    run.all,
+		values: run.values,
+		totals: run.totals,
+		span:   idx,
+	}
+	if self.total {
+		// total() reads the variables of all positions, by group
+		env.span = run.all
+	}
 	// prepare aggregate variable
-	if len(self.Variables) > 0 {
-		params = make(map[string]interface{}, 60)
-		for _, v := range self.Variables {
-			if v.E.A != "" {
-				params[v.Name] = self.evaluate(positions, params, v.E)
-			}
+	for _, v := range self.Variables {
+		if v.E.A != "" {
+			env.vars[v.Name] = env.constColumn(self.value(env, idx, v.E), env.span)
 		}
 	}
-	v := self.evaluate(positions, params)
+	// prepare non-aggregate variable
+	for _, v := range self.Variables {
+		if v.E.A == "" {
+			self.bindAggregates(env, idx, v.E)
+			env.vars[v.Name] = env.fill(v.E, env.span)
+		}
+	}
+	v := self.evaluate(env, idx)
 	if self.Graph {
-		if v2, ok2 := v.(float64); ok2 {
-			tmp := self.History[gname]
-			n := len(tmp)
-			now := float64(time.Now().Unix())
-			if n > 1 && now-tmp[0][0] > 25*3600 { // reduce history every 1h
-				for i := 1; i < n; i += 1 {
-					if now-tmp[i][0] < 24*3600 {
-						tmp = tmp[i:]
-						n = len(tmp)
-						break
-					}
+		switch v2 := v.(type) {
+		case float64:
+			recordHistory(historyBucket, gname, v2)
+		case [][2]interface{}: // top
+			for _, item := range v2 {
+				name, _ := item[0].(string)
+				if value, ok := item[1].(float64); ok {
+					recordHistory(historyBucket, HistorySeries(gname, name), value)
 				}
 			}
-			if n > 1 {
-				tmp1 := tmp[n-2]
-				tmp2 := tmp[n-1]
-				if now-tmp1[0] > 60. && math.Abs(tmp1[1]-v2) > math.Abs(tmp1[1]+v2)/2000. {
-					self.History[gname] = append(tmp, [2]float64{now, v2})
-				} else {
-					tmp2[0] = now
-					tmp2[1] = v2
+		case []interface{}: // call() returning name/value list
+			for _, item := range v2 {
+				if item2, ok := item.([]interface{}); ok && len(item2) == 2 {
+					name, _ := item2[0].(string)
+					if value, ok := item2[1].(float64); ok {
+						recordHistory(historyBucket, HistorySeries(gname, name), value)
+					}
 				}
-			} else {
-				self.History[gname] = append(tmp, [2]float64{now, v2})
 			}
 		}
 	}
@@ -0,0 +1,166 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func testPortfolio(t *testing.T, content string) *Portfolio {
+	cfg, err := ParseRiskIni(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePortfolio(cfg, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func sectorBook() []*Position {
+	var out []*Position
+	for _, v := range []struct {
+		sector string
+		pos    float64
+	}{{"A", 1}, {"B", -4}, {"A", 3}, {"C", 0}} {
+		p := &Position{Security: &Security{Sector: v.sector, Symbol: v.sector}}
+		p.Qty = v.pos
+		out = append(out, p)
+	}
+	return out
+}
+
+// groupValues are the values by group of a param of a run
+func groupValues(t *testing.T, out interface{}) map[string]float64 {
+	m := make(map[string]float64)
+	list, ok := out.([]interface{})
+	if !ok {
+		t.Fatalf("not a list of groups: %v", out)
+	}
+	for _, item := range list {
+		item := item.([]interface{})
+		v, _ := item[1].(float64)
+		if item[1] == "NaN" {
+			v = math.NaN()
+		}
+		m[item[0].(string)] = v
+	}
+	return m
+}
+
+func TestTotalShare(t *testing.T) {
+	p := testPortfolio(t, strings.Join([]string{
+		"[share]",
+		"group = sector",
+		"[[share]]",
+		"formula = sum(abs(Pos)) / total(sum(abs(Pos)))",
+		"[vshare]",
+		"group = sector",
+		"[[vshare]]",
+		"formula = sum(v) / total(sum(v))",
+		"[[[var]]]",
+		"v = abs(Pos)",
+		"[gshare]",
+		"group = sector",
+		"[[gshare]]",
+		"formula = sum(v) / total(sum(v))",
+		"[[[var]]]",
+		"s = sum(abs(Pos))",
+		"v = abs(Pos) / s",
+	}, "\n"))
+	for _, r := range p.RiskDefs {
+		rp := r.Params[0]
+		if once := r.Name != "gshare"; rp.total == once || (len(rp.totals) == 1) != once {
+			t.Errorf("%s: total() by group %v, once by run %d", r.Name, rp.total, len(rp.totals))
+		}
+		run := r.newRun(NewPositionView(sectorBook()), make(map[*RiskParamDef]map[string]float64))
+		r.runParam(run, rp, "test", 0)
+		got := groupValues(t, r.report(run))
+		want := map[string]float64{"A": 0.5, "B": 0.5, "C": 0}
+		if r.Name == "gshare" {
+			// total() sees v of the group at all positions
+			want = map[string]float64{"A": 0.5, "B": 4. / 8, "C": math.NaN()}
+		}
+		for g, v := range want {
+			if !sameFloat(got[g], v) {
+				t.Errorf("%s of %s = %v, want %v", r.Name, g, got[g], v)
+			}
+		}
+		if len(run.totals) != len(rp.totals) {
+			t.Errorf("%s: %d totals run once, want %d", r.Name, len(run.totals), len(rp.totals))
+		}
+	}
+}
+
+func TestRefOrder(t *testing.T) {
+	p := testPortfolio(t, strings.Join([]string{
+		"[a]",
+		"[[x]]",
+		`formula = ref("b.y") * 2`,
+		"[b]",
+		"group = sector",
+		"[[y]]",
+		"formula = sum(Pos)",
+		"[[z]]",
+		`formula = ref("b.y") + ref("c")`,
+		"[c]",
+		"[[c]]",
+		"formula = sum(abs(Pos))",
+		"[d]",
+		"[[w]]",
+		`formula = ref("c") + 1`,
+	}, "\n"))
+	var order []string
+	for _, rp := range p.order {
+		order = append(order, rp.Parent.Name+"."+rp.Name)
+	}
+	if got := strings.Join(order, " "); got != "b.y a.x c.c b.z d.w" {
+		t.Errorf("order %s", got)
+	}
+	rpt := p.Run(sectorBook(), 0)
+	if got := groupValues(t, rpt["b"].(map[string]interface{})["y"]); got["A"] != 4 || got["B"] != -4 {
+		t.Errorf("b.y = %v", got)
+	}
+	if got := rpt["d"]; !sameFloat(got.([]interface{})[0].([]interface{})[1].(float64), 9) {
+		t.Errorf("d.w = %v", got)
+	}
+}
+
+func TestRefErrors(t *testing.T) {
+	for _, c := range []struct{ content, err string }{
+		{"[a]\n[[x]]\nformula = ref(\"b.y\")\n[b]\n[[y]]\nformula = ref(\"a.x\") + 1\n",
+			`line 6: ref("a.x"): cycle a.x -> b.y -> a.x`},
+		{"[a]\n[[x]]\nformula = ref(\"a.x\")\n", "cycle a.x -> a.x"},
+		{"[a]\n[[x]]\nformula = ref(\"b\")\n", "no param b"},
+		{"[a]\n[[x]]\nformula = ref(\"b.y\")\n[b]\n[[y]]\nformula = Pos\n", "b.y is not an aggregate"},
+	} {
+		cfg, err := ParseRiskIni(c.content)
+		if err == nil {
+			_, err = ParsePortfolio(cfg, ".")
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: %v, want %s", c.content, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,599 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Expressions are type checked when parsed instead of being evaluated once,
+// a precedence parser over the govaluate tokens follows its operators from
+// the , separator up to function calls:
+//
+//   ? : ??   ||   &&   == != < <= > >= =~ !~ in   & | ^   << >>   + -   * / %   **   - ! ~
+//
+// Variables have the types Evaluate gives them, [[[var]]] variables the
+// type of their expression and functions the signature in functionTypes.
+// The parser compiles the expression to closures as it goes, see
+// compile.go, a node of an unknown type is left to govaluate.
+
+type exprType int
+
+const (
+	typeAny exprType = iota // known when evaluated, like the result of call()
+	typeNumber
+	typeBool
+	typeString
+	typeList // (a, b, c) of in
+)
+
+func (t exprType) String() string {
+	return [...]string{"any", "number", "bool", "string", "list"}[t]
+}
+
+// zero is a value of t for the params of ParseExpr
+func (t exprType) zero() interface{} {
+	switch t {
+	case typeNumber:
+		return 0.0
+	case typeBool:
+		return false
+	case typeString:
+		return ""
+	}
+	return nil
+}
+
+func typeOfValue(v interface{}) exprType {
+	switch v := v.(type) {
+	case float64, int, int64:
+		return typeNumber
+	case bool:
+		return typeBool
+	case string:
+		return typeString
+	case groupParam:
+		return v.t
+	}
+	return typeAny
+}
+
+// funcType is the signature of a function, the last of Args repeats if
+// Variadic, Compile makes the node of compiled args. Check replaces Result
+// and Compile for functions whose result depends on the args.
+type funcType struct {
+	Args     []exprType
+	Variadic bool
+	Result   exprType
+	Compile  func(args []*node) *node
+	Check    func(self *typeChecker, args []*node) (*node, error)
+}
+
+var functionTypes = map[string]funcType{
+	"min":    number2(math.Min),
+	"max":    number2(math.Max),
+	"pow":    number2(math.Pow),
+	"sqrt":   number1(math.Sqrt),
+	"round":  number1(math.Round),
+	"isNaN":  numberTest(math.IsNaN),
+	"ceil":   number1(math.Ceil),
+	"floor":  number1(math.Floor),
+	"exp":    number1(math.Exp),
+	"exp2":   number1(math.Exp2),
+	"abs":    number1(math.Abs),
+	"log":    number1(math.Log),
+	"log2":   number1(math.Log2),
+	"log10":  number1(math.Log10),
+	"isInf":  numberTest(func(a float64) bool { return math.IsInf(a, 0) }),
+	"strlen": {Args: []exprType{typeString}, Result: typeNumber, Compile: compileStrlen},
+
+	"if":          {Args: []exprType{typeBool, typeAny, typeAny}, Check: checkIf},
+	"coalesce":    {Args: []exprType{typeAny}, Variadic: true, Check: checkCoalesce},
+	"in":          {Args: []exprType{typeAny, typeList}, Result: typeBool, Check: checkIn},
+	"startsWith":  stringTest(strings.HasPrefix),
+	"endsWith":    stringTest(strings.HasSuffix),
+	"contains":    stringTest(strings.Contains),
+	"regexMatch":  {Args: []exprType{typeString, typeString}, Result: typeBool, Check: checkRegexMatch},
+	"clamp":       {Args: []exprType{typeNumber, typeNumber, typeNumber}, Result: typeNumber, Compile: compileClamp},
+	"sign":        number1(sign),
+	"now":         number0(now),
+	"today":       number0(today),
+	"daysBetween": number2(daysBetween),
+	"list":        {Args: []exprType{typeString}, Result: typeList, Check: checkList},
+}
+
+func number1(f func(float64) float64) funcType {
+	return funcType{Args: []exprType{typeNumber}, Result: typeNumber, Compile: func(args []*node) *node {
+		a := args[0].num
+		return numberNode(func(e *exprEnv) float64 { return f(a(e)) })
+	}}
+}
+
+func number2(f func(float64, float64) float64) funcType {
+	return funcType{Args: []exprType{typeNumber, typeNumber}, Result: typeNumber, Compile: func(args []*node) *node {
+		a, b := args[0].num, args[1].num
+		return numberNode(func(e *exprEnv) float64 { return f(a(e), b(e)) })
+	}}
+}
+
+func numberTest(f func(float64) bool) funcType {
+	return funcType{Args: []exprType{typeNumber}, Result: typeBool, Compile: func(args []*node) *node {
+		a := args[0].num
+		return boolNode(func(e *exprEnv) bool { return f(a(e)) })
+	}}
+}
+
+func compileStrlen(args []*node) *node {
+	a := args[0].str
+	return numberNode(func(e *exprEnv) float64 { return float64(len(a(e))) })
+}
+
+type typeChecker struct {
+	tokens []govaluate.ExpressionToken
+	funcs  []string // names of the function tokens, in order
+	params map[string]interface{}
+	path   string // of list() files
+	refs   []exprRef
+	pos    int
+}
+
+// checkExpr returns the type of e parsed from expr with predefinedFunctions,
+// and its closures if it compiles, params are the variables besides those
+// of positions
+func checkExpr(expr string, e *govaluate.EvaluableExpression, params map[string]interface{}, path string) (exprType, *compiledExpr, error) {
+	self := &typeChecker{tokens: e.Tokens(), funcs: functionNames(expr), params: params, path: path}
+	if len(self.tokens) == 0 {
+		return typeAny, nil, fmt.Errorf("empty expression")
+	}
+	n, err := self.list()
+	if err == nil && self.pos < len(self.tokens) {
+		err = fmt.Errorf("unexpected %s", tokenString(self.tokens[self.pos]))
+	}
+	if err != nil {
+		return typeAny, nil, err
+	}
+	// c ? x is nil when c is false, NaN to aggregates
+	n = nanIfFalse(n)
+	if !compiled(n) {
+		return n.t, nil, nil
+	}
+	return n.t, &compiledExpr{root: n, refs: self.refs}, nil
+}
+
+// nanIfFalse compiles c ? x of numbers to NaN when c is false
+func nanIfFalse(n *node) *node {
+	if n.cond == nil || n.t != typeNumber || !compiled(n.cond, n.then) {
+		return n
+	}
+	c, x := n.cond.b, n.then.num
+	return numberNode(func(e *exprEnv) float64 {
+		if c(e) {
+			return x(e)
+		}
+		return math.NaN()
+	})
+}
+
+// functionNames lists the names of predefinedFunctions called in expr, the
+// tokens of functions only keep the function
+func functionNames(expr string) []string {
+	var out []string
+	for i := 0; i < len(expr); i++ {
+		c := rune(expr[i])
+		switch {
+		case c == '\'' || c == '"':
+			for i++; i < len(expr) && rune(expr[i]) != c; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+		case c == '[':
+			for i < len(expr) && expr[i] != ']' {
+				i++
+			}
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i
+			for j < len(expr) && isNameChar(rune(expr[j])) {
+				j++
+			}
+			if _, ok := predefinedFunctions[expr[i:j]]; ok && unicode.IsLetter(c) {
+				name := expr[i:j]
+				if name == inFunction {
+					name = "in"
+				}
+				out = append(out, name)
+			}
+			i = j - 1
+		}
+	}
+	return out
+}
+
+func isNameChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+func tokenString(t govaluate.ExpressionToken) string {
+	switch t.Kind {
+	case govaluate.CLAUSE:
+		return "("
+	case govaluate.CLAUSE_CLOSE:
+		return ")"
+	case govaluate.STRING:
+		return fmt.Sprintf("'%v'", t.Value)
+	case govaluate.FUNCTION:
+		return "function"
+	}
+	return fmt.Sprint(t.Value)
+}
+
+// peek returns the operator at pos if it is of kind and one of ops
+func (self *typeChecker) peek(kind govaluate.TokenKind, ops ...string) (string, bool) {
+	if self.pos >= len(self.tokens) || self.tokens[self.pos].Kind != kind {
+		return "", false
+	}
+	op, _ := self.tokens[self.pos].Value.(string)
+	if len(ops) == 0 {
+		return op, true
+	}
+	for _, op2 := range ops {
+		if op == op2 {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// list is a , separated list, of function args or in
+func (self *typeChecker) list() (*node, error) {
+	n, err := self.ternary()
+	if err != nil {
+		return n, err
+	}
+	if _, ok := self.peek(govaluate.SEPARATOR); !ok {
+		return n, nil
+	}
+	l := &node{t: typeList, list: []*node{n}}
+	for {
+		if _, ok := self.peek(govaluate.SEPARATOR); !ok {
+			return l, nil
+		}
+		self.pos++
+		n, err := self.ternary()
+		if err != nil {
+			return n, err
+		}
+		l.list = append(l.list, n)
+	}
+}
+
+func (self *typeChecker) ternary() (*node, error) {
+	n, err := self.or()
+	for err == nil {
+		op, ok := self.peek(govaluate.TERNARY)
+		if !ok {
+			break
+		}
+		self.pos++
+		switch op {
+		case "?":
+			if err = expectType(n.t, typeBool, "?"); err != nil {
+				break
+			}
+			var x *node
+			if x, err = self.or(); err != nil {
+				break
+			}
+			if _, ok := self.peek(govaluate.TERNARY, ":"); ok {
+				self.pos++
+				var y *node
+				if y, err = self.ternary(); err == nil {
+					n, err = compileTernary(n, x, y)
+				}
+			} else {
+				// c ? x without : is nil when c is false
+				n = &node{t: x.t, cond: n, then: x}
+			}
+		case "??":
+			var y *node
+			if y, err = self.or(); err == nil {
+				if n.cond != nil {
+					n, err = compileTernary(n.cond, n.then, y)
+				} else {
+					// only nil is replaced
+					_, err = sameType(n.t, y.t, "??")
+				}
+			}
+		default:
+			err = fmt.Errorf("%s without ?", op)
+		}
+	}
+	return n, err
+}
+
+func (self *typeChecker) or() (*node, error) {
+	return self.logical("||", self.and)
+}
+
+func (self *typeChecker) and() (*node, error) {
+	return self.logical("&&", self.comparison)
+}
+
+func (self *typeChecker) logical(op string, next func() (*node, error)) (*node, error) {
+	n, err := next()
+	for err == nil {
+		if _, ok := self.peek(govaluate.LOGICALOP, op); !ok {
+			break
+		}
+		self.pos++
+		var n2 *node
+		if n2, err = next(); err == nil {
+			if err = expectTypes(n.t, n2.t, typeBool, op); err == nil {
+				n = compileLogical(op, n, n2)
+			}
+		}
+	}
+	return n, err
+}
+
+func (self *typeChecker) comparison() (*node, error) {
+	n, err := self.arithmetic(0)
+	for err == nil {
+		op, ok := self.peek(govaluate.COMPARATOR)
+		if !ok {
+			break
+		}
+		self.pos++
+		var n2 *node
+		if n2, err = self.arithmetic(0); err != nil {
+			break
+		}
+		t, t2 := n.t, n2.t
+		switch op {
+		case "==", "!=":
+			if t != typeAny && t2 != typeAny && t != t2 {
+				err = fmt.Errorf("%s of %s and %s is always %v", op, t, t2, op == "!=")
+			}
+		case "=~", "!~":
+			err = expectTypes(t, t2, typeString, op)
+		case "in":
+			if t2 != typeList && t2 != typeAny {
+				err = fmt.Errorf("in needs a list like (a, b), got %s", t2)
+			}
+		default:
+			if t != typeString || t2 != typeString {
+				err = expectTypes(t, t2, typeNumber, op)
+			}
+		}
+		n = compileComparison(op, n, n2)
+	}
+	return n, err
+}
+
+// arithmeticOps by precedence, + also joins strings
+var arithmeticOps = [][]string{{"&", "|", "^"}, {"<<", ">>"}, {"+", "-"}, {"*", "/", "%"}, {"**"}}
+
+func (self *typeChecker) arithmetic(level int) (*node, error) {
+	if level == len(arithmeticOps) {
+		return self.prefix()
+	}
+	n, err := self.arithmetic(level + 1)
+	for err == nil {
+		op, ok := self.peek(govaluate.MODIFIER, arithmeticOps[level]...)
+		if !ok {
+			break
+		}
+		self.pos++
+		var n2 *node
+		if n2, err = self.arithmetic(level + 1); err != nil {
+			break
+		}
+		t, t2 := n.t, n2.t
+		if op == "+" && (t == typeString || t2 == typeString) && t != typeBool && t2 != typeBool {
+			n = compileConcat(n, n2)
+			continue
+		}
+		if err = expectTypes(t, t2, typeNumber, op); err == nil {
+			n = compileArithmetic(op, n, n2)
+		}
+	}
+	return n, err
+}
+
+func (self *typeChecker) prefix() (*node, error) {
+	if _, ok := self.peek(govaluate.PREFIX); !ok {
+		return self.value()
+	}
+	op := tokenString(self.tokens[self.pos])
+	self.pos++
+	n, err := self.prefix()
+	if err != nil {
+		return n, err
+	}
+	want := typeNumber
+	if op == "!" {
+		want = typeBool
+	}
+	if err := expectType(n.t, want, op); err != nil {
+		return n, err
+	}
+	return compilePrefix(op, n), nil
+}
+
+func (self *typeChecker) value() (*node, error) {
+	if self.pos >= len(self.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := self.tokens[self.pos]
+	self.pos++
+	switch tok.Kind {
+	case govaluate.NUMERIC, govaluate.TIME, govaluate.BOOLEAN, govaluate.STRING, govaluate.PATTERN:
+		return compileLiteral(tok), nil
+	case govaluate.VARIABLE:
+		name, _ := tok.Value.(string)
+		// Evaluate sets the position variables over params
+		if id, ok := positionVarIndex[name]; ok {
+			return self.ref(name, id, positionVars[id].t), nil
+		}
+		if v, ok := self.params[name]; ok {
+			return self.ref(name, -1, typeOfValue(v)), nil
+		}
+		return nil, fmt.Errorf("undefined variable %s", name)
+	case govaluate.FUNCTION:
+		return self.call()
+	case govaluate.CLAUSE:
+		n, err := self.list()
+		if err != nil {
+			return n, err
+		}
+		if _, ok := self.peek(govaluate.CLAUSE_CLOSE); !ok {
+			return n, fmt.Errorf("missing )")
+		}
+		self.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", tokenString(tok))
+}
+
+// ref is a variable read from the column k of exprEnv
+func (self *typeChecker) ref(name string, id int, t exprType) *node {
+	k := len(self.refs)
+	for i, r := range self.refs {
+		if r.name == name {
+			k = i
+		}
+	}
+	if k == len(self.refs) {
+		self.refs = append(self.refs, exprRef{name: name, pos: id})
+	}
+	return compileRef(k, t)
+}
+
+// call checks the args of the function token before pos
+func (self *typeChecker) call() (*node, error) {
+	name := "function"
+	n := 0
+	for _, tok := range self.tokens[:self.pos-1] {
+		if tok.Kind == govaluate.FUNCTION {
+			n++
+		}
+	}
+	if n < len(self.funcs) {
+		name = self.funcs[n]
+	}
+	var args []*node
+	if _, ok := self.peek(govaluate.CLAUSE); !ok {
+		a, err := self.value()
+		if err != nil {
+			return a, err
+		}
+		args = append(args, a)
+	} else if self.pos++; self.pos < len(self.tokens) && self.tokens[self.pos].Kind == govaluate.CLAUSE_CLOSE {
+		self.pos++
+	} else {
+		for {
+			a, err := self.ternary()
+			if err != nil {
+				return a, err
+			}
+			args = append(args, a)
+			if _, ok := self.peek(govaluate.SEPARATOR); !ok {
+				break
+			}
+			self.pos++
+		}
+		if _, ok := self.peek(govaluate.CLAUSE_CLOSE); !ok {
+			return nil, fmt.Errorf("missing ) of %s()", name)
+		}
+		self.pos++
+	}
+	sig, ok := functionTypes[name]
+	if !ok {
+		return &node{t: typeAny}, nil
+	}
+	if len(args) < len(sig.Args) || (!sig.Variadic && len(args) > len(sig.Args)) {
+		return nil, fmt.Errorf("%s() takes %s, got %d", name, argCount(sig), len(args))
+	}
+	for i, a := range args {
+		want := sig.Args[len(sig.Args)-1]
+		if i < len(sig.Args) {
+			want = sig.Args[i]
+		}
+		if err := expectType(a.t, want, fmt.Sprintf("argument %d of %s()", i+1, name)); err != nil {
+			return nil, err
+		}
+		// NaN where govaluate passes nil, which functions read as NaN
+		args[i] = nanIfFalse(a)
+	}
+	if sig.Check != nil {
+		return sig.Check(self, args)
+	}
+	if sig.Compile != nil && compiled(args...) {
+		return sig.Compile(args), nil
+	}
+	return &node{t: sig.Result}, nil
+}
+
+func argCount(sig funcType) string {
+	var strs []string
+	for _, t := range sig.Args {
+		strs = append(strs, t.String())
+	}
+	str := strings.Join(strs, ", ")
+	if sig.Variadic {
+		str += ", ..."
+	}
+	return "(" + str + ")"
+}
+
+// expectType checks t of what is want, any is checked when evaluated
+func expectType(t exprType, want exprType, what string) error {
+	if t != want && t != typeAny && want != typeAny {
+		return fmt.Errorf("%s needs %s, got %s", what, want, t)
+	}
+	return nil
+}
+
+func expectTypes(t exprType, t2 exprType, want exprType, op string) error {
+	if err := expectType(t, want, op); err != nil {
+		return fmt.Errorf("%s of %s and %s, expect %ss", op, t, t2, want)
+	}
+	if err := expectType(t2, want, op); err != nil {
+		return fmt.Errorf("%s of %s and %s, expect %ss", op, t, t2, want)
+	}
+	return nil
+}
+
+// sameType is the type of both branches of op
+func sameType(t exprType, t2 exprType, op string) (exprType, error) {
+	switch {
+	case t == t2:
+		return t, nil
+	case t == typeAny || t2 == typeAny:
+		return typeAny, nil
+	}
+	return typeAny, fmt.Errorf("%s of %s and %s", op, t, t2)
+}
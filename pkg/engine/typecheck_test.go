@@ -0,0 +1,72 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTypeCheck(t *testing.T) {
+	params := map[string]interface{}{"n": 0.0, "s": "", "b": false}
+	for _, c := range []struct {
+		expr string
+		tmpl interface{}
+		want string // the type, or the error after the expression
+	}{
+		{"Qty > 1 ? Qty : 0", nil, "number"},
+		{"Qty > 1 ? Qty", nil, "number"},
+		{"Qty ?? 1", nil, "number"},
+		{"Qty + Symbol", nil, "string"},
+		{"n + 1", nil, "number"},
+		{"s + 'x'", nil, "string"},
+		{"b && Qty > 0", nil, "bool"},
+		{"Symbol in ('A', 'B')", nil, "bool"},
+		{"strlen(Symbol) > 2", nil, "bool"},
+		{"sqrt(Symbol)", nil, "argument 1 of sqrt() needs number, got string"},
+		{"sqrt(1, 2)", nil, "sqrt() takes (number), got 2"},
+		{"Market == 1", nil, "== of string and number is always false"},
+		{"Market != 1", nil, "!= of string and number is always true"},
+		{"Qty ? 1 : 2", nil, "? needs bool, got number"},
+		{"Symbol in 'A'", nil, "in needs a list like (a, b), got string"},
+		{"foo + 1", nil, "undefined variable foo"},
+		{"1 + ", nil, "Unexpected end of expression"},
+		{"Qty > 0", 0.0, "which must return number, not bool"},
+		{"Symbol", 0.0, "which must return number, not string"},
+		{"Qty", true, "which must return bool, not number"},
+	} {
+		got := ""
+		e, err := ParseExpr("1", c.expr, "formula", params, c.tmpl, ".")
+		if err != nil {
+			prefix := "invalid formula expression on line 1: " + c.expr + ": "
+			if got = err.Error(); !strings.HasPrefix(got, prefix) {
+				t.Errorf("%s: %s", c.expr, got)
+				continue
+			}
+			got = got[len(prefix):]
+		} else {
+			got = e.T.String()
+		}
+		if got != c.want {
+			t.Errorf("%s: %s, want %s", c.expr, got, c.want)
+		}
+	}
+}
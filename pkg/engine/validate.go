@@ -0,0 +1,410 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidateRiskIni checks a risk .ini file as a whole, unlike ParseIni which
+// stops at the first error, so editors can mark every problem.
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic Line and Col count from 1, Fix is a suggested replacement of
+// the text at Col, File is set for problems in included files
+type Diagnostic struct {
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"`
+	File     string `json:"file,omitempty"`
+}
+
+// iniKeys are the keys known at each section depth, sections named var hold
+// variables of any name
+var iniKeys = [][]string{
+	{"name", "acc", "filter", includeKey},
+	{"name", "group", "group_name", "f", "formula", "upper_bound", "lower_bound", "trade_stop", "window", "graph", includeKey},
+	{"formula", "upper_bound", "lower_bound", "trade_stop", "window", "graph", includeKey},
+}
+
+var boolValues = []string{"true", "false", "y", "n", "yes", "no", "1", "0"}
+
+var iniRefRe = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// HasErrors tells if any of diags is an error
+func HasErrors(diags []*Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type iniValidator struct {
+	diags []*Diagnostic
+	file  string // of the lines being checked, for %include
+	refs  map[string]bool
+}
+
+func (self *iniValidator) add(line int, col int, severity string, fix string, format string, args ...interface{}) {
+	self.diags = append(self.diags, &Diagnostic{
+		Line:     line,
+		Col:      col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Fix:      fix,
+		File:     self.file,
+	})
+}
+
+// ValidateRiskIni returns the diagnostics of content sorted by position,
+// pyPath is the python module directory of call()
+func ValidateRiskIni(content string, pyPath string) []*Diagnostic {
+	v := &iniValidator{diags: []*Diagnostic{}}
+	v.syntax(content)
+	// then includes and expressions, which stop at the first error
+	cfg, err := ParseRiskIni(content)
+	if err == nil {
+		_, err = ParsePortfolio(cfg, pyPath)
+	}
+	if err != nil {
+		v.fromError(err, content)
+	}
+	return v.sorted()
+}
+
+// ValidateRiskFile is ValidateRiskIni for portfolio files of any format,
+// columns of other formats are 1
+func ValidateRiskFile(fn string, content string, pyPath string) []*Diagnostic {
+	format := FileFormat(fn)
+	if format == "ini" {
+		return ValidateRiskIni(content, pyPath)
+	}
+	v := &iniValidator{diags: []*Diagnostic{}}
+	cfg, err := ParseFormat(format, content)
+	if err != nil {
+		v.fromError(err, "")
+		return v.sorted()
+	}
+	v.findRefs(content)
+	v.tree(cfg, false)
+	if cfg, err = ParseRiskFile(fn, content); err == nil {
+		_, err = ParsePortfolio(cfg, pyPath)
+	}
+	if err != nil {
+		v.fromError(err, "")
+	}
+	return v.sorted()
+}
+
+func (self *iniValidator) sorted() []*Diagnostic {
+	sort.SliceStable(self.diags, func(i, j int) bool {
+		a, b := self.diags[i], self.diags[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return self.diags
+}
+
+var errLineRe = regexp.MustCompile(`line (\d+)(?: of (\S+?))?:`)
+
+// fromError makes a diagnostic of an error mentioning a line
+func (self *iniValidator) fromError(err error, content string) {
+	msg := err.Error()
+	m := errLineRe.FindStringSubmatch(msg)
+	if m == nil {
+		self.add(1, 1, SeverityError, "", "%s", msg)
+		return
+	}
+	ln, _ := strconv.Atoi(m[1])
+	// the position is in the diagnostic
+	if i := strings.Index(msg, " on "+m[0]); i >= 0 {
+		msg = msg[:i] + ":" + msg[i+len(m[0])+4:]
+	} else {
+		msg = strings.TrimSpace(strings.Replace(msg, m[0], "", 1))
+	}
+	for _, d := range self.diags {
+		if d.Line == ln && d.File == m[2] && d.Severity == SeverityError {
+			// found by the syntax pass already
+			return
+		}
+	}
+	col := 1
+	if m[2] == "" {
+		lines := strings.Split(content, "\n")
+		if ln-1 < len(lines) {
+			line := lines[ln-1]
+			if n := strings.Index(line, "="); n > 0 {
+				col = n + 2 + len(line[n+1:]) - len(strings.TrimLeft(line[n+1:], " \t"))
+			}
+		}
+	}
+	self.file = m[2]
+	self.add(ln, col, SeverityError, "", "%s", msg)
+	self.file = ""
+}
+
+func (self *iniValidator) syntax(content string) {
+	type section struct {
+		name  string
+		depth int
+		keys  map[string]int
+		subs  map[string]int
+		hasF  bool
+		line  int
+		file  string
+		isVar bool
+	}
+	var stack []*section
+	top := &section{keys: map[string]int{}, subs: map[string]int{}}
+	stack = append(stack, top)
+	closeSection := func(s *section) {
+		if s.depth == 2 && !s.isVar && !s.hasF {
+			self.file = s.file
+			self.add(s.line, 1, SeverityWarning, "", "param %s has no formula and is ignored", s.name)
+		}
+	}
+	self.findRefs(content)
+	for _, l := range lexIni(content, "", sharedIncludes) {
+		ln, col := l.Ln, l.Col
+		self.file = l.File
+		if l.Err != "" {
+			self.add(ln, col, SeverityError, "", "%s", l.Err)
+			continue
+		}
+		if l.Warn != "" {
+			self.add(ln, col, SeverityWarning, "", "%s", l.Warn)
+		}
+		switch l.Kind {
+		case iniSectionLine:
+			depth, name := l.Depth, l.Name
+			if l.Closing != depth {
+				fix := strings.Repeat("[", depth) + name + strings.Repeat("]", depth)
+				self.add(ln, col, SeverityError, fix, "section %s has %d opening and %d closing brackets", name, depth, l.Closing)
+			}
+			if name == "" {
+				self.add(ln, col, SeverityError, "", "empty section name")
+			}
+			cur := stack[len(stack)-1]
+			if depth > cur.depth+1 {
+				self.add(ln, col, SeverityError, strings.Repeat("[", cur.depth+1)+name+strings.Repeat("]", cur.depth+1),
+					"section %s is %d levels deep under a level %d section", name, depth, cur.depth)
+				continue
+			}
+			for len(stack) > depth {
+				closeSection(stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			parent := stack[len(stack)-1]
+			if prev, ok := parent.subs[name]; ok {
+				self.add(ln, col, SeverityError, "", "duplicate section %s, first on line %d", name, prev)
+			}
+			parent.subs[name] = ln
+			s := &section{name: name, depth: depth, keys: map[string]int{}, subs: map[string]int{}, line: ln, file: l.File}
+			s.isVar = name == "var" && (depth == 2 || depth == 3)
+			if parent.isVar {
+				self.add(ln, col, SeverityWarning, "", "section %s in var is ignored", name)
+			} else if depth > 2 && !s.isVar {
+				self.add(ln, col, SeverityWarning, "", "section %s is too deep and ignored, params are level 2", name)
+			}
+			stack = append(stack, s)
+		case iniOther:
+			if l.Value != "" && l.Warn == "" {
+				self.add(ln, col, SeverityWarning, "", "line ignored, expect key = value")
+			}
+		case iniValue:
+			cur := stack[len(stack)-1]
+			key, value := l.Key, l.Value
+			if key == "" {
+				self.add(ln, col, SeverityWarning, "", "line without key ignored")
+				continue
+			}
+			if prev, ok := cur.keys[key]; ok {
+				self.add(ln, col, SeverityError, "", "duplicate key %s, first on line %d", key, prev)
+			}
+			cur.keys[key] = ln
+			if self.key(ln, col, l.VCol, cur.depth, cur.isVar, key, value) {
+				cur.hasF = true
+			}
+		}
+	}
+	self.file = ""
+	for len(stack) > 1 {
+		closeSection(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+	}
+}
+
+// findRefs records the keys of ${} references, constants rather than
+// unknown keys
+func (self *iniValidator) findRefs(content string) {
+	self.refs = make(map[string]bool)
+	for _, m := range iniRefRe.FindAllStringSubmatch(content, -1) {
+		parts := strings.Split(m[1], ".")
+		self.refs[strings.TrimSpace(parts[len(parts)-1])] = true
+	}
+}
+
+// key checks a key and value of a section at depth, and tells if it
+// defines a formula
+func (self *iniValidator) key(ln int, col int, vcol int, depth int, isVar bool, key string, value string) bool {
+	if isVar {
+		if !identRe.MatchString(key) {
+			self.add(ln, col, SeverityError, "", "variable name %s is not an identifier", key)
+		}
+		return false
+	}
+	if depth > 2 {
+		return false
+	}
+	if !contains(iniKeys[depth], key) && !self.refs[key] {
+		fix := suggest(key, iniKeys[depth])
+		if fix != "" {
+			self.add(ln, col, SeverityWarning, fix, "unknown key %s, did you mean %s?", key, fix)
+		} else {
+			self.add(ln, col, SeverityWarning, "", "unknown key %s in a level %d section, expect one of %s", key, depth, strings.Join(iniKeys[depth], ", "))
+		}
+		return false
+	}
+	if !strings.Contains(value, "${") {
+		// else checked when interpolated
+		self.value(ln, vcol, key, value)
+	}
+	return (key == "formula" && value != "") || key == includeKey
+}
+
+// tree checks the keys of a portfolio in another format than ini
+func (self *iniValidator) tree(s *IniSection, isVar bool) {
+	hasF := false
+	for _, v := range s.Values {
+		ln, _ := strconv.Atoi(v[2])
+		if self.key(ln, 1, 1, s.Depth, isVar, v[0], v[1]) {
+			hasF = true
+		}
+	}
+	if s.Depth == 2 && !isVar && !hasF {
+		self.add(s.Line, 1, SeverityWarning, "", "param %s has no formula and is ignored", s.Name)
+	}
+	for _, s2 := range s.Sections {
+		if isVar {
+			self.add(s2.Line, 1, SeverityWarning, "", "section %s in var is ignored", s2.Name)
+		} else if s2.Depth > 2 && s2.Name != "var" {
+			self.add(s2.Line, 1, SeverityWarning, "", "section %s is too deep and ignored, params are level 2", s2.Name)
+			continue
+		}
+		self.tree(s2, s2.Name == "var" && (s2.Depth == 2 || s2.Depth == 3))
+	}
+}
+
+// value checks the values parsed leniently by newRiskParamDef, a - bound is
+// a group without one
+func (self *iniValidator) value(ln int, col int, key string, value string) {
+	switch key {
+	case "upper_bound", "lower_bound":
+		off := 0
+		for _, str := range strings.Split(value, ",") {
+			str2 := strings.TrimSpace(str)
+			if str2 != "" && str2 != "-" {
+				if _, err := strconv.ParseFloat(str2, 64); err != nil {
+					c := col + off + strings.Index(str, str2)
+					self.add(ln, c, SeverityError, "", "%s %s is not a number", key, str2)
+				}
+			}
+			off += len(str) + 1
+		}
+	case "trade_stop":
+		if _, err := strconv.ParseBool(value); err != nil && value != "" {
+			self.add(ln, col, SeverityError, "false", "trade_stop %s is not true or false", value)
+		}
+	case "graph":
+		if !contains(boolValues, strings.ToLower(value)) && value != "" {
+			self.add(ln, col, SeverityWarning, "", "graph %s is taken as false, expect one of %s", value, strings.Join(boolValues, ", "))
+		}
+	case "window":
+		w := split(value, ",")
+		if len(w) > 0 {
+			if v, err := strconv.Atoi(w[0]); err != nil || v < 0 {
+				self.add(ln, col, SeverityError, "", "window %s is not seconds", w[0])
+			}
+		}
+	}
+}
+
+func contains(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// suggest is the closest of candidates within 2 edits of str
+func suggest(str string, candidates []string) string {
+	best, bestD := "", 3
+	for _, c := range candidates {
+		if d := levenshtein(str, c); d < bestD {
+			best, bestD = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,90 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// diagString is a diagnostic as line:col severity message [fix]
+func diagString(d *Diagnostic) string {
+	s := fmt.Sprintf("%d:%d %s %s", d.Line, d.Col, d.Severity, d.Message)
+	if d.Fix != "" {
+		s += " [" + d.Fix + "]"
+	}
+	return s
+}
+
+func TestValidateRiskIni(t *testing.T) {
+	for _, c := range []struct {
+		lines []string
+		diags []string
+	}{
+		{[]string{"name = p", "[s]", "[[p]]", "formula = 1"}, nil},
+		{[]string{"[s]", "[[p]", "formula = 1"},
+			[]string{"2:1 error section p has 2 opening and 1 closing brackets [[[p]]]"}},
+		{[]string{"[s]", "[[[p]]]", "formula = 1"},
+			[]string{"2:1 error section p is 3 levels deep under a level 1 section [[[p]]]"}},
+		{[]string{"[s]", "[[p]]", "formula = 1", "formula = 2"},
+			[]string{"4:1 error duplicate key formula, first on line 3"}},
+		{[]string{"[s]", "[[p]]", "formula = 1", "[[p]]", "formula = 2"},
+			[]string{"4:1 error duplicate section p, first on line 2"}},
+		{[]string{"[s]", "[[p]]", "fromula = 1"},
+			[]string{"2:1 warning param p has no formula and is ignored", "3:1 warning unknown key fromula, did you mean formula? [formula]"}},
+		{[]string{"[s]", "grp = x"},
+			[]string{"2:1 warning unknown key grp, did you mean group? [group]"}},
+		{[]string{"[s]", "[[p]]", "formula = 1", "upper_bound = 1, x", "trade_stop = maybe"},
+			[]string{"4:18 error upper_bound x is not a number", "5:14 error trade_stop maybe is not true or false [false]"}},
+		{[]string{"[s]", "[[p]]", "formula = 1 +"},
+			[]string{"3:11 error invalid formula expression: 1 +: Unexpected end of expression"}},
+	} {
+		var got []string
+		for _, d := range ValidateRiskIni(strings.Join(c.lines, "\n"), "") {
+			got = append(got, diagString(d))
+		}
+		if strings.Join(got, "\n") != strings.Join(c.diags, "\n") {
+			t.Errorf("%q:\n%s\nwant\n%s", c.lines, strings.Join(got, "\n"), strings.Join(c.diags, "\n"))
+		}
+	}
+}
+
+func TestValidateRiskFile(t *testing.T) {
+	content := strings.Join([]string{
+		"s:",
+		"  grp: x",
+		"  p:",
+		"    formula: 1",
+		"    trade_stop: maybe",
+	}, "\n")
+	var got []string
+	for _, d := range ValidateRiskFile("p.yaml", content, "") {
+		got = append(got, diagString(d))
+	}
+	want := []string{
+		"2:1 warning unknown key grp, did you mean group? [group]",
+		"5:1 error trade_stop maybe is not true or false [false]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
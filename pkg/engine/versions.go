@@ -0,0 +1,211 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every save or delete of a risk file adds a version to a bolt database, a
+// bucket per user with a bucket per file, keyed by big endian version
+// numbers from 1. Versions are never pruned.
+
+type FileVersion struct {
+	Version int    `json:"version"`
+	Author  string `json:"author"`
+	Comment string `json:"comment,omitempty"`
+	Time    int64  `json:"time"`
+	Size    int    `json:"size"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type storedVersion struct {
+	FileVersion
+	Content string `json:"content"`
+}
+
+var versionsDb *bolt.DB
+
+func OpenVersions(fn string) error {
+	db, err := bolt.Open(fn, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	versionsDb = db
+	return nil
+}
+
+func CloseVersions() {
+	if versionsDb != nil {
+		versionsDb.Close()
+		versionsDb = nil
+	}
+}
+
+func versionKey(version int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+// recordVersion adds a version of fn, prev is the content before the save
+// or delete, kept as version 1 first for files saved before versioning
+func recordVersion(userId int, fn string, prev []byte, content []byte, author string, comment string, deleted bool) error {
+	if versionsDb == nil {
+		return nil
+	}
+	return versionsDb.Update(func(tx *bolt.Tx) error {
+		ub, err := tx.CreateBucketIfNotExists([]byte(strconv.Itoa(userId)))
+		if err != nil {
+			return err
+		}
+		b, err := ub.CreateBucketIfNotExists([]byte(fn))
+		if err != nil {
+			return err
+		}
+		put := func(v *storedVersion) error {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			v.Version = int(seq)
+			v.Time = time.Now().Unix()
+			v.Size = len(v.Content)
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return b.Put(versionKey(v.Version), data)
+		}
+		if k, _ := b.Cursor().First(); k == nil && prev != nil {
+			if err := put(&storedVersion{FileVersion{Comment: "before versioning"}, string(prev)}); err != nil {
+				return err
+			}
+		}
+		return put(&storedVersion{FileVersion{Author: author, Comment: comment, Deleted: deleted}, string(content)})
+	})
+}
+
+func fileBucket(tx *bolt.Tx, userId int, fn string) *bolt.Bucket {
+	ub := tx.Bucket([]byte(strconv.Itoa(userId)))
+	if ub == nil {
+		return nil
+	}
+	return ub.Bucket([]byte(fn))
+}
+
+// FileVersions are the versions of fn, oldest first
+func FileVersions(userId int, fn string) ([]*FileVersion, error) {
+	if versionsDb == nil {
+		return nil, fmt.Errorf("versions are not enabled")
+	}
+	out := []*FileVersion{}
+	err := versionsDb.View(func(tx *bolt.Tx) error {
+		b := fileBucket(tx, userId, fn)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var sv storedVersion
+			if err := json.Unmarshal(v, &sv); err != nil {
+				return err
+			}
+			out = append(out, &sv.FileVersion)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// FileVersionContent returns a version of fn, the latest if version is 0
+func FileVersionContent(userId int, fn string, version int) (string, *FileVersion, error) {
+	if versionsDb == nil {
+		return "", nil, fmt.Errorf("versions are not enabled")
+	}
+	var sv *storedVersion
+	err := versionsDb.View(func(tx *bolt.Tx) error {
+		b := fileBucket(tx, userId, fn)
+		if b == nil {
+			return fmt.Errorf("no versions of %s", fn)
+		}
+		var v []byte
+		if version == 0 {
+			_, v = b.Cursor().Last()
+		} else {
+			v = b.Get(versionKey(version))
+		}
+		if v == nil {
+			return fmt.Errorf("no version %d of %s", version, fn)
+		}
+		sv = &storedVersion{}
+		return json.Unmarshal(v, sv)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return sv.Content, &sv.FileVersion, nil
+}
+
+// DiffFileVersions is the unified diff from version from to version to of
+// fn, to 0 for the current file
+func DiffFileVersions(userId int, fn string, from int, to int) (string, error) {
+	a, _, err := FileVersionContent(userId, fn, from)
+	if err != nil {
+		return "", err
+	}
+	nameB := fn
+	var b string
+	if to == 0 {
+		data, err := Files.Read(userId, fn)
+		if err != nil {
+			return "", err
+		}
+		b = string(data)
+	} else if b, _, err = FileVersionContent(userId, fn, to); err != nil {
+		return "", err
+	}
+	if to != 0 {
+		nameB = fmt.Sprintf("%s@%d", fn, to)
+	}
+	return UnifiedDiff(a, b, fmt.Sprintf("%s@%d", fn, from), nameB), nil
+}
+
+// RollbackFile saves version of fn again as a new version and reloads the
+// portfolios
+func RollbackFile(userId int, fn string, version int, author string, comment string) error {
+	content, v, err := FileVersionContent(userId, fn, version)
+	if err != nil {
+		return err
+	}
+	if v.Deleted {
+		return fmt.Errorf("version %d of %s is a delete", version, fn)
+	}
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to version %d", version)
+	}
+	return SaveFile(userId, fn, content, author, comment)
+}
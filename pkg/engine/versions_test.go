@@ -0,0 +1,117 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"testing"
+)
+
+// versionString is a version as number:author:comment:size, and :deleted
+func versionString(v *FileVersion) string {
+	s := fmt.Sprintf("%d:%s:%s:%d", v.Version, v.Author, v.Comment, v.Size)
+	if v.Deleted {
+		s += ":deleted"
+	}
+	return s
+}
+
+func checkVersions(t *testing.T, userId int, fn string, want ...string) {
+	versions, err := FileVersions(userId, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range versions {
+		got = append(got, versionString(v))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("versions of %s = %v, want %v", fn, got, want)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	withTestStore(t)
+	const v1, v2 = "[r]\nformula = 1", "[r]\nformula = 1\n"
+	// a file saved before versioning is kept as version 1
+	if err := Files.Write(1, "a.ini", []byte("[r]\nformula = 0\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{v1, v2} {
+		if err := SaveFile(1, "a.ini", content, "alice", "save"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteFile(1, "a.ini", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveFile(2, "a.ini", v1, "carol", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, 1, "a.ini", "1::before versioning:16", "2:alice:save:15", "3:alice:save:16", "4:bob::0:deleted")
+	checkVersions(t, 2, "a.ini", "1:carol::15")
+	checkVersions(t, 1, "b.ini")
+	if content, v, err := FileVersionContent(1, "a.ini", 0); err != nil || content != "" || !v.Deleted {
+		t.Errorf("latest = %q %+v %v, want the delete", content, v, err)
+	}
+	if _, _, err := FileVersionContent(1, "a.ini", 5); err == nil || err.Error() != "no version 5 of a.ini" {
+		t.Errorf("missing version: %v", err)
+	}
+	if _, _, err := FileVersionContent(1, "b.ini", 1); err == nil || err.Error() != "no versions of b.ini" {
+		t.Errorf("missing file: %v", err)
+	}
+	// the versions differ by the newline only
+	diff, err := DiffFileVersions(1, "a.ini", 2, 3)
+	want := "--- a.ini@2\n+++ a.ini@3\n@@ -1,2 +1,2 @@\n [r]\n-formula = 1\n\\ No newline at end of file\n+formula = 1\n"
+	if err != nil || diff != want {
+		t.Errorf("diff 2 to 3 = %q %v, want %q", diff, err, want)
+	}
+}
+
+func TestRollbackFile(t *testing.T) {
+	withTestStore(t)
+	const v1 = "[r]\r\nformula = 1  # old"
+	for _, content := range []string{v1, "[r]\nformula = 2\n"} {
+		if err := SaveFile(1, "a.ini", content, "alice", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteFile(1, "a.ini", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackFile(1, "a.ini", 3, "bob", ""); err == nil || err.Error() != "version 3 of a.ini is a delete" {
+		t.Errorf("rollback to a delete: %v", err)
+	}
+	if err := RollbackFile(1, "a.ini", 9, "bob", ""); err == nil {
+		t.Error("rollback to a missing version")
+	}
+	if err := RollbackFile(1, "a.ini", 1, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Files.Read(1, "a.ini")
+	if err != nil || string(data) != v1 {
+		t.Errorf("rolled back to %q %v, want %q", data, err, v1)
+	}
+	checkVersions(t, 1, "a.ini", "1:alice::23", "2:alice::16", "3:alice::0:deleted", "4:bob:rollback to version 1:23")
+	if diff, err := DiffFileVersions(1, "a.ini", 1, 0); err != nil || diff != "" {
+		t.Errorf("diff to the rollback = %q %v", diff, err)
+	}
+}
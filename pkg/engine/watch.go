@@ -0,0 +1,189 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// FileWatcher reloads the files of the user directories under a
+// LocalFileStore root and of SharedDir when they change on disk. Events are
+// collected for watchDelay after the last one, editors write in several
+// steps, and the reloads run through apply on the engine goroutine.
+
+const watchDelay = 200 * time.Millisecond
+
+var userDirRe = regexp.MustCompile(`^__(\d+)__$`)
+
+type FileWatcher struct {
+	root    string
+	apply   func(func()) bool
+	watcher *fsnotify.Watcher
+	changed map[int]map[string]bool
+	shared  map[string]bool // extensions changed in SharedDir
+	timer   *time.Timer
+}
+
+// WatchFiles starts watching root, apply runs a reload on the engine
+// goroutine and returns false if it could not, to be retried
+func WatchFiles(root string, apply func(func()) bool) (*FileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	self := &FileWatcher{
+		root:    filepath.Clean(root),
+		apply:   apply,
+		watcher: w,
+		changed: make(map[int]map[string]bool),
+		shared:  make(map[string]bool),
+		timer:   time.NewTimer(time.Hour),
+	}
+	self.timer.Stop()
+	if err := w.Add(self.root); err != nil {
+		w.Close()
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(self.root)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			self.addDir(f.Name(), false)
+		}
+	}
+	// SharedDir may be out of root
+	if err := w.Add(filepath.Clean(SharedDir)); err != nil {
+		log.Println("watch", SharedDir+":", err)
+	}
+	go self.run()
+	return self, nil
+}
+
+func (self *FileWatcher) Close() error {
+	return self.watcher.Close()
+}
+
+// addDir watches a user or the shared directory of root, all its files are
+// reloaded if it was created after the watch started
+func (self *FileWatcher) addDir(name string, created bool) {
+	userId := -1
+	if m := userDirRe.FindStringSubmatch(name); m != nil {
+		userId, _ = strconv.Atoi(m[1])
+	} else if filepath.Join(self.root, name) != filepath.Clean(SharedDir) {
+		return
+	}
+	dir := filepath.Join(self.root, name)
+	if err := self.watcher.Add(dir); err != nil {
+		log.Println("watch", dir+":", err)
+		return
+	}
+	if !created {
+		return
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		self.add(userId, f.Name())
+	}
+}
+
+// add records a changed file of a user, -1 for SharedDir
+func (self *FileWatcher) add(userId int, name string) {
+	if ValidateFileName(name) != nil {
+		// temp files, __init__.py and .pyc
+		return
+	}
+	if userId < 0 {
+		self.shared[filepath.Ext(name)] = true
+	} else {
+		if self.changed[userId] == nil {
+			self.changed[userId] = make(map[string]bool)
+		}
+		self.changed[userId][name] = true
+	}
+	self.timer.Reset(watchDelay)
+}
+
+func (self *FileWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-self.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			dir, name := filepath.Split(ev.Name)
+			dir = filepath.Clean(dir)
+			if dir == self.root {
+				if ev.Op&fsnotify.Create != 0 {
+					self.addDir(name, true)
+				}
+			} else if dir == filepath.Clean(SharedDir) {
+				self.add(-1, name)
+			} else if m := userDirRe.FindStringSubmatch(filepath.Base(dir)); m != nil && filepath.Dir(dir) == self.root {
+				userId, _ := strconv.Atoi(m[1])
+				self.add(userId, name)
+			}
+		case err, ok := <-self.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("watch:", err)
+		case <-self.timer.C:
+			self.flush()
+		}
+	}
+}
+
+func (self *FileWatcher) flush() {
+	changed, shared := self.changed, self.shared
+	ok := self.apply(func() {
+		if shared[".py"] {
+			RestartPy()
+		}
+		if shared[".ini"] {
+			ReloadShared()
+		}
+		for userId, files := range changed {
+			for fn := range files {
+				ReloadFile(userId, fn)
+			}
+		}
+	})
+	if !ok {
+		log.Println("watch: engine busy, retry reloads")
+		self.timer.Reset(time.Second)
+		return
+	}
+	self.changed = make(map[int]map[string]bool)
+	self.shared = make(map[string]bool)
+}
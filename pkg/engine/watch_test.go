@@ -0,0 +1,188 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withUser loads no portfolios of userId until the test ends, so that
+// ReloadFile loads its files
+func withUser(t *testing.T, userId int) {
+	UserPortfolios[userId] = make(map[string]*Portfolio)
+	loadedFiles[userId] = make(map[string][sha1.Size]byte)
+	t.Cleanup(func() {
+		delete(UserPortfolios, userId)
+		delete(loadedFiles, userId)
+		delete(breachAcks, userId)
+	})
+}
+
+// paramSources are the params of the portfolios of userId as
+// portfolio.risk.param=source
+func paramSources(userId int) string {
+	var out []string
+	for _, p := range UserPortfolios[userId] {
+		for _, rd := range p.RiskDefs {
+			for _, rp := range rd.Params {
+				out = append(out, p.Name+"."+rd.Name+"."+rp.Name+"="+strings.TrimSpace(rp.Source))
+			}
+		}
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+func TestFileWatcher(t *testing.T) {
+	root := withTestStore(t)
+	shared := withSharedFiles(t, nil)
+	withUser(t, 1)
+	dir := filepath.Join(root, GetPath(1))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the reloads of each flush, as user/file or shared ext, and the params
+	// after, read on the goroutine of the reloads as the engine would
+	flushes := make(chan [2]string, 10)
+	var w *FileWatcher
+	ready := make(chan struct{})
+	w, err := WatchFiles(root, func(f func()) bool {
+		<-ready
+		var got []string
+		for userId, files := range w.changed {
+			for fn := range files {
+				got = append(got, fmt.Sprintf("%d/%s", userId, fn))
+			}
+		}
+		for ext := range w.shared {
+			got = append(got, "shared "+ext)
+		}
+		sort.Strings(got)
+		f()
+		flushes <- [2]string{strings.Join(got, " "), paramSources(1)}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	close(ready)
+	for _, c := range []struct {
+		name    string
+		change  func(string) error
+		reloads string
+		params  string
+	}{
+		{"write", func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "a.ini"), []byte("name = p\n[r]\nformula = 1\n"), 0644)
+		}, "1/a.ini", "p.r.r=formula=1"},
+		{"rewrite", func(dir string) error {
+			if err := ioutil.WriteFile(filepath.Join(dir, ".a.ini.swp"), []byte("x"), 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, "a.ini"), []byte("name = p\n[r]\nformula = 2\n"), 0644)
+		}, "1/a.ini", "p.r.r=formula=2"},
+		{"write another", func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "b.ini"), []byte("[s]\nformula = 3\n"), 0644)
+		}, "1/b.ini", "b.s.s=formula=3 p.r.r=formula=2"},
+		{"remove", func(dir string) error {
+			return os.Remove(filepath.Join(dir, "a.ini"))
+		}, "1/a.ini", "b.s.s=formula=3"},
+		{"shared", func(string) error {
+			return ioutil.WriteFile(filepath.Join(shared, "x.ini"), []byte("x = 1\n"), 0644)
+		}, "shared .ini", "b.s.s=formula=3"},
+	} {
+		if err := c.change(dir); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-flushes:
+			if got[0] != c.reloads {
+				t.Errorf("%s: reloads %s, want %s", c.name, got[0], c.reloads)
+			}
+			if got[1] != c.params {
+				t.Errorf("%s: params %s, want %s", c.name, got[1], c.params)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no reload", c.name)
+		}
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	openTestHistory(t)
+	historyPruned = time.Now()
+	withUser(t, 1)
+	old := testPortfolio(t, "name = p\n[r]\n[[x]]\nformula = 1\n[[y]]\nformula = 2\n[s]\nformula = 3\n")
+	// the state of each param, as acked breaches and history tails
+	seed := func() {
+		breachAcks[1] = make(map[string]*Ack)
+		for _, key := range [][2]string{{"r", "x"}, {"r", "y"}, {"s", "s"}} {
+			breachAcks[1][BreachKey("p", key[0], key[1], "g", "")] = &Ack{By: "alice"}
+			recordHistory(historyBucket(1, "p", key[0], key[1]), HistorySeries("g", ""), 1)
+		}
+	}
+	state := func() string {
+		var out []string
+		for key := range breachAcks[1] {
+			out = append(out, "ack "+strings.Join(strings.Split(key, "\x1f")[1:3], "."))
+		}
+		for id := range historyTails {
+			parts := strings.Split(strings.Split(id, "\x01")[0], "\x00")
+			out = append(out, "tail "+parts[2]+"."+parts[3])
+		}
+		sort.Strings(out)
+		return strings.Join(out, ", ")
+	}
+	for _, c := range []struct {
+		name string
+		next string
+		want string
+	}{
+		{"unchanged", "name = p\n[r]\n[[x]]\nformula = 1\n[[y]]\nformula = 2\n[s]\nformula = 3\n",
+			"ack r.x, ack r.y, ack s.s, tail r.x, tail r.y, tail s.s"},
+		{"changed and removed", "name = p\n[r]\n[[x]]\nformula = 1\n[[y]]\nformula = 5\n",
+			"ack r.x, tail r.x"},
+		{"comment added", "%dialect 2\n# risks\nname = p\n[r]\n[[x]]\nformula = 1  # same\n[[y]]\nformula = 2\n[s]\nformula = 3\n",
+			"ack r.x, ack r.y, ack s.s, tail r.x, tail r.y, tail s.s"},
+		{"renamed portfolio", "name = q\n[r]\n[[x]]\nformula = 1\n[[y]]\nformula = 2\n[s]\nformula = 3\n", ""},
+		{"removed file", "", ""},
+	} {
+		historyTails = make(map[string]*historyTail)
+		seed()
+		var next *Portfolio
+		if c.next != "" {
+			next = testPortfolio(t, c.next)
+		}
+		migrateState(1, old, next)
+		if got := state(); got != c.want {
+			t.Errorf("%s: state %s, want %s", c.name, got, c.want)
+		}
+	}
+}